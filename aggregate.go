@@ -0,0 +1,444 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// aggregateFuncs are the metric functions which take a number attribute path
+var aggregateFuncs = []string{"sum", "avg", "min", "max"}
+
+// AggregateResult is the outcome of grouping the CIs of a CI Type by the
+// values of zero or more attributes and computing metrics for each group.
+type AggregateResult struct {
+	XMLName xml.Name       `json:"-" xml:"aggregate"`
+	CIType  string         `json:"citype" xml:"citype,attr"`
+	GroupBy []string       `json:"groupBy" xml:"groupBy>path"`
+	Metrics []string       `json:"metrics" xml:"metrics>metric"`
+	Rows    []AggregateRow `json:"rows" xml:"row"`
+}
+
+// AggregateRow is a group of CIs with the attribute values they share and the
+// metrics computed over them.
+type AggregateRow struct {
+	Group  []AggregateValue `json:"group" xml:"group"`
+	Values []AggregateValue `json:"values" xml:"value"`
+}
+
+// AggregateValue is a named value in an aggregate row. A nil value represents
+// a missing attribute or a metric with no values to compute it from.
+type AggregateValue struct {
+	Name  string
+	Value interface{}
+}
+
+// aggregateMetric is a parsed metric such as count or sum(disk.size).
+type aggregateMetric struct {
+	Name string
+	Func string
+	Path string
+}
+
+// aggregateGroup accumulates the metrics of a group of CIs.
+type aggregateGroup struct {
+	Keys  []interface{}
+	Count int
+	Sums  []float64
+	Mins  []float64
+	Maxs  []float64
+	Ns    []int
+}
+
+// Aggregation groups CIs and accumulates metrics for each group.
+type Aggregation struct {
+	CIType  string
+	GroupBy []string
+	Metrics []aggregateMetric
+	groups  map[string]*aggregateGroup
+}
+
+// NewAggregation returns an aggregation of the CIs of a CI Type given the
+// comma separated attribute paths to group by and metrics to compute. Metrics
+// default to count.
+func NewAggregation(citype *CIType, groupBy string, metrics string) (*Aggregation, error) {
+	agg := &Aggregation{
+		CIType:  citype.ShortName,
+		GroupBy: []string{},
+		Metrics: []aggregateMetric{},
+		groups:  make(map[string]*aggregateGroup),
+	}
+
+	for _, path := range splitAggregateList(groupBy) {
+		path = normalizePath(path)
+		att := citype.Attributes.GetByPath(path)
+		if att == nil {
+			return nil, errors.New(fmt.Sprintf("No such attribute to group by: %s", path))
+		}
+
+		if att.Type == "group" || att.IsArray {
+			return nil, errors.New(fmt.Sprintf("Cannot group by group or array attribute: %s", path))
+		}
+
+		agg.GroupBy = append(agg.GroupBy, path)
+	}
+
+	if metrics == "" {
+		metrics = "count"
+	}
+
+	for _, s := range splitAggregateList(metrics) {
+		metric, err := parseAggregateMetric(citype, s)
+		if err != nil {
+			return nil, err
+		}
+
+		agg.Metrics = append(agg.Metrics, *metric)
+	}
+
+	return agg, nil
+}
+
+// splitAggregateList splits a comma separated list and trims each entry.
+func splitAggregateList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// parseAggregateMetric parses a metric which is either count or one of the
+// aggregate functions applied to a number attribute, as in avg(cpu.count).
+func parseAggregateMetric(citype *CIType, s string) (*aggregateMetric, error) {
+	if s == "count" {
+		return &aggregateMetric{Name: s, Func: s}, nil
+	}
+
+	open := strings.Index(s, "(")
+	if open < 0 || !strings.HasSuffix(s, ")") {
+		return nil, errors.New(fmt.Sprintf("Invalid metric: %s", s))
+	}
+
+	fn := strings.TrimSpace(s[:open])
+	if !containsString(aggregateFuncs, fn) {
+		return nil, errors.New(fmt.Sprintf("Unsupported metric function: %s", fn))
+	}
+
+	path := normalizePath(strings.TrimSpace(s[open+1 : len(s)-1]))
+	att := citype.Attributes.GetByPath(path)
+	if att == nil {
+		return nil, errors.New(fmt.Sprintf("No such attribute for metric %s: %s", s, path))
+	}
+
+	if att.Type != "number" || att.IsArray {
+		return nil, errors.New(fmt.Sprintf("Metric %s requires a number attribute: %s", fn, path))
+	}
+
+	return &aggregateMetric{Name: fmt.Sprintf("%s(%s)", fn, path), Func: fn, Path: path}, nil
+}
+
+// Add adds a CI to the group of its attribute values.
+func (c *Aggregation) Add(ci *CI) {
+	keys := make([]interface{}, len(c.GroupBy))
+	for i, path := range c.GroupBy {
+		keys[i] = getPath(ci.Value, path)
+	}
+
+	b, _ := json.Marshal(keys)
+	group, ok := c.groups[string(b)]
+	if !ok {
+		n := len(c.Metrics)
+		group = &aggregateGroup{
+			Keys: keys,
+			Sums: make([]float64, n),
+			Mins: make([]float64, n),
+			Maxs: make([]float64, n),
+			Ns:   make([]int, n),
+		}
+		c.groups[string(b)] = group
+	}
+
+	group.Count++
+	for i, metric := range c.Metrics {
+		if metric.Path == "" {
+			continue
+		}
+
+		f, ok := aggregateNumber(getPath(ci.Value, metric.Path))
+		if !ok {
+			continue
+		}
+
+		if group.Ns[i] == 0 || f < group.Mins[i] {
+			group.Mins[i] = f
+		}
+
+		if group.Ns[i] == 0 || f > group.Maxs[i] {
+			group.Maxs[i] = f
+		}
+
+		group.Sums[i] += f
+		group.Ns[i]++
+	}
+}
+
+// aggregateNumber returns the value of a number attribute as a float64.
+func aggregateNumber(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+
+	case int:
+		return float64(v), true
+
+	case int64:
+		return float64(v), true
+	}
+
+	return 0, false
+}
+
+// Result returns the rows of the aggregation ordered by their group values.
+func (c *Aggregation) Result() *AggregateResult {
+	result := &AggregateResult{
+		CIType:  c.CIType,
+		GroupBy: c.GroupBy,
+		Metrics: make([]string, len(c.Metrics)),
+		Rows:    []AggregateRow{},
+	}
+
+	for i, metric := range c.Metrics {
+		result.Metrics[i] = metric.Name
+	}
+
+	groups := make([]*aggregateGroup, 0, len(c.groups))
+	for _, group := range c.groups {
+		groups = append(groups, group)
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		for k := range groups[i].Keys {
+			if cmp := compareAggregateValues(groups[i].Keys[k], groups[j].Keys[k]); cmp != 0 {
+				return cmp < 0
+			}
+		}
+
+		return false
+	})
+
+	for _, group := range groups {
+		row := AggregateRow{
+			Group:  make([]AggregateValue, len(c.GroupBy)),
+			Values: make([]AggregateValue, len(c.Metrics)),
+		}
+
+		for i, path := range c.GroupBy {
+			row.Group[i] = AggregateValue{path, group.Keys[i]}
+		}
+
+		for i, metric := range c.Metrics {
+			var val interface{}
+			switch {
+			case metric.Func == "count":
+				val = group.Count
+
+			case metric.Func == "sum":
+				val = group.Sums[i]
+
+			case group.Ns[i] == 0:
+				// No values for avg, min or max
+
+			case metric.Func == "avg":
+				val = group.Sums[i] / float64(group.Ns[i])
+
+			case metric.Func == "min":
+				val = group.Mins[i]
+
+			case metric.Func == "max":
+				val = group.Maxs[i]
+			}
+
+			row.Values[i] = AggregateValue{metric.Name, val}
+		}
+
+		result.Rows = append(result.Rows, row)
+	}
+
+	return result
+}
+
+// compareAggregateValues orders group values with missing values first,
+// followed by booleans, numbers and strings.
+func compareAggregateValues(a, b interface{}) int {
+	rank := func(v interface{}) int {
+		switch v.(type) {
+		case nil:
+			return 0
+		case bool:
+			return 1
+		case float64, int, int64:
+			return 2
+		case string:
+			return 3
+		}
+		return 4
+	}
+
+	if ra, rb := rank(a), rank(b); ra != rb {
+		return ra - rb
+	}
+
+	switch v := a.(type) {
+	case bool:
+		if v == b.(bool) {
+			return 0
+		} else if !v {
+			return -1
+		}
+		return 1
+
+	case string:
+		return strings.Compare(v, b.(string))
+	}
+
+	fa, okA := aggregateNumber(a)
+	fb, okB := aggregateNumber(b)
+	if okA && okB {
+		if fa < fb {
+			return -1
+		} else if fa > fb {
+			return 1
+		}
+		return 0
+	}
+
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// MarshalJSON renders the group and values of a row as objects keyed by
+// attribute path and metric name.
+func (c AggregateRow) MarshalJSON() ([]byte, error) {
+	toMap := func(values []AggregateValue) map[string]interface{} {
+		m := make(map[string]interface{}, len(values))
+		for _, v := range values {
+			m[v.Name] = v.Value
+		}
+		return m
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"group":  toMap(c.Group),
+		"values": toMap(c.Values),
+	})
+}
+
+// MarshalXML renders a value as an element with a name attribute. Missing
+// values are marked with a nil attribute.
+func (c AggregateValue) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	elem := struct {
+		Name string `xml:"name,attr"`
+		Nil  bool   `xml:"nil,attr,omitempty"`
+		Text string `xml:",chardata"`
+	}{c.Name, c.Value == nil, formatCsvValue(c.Value, defaultCsvDelimiter)}
+
+	return e.EncodeElement(elem, start)
+}
+
+// MarshalCSV renders a row per group with a column for each group by path
+// followed by a column for each metric.
+func (c *AggregateResult) MarshalCSV() ([][]string, error) {
+	header := append(append([]string{}, c.GroupBy...), c.Metrics...)
+	records := [][]string{header}
+	for _, row := range c.Rows {
+		record := make([]string, 0, len(header))
+		for _, v := range row.Group {
+			record = append(record, formatCsvValue(v.Value, defaultCsvDelimiter))
+		}
+
+		for _, v := range row.Values {
+			record = append(record, formatCsvValue(v.Value, defaultCsvDelimiter))
+		}
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// AggregateCIs groups the CIs of a CI Type matching the optional filter by
+// the attribute paths in the groupBy query parameter and computes the
+// metrics in the metrics query parameter for each group.
+func AggregateCIs(res http.ResponseWriter, req *http.Request) {
+	cmdb := GetPathVar(req, "cmdb")
+	db := GetCmdbBackend(req, cmdb)
+	if db == nil {
+		log.Printf("No such CMDB found: %s", cmdb)
+		ErrNotFound(res, req)
+		return
+	}
+
+	var citype CIType
+	err := db.C(ciTypeCollection).Find(M{"shortname": GetPathVar(req, "citype")}).One(&citype)
+	if Handle(res, req, err) {
+		return
+	}
+
+	params := req.URL.Query()
+	agg, err := NewAggregation(&citype, params.Get("groupBy"), params.Get("metrics"))
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
+	filter, err := GetRequestFilter(req)
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
+	var ci CI
+	iter := db.C(citype.ShortName).Find(nil).Iter()
+	for iter.Next(&ci) {
+		if filter != nil {
+			if ok, err := filter.IsTrue(ci.Value); err != nil || !ok {
+				ci = CI{}
+				continue
+			}
+		}
+
+		agg.Add(&ci)
+		ci = CI{}
+	}
+
+	if Handle(res, req, iter.Close()) {
+		return
+	}
+
+	Render(res, req, http.StatusOK, agg.Result())
+}
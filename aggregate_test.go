@@ -0,0 +1,152 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func getAggregateTestCIType() *CIType {
+	return &CIType{
+		ShortName: "server",
+		Attributes: CITypeAttributeList{
+			{Name: "OS", ShortName: "os", Type: "group", Children: CITypeAttributeList{
+				{Name: "Name", ShortName: "name", Type: "string"},
+			}},
+			{Name: "Environment", ShortName: "environment", Type: "string"},
+			{Name: "Storage", ShortName: "storage", Type: "number"},
+			{Name: "Tags", ShortName: "tags", Type: "string", IsArray: true},
+		},
+	}
+}
+
+func TestNewAggregation(t *testing.T) {
+	citype := getAggregateTestCIType()
+	agg, err := NewAggregation(citype, "OS.Name, environment", "count,sum(Storage),max(storage)")
+	if err != nil {
+		t.Fatalf("Expected aggregation but got: %s", err)
+	}
+
+	areEqual(t, reflect.DeepEqual(agg.GroupBy, []string{"os.name", "environment"}), true)
+	areEqual(t, len(agg.Metrics), 3)
+	areEqual(t, agg.Metrics[1].Name, "sum(storage)")
+
+	agg, err = NewAggregation(citype, "", "")
+	areEqual(t, err, nil)
+	areEqual(t, agg.Metrics[0].Name, "count")
+
+	invalid := [][]string{
+		{"missing", ""},
+		{"os", ""},
+		{"tags", ""},
+		{"", "total"},
+		{"", "median(storage)"},
+		{"", "sum(environment)"},
+		{"", "avg(missing)"},
+		{"", "sum(storage"},
+	}
+
+	for _, args := range invalid {
+		if _, err := NewAggregation(citype, args[0], args[1]); err == nil {
+			t.Errorf("Expected groupBy '%s' and metrics '%s' to fail", args[0], args[1])
+		}
+	}
+}
+
+func TestAggregationResult(t *testing.T) {
+	agg, _ := NewAggregation(getAggregateTestCIType(), "environment", "count,sum(storage),avg(storage),min(storage),max(storage)")
+	for _, value := range []map[string]interface{}{
+		{"environment": "prod", "storage": float64(100)},
+		{"environment": "prod", "storage": float64(300)},
+		{"environment": "dev", "storage": float64(50)},
+		{"environment": "dev"},
+		{"storage": float64(10)},
+	} {
+		agg.Add(&CI{Value: value})
+	}
+
+	result := agg.Result()
+	areEqual(t, len(result.Rows), 3)
+
+	// Missing group values sort first
+	areEqual(t, result.Rows[0].Group[0].Value, nil)
+	areEqual(t, result.Rows[1].Group[0].Value, "dev")
+
+	prod := result.Rows[2].Values
+	areEqual(t, prod[0].Value, 2)
+	areEqual(t, prod[1].Value, float64(400))
+	areEqual(t, prod[2].Value, float64(200))
+	areEqual(t, prod[3].Value, float64(100))
+	areEqual(t, prod[4].Value, float64(300))
+
+	// Missing values are ignored
+	dev := result.Rows[1].Values
+	areEqual(t, dev[0].Value, 2)
+	areEqual(t, dev[2].Value, float64(50))
+
+	records, err := result.MarshalCSV()
+	areEqual(t, err, nil)
+	areEqual(t, strings.Join(records[0], ","), "environment,count,sum(storage),avg(storage),min(storage),max(storage)")
+	areEqual(t, strings.Join(records[3], ","), "prod,2,400,200,100,300")
+
+	b, _ := json.Marshal(result.Rows[2])
+	areEqual(t, string(b), `{"group":{"environment":"prod"},"values":{"avg(storage)":200,"count":2,"max(storage)":300,"min(storage)":100,"sum(storage)":400}}`)
+
+	b, _ = xml.Marshal(result.Rows[0])
+	if !strings.Contains(string(b), `<group name="environment" nil="true"></group>`) {
+		t.Errorf("Expected missing group value to be marked nil in: %s", b)
+	}
+}
+
+func TestAggregateCIs(t *testing.T) {
+	citype := Post(t, V1Uri("/cmdbs/temp/citypes"), `{"name":"Aggregate Server","attributes":[{"name":"environment","type":"string"},{"name":"storage","type":"number"}]}`)
+	defer Delete(t, citype)
+
+	Post(t, V1Uri("/cmdbs/temp/aggregate-server"), `{"environment":"prod","storage":100}`)
+	Post(t, V1Uri("/cmdbs/temp/aggregate-server"), `{"environment":"prod","storage":300}`)
+	Post(t, V1Uri("/cmdbs/temp/aggregate-server"), `{"environment":"dev","storage":50}`)
+
+	filter := url.QueryEscape(`storage > 60`)
+	req := NewRequest("GET", V1Uri("/cmdbs/temp/aggregate-server/aggregate?groupBy=environment&metrics=count,sum(storage)&filter="+filter+"&format=json"), nil)
+	res := httptest.NewRecorder()
+	GetServer().ServeHTTP(res, req)
+	areEqual(t, res.Code, http.StatusOK)
+
+	var result struct {
+		Rows []struct {
+			Group  map[string]interface{}
+			Values map[string]interface{}
+		}
+	}
+
+	json.Unmarshal(res.Body.Bytes(), &result)
+	areEqual(t, len(result.Rows), 1)
+	areEqual(t, result.Rows[0].Values["sum(storage)"], float64(400))
+
+	req = NewRequest("GET", V1Uri("/cmdbs/temp/aggregate-server/aggregate?metrics=sum(environment)"), nil)
+	res = httptest.NewRecorder()
+	GetServer().ServeHTTP(res, req)
+	areEqual(t, res.Code, http.StatusBadRequest)
+}
@@ -0,0 +1,382 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/codegangsta/negroni"
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	auditCollection = "audit"
+)
+
+// Audit actions
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+// AuditRecord is an entry in the append only audit log of a tenant. Each
+// record includes the hash of the previous record so that any modification
+// or removal of a record breaks the chain.
+type AuditRecord struct {
+	model       `json:"-" bson:",inline"`
+	TenantId    interface{} `json:"-" xml:"-"`
+	Sequence    int64       `json:"sequence"`
+	Time        time.Time   `json:"time"`
+	Actor       string      `json:"actor"`
+	Action      string      `json:"action"`
+	Method      string      `json:"method"`
+	Resource    string      `json:"resource"`
+	RequestHash string      `json:"requestHash,omitempty" xml:",omitempty" bson:",omitempty"`
+	BeforeHash  string      `json:"beforeHash,omitempty" xml:",omitempty" bson:",omitempty"`
+	AfterHash   string      `json:"afterHash,omitempty" xml:",omitempty" bson:",omitempty"`
+	Status      int         `json:"status"`
+	Outcome     string      `json:"outcome"`
+	PrevHash    string      `json:"prevHash"`
+	Hash        string      `json:"hash"`
+}
+
+// ComputeHash returns the chained hash of the record's content and the hash
+// of the previous record.
+func (c *AuditRecord) ComputeHash() string {
+	tenant := ""
+	if c.TenantId != nil {
+		tenant = IdToString(c.TenantId)
+	}
+
+	content := strings.Join([]string{
+		c.PrevHash,
+		strconv.FormatInt(c.Sequence, 10),
+		tenant,
+		c.Time.UTC().Format(time.RFC3339Nano),
+		c.Actor,
+		c.Action,
+		c.Method,
+		c.Resource,
+		c.RequestHash,
+		c.BeforeHash,
+		c.AfterHash,
+		strconv.Itoa(c.Status),
+		c.Outcome,
+	}, "\n")
+
+	return hashBytes([]byte(content))
+}
+
+func hashBytes(b []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(b))
+}
+
+// hashingBody hashes a request body as it is read so that large payloads
+// need not be held in memory.
+type hashingBody struct {
+	io.Reader
+	body io.ReadCloser
+	hash hash.Hash
+	size int64
+}
+
+func newHashingBody(body io.ReadCloser) *hashingBody {
+	c := &hashingBody{body: body, hash: sha256.New()}
+	c.Reader = io.TeeReader(body, c)
+	return c
+}
+
+func (c *hashingBody) Write(p []byte) (int, error) {
+	c.size += int64(len(p))
+	return c.hash.Write(p)
+}
+
+// Close reads the remainder of the body so that it is hashed in full.
+func (c *hashingBody) Close() error {
+	io.Copy(ioutil.Discard, c.Reader)
+	return c.body.Close()
+}
+
+// Sum returns the hash of the body, or an empty string if it is empty.
+func (c *hashingBody) Sum() string {
+	c.Close()
+	if c.size == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%x", c.hash.Sum(nil))
+}
+
+// VerifyAuditChain checks that the given records, ordered by sequence, form an
+// unbroken hash chain. The sequence number of the first invalid record is
+// returned if the chain is broken.
+func VerifyAuditChain(records []AuditRecord) (int64, bool) {
+	prev := ""
+	seq := int64(0)
+	for _, record := range records {
+		seq++
+		if record.Sequence != seq || record.PrevHash != prev || record.ComputeHash() != record.Hash {
+			return seq, false
+		}
+
+		prev = record.Hash
+	}
+
+	return 0, true
+}
+
+var auditMutex sync.Mutex
+
+// AppendAuditRecord adds a record to the end of its tenant's audit chain.
+func AppendAuditRecord(record *AuditRecord) error {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	c := RootDb().C(auditCollection)
+
+	// Another server may append to the chain at the same time, in which case
+	// the unique sequence index will reject one of the records
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		var last AuditRecord
+		err = c.Find(M{"tenantid": record.TenantId}).Sort("-sequence").One(&last)
+		if err == mgo.ErrNotFound {
+			record.Sequence = 1
+			record.PrevHash = ""
+		} else if err != nil {
+			return err
+		} else {
+			record.Sequence = last.Sequence + 1
+			record.PrevHash = last.Hash
+		}
+
+		record.Hash = record.ComputeHash()
+		err = c.Insert(record)
+		if !mgo.IsDup(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// AuditHandler is a middleware handler which records every mutating request
+// in the audit log.
+type AuditHandler struct {
+	router *mux.Router
+}
+
+// NewAuditHandler returns an AuditHandler which uses the given router to
+// retrieve the state of resources before and after they are modified. Only
+// named GET routes are retrieved, as these address a single resource rather
+// than a collection or stream.
+func NewAuditHandler(router *mux.Router) *AuditHandler {
+	return &AuditHandler{router}
+}
+
+func (c *AuditHandler) ServeHTTP(res http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	var action string
+	switch req.Method {
+	case "POST":
+		action = AuditCreate
+	case "PUT", "PATCH":
+		action = AuditUpdate
+	case "DELETE":
+		action = AuditDelete
+	default:
+		next(res, req)
+		return
+	}
+
+	auth := GetAuthContext(req)
+	if auth == nil {
+		next(res, req)
+		return
+	}
+
+	record := AuditRecord{
+		TenantId: auth.Tenant.Id,
+		Time:     time.Now().UTC().Truncate(time.Millisecond),
+		Actor:    auth.User.Email,
+		Action:   action,
+		Method:   req.Method,
+		Resource: req.URL.Path,
+	}
+	record.InitModel()
+
+	// Hash the request payload as it is read by the handler
+	var body *hashingBody
+	if req.Body != nil {
+		body = newHashingBody(req.Body)
+		req.Body = body
+	}
+
+	// The response status is needed for the outcome
+	rw, ok := res.(negroni.ResponseWriter)
+	if !ok {
+		rw = negroni.NewResponseWriter(res)
+		res = rw
+	}
+
+	if action != AuditCreate {
+		record.BeforeHash = c.snapshot(req, record.Resource)
+	}
+
+	next(res, req)
+
+	if body != nil {
+		record.RequestHash = body.Sum()
+	}
+
+	// Created and relocated resources are identified by their new location
+	if location := res.Header().Get("Location"); location != "" {
+		record.Resource = location
+	}
+
+	if action != AuditDelete {
+		record.AfterHash = c.snapshot(req, record.Resource)
+	}
+
+	record.Status = rw.Status()
+	if record.Status < 400 {
+		record.Outcome = "success"
+	} else {
+		record.Outcome = "failure"
+	}
+
+	err := AppendAuditRecord(&record)
+	if err != nil {
+		log.Printf("Error writing audit record for %s %s: %s", record.Method, record.Resource, err)
+	}
+}
+
+// snapshot returns the hash of the JSON representation of the resource at the
+// given path, or an empty string if it can not be retrieved or the path does
+// not address a single resource.
+func (c *AuditHandler) snapshot(orig *http.Request, path string) string {
+	req, err := http.NewRequest("GET", path+"?format=json", nil)
+	if err != nil {
+		return ""
+	}
+
+	var match mux.RouteMatch
+	if !c.router.Match(req, &match) || match.Route == nil || match.Route.GetName() == "" {
+		return ""
+	}
+	req.Header.Set("X-Auth-Token", orig.Header.Get("X-Auth-Token"))
+	defer forgetAuthContext(req)
+
+	res := httptest.NewRecorder()
+	c.router.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		return ""
+	}
+
+	return hashBytes(res.Body.Bytes())
+}
+
+// GetAuditRecords returns the audit log for the current tenant, most recent
+// first. Results may be filtered with the actor, action, resource (prefix),
+// outcome, since and until query parameters and limited with limit.
+func GetAuditRecords(res http.ResponseWriter, req *http.Request) {
+	auth := GetAuthContext(req)
+	if !auth.User.IsAdmin() {
+		ErrForbidden(res, req, errors.New("Only tenant administrators may read the audit log"))
+		return
+	}
+
+	query := req.URL.Query()
+
+	filter := M{"tenantid": auth.Tenant.Id}
+	for _, param := range []string{"actor", "action", "outcome"} {
+		if val := query.Get(param); val != "" {
+			filter[param] = val
+		}
+	}
+
+	if resource := query.Get("resource"); resource != "" {
+		filter["resource"] = M{"$regex": "^" + regexp.QuoteMeta(resource)}
+	}
+
+	timeRange, err := GetRequestTimeRange(req)
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
+	if timeRange != nil {
+		filter["time"] = timeRange
+	}
+
+	limit, err := GetRequestLimit(req, 100)
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
+	records := []AuditRecord{}
+	err = RootDb().C(auditCollection).Find(filter).Sort("-sequence").Limit(limit).All(&records)
+	if Handle(res, req, err) {
+		return
+	}
+
+	Render(res, req, http.StatusOK, records)
+}
+
+// VerifyAuditRecords checks the integrity of the current tenant's audit
+// chain.
+func VerifyAuditRecords(res http.ResponseWriter, req *http.Request) {
+	auth := GetAuthContext(req)
+	if !auth.User.IsAdmin() {
+		ErrForbidden(res, req, errors.New("Only tenant administrators may verify the audit log"))
+		return
+	}
+
+	records := []AuditRecord{}
+	err := RootDb().C(auditCollection).Find(M{"tenantid": auth.Tenant.Id}).Sort("sequence").All(&records)
+	if Handle(res, req, err) {
+		return
+	}
+
+	brokenAt, valid := VerifyAuditChain(records)
+	result := map[string]interface{}{
+		"valid":   valid,
+		"records": len(records),
+	}
+
+	if !valid {
+		log.Printf("Audit chain for tenant %s is broken at sequence %d", auth.Tenant.Code, brokenAt)
+		result["brokenAt"] = brokenAt
+	}
+
+	Render(res, req, http.StatusOK, result)
+}
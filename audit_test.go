@@ -0,0 +1,116 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAuditChain(n int) []AuditRecord {
+	records := make([]AuditRecord, n)
+	prev := ""
+	for i := range records {
+		records[i] = AuditRecord{
+			TenantId: NewId(),
+			Sequence: int64(i + 1),
+			Time:     time.Now().UTC().Truncate(time.Millisecond),
+			Actor:    "root@localhost",
+			Action:   AuditCreate,
+			Method:   "POST",
+			Resource: V1Uri("/cmdbs/temp"),
+			Status:   201,
+			Outcome:  "success",
+			PrevHash: prev,
+		}
+		records[i].Hash = records[i].ComputeHash()
+		prev = records[i].Hash
+	}
+
+	return records
+}
+
+func TestAuditChain(t *testing.T) {
+	records := newTestAuditChain(5)
+	if _, ok := VerifyAuditChain(records); !ok {
+		t.Errorf("Expected valid audit chain to verify")
+	}
+
+	// Modified record
+	records[2].Actor = "mallory@localhost"
+	if seq, ok := VerifyAuditChain(records); ok || seq != 3 {
+		t.Errorf("Expected modified audit record to break the chain at 3 - Got %d", seq)
+	}
+
+	// Modified and rehashed record
+	records[2].Hash = records[2].ComputeHash()
+	if seq, ok := VerifyAuditChain(records); ok || seq != 4 {
+		t.Errorf("Expected rehashed audit record to break the chain at 4 - Got %d", seq)
+	}
+
+	// Removed record
+	records = newTestAuditChain(5)
+	records = append(records[:1], records[2:]...)
+	if seq, ok := VerifyAuditChain(records); ok || seq != 2 {
+		t.Errorf("Expected removed audit record to break the chain at 2 - Got %d", seq)
+	}
+}
+
+func TestHashingBody(t *testing.T) {
+	payload := `{"hostname":"web01"}`
+	body := newHashingBody(ioutil.NopCloser(strings.NewReader(payload)))
+
+	// Unread bytes are hashed
+	b := make([]byte, 4)
+	body.Read(b)
+	areEqual(t, body.Sum(), hashBytes([]byte(payload)))
+
+	body = newHashingBody(ioutil.NopCloser(strings.NewReader("")))
+	areEqual(t, body.Sum(), "")
+}
+
+func TestAuditSnapshot(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/things", func(res http.ResponseWriter, req *http.Request) {
+		t.Errorf("Expected collections not to be retrieved for the audit log")
+	}).Methods("GET")
+	router.HandleFunc("/things/{id}", func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(mux.Vars(req)["id"]))
+	}).Methods("GET").Name("thing")
+
+	handler := NewAuditHandler(router)
+	req, _ := http.NewRequest("PUT", "/things", nil)
+	areEqual(t, handler.snapshot(req, "/things"), "")
+	areEqual(t, handler.snapshot(req, "/things/1"), hashBytes([]byte("1")))
+}
+
+func TestAuditLog(t *testing.T) {
+	// Create an audited resource
+	location := Post(t, V1Uri("/cmdbs/temp/citypes"), `{"name":"Audited CI Type"}`)
+	Delete(t, location)
+
+	Get(t, V1Uri("/audit"))
+	Get(t, V1Uri("/audit?action=delete&resource="+location))
+
+	result := Get(t, V1Uri("/audit/verify"))
+	areEqual(t, result["valid"], true)
+}
@@ -19,9 +19,11 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"gopkg.in/mgo.v2"
 	"log"
 	"net/http"
+	"sync"
 )
 
 type AuthHandler struct {
@@ -35,6 +37,15 @@ type AuthContext struct {
 type AuthMap map[*http.Request]*AuthContext
 
 var authCache AuthMap
+var authCacheMutex sync.Mutex
+
+// forgetAuthContext removes a request from the auth context cache.
+func forgetAuthContext(req *http.Request) {
+	authCacheMutex.Lock()
+	defer authCacheMutex.Unlock()
+
+	delete(authCache, req)
+}
 
 func NewAuthHandler() *AuthHandler {
 	return &AuthHandler{}
@@ -54,23 +65,34 @@ func (c *AuthHandler) ServeHTTP(res http.ResponseWriter, req *http.Request, next
 			ErrUnauthorized(res, req)
 			return
 		}
+
+		// Users must enrol in two factor authentication before doing
+		// anything else if their tenant requires it
+		if context.Tenant.RequireTotp && !context.User.TotpEnabled && !isTotpEnrolmentPath(req.URL.Path) {
+			log.Printf("User %s has not enrolled in two factor authentication", context.User.Email)
+			forgetAuthContext(req)
+			ErrForbidden(res, req, errors.New("Two factor authentication enrolment is required"))
+			return
+		}
 	}
 
 	// Process request chain
 	next(res, req)
 
 	// Remove the user from the request cache
-	delete(authCache, req)
+	forgetAuthContext(req)
 }
 
 func GetAuthContext(req *http.Request) *AuthContext {
 	// Initialize the context cache
+	authCacheMutex.Lock()
 	if authCache == nil {
 		authCache = AuthMap{}
 	}
 
 	// Is the user cached already?
 	context, ok := authCache[req]
+	authCacheMutex.Unlock()
 	if ok {
 		return context
 	}
@@ -80,11 +102,19 @@ func GetAuthContext(req *http.Request) *AuthContext {
 	if apiKey == "" {
 		return nil
 	} else {
-		// Find the user
+		// Find the user by API key or session token
 		var user User
 		err := RootDb().C("users").Find(M{"apikey": apiKey}).One(&user)
 		if err == mgo.ErrNotFound {
-			return nil
+			sessionUser, err := GetSessionUser(apiKey)
+			if err == mgo.ErrNotFound {
+				return nil
+			} else if err != nil {
+				log.Printf("Error retrieving session user from the database: %s", err.Error())
+				return nil
+			}
+
+			user = *sessionUser
 		} else if err != nil {
 			log.Printf("Error retrieving API user from the database: %s", err.Error())
 			return nil
@@ -102,42 +132,133 @@ func GetAuthContext(req *http.Request) *AuthContext {
 
 		// Add the context to the cache
 		context = &AuthContext{&user, &tenant}
+		authCacheMutex.Lock()
 		authCache[req] = context
+		authCacheMutex.Unlock()
 		return context
 	}
 }
 
-// GetApiKey accepts a JSON request body with a user name and password
-// encapsulated and returns the user's API key
-func GetApiKey(res http.ResponseWriter, req *http.Request) {
+func isTotpEnrolmentPath(path string) bool {
+	switch path {
+	case V1Uri("/users/current"), V1Uri("/users/current/totp"), V1Uri("/users/current/totp/verify"), V1Uri("/sessions/current"):
+		return true
+	}
+
+	return false
+}
+
+// LoginUser authenticates the username and password in a JSON request body,
+// along with a two factor authentication code if the user has enrolled.
+// If authentication fails, an error response is written and nil is returned.
+func LoginUser(res http.ResponseWriter, req *http.Request) *User {
 	// Parse the request body. Should be:
 	// {
 	//    "username":"some@email.com",
-	//    "password":"S0m3P4ssw0RD"
+	//    "password":"S0m3P4ssw0RD",
+	//    "code":"123456"
 	// }
 	body := make(map[string]string)
 	err := Bind(req, &body)
 	if err != nil {
 		ErrBadRequest(res, req, err)
-		return
+		return nil
 	}
 	if body["username"] == "" || body["password"] == "" {
 		err = errors.New("Username or password not specified")
 		ErrBadRequest(res, req, err)
-		return
+		return nil
 	}
 
-	// Find the user account
-	var user User
-	err = RootDb().C("users").Find(M{"email": body["username"]}).One(&user)
+	// Refuse attempts from throttled accounts and addresses
+	address := GetSourceAddress(req)
+	wait, err := CheckLoginThrottle(body["username"], address)
+	if Handle(res, req, err) {
+		return nil
+	}
+
+	if wait > 0 {
+		LogSecurityEvent(req, EventLoginRefused, body["username"], nil, fmt.Sprintf("retry after %v", wait))
+		ErrTooManyRequests(res, req, wait)
+		return nil
+	}
+
+	// Authenticate with the configured providers
+	user, err := AuthenticateUser(body["username"], body["password"])
 	if err != nil {
+		if err != ErrInvalidCredentials && err != ErrUnknownUser {
+			log.Printf("Error authenticating %s: %s", body["username"], err)
+		}
+
+		failLogin(res, req, body["username"], address, "")
+		return nil
+	}
+
+	// Validate the second factor
+	if !checkLoginSecondFactor(res, req, user, body["username"], address, body["code"]) {
+		return nil
+	}
+
+	// Failures were counted against the username as given
+	err = ResetLoginFailures(body["username"])
+	if Handle(res, req, err) {
+		return nil
+	}
+
+	LogSecurityEvent(req, EventLoginSuccess, body["username"], user, "")
+
+	return user
+}
+
+// checkLoginSecondFactor validates the two factor authentication code given
+// at login by a user who has enrolled. If the code is missing or invalid, an
+// error response is written and false is returned.
+func checkLoginSecondFactor(res http.ResponseWriter, req *http.Request, user *User, username string, address string, code string) bool {
+	if !user.TotpEnabled {
+		return true
+	}
+
+	if code == "" {
+		res.Header().Set("X-Auth-Required", "totp")
 		ErrUnauthorized(res, req)
+		return false
+	}
+
+	ok, err := CheckSecondFactor(user, code)
+	if Handle(res, req, err) {
+		return false
+	}
+
+	if !ok {
+		failLogin(res, req, username, address, "invalid two factor authentication code")
+		return false
+	}
+
+	return true
+}
+
+// failLogin records a failed login attempt and writes an unauthorized
+// response.
+func failLogin(res http.ResponseWriter, req *http.Request, username string, address string, message string) {
+	LogSecurityEvent(req, EventLoginFailure, username, nil, message)
+
+	locked, err := RecordLoginFailure(username, address)
+	if Handle(res, req, err) {
 		return
 	}
 
-	// Validate the password
-	if !CheckPassword(user.PasswordHash, body["password"]) {
-		ErrUnauthorized(res, req)
+	if locked {
+		LogSecurityEvent(req, EventLockout, username, nil, "")
+	}
+
+	ErrUnauthorized(res, req)
+}
+
+// GetApiKey accepts a JSON request body with a user name and password
+// encapsulated and returns the user's API key
+func GetApiKey(res http.ResponseWriter, req *http.Request) {
+	user := LoginUser(res, req)
+	if user == nil {
 		return
 	}
 
@@ -0,0 +1,210 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// LdapConn is the subset of an LDAP client connection used to authenticate
+// users. It is satisfied by *ldap.Conn.
+type LdapConn interface {
+	Bind(username string, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close()
+}
+
+// LdapAuthProvider authenticates users against an LDAP directory or Active
+// Directory domain and provisions their Alexandria account on first login.
+type LdapAuthProvider struct {
+	// Config overrides the global LDAP configuration if set
+	Config *LdapConfig
+
+	// Dial overrides the function used to connect to the directory if set
+	Dial func(config *LdapConfig) (LdapConn, error)
+}
+
+func (c *LdapAuthProvider) GetName() string {
+	return "ldap"
+}
+
+func (c *LdapAuthProvider) getConfig() (*LdapConfig, error) {
+	if c.Config != nil {
+		return c.Config, nil
+	}
+
+	config, err := GetConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return &config.Auth.Ldap, nil
+}
+
+func (c *LdapAuthProvider) dial(config *LdapConfig) (LdapConn, error) {
+	if c.Dial != nil {
+		return c.Dial(config)
+	}
+
+	return DialLdap(config)
+}
+
+// DialLdap connects to the directory server described in the given
+// configuration, upgrading the connection with StartTLS if required.
+func DialLdap(config *LdapConfig) (LdapConn, error) {
+	if config.Url == "" {
+		return nil, errors.New("No LDAP server URL configured")
+	}
+
+	conn, err := ldap.DialURL(config.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.StartTLS {
+		u, err := url.Parse(config.Url)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		err = conn.StartTLS(&tls.Config{ServerName: u.Hostname()})
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+func (c *LdapAuthProvider) Authenticate(username string, password string) (*User, error) {
+	identity, err := c.Lookup(username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	return ProvisionUser(identity)
+}
+
+// Lookup finds the directory entry for the given username by email address or
+// account name, verifies the password by binding as that entry and returns
+// the user's identity with their directory groups mapped to roles.
+func (c *LdapAuthProvider) Lookup(username string, password string) (*ExternalIdentity, error) {
+	// An empty password would perform an unauthenticated bind
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	config, err := c.getConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := c.dial(config)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Bind with the service account to search the directory
+	if config.BindDN != "" {
+		err = conn.Bind(config.BindDN, config.BindPassword)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("LDAP service account bind failed: %s", err))
+		}
+	}
+
+	// Find the user
+	filter := strings.Replace(config.UserFilter, "%s", ldap.EscapeFilter(username), -1)
+	search := ldap.NewSearchRequest(
+		config.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		filter,
+		[]string{"dn", "mail", "givenName", "sn", "memberOf"},
+		nil,
+	)
+
+	result, err := conn.Search(search)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.Entries) == 0 {
+		return nil, ErrUnknownUser
+	}
+
+	if len(result.Entries) > 1 {
+		return nil, errors.New(fmt.Sprintf("LDAP search for '%s' returned more than one entry", username))
+	}
+
+	entry := result.Entries[0]
+
+	// Validate the password
+	err = conn.Bind(entry.DN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, ErrInvalidCredentials
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Map groups to roles
+	roles := mapLdapGroups(config.GroupMap, entry.GetAttributeValues("memberOf"))
+	if len(config.GroupMap) > 0 && len(roles) == 0 {
+		log.Printf("LDAP user %s is not a member of any mapped group", entry.DN)
+		return nil, ErrInvalidCredentials
+	}
+
+	identity := &ExternalIdentity{
+		Provider:   c.GetName(),
+		Subject:    entry.DN,
+		Email:      entry.GetAttributeValue("mail"),
+		FirstName:  entry.GetAttributeValue("givenName"),
+		LastName:   entry.GetAttributeValue("sn"),
+		Roles:      roles,
+		TenantCode: config.TenantCode,
+		Provision:  config.Provision,
+	}
+
+	return identity, nil
+}
+
+// mapLdapGroups returns the distinct roles mapped to the given group DNs.
+// Distinguished names are compared case insensitively.
+func mapLdapGroups(groupMap map[string]string, groups []string) []string {
+	roles := []string{}
+	seen := map[string]bool{}
+	for dn, role := range groupMap {
+		for _, group := range groups {
+			if strings.EqualFold(dn, group) && !seen[role] {
+				seen[role] = true
+				roles = append(roles, role)
+			}
+		}
+	}
+
+	sort.Strings(roles)
+	return roles
+}
@@ -0,0 +1,199 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"strings"
+	"testing"
+)
+
+// fakeLdapEntry is a user account in the in-process test directory
+type fakeLdapEntry struct {
+	Password   string
+	Attributes map[string][]string
+}
+
+// fakeLdapDirectory is an in-process stand-in for an LDAP server which
+// implements LdapConn.
+type fakeLdapDirectory struct {
+	Entries map[string]fakeLdapEntry
+	BoundAs string
+}
+
+func (c *fakeLdapDirectory) Bind(username string, password string) error {
+	entry, ok := c.Entries[username]
+	if !ok || entry.Password != password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, fmt.Errorf("Invalid credentials for %s", username))
+	}
+
+	c.BoundAs = username
+	return nil
+}
+
+func (c *fakeLdapDirectory) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if c.BoundAs == "" {
+		return nil, ldap.NewError(ldap.LDAPResultInsufficientAccessRights, fmt.Errorf("Anonymous search is not permitted"))
+	}
+
+	// Match any entry whose mail or sAMAccountName appears in the filter
+	result := &ldap.SearchResult{}
+	for dn, entry := range c.Entries {
+		if !strings.HasSuffix(dn, req.BaseDN) {
+			continue
+		}
+
+		match := false
+		for _, attr := range []string{"mail", "sAMAccountName"} {
+			for _, val := range entry.Attributes[attr] {
+				if strings.Contains(req.Filter, fmt.Sprintf("(%s=%s)", attr, ldap.EscapeFilter(val))) {
+					match = true
+				}
+			}
+		}
+
+		if match {
+			ldapEntry := ldap.NewEntry(dn, entry.Attributes)
+			result.Entries = append(result.Entries, ldapEntry)
+		}
+	}
+
+	return result, nil
+}
+
+func (c *fakeLdapDirectory) Close() {
+	c.BoundAs = ""
+}
+
+func newTestLdapProvider() *LdapAuthProvider {
+	directory := &fakeLdapDirectory{
+		Entries: map[string]fakeLdapEntry{
+			"cn=svc-alexandria,ou=Service,dc=example,dc=com": {
+				Password: "S3rv1ce",
+			},
+			"cn=Jane Citizen,ou=Staff,dc=example,dc=com": {
+				Password: "J4neP4ss",
+				Attributes: map[string][]string{
+					"mail":           {"jane.citizen@example.com"},
+					"sAMAccountName": {"jcitizen"},
+					"givenName":      {"Jane"},
+					"sn":             {"Citizen"},
+					"memberOf": {
+						"CN=CMDB Admins,OU=Groups,DC=example,DC=com",
+						"cn=Staff,ou=Groups,dc=example,dc=com",
+					},
+				},
+			},
+			"cn=John Outsider,ou=Staff,dc=example,dc=com": {
+				Password: "J0hnP4ss",
+				Attributes: map[string][]string{
+					"mail":           {"john.outsider@example.com"},
+					"sAMAccountName": {"joutsider"},
+					"memberOf":       {"cn=Contractors,ou=Groups,dc=example,dc=com"},
+				},
+			},
+		},
+	}
+
+	return &LdapAuthProvider{
+		Config: &LdapConfig{
+			BindDN:       "cn=svc-alexandria,ou=Service,dc=example,dc=com",
+			BindPassword: "S3rv1ce",
+			BaseDN:       "dc=example,dc=com",
+			UserFilter:   "(&(objectClass=person)(|(mail=%s)(sAMAccountName=%s)))",
+			GroupMap: map[string]string{
+				"cn=cmdb admins,ou=groups,dc=example,dc=com": RoleAdmin,
+				"cn=staff,ou=groups,dc=example,dc=com":       RoleUser,
+			},
+			TenantCode: "abcd-123456-123456",
+			Provision:  true,
+		},
+		Dial: func(config *LdapConfig) (LdapConn, error) {
+			return directory, nil
+		},
+	}
+}
+
+func TestLdapLookup(t *testing.T) {
+	provider := newTestLdapProvider()
+
+	// Lookup by email address and account name
+	for _, username := range []string{"jane.citizen@example.com", "jcitizen"} {
+		identity, err := provider.Lookup(username, "J4neP4ss")
+		if err != nil {
+			t.Errorf("Expected LDAP user '%s' to authenticate but got: %s", username, err)
+			continue
+		}
+
+		areEqual(t, identity.Email, "jane.citizen@example.com")
+		areEqual(t, identity.FirstName, "Jane")
+		areEqual(t, identity.LastName, "Citizen")
+		areEqual(t, identity.Provider, "ldap")
+		areEqual(t, identity.TenantCode, "abcd-123456-123456")
+		areEqual(t, identity.Provision, true)
+		areEqual(t, strings.Join(identity.Roles, ","), "admin,user")
+	}
+}
+
+func TestLdapBadCredentials(t *testing.T) {
+	provider := newTestLdapProvider()
+
+	if _, err := provider.Lookup("jcitizen", "WrongP4ssw0RD!"); err != ErrInvalidCredentials {
+		t.Errorf("Expected invalid credentials for bad LDAP password but got: %v", err)
+	}
+
+	if _, err := provider.Lookup("jcitizen", ""); err != ErrInvalidCredentials {
+		t.Errorf("Expected invalid credentials for empty LDAP password but got: %v", err)
+	}
+
+	if _, err := provider.Lookup("nobody@example.com", "J4neP4ss"); err != ErrUnknownUser {
+		t.Errorf("Expected unknown user for missing LDAP entry but got: %v", err)
+	}
+
+	// Filter injection should not match other entries
+	if _, err := provider.Lookup("*", "J4neP4ss"); err != ErrUnknownUser {
+		t.Errorf("Expected unknown user for wildcard LDAP username but got: %v", err)
+	}
+}
+
+func TestLdapUnmappedGroup(t *testing.T) {
+	provider := newTestLdapProvider()
+
+	if _, err := provider.Lookup("joutsider", "J0hnP4ss"); err != ErrInvalidCredentials {
+		t.Errorf("Expected LDAP user without a mapped group to be refused but got: %v", err)
+	}
+
+	// Without a group map every directory user is allowed in
+	provider.Config.GroupMap = nil
+	identity, err := provider.Lookup("joutsider", "J0hnP4ss")
+	if err != nil {
+		t.Errorf("Expected LDAP user to authenticate without a group map but got: %s", err)
+	} else {
+		areEqual(t, len(identity.Roles), 0)
+	}
+}
+
+func TestLdapServiceBind(t *testing.T) {
+	provider := newTestLdapProvider()
+	provider.Config.BindPassword = "WrongP4ssw0RD!"
+
+	if _, err := provider.Lookup("jcitizen", "J4neP4ss"); err == nil {
+		t.Errorf("Expected LDAP lookup to fail with a bad service account password")
+	}
+}
@@ -0,0 +1,210 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"log"
+	"strings"
+)
+
+// ErrInvalidCredentials is returned by an AuthProvider when the supplied
+// username and password are not valid.
+var ErrInvalidCredentials = errors.New("Invalid username or password")
+
+// ErrUnknownUser is returned by an AuthProvider when it has no record of the
+// requested user so that the next provider may be consulted.
+var ErrUnknownUser = errors.New("Unknown user")
+
+// AuthProvider authenticates a username and password and returns the
+// corresponding Alexandria user account.
+type AuthProvider interface {
+	GetName() string
+	Authenticate(username string, password string) (*User, error)
+}
+
+// ExternalIdentity describes a user as asserted by an external identity
+// provider such as an LDAP directory.
+type ExternalIdentity struct {
+	Provider   string
+	Subject    string
+	Email      string
+	FirstName  string
+	LastName   string
+	Roles      []string
+	TenantCode string
+	Provision  bool
+}
+
+var authProviderMap map[string]AuthProvider
+
+// GetAuthProvider returns the authentication provider registered with the
+// given name or nil if no such provider exists.
+func GetAuthProvider(name string) AuthProvider {
+	if authProviderMap == nil {
+		// Initialize the map
+		authProviderMap = map[string]AuthProvider{}
+		providers := []AuthProvider{
+			&LocalAuthProvider{},
+			&LdapAuthProvider{},
+		}
+
+		for _, provider := range providers {
+			authProviderMap[provider.GetName()] = provider
+		}
+	}
+
+	return authProviderMap[name]
+}
+
+// AuthenticateUser consults each configured authentication provider in turn
+// and returns the first user account which authenticates successfully.
+func AuthenticateUser(username string, password string) (*User, error) {
+	config, err := GetConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range config.Auth.Providers {
+		provider := GetAuthProvider(name)
+		if provider == nil {
+			return nil, errors.New(fmt.Sprintf("Unsupported authentication provider: %s", name))
+		}
+
+		user, err := provider.Authenticate(username, password)
+		if err == ErrUnknownUser {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return user, nil
+	}
+
+	return nil, ErrInvalidCredentials
+}
+
+// LocalAuthProvider authenticates users against the password hashes stored in
+// the users collection.
+type LocalAuthProvider struct{}
+
+func (c *LocalAuthProvider) GetName() string {
+	return "local"
+}
+
+func (c *LocalAuthProvider) Authenticate(username string, password string) (*User, error) {
+	var user User
+	err := RootDb().C("users").Find(M{"email": username}).One(&user)
+	if err == mgo.ErrNotFound {
+		return nil, ErrUnknownUser
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Defer externally managed accounts to their own provider
+	if !user.IsLocal() {
+		return nil, ErrUnknownUser
+	}
+
+	if !CheckPassword(user.PasswordHash, password) {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &user, nil
+}
+
+// ProvisionUser returns the Alexandria user account for an external identity.
+// The account's name and roles are refreshed from the identity on each call
+// and, if the identity allows it, missing accounts are created in the
+// identity's configured tenant.
+func ProvisionUser(identity *ExternalIdentity) (*User, error) {
+	if identity.Email == "" {
+		return nil, errors.New(fmt.Sprintf("No email address was provided by %s for %s", identity.Provider, identity.Subject))
+	}
+
+	email := strings.ToLower(identity.Email)
+
+	var user User
+	err := RootDb().C("users").Find(M{"email": email}).One(&user)
+	if err == nil {
+		if user.Provider != identity.Provider {
+			return nil, errors.New(fmt.Sprintf("User %s is not managed by %s", email, identity.Provider))
+		}
+
+		user.FirstName = identity.FirstName
+		user.LastName = identity.LastName
+		user.Roles = identity.Roles
+		user.SetModified()
+
+		err = RootDb().C("users").UpdateId(user.Id, M{"$set": M{
+			"firstname": user.FirstName,
+			"lastname":  user.LastName,
+			"roles":     user.Roles,
+			"modified":  user.Modified,
+			"revision":  user.Revision,
+		}})
+		if err != nil {
+			return nil, err
+		}
+
+		return &user, nil
+	} else if err != mgo.ErrNotFound {
+		return nil, err
+	}
+
+	if !identity.Provision {
+		return nil, ErrUnknownUser
+	}
+
+	// Find the tenant for new accounts
+	var tenant Tenant
+	err = RootDb().C("tenants").Find(M{"code": strings.ToLower(identity.TenantCode)}).One(&tenant)
+	if err == mgo.ErrNotFound {
+		return nil, errors.New(fmt.Sprintf("No tenant found for %s provisioning with code: %s", identity.Provider, identity.TenantCode))
+	} else if err != nil {
+		return nil, err
+	}
+
+	user = User{
+		FirstName: identity.FirstName,
+		LastName:  identity.LastName,
+		Email:     email,
+		Provider:  identity.Provider,
+		Roles:     identity.Roles,
+	}
+	user.InitModel()
+	user.TenantId = tenant.Id
+
+	err = user.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	err = RootDb().C("users").Insert(&user)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Provisioned %s user '%s %s <%s>' in tenant %s", identity.Provider, user.FirstName, user.LastName, user.Email, tenant.Code)
+
+	return &user, nil
+}
@@ -0,0 +1,468 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+)
+
+const (
+	batchMaxRequests = 100
+	batchConcurrency = 8
+)
+
+// BatchOperation is a single API request in a batch. The path is relative to
+// the API version prefix and may include a query string.
+type BatchOperation struct {
+	Id      string            `json:"id,omitempty"`
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+// header returns the headers of the operation, which default to JSON. The
+// client address may only be given by the batch request itself.
+func (c *BatchOperation) header() http.Header {
+	header := http.Header{}
+	for key, val := range c.Headers {
+		header.Set(key, val)
+	}
+
+	header.Del("X-Forwarded-For")
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "application/json")
+	}
+
+	if header.Get("Accept") == "" {
+		header.Set("Accept", "application/json")
+	}
+
+	return header
+}
+
+// BatchRequest is a list of API requests to perform in order, concurrently
+// or as a single transaction of CI writes.
+type BatchRequest struct {
+	Requests      []BatchOperation `json:"requests"`
+	Concurrent    bool             `json:"concurrent,omitempty"`
+	Transactional bool             `json:"transactional,omitempty"`
+}
+
+// BatchResult is the response to a single request in a batch.
+type BatchResult struct {
+	Id         string            `json:"id,omitempty"`
+	Status     int               `json:"status"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Body       json.RawMessage   `json:"body,omitempty"`
+	RolledBack bool              `json:"rolledBack,omitempty"`
+}
+
+// ciWrite identifies the CI affected by a batch operation which creates,
+// upserts or deletes a CI.
+type ciWrite struct {
+	Cmdb   string
+	CIType string
+	Id     string
+
+	// CI before the write, or nil if it was created
+	Previous *CI
+}
+
+// parseCIWrite returns the CI write performed by an operation, or nil if the
+// operation does not write a single CI.
+func parseCIWrite(op *BatchOperation) *ciWrite {
+	u, err := url.Parse(op.Path)
+	if err != nil {
+		return nil
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(u.Path, ApiV1Prefix), "/"), "/")
+	if len(parts) < 3 || parts[0] != "cmdbs" || containsString(ciTypeReservedNames, parts[2]) {
+		return nil
+	}
+
+	write := &ciWrite{Cmdb: parts[1], CIType: parts[2]}
+	switch {
+	case len(parts) == 3 && (op.Method == "POST" || op.Method == "PUT"):
+		return write
+
+	case len(parts) == 4 && op.Method == "DELETE":
+		write.Id = parts[3]
+		return write
+	}
+
+	return nil
+}
+
+// snapshot records the CI which an operation is about to replace or delete.
+// Upserted CIs are identified the same way as by UpsertCI.
+func (c *ciWrite) snapshot(req *http.Request, op *BatchOperation) error {
+	db := GetCmdbBackend(req, c.Cmdb)
+	if db == nil || op.Method == "POST" {
+		return nil
+	}
+
+	col := db.C(c.CIType)
+	if op.Method == "DELETE" {
+		oid, err := IdFromString(c.Id)
+		if err != nil {
+			return nil
+		}
+
+		previous := &CI{}
+		err = col.FindId(oid).One(previous)
+		if err == mgo.ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		c.Previous = previous
+		return nil
+	}
+
+	var typ CIType
+	err := db.C(ciTypeCollection).Find(M{"shortname": c.CIType}).One(&typ)
+	if err == mgo.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Decode the body as the handler will. Requests which are invalid will
+	// fail without changing anything.
+	body, err := http.NewRequest(op.Method, op.Path, bytes.NewReader(op.Body))
+	if err != nil {
+		return nil
+	}
+	body.Header = op.header()
+
+	ci := CI{}
+	if Bind(body, &ci.Value) != nil || validateCI(&ci, &typ) != nil {
+		return nil
+	}
+
+	previous, err := findIdentifiedCI(col, &typ, ci.Value)
+	if err == ErrIdentityConflict {
+		return nil
+	}
+
+	c.Previous = previous
+	return err
+}
+
+// rollback reverses the write, unless the CI has been modified since.
+func (c *ciWrite) rollback(req *http.Request) error {
+	db := GetCmdbBackend(req, c.Cmdb)
+	if db == nil {
+		return errors.New(fmt.Sprintf("No such CMDB found: %s", c.Cmdb))
+	}
+
+	col := db.C(c.CIType)
+	oid, err := IdFromString(c.Id)
+	if err != nil {
+		return err
+	}
+
+	current := &CI{}
+	err = col.FindId(oid).One(current)
+	if err == mgo.ErrNotFound {
+		current = nil
+	} else if err != nil {
+		return err
+	}
+
+	switch {
+	case c.Previous == nil:
+		// Remove the created CI
+		if current == nil || current.Revision != 1 {
+			return ErrStaleRevision
+		}
+
+		err = RemoveRevision(col, oid, current.Revision)
+		if err == nil {
+			RecordCIChange(req, ChangeDeleted, c.Cmdb, c.CIType, current, current.Value)
+		}
+
+	case current == nil:
+		// Restore the deleted CI
+		restored := *c.Previous
+		restored.SetModified()
+		err = col.Insert(&restored)
+		if err == nil {
+			RecordCIChange(req, ChangeCreated, c.Cmdb, c.CIType, &restored, nil)
+		}
+
+	default:
+		// Restore the updated CI
+		if current.Revision != c.Previous.Revision+1 {
+			return ErrStaleRevision
+		}
+
+		restored := *c.Previous
+		restored.Revision = current.Revision
+		restored.SetModified()
+		err = UpdateRevision(col, oid, current.Revision, &restored)
+		if err == nil {
+			RecordCIChange(req, ChangeUpdated, c.Cmdb, c.CIType, &restored, current.Value)
+		}
+	}
+
+	return err
+}
+
+// BatchHandler performs each request in a batch with the given handler, as
+// the user who submitted the batch.
+type BatchHandler struct {
+	handler http.Handler
+}
+
+func NewBatchHandler(handler http.Handler) *BatchHandler {
+	return &BatchHandler{handler}
+}
+
+// newBatchProblem returns the result of an operation which was not
+// performed.
+func newBatchProblem(req *http.Request, op *BatchOperation, status int, code string, err error) *BatchResult {
+	body, _ := json.Marshal(NewProblem(req, status, code, err))
+	return &BatchResult{Id: op.Id, Status: status, Body: body}
+}
+
+// perform sends a single operation to the API and returns its response.
+func (c *BatchHandler) perform(parent *http.Request, index int, op *BatchOperation) *BatchResult {
+	switch op.Method {
+	case "GET", "POST", "PUT", "PATCH", "DELETE":
+	default:
+		return newBatchProblem(parent, op, http.StatusBadRequest, CodeBadRequest, errors.New(fmt.Sprintf("Unsupported method '%s' in batch request %d", op.Method, index)))
+	}
+
+	u, err := url.Parse(op.Path)
+	if err != nil || !strings.HasPrefix(op.Path, "/") {
+		return newBatchProblem(parent, op, http.StatusBadRequest, CodeBadRequest, errors.New(fmt.Sprintf("Invalid path '%s' in batch request %d", op.Path, index)))
+	}
+
+	if !strings.HasPrefix(u.Path, ApiV1Prefix+"/") {
+		u.Path = V1Uri(u.Path)
+	}
+
+	if path.Clean(u.Path) == V1Uri("/batch") {
+		return newBatchProblem(parent, op, http.StatusBadRequest, CodeBadRequest, errors.New("Batch requests may not be nested"))
+	}
+
+	req, err := http.NewRequest(op.Method, u.String(), bytes.NewReader(op.Body))
+	if err != nil {
+		return newBatchProblem(parent, op, http.StatusBadRequest, CodeBadRequest, err)
+	}
+
+	// Authenticate as the user who submitted the batch
+	req.Header = op.header()
+	req.Header.Set("X-Auth-Token", parent.Header.Get("X-Auth-Token"))
+	if forwarded := parent.Header.Get("X-Forwarded-For"); forwarded != "" {
+		req.Header.Set("X-Forwarded-For", forwarded)
+	}
+	req.RemoteAddr = parent.RemoteAddr
+
+	id := fmt.Sprintf("%s-%d", GetRequestId(parent), index)
+	req = req.WithContext(context.WithValue(parent.Context(), requestIdKey{}, id))
+
+	res := httptest.NewRecorder()
+	c.handler.ServeHTTP(res, req)
+
+	result := &BatchResult{Id: op.Id, Status: res.Code, Headers: map[string]string{}}
+	for _, key := range []string{"Location", "ETag"} {
+		if val := res.Header().Get(key); val != "" {
+			result.Headers[key] = val
+		}
+	}
+
+	body := res.Body.Bytes()
+	if len(body) > 0 {
+		if !json.Valid(body) {
+			body, _ = json.Marshal(string(body))
+		}
+
+		result.Body = body
+	}
+
+	return result
+}
+
+// transact performs operations in order, stopping at the first failure and
+// reversing each CI write already performed. Writes by other requests are
+// not isolated from the transaction, so CIs modified by another request
+// before the rollback are left unchanged.
+func (c *BatchHandler) transact(req *http.Request, ops []BatchOperation) []*BatchResult {
+	results := make([]*BatchResult, len(ops))
+	writes := make([]*ciWrite, len(ops))
+
+	failed := false
+	for i := range ops {
+		op := &ops[i]
+		if failed {
+			results[i] = &BatchResult{Id: op.Id, Status: http.StatusFailedDependency}
+			continue
+		}
+
+		write := parseCIWrite(op)
+		if write != nil {
+			if err := write.snapshot(req, op); err != nil {
+				results[i] = newBatchProblem(req, op, http.StatusInternalServerError, CodeInternalError, err)
+				failed = true
+				continue
+			}
+		}
+
+		results[i] = c.perform(req, i, op)
+		if results[i].Status >= 400 {
+			failed = true
+			continue
+		}
+
+		if write == nil {
+			continue
+		}
+
+		// Identify the CI which was written
+		switch ops[i].Method {
+		case "POST":
+			write.Id = path.Base(results[i].Headers["Location"])
+
+		case "PUT":
+			var upsert CIUpsertResult
+			json.Unmarshal(results[i].Body, &upsert)
+			if upsert.Status == UpsertUnchanged {
+				continue
+			}
+
+			write.Id = upsert.Id
+			if upsert.Status == UpsertCreated {
+				write.Previous = nil
+			} else if write.Previous == nil {
+				log.Printf("Batch request %d updated CI %s which can not be rolled back", i, upsert.Id)
+				continue
+			}
+		}
+
+		writes[i] = write
+	}
+
+	if !failed {
+		return results
+	}
+
+	for i := len(writes) - 1; i >= 0; i-- {
+		if writes[i] == nil {
+			continue
+		}
+
+		err := writes[i].rollback(req)
+		if err != nil {
+			log.Printf("Error rolling back batch request %d to %s/%s/%s: %s", i, writes[i].Cmdb, writes[i].CIType, writes[i].Id, err)
+			continue
+		}
+
+		results[i].RolledBack = true
+	}
+
+	return results
+}
+
+func (c *BatchHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	var batch BatchRequest
+	err := Bind(req, &batch)
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
+	if len(batch.Requests) == 0 {
+		ErrBadRequest(res, req, errors.New("No requests specified"))
+		return
+	}
+
+	if len(batch.Requests) > batchMaxRequests {
+		ErrBadRequest(res, req, errors.New(fmt.Sprintf("A batch may include at most %d requests", batchMaxRequests)))
+		return
+	}
+
+	// Methods are compared in upper case from here on
+	for i := range batch.Requests {
+		batch.Requests[i].Method = strings.ToUpper(batch.Requests[i].Method)
+	}
+
+	var results []*BatchResult
+	switch {
+	case batch.Transactional:
+		if batch.Concurrent {
+			ErrBadRequest(res, req, errors.New("Transactional batches may not be performed concurrently"))
+			return
+		}
+
+		// Only CI writes can be reversed
+		errs := ValidationErrors{}
+		for i := range batch.Requests {
+			op := &batch.Requests[i]
+			if op.Method != "GET" && parseCIWrite(op) == nil {
+				errs = errs.Add(errors.New(fmt.Sprintf("Batch request %d is not a CI write and may not be performed in a transaction", i)))
+			}
+		}
+
+		if err := errs.Err(); err != nil {
+			ErrBadRequest(res, req, err)
+			return
+		}
+
+		results = c.transact(req, batch.Requests)
+
+	case batch.Concurrent:
+		results = make([]*BatchResult, len(batch.Requests))
+		sem := make(chan struct{}, batchConcurrency)
+		var wg sync.WaitGroup
+		for i := range batch.Requests {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int) {
+				defer wg.Done()
+				results[i] = c.perform(req, i, &batch.Requests[i])
+				<-sem
+			}(i)
+		}
+		wg.Wait()
+
+	default:
+		results = make([]*BatchResult, len(batch.Requests))
+		for i := range batch.Requests {
+			results[i] = c.perform(req, i, &batch.Requests[i])
+		}
+	}
+
+	RenderJson(res, req, http.StatusOK, results)
+}
@@ -0,0 +1,182 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseCIWrite(t *testing.T) {
+	tests := []struct {
+		Method string
+		Path   string
+		CIType string
+		Id     string
+	}{
+		{"POST", "/cmdbs/temp/server", "server", ""},
+		{"PUT", "/api/v1/cmdbs/temp/server?dryRun=false", "server", ""},
+		{"DELETE", "/cmdbs/temp/server/0123456789abcdef01234567", "server", "0123456789abcdef01234567"},
+		{"POST", "/cmdbs/temp/citypes", "", ""},
+		{"POST", "/cmdbs/temp/server/bulk", "", ""},
+		{"DELETE", "/cmdbs/temp/webhooks/ticketing", "", ""},
+		{"GET", "/cmdbs/temp/server", "", ""},
+		{"POST", "/users", "", ""},
+	}
+
+	for _, test := range tests {
+		write := parseCIWrite(&BatchOperation{Method: test.Method, Path: test.Path})
+		if test.CIType == "" {
+			if write != nil {
+				t.Errorf("Expected %s %s not to be a CI write", test.Method, test.Path)
+			}
+			continue
+		}
+
+		if write == nil {
+			t.Errorf("Expected %s %s to be a CI write", test.Method, test.Path)
+			continue
+		}
+
+		areEqual(t, write.Cmdb, "temp")
+		areEqual(t, write.CIType, test.CIType)
+		areEqual(t, write.Id, test.Id)
+	}
+}
+
+func TestBatchOperationHeader(t *testing.T) {
+	op := BatchOperation{Headers: map[string]string{
+		"x-forwarded-for": "203.0.113.1",
+		"content-type":    "application/yaml",
+	}}
+
+	header := op.header()
+	areEqual(t, header.Get("X-Forwarded-For"), "")
+	areEqual(t, header.Get("Content-Type"), "application/yaml")
+	areEqual(t, header.Get("Accept"), "application/json")
+}
+
+func serveBatch(handler http.Handler, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", V1Uri("/batch"), strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Auth-Token", "secret")
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	return res
+}
+
+func TestBatchRequests(t *testing.T) {
+	var calls int32
+	api := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if req.Header.Get("X-Auth-Token") != "secret" {
+			ErrUnauthorized(res, req)
+			return
+		}
+
+		switch req.Method {
+		case "GET":
+			RenderJson(res, req, http.StatusOK, map[string]string{"path": req.URL.Path})
+		case "POST":
+			RenderCreated(res, req, req.URL.Path+"/0123456789abcdef01234567")
+		default:
+			ErrNotFound(res, req)
+		}
+	})
+
+	for _, concurrent := range []bool{false, true} {
+		atomic.StoreInt32(&calls, 0)
+		res := serveBatch(NewBatchHandler(api), fmt.Sprintf(`{
+			"concurrent": %t,
+			"requests": [
+				{ "id": "a", "method": "get", "path": "/cmdbs/temp/server" },
+				{ "id": "b", "method": "POST", "path": "/cmdbs/temp/server", "body": { "hostname": "web01" }, "headers": { "X-Auth-Token": "other" } },
+				{ "id": "c", "method": "DELETE", "path": "/cmdbs/temp/server/0123456789abcdef01234567" },
+				{ "id": "d", "method": "POST", "path": "/batch" },
+				{ "id": "e", "method": "TRACE", "path": "/info" }
+			]
+		}`, concurrent))
+		areEqual(t, res.Code, http.StatusOK)
+		areEqual(t, atomic.LoadInt32(&calls), int32(3))
+
+		var results []BatchResult
+		json.Unmarshal(res.Body.Bytes(), &results)
+		areEqual(t, len(results), 5)
+		areEqual(t, results[0].Id, "a")
+		areEqual(t, results[0].Status, http.StatusOK)
+		areEqual(t, string(results[0].Body), `{"path":"/api/v1/cmdbs/temp/server"}`)
+		areEqual(t, results[1].Status, http.StatusCreated)
+		areEqual(t, results[1].Headers["Location"], V1Uri("/cmdbs/temp/server/0123456789abcdef01234567"))
+		areEqual(t, results[2].Status, http.StatusNotFound)
+		areEqual(t, results[3].Status, http.StatusBadRequest)
+		areEqual(t, results[4].Status, http.StatusBadRequest)
+	}
+}
+
+func TestBadBatchRequests(t *testing.T) {
+	api := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		t.Errorf("Expected no requests to be performed")
+	})
+
+	bodies := []string{
+		`{"requests":[]}`,
+		`{"transactional":true,"concurrent":true,"requests":[{"method":"POST","path":"/cmdbs/temp/server"}]}`,
+		`{"transactional":true,"requests":[{"method":"POST","path":"/cmdbs/temp/citypes"}]}`,
+	}
+
+	for _, body := range bodies {
+		res := serveBatch(NewBatchHandler(api), body)
+		areEqual(t, res.Code, http.StatusBadRequest)
+	}
+}
+
+func TestTransactionalBatch(t *testing.T) {
+	typUrl := Post(t, V1Uri("/cmdbs/temp/citypes"), `{
+		"name":"Batch Test",
+		"attributes":[ { "name":"serial", "type":"string", "required":true } ]
+	}`)
+	defer Delete(t, typUrl)
+
+	req := NewRequest("POST", V1Uri("/batch"), strings.NewReader(`{
+		"transactional": true,
+		"requests": [
+			{ "method": "post", "path": "/cmdbs/temp/batch-test", "body": { "serial": "ABC123" } },
+			{ "method": "POST", "path": "/cmdbs/temp/batch-test", "body": { "hostname": "web01" } },
+			{ "method": "POST", "path": "/cmdbs/temp/batch-test", "body": { "serial": "DEF456" } }
+		]
+	}`))
+	req.Header.Set("Content-Type", "application/json")
+	res := httptest.NewRecorder()
+	GetServer().ServeHTTP(res, req)
+	areEqual(t, res.Code, http.StatusOK)
+
+	var results []BatchResult
+	json.Unmarshal(res.Body.Bytes(), &results)
+	areEqual(t, results[0].Status, http.StatusCreated)
+	areEqual(t, results[0].RolledBack, true)
+	areEqual(t, results[1].Status, http.StatusBadRequest)
+	areEqual(t, results[2].Status, http.StatusFailedDependency)
+
+	GetMissing(t, results[0].Headers["Location"])
+}
@@ -0,0 +1,425 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	outboxCollection = "outbox"
+
+	defaultBusPrefix  = "alexandria"
+	busPublishTimeout = 10 * time.Second
+
+	// Messages are republished if a server claims them and fails to publish
+	// them within the lease
+	outboxLease        = time.Minute
+	outboxPollInterval = 5 * time.Second
+	outboxMaxBackoff   = time.Minute
+
+	// Published messages are removed after the retention period
+	outboxRetention = 24 * time.Hour
+)
+
+// Bus event kinds
+const (
+	BusKindCI     = "ci"
+	BusKindCIType = "citype"
+	BusKindCmdb   = "cmdb"
+)
+
+// Outbox statuses
+const (
+	OutboxPending   = "pending"
+	OutboxPublished = "published"
+)
+
+// BusMessage is a message sent to or received from a message bus.
+type BusMessage struct {
+	Subject       string
+	Id            string
+	CorrelationId string
+	ReplyTo       string
+	Body          []byte
+}
+
+// Publisher sends messages to a message bus. Publish returns once the bus has
+// accepted the message.
+type Publisher interface {
+	Publish(msg *BusMessage) error
+	Close() error
+}
+
+// NewPublisher returns the publisher for the configured message bus, or nil
+// if no message bus is configured.
+func NewPublisher(config *BusConfig) (Publisher, error) {
+	switch config.Driver {
+	case "":
+		return nil, nil
+
+	case "amqp":
+		return NewAmqpPublisher(config.Url, config.Exchange), nil
+
+	case "nats":
+		return NewNatsPublisher(config.Url, config.Prefix)
+
+	case "memory":
+		return NewMemoryBus(), nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("Unsupported message bus driver: %s", config.Driver))
+}
+
+// BusEvent is a change to a CI, CI Type or CMDB published to the message
+// bus.
+type BusEvent struct {
+	Id       string       `json:"id"`
+	Time     time.Time    `json:"time"`
+	Tenant   string       `json:"tenant"`
+	Kind     string       `json:"kind"`
+	Action   string       `json:"action"`
+	Actor    string       `json:"actor,omitempty"`
+	Cmdb     string       `json:"cmdb"`
+	CIType   string       `json:"citype,omitempty"`
+	Resource string       `json:"resource"`
+	Revision int          `json:"revision,omitempty"`
+	Diff     []ChangeDiff `json:"diff,omitempty"`
+	Data     interface{}  `json:"data,omitempty"`
+}
+
+// Subject returns the subject or routing key of an event. Subjects have the
+// form prefix.tenant.cmdb.kind.action, with the CI Type following the kind
+// of CI events.
+func (c *BusEvent) Subject(prefix string) string {
+	parts := []string{prefix, c.Tenant, c.Cmdb, c.Kind}
+	if c.Kind == BusKindCI {
+		parts = append(parts, c.CIType)
+	}
+
+	return strings.Join(append(parts, c.Action), ".")
+}
+
+// NewBusEvent returns an event for a change made by a request.
+func NewBusEvent(req *http.Request, kind string, action string, cmdb string, resource string, revision int, data interface{}) *BusEvent {
+	event := &BusEvent{
+		Id:       IdToString(NewId()),
+		Time:     time.Now().UTC().Truncate(time.Millisecond),
+		Kind:     kind,
+		Action:   action,
+		Cmdb:     strings.ToLower(cmdb),
+		Resource: resource,
+		Revision: revision,
+		Data:     data,
+	}
+
+	if auth := GetAuthContext(req); auth != nil {
+		event.Tenant = auth.Tenant.Code
+		event.Actor = auth.User.Email
+	}
+
+	return event
+}
+
+// newCIBusEvent returns the message bus event for a CI change event.
+func newCIBusEvent(change *ChangeEvent) *BusEvent {
+	return &BusEvent{
+		Id:       IdToString(NewId()),
+		Time:     change.Time,
+		Tenant:   change.tenant,
+		Kind:     BusKindCI,
+		Action:   change.Type,
+		Actor:    change.Actor,
+		Cmdb:     change.Cmdb,
+		CIType:   change.CIType,
+		Resource: change.CIId,
+		Revision: change.CIRevision,
+		Diff:     change.Diff,
+		Data:     change.value,
+	}
+}
+
+// outboxMessage is a message stored until it is published so that messages
+// are not lost if the message bus is unavailable.
+type outboxMessage struct {
+	model       `bson:",inline"`
+	Subject     string
+	MessageId   string
+	Body        []byte
+	Status      string
+	NextAttempt time.Time
+	Attempts    int
+	Error       string    `bson:",omitempty"`
+	Published   time.Time `bson:",omitempty"`
+}
+
+// OutboxRelay publishes the messages in the outbox in the order they were
+// added.
+type OutboxRelay struct {
+	publisher Publisher
+	prefix    string
+	wake      chan struct{}
+}
+
+// busRelay is nil if no message bus is configured.
+var busRelay *OutboxRelay
+
+func NewOutboxRelay(publisher Publisher, prefix string) *OutboxRelay {
+	if prefix == "" {
+		prefix = defaultBusPrefix
+	}
+
+	return &OutboxRelay{
+		publisher: publisher,
+		prefix:    prefix,
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// StartBus publishes events to the given message bus.
+func StartBus(publisher Publisher, prefix string) *OutboxRelay {
+	busRelay = NewOutboxRelay(publisher, prefix)
+	go busRelay.run()
+	return busRelay
+}
+
+// Wake prompts the relay to publish new messages.
+func (c *OutboxRelay) Wake() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *OutboxRelay) run() {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	backoff := time.Duration(0)
+	for {
+		for {
+			published, err := c.publishNext()
+			if err != nil {
+				// Wait for the message bus to recover
+				backoff = backoff*2 + time.Second
+				if backoff > outboxMaxBackoff {
+					backoff = outboxMaxBackoff
+				}
+				log.Printf("Error publishing to message bus, retrying in %v: %s", backoff, err)
+				time.Sleep(backoff)
+				break
+			}
+
+			backoff = 0
+			if !published {
+				break
+			}
+		}
+
+		select {
+		case <-c.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// publishNext claims and publishes the oldest message in the outbox. False is
+// returned if the outbox is empty.
+func (c *OutboxRelay) publishNext() (bool, error) {
+	now := time.Now()
+	outbox := RootDb().C(outboxCollection)
+
+	var msg outboxMessage
+	_, err := outbox.Find(M{"status": OutboxPending, "nextattempt": M{"$lte": now}}).Sort("created", "_id").Apply(mgo.Change{
+		Update:    M{"$set": M{"nextattempt": now.Add(outboxLease)}, "$inc": M{"attempts": 1}},
+		ReturnNew: true,
+	}, &msg)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	err = c.publisher.Publish(&BusMessage{Subject: msg.Subject, Id: msg.MessageId, Body: msg.Body})
+	if err != nil {
+		// Release the message to be retried in order
+		outbox.UpdateId(msg.Id, M{"$set": M{"nextattempt": now, "error": err.Error()}})
+		return false, err
+	}
+
+	err = outbox.UpdateId(msg.Id, M{"$set": M{"status": OutboxPublished, "published": time.Now()}, "$unset": M{"error": ""}})
+	return true, err
+}
+
+// Queue adds events to the outbox to be published.
+func (c *OutboxRelay) Queue(events []*BusEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	docs := make([]interface{}, len(events))
+	for i, event := range events {
+		body, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		msg := &outboxMessage{
+			Subject:   event.Subject(c.prefix),
+			MessageId: event.Id,
+			Body:      body,
+			Status:    OutboxPending,
+		}
+		msg.InitModel()
+		msg.NextAttempt = msg.Created
+		docs[i] = msg
+	}
+
+	err := RootDb().C(outboxCollection).Insert(docs...)
+	if err != nil {
+		return err
+	}
+
+	c.Wake()
+	return nil
+}
+
+// QueueBusEvents adds events to the outbox to be published to the message
+// bus, if one is configured. Nil events are ignored. Errors are logged but not
+// returned so that a change which has been stored is never reported as
+// failed.
+func QueueBusEvents(events ...*BusEvent) {
+	if busRelay == nil {
+		return
+	}
+
+	valid := make([]*BusEvent, 0, len(events))
+	for _, event := range events {
+		if event != nil {
+			valid = append(valid, event)
+		}
+	}
+
+	err := busRelay.Queue(valid)
+	if err != nil {
+		log.Printf("Error queueing %d message bus events: %s", len(valid), err)
+	}
+}
+
+// RecordBusEvent queues an event for a change to a CI Type or CMDB made by a
+// request.
+func RecordBusEvent(req *http.Request, kind string, action string, cmdb string, resource string, revision int, data interface{}) {
+	if busRelay == nil {
+		return
+	}
+
+	QueueBusEvents(NewBusEvent(req, kind, action, cmdb, resource, revision, data))
+}
+
+// subjectMatches returns true if a subject matches a pattern in which '*'
+// matches a single token and a trailing '>' or '#' matches one or more
+// tokens.
+func subjectMatches(pattern string, subject string) bool {
+	p := strings.Split(pattern, ".")
+	s := strings.Split(subject, ".")
+	for i, token := range p {
+		if (token == ">" || token == "#") && i == len(p)-1 {
+			return len(s) > i
+		}
+
+		if i >= len(s) || (token != "*" && token != s[i]) {
+			return false
+		}
+	}
+
+	return len(p) == len(s)
+}
+
+// Number of published messages retained by a MemoryBus
+const memoryBusMaxMessages = 1000
+
+// MemoryBus is an in-process message bus for tests and single server
+// deployments. Only the most recent messages are retained.
+type MemoryBus struct {
+	mutex       sync.Mutex
+	messages    []BusMessage
+	subscribers map[string][]func(*BusMessage)
+
+	// Publish fails with Err if it is set
+	Err error
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{subscribers: map[string][]func(*BusMessage){}}
+}
+
+func (c *MemoryBus) Publish(msg *BusMessage) error {
+	c.mutex.Lock()
+	if c.Err != nil {
+		c.mutex.Unlock()
+		return c.Err
+	}
+
+	c.messages = append(c.messages, *msg)
+	if len(c.messages) > memoryBusMaxMessages {
+		c.messages = append([]BusMessage{}, c.messages[len(c.messages)-memoryBusMaxMessages:]...)
+	}
+	handlers := []func(*BusMessage){}
+	for pattern, subs := range c.subscribers {
+		if subjectMatches(pattern, msg.Subject) {
+			handlers = append(handlers, subs...)
+		}
+	}
+	c.mutex.Unlock()
+
+	for _, handler := range handlers {
+		handler(msg)
+	}
+
+	return nil
+}
+
+// Consume calls handler for each message published with a subject which
+// matches the pattern.
+func (c *MemoryBus) Consume(pattern string, handler func(*BusMessage)) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.subscribers[pattern] = append(c.subscribers[pattern], handler)
+	return nil
+}
+
+// Messages returns the most recent messages published.
+func (c *MemoryBus) Messages() []BusMessage {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return append([]BusMessage{}, c.messages...)
+}
+
+func (c *MemoryBus) Close() error {
+	return nil
+}
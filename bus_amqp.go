@@ -0,0 +1,221 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"errors"
+	"github.com/streadway/amqp"
+	"log"
+	"sync"
+	"time"
+)
+
+// AmqpPublisher publishes messages to a durable AMQP 0-9-1 topic exchange
+// with the message subject as the routing key. Each message is persistent and
+// confirmed by the broker before Publish returns. Messages are consumed from
+// durable queues bound to the same exchange.
+type AmqpPublisher struct {
+	url      string
+	exchange string
+
+	mutex    sync.Mutex
+	conn     *amqp.Connection
+	channel  *amqp.Channel
+	confirms chan amqp.Confirmation
+}
+
+func NewAmqpPublisher(url string, exchange string) *AmqpPublisher {
+	if exchange == "" {
+		exchange = defaultBusPrefix
+	}
+
+	return &AmqpPublisher{url: url, exchange: exchange}
+}
+
+func (c *AmqpPublisher) connect() error {
+	conn, err := amqp.Dial(c.url)
+	if err != nil {
+		return err
+	}
+
+	channel, err := conn.Channel()
+	if err == nil {
+		err = channel.ExchangeDeclare(c.exchange, "topic", true, false, false, false, nil)
+	}
+
+	if err == nil {
+		err = channel.Confirm(false)
+	}
+
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	c.conn = conn
+	c.channel = channel
+	c.confirms = channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	return nil
+}
+
+// reset closes the connection so that the next message reconnects.
+func (c *AmqpPublisher) reset() {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+
+	c.conn = nil
+	c.channel = nil
+	c.confirms = nil
+}
+
+func (c *AmqpPublisher) Publish(msg *BusMessage) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.channel == nil {
+		if err := c.connect(); err != nil {
+			return err
+		}
+	}
+
+	err := c.channel.Publish(c.exchange, msg.Subject, false, false, amqp.Publishing{
+		ContentType:   "application/json",
+		DeliveryMode:  amqp.Persistent,
+		MessageId:     msg.Id,
+		CorrelationId: msg.CorrelationId,
+		ReplyTo:       msg.ReplyTo,
+		Timestamp:     time.Now(),
+		Body:          msg.Body,
+	})
+	if err != nil {
+		c.reset()
+		return err
+	}
+
+	select {
+	case confirm, ok := <-c.confirms:
+		if !ok {
+			c.reset()
+			return errors.New("AMQP channel closed before the message was confirmed")
+		}
+
+		if !confirm.Ack {
+			return errors.New("AMQP broker rejected the message")
+		}
+
+	case <-time.After(busPublishTimeout):
+		c.reset()
+		return errors.New("Timed out waiting for AMQP broker to confirm the message")
+	}
+
+	return nil
+}
+
+func (c *AmqpPublisher) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.reset()
+	return nil
+}
+
+// consume declares a queue bound to the exchange by its name and starts
+// consuming from it.
+func (c *AmqpPublisher) consume(queue string) (*amqp.Connection, <-chan amqp.Delivery, error) {
+	conn, err := amqp.Dial(c.url)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	channel, err := conn.Channel()
+	if err == nil {
+		err = channel.ExchangeDeclare(c.exchange, "topic", true, false, false, false, nil)
+	}
+
+	if err == nil {
+		_, err = channel.QueueDeclare(queue, true, false, false, false, nil)
+	}
+
+	if err == nil {
+		err = channel.QueueBind(queue, queue, c.exchange, false, nil)
+	}
+
+	if err == nil {
+		err = channel.Qos(1, 0, false)
+	}
+
+	var deliveries <-chan amqp.Delivery
+	if err == nil {
+		deliveries, err = channel.Consume(queue, "", false, false, false, false, nil)
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return conn, deliveries, nil
+}
+
+// Consume calls handler for each message in the given queue, reconnecting if
+// the connection to the broker is lost. Messages are acknowledged once
+// handled so that messages in progress are redelivered after a failure.
+func (c *AmqpPublisher) Consume(queue string, handler func(*BusMessage)) error {
+	conn, deliveries, err := c.consume(queue)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			for delivery := range deliveries {
+				handler(&BusMessage{
+					Subject:       delivery.RoutingKey,
+					Id:            delivery.MessageId,
+					CorrelationId: delivery.CorrelationId,
+					ReplyTo:       delivery.ReplyTo,
+					Body:          delivery.Body,
+				})
+				delivery.Ack(false)
+			}
+
+			conn.Close()
+
+			backoff := time.Duration(0)
+			for {
+				backoff = backoff*2 + time.Second
+				if backoff > outboxMaxBackoff {
+					backoff = outboxMaxBackoff
+				}
+
+				log.Printf("Lost connection to AMQP queue %s, reconnecting in %v", queue, backoff)
+				time.Sleep(backoff)
+
+				conn, deliveries, err = c.consume(queue)
+				if err == nil {
+					break
+				}
+
+				log.Printf("Error connecting to AMQP queue %s: %s", queue, err)
+			}
+		}
+	}()
+
+	return nil
+}
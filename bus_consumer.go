@@ -0,0 +1,304 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Command actions
+const (
+	CommandCreate = "create"
+	CommandUpsert = "upsert"
+	CommandDelete = "delete"
+)
+
+// Outcome of a command which deleted a CI
+const CommandDeleted = "deleted"
+
+// Consumer receives the messages sent to a queue or subject of a message bus.
+// Messages are acknowledged once the handler returns.
+type Consumer interface {
+	Consume(queue string, handler func(*BusMessage)) error
+}
+
+// BusCommand is a request received from the message bus to create, upsert or
+// delete a CI. Commands are authenticated by the API key of a user.
+type BusCommand struct {
+	Id      string                 `json:"id"`
+	ApiKey  string                 `json:"apiKey"`
+	Action  string                 `json:"action"`
+	Cmdb    string                 `json:"cmdb"`
+	CIType  string                 `json:"citype"`
+	CIId    string                 `json:"ci,omitempty"`
+	Value   map[string]interface{} `json:"value,omitempty"`
+	ReplyTo string                 `json:"replyTo,omitempty"`
+}
+
+// BusReply is the outcome of a command, published to the reply subject of the
+// command. Status is the equivalent HTTP status code.
+type BusReply struct {
+	RequestId string    `json:"requestId"`
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Status    int       `json:"status"`
+	Cmdb      string    `json:"cmdb,omitempty"`
+	CIType    string    `json:"citype,omitempty"`
+	CIId      string    `json:"ci,omitempty"`
+	Result    string    `json:"result,omitempty"`
+	Error     *Problem  `json:"error,omitempty"`
+}
+
+// Request returns the API request which performs the command so that commands
+// are authenticated, validated, audited and recorded exactly as API requests
+// are.
+func (c *BusCommand) Request() (*http.Request, error) {
+	if c.Cmdb == "" || c.CIType == "" {
+		return nil, errors.New("Command must specify a CMDB and CI Type")
+	}
+
+	uri := path.Join("/cmdbs", url.PathEscape(c.Cmdb), url.PathEscape(c.CIType))
+
+	var method string
+	switch c.Action {
+	case CommandCreate:
+		method = "POST"
+	case CommandUpsert:
+		method = "PUT"
+	case CommandDelete:
+		if c.CIId == "" {
+			return nil, errors.New("Delete command must specify a CI")
+		}
+
+		method = "DELETE"
+		uri = path.Join(uri, url.PathEscape(c.CIId))
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported command action: '%s'", c.Action))
+	}
+
+	var body []byte
+	if method != "DELETE" {
+		var err error
+		body, err = json.Marshal(c.Value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(method, V1Uri(uri), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("X-Auth-Token", c.ApiKey)
+	req.Header.Set("X-Request-Id", c.Id)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	return req, nil
+}
+
+// CommandConsumer performs the commands received from a message bus queue and
+// publishes their outcomes.
+type CommandConsumer struct {
+	publisher Publisher
+	handler   http.Handler
+	replyTo   string
+}
+
+// NewCommandConsumer returns a consumer which performs commands with the given
+// API handler and publishes replies to the reply subject of each command, or
+// prefix.replies if none is given. The reply subject of a command, whether
+// given by the command or the transport, must be prefix.replies, a subject of
+// the form prefix.replies.* or the inbox of a NATS request.
+func NewCommandConsumer(publisher Publisher, handler http.Handler, prefix string) *CommandConsumer {
+	if prefix == "" {
+		prefix = defaultBusPrefix
+	}
+
+	return &CommandConsumer{
+		publisher: publisher,
+		handler:   handler,
+		replyTo:   prefix + ".replies",
+	}
+}
+
+// StartCommandConsumer performs the commands sent to the given queue.
+func StartCommandConsumer(consumer Consumer, publisher Publisher, handler http.Handler, prefix string, queue string) error {
+	c := NewCommandConsumer(publisher, handler, prefix)
+	log.Printf("Consuming commands from %s", queue)
+	return consumer.Consume(queue, c.Handle)
+}
+
+func newBusReply(cmd *BusCommand) *BusReply {
+	return &BusReply{
+		RequestId: cmd.Id,
+		Time:      time.Now().UTC().Truncate(time.Millisecond),
+		Action:    cmd.Action,
+		Cmdb:      cmd.Cmdb,
+		CIType:    cmd.CIType,
+		CIId:      cmd.CIId,
+	}
+}
+
+// setError records that the command failed.
+func (c *BusReply) setError(status int, code string, err error) {
+	c.Status = status
+	c.Error = &Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Code:      code,
+		RequestId: c.RequestId,
+	}
+
+	if err != nil {
+		c.Error.Detail = err.Error()
+	}
+}
+
+// Execute performs a command and returns its outcome.
+func (c *CommandConsumer) Execute(cmd *BusCommand) *BusReply {
+	reply := newBusReply(cmd)
+	req, err := cmd.Request()
+	if err != nil {
+		reply.setError(http.StatusBadRequest, CodeBadRequest, err)
+		return reply
+	}
+
+	res := httptest.NewRecorder()
+	c.handler.ServeHTTP(res, req)
+	reply.Status = res.Code
+
+	if res.Code >= 400 {
+		var problem Problem
+		if json.Unmarshal(res.Body.Bytes(), &problem) == nil {
+			problem.RequestId = cmd.Id
+			reply.Error = &problem
+		} else {
+			reply.setError(res.Code, CodeInternalError, nil)
+		}
+
+		return reply
+	}
+
+	switch cmd.Action {
+	case CommandCreate:
+		reply.Result = UpsertCreated
+		reply.CIId = path.Base(res.Header().Get("Location"))
+
+	case CommandUpsert:
+		var result CIUpsertResult
+		json.Unmarshal(res.Body.Bytes(), &result)
+		reply.Result = result.Status
+		reply.CIId = result.Id
+
+	case CommandDelete:
+		reply.Result = CommandDeleted
+	}
+
+	return reply
+}
+
+// Prefix of the reply subjects of NATS requests
+const natsInboxPrefix = "_INBOX."
+
+// isReplySubject returns true if a reply subject is the default reply subject
+// or a single token below it, or the inbox of a NATS request, so that
+// commands cannot publish to the subjects of events or other commands.
+func (c *CommandConsumer) isReplySubject(subject string) bool {
+	if subject == c.replyTo {
+		return true
+	}
+
+	if _, ok := c.publisher.(*NatsPublisher); ok && strings.HasPrefix(subject, natsInboxPrefix) {
+		for _, token := range strings.Split(strings.TrimPrefix(subject, natsInboxPrefix), ".") {
+			if token == "" || strings.ContainsAny(token, "*># ") {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	token := strings.TrimPrefix(subject, c.replyTo+".")
+	return token != subject && token != "" && !strings.ContainsAny(token, ".*># ")
+}
+
+// Handle performs a command received from the message bus and publishes its
+// outcome. Messages which are not valid commands are answered with an error.
+func (c *CommandConsumer) Handle(msg *BusMessage) {
+	var cmd BusCommand
+	err := json.Unmarshal(msg.Body, &cmd)
+	if cmd.Id == "" {
+		cmd.Id = msg.Id
+	}
+
+	if cmd.Id == "" {
+		cmd.Id = msg.CorrelationId
+	}
+
+	// The reply address of the transport takes precedence
+	replyTo := msg.ReplyTo
+	if replyTo == "" {
+		replyTo = cmd.ReplyTo
+	}
+
+	var reply *BusReply
+	if err != nil {
+		reply = newBusReply(&BusCommand{Id: cmd.Id})
+		reply.setError(http.StatusBadRequest, CodeBadRequest, errors.New(fmt.Sprintf("Invalid command: %s", err)))
+	} else if replyTo != "" && !c.isReplySubject(replyTo) {
+		reply = newBusReply(&cmd)
+		reply.setError(http.StatusBadRequest, CodeBadRequest, errors.New(fmt.Sprintf("Reply subject must be %s or begin with %s.", c.replyTo, c.replyTo)))
+		replyTo = ""
+	} else {
+		reply = c.Execute(&cmd)
+	}
+
+	if reply.Error != nil {
+		log.Printf("Command %s failed: %s", cmd.Id, reply.Error.Detail)
+	}
+
+	if replyTo == "" {
+		replyTo = c.replyTo
+	}
+
+	body, err := json.Marshal(reply)
+	if err == nil {
+		err = c.publisher.Publish(&BusMessage{
+			Subject:       replyTo,
+			Id:            IdToString(NewId()),
+			CorrelationId: cmd.Id,
+			Body:          body,
+		})
+	}
+
+	if err != nil {
+		log.Printf("Error publishing reply to command %s: %s", cmd.Id, err)
+	}
+}
@@ -0,0 +1,145 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestBusCommandRequest(t *testing.T) {
+	cmd := &BusCommand{Id: "req-1", ApiKey: "secret", Action: CommandCreate, Cmdb: "temp", CIType: "server", Value: map[string]interface{}{"hostname": "web01"}}
+	req, err := cmd.Request()
+	if err != nil {
+		t.Fatalf("Error creating request: %s", err)
+	}
+	areEqual(t, req.Method, "POST")
+	areEqual(t, req.URL.Path, V1Uri("/cmdbs/temp/server"))
+	areEqual(t, req.Header.Get("X-Auth-Token"), "secret")
+	areEqual(t, req.Header.Get("X-Request-Id"), "req-1")
+
+	cmd.Action = CommandUpsert
+	req, _ = cmd.Request()
+	areEqual(t, req.Method, "PUT")
+
+	cmd.Action = CommandDelete
+	_, err = cmd.Request()
+	if err == nil {
+		t.Errorf("Expected delete command without a CI to fail")
+	}
+
+	cmd.CIId = "0123456789abcdef01234567"
+	req, _ = cmd.Request()
+	areEqual(t, req.Method, "DELETE")
+	areEqual(t, req.URL.Path, V1Uri("/cmdbs/temp/server/0123456789abcdef01234567"))
+
+	cmd.Action = "rename"
+	_, err = cmd.Request()
+	if err == nil {
+		t.Errorf("Expected unsupported action to fail")
+	}
+}
+
+func TestCommandConsumer(t *testing.T) {
+	// Stand in for the API
+	api := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "POST":
+			res.Header().Set("Location", V1Uri("/cmdbs/temp/server/0123456789abcdef01234567"))
+			res.WriteHeader(http.StatusCreated)
+		case "PUT":
+			ErrBadRequest(res, req, ValidationErrors{}.Add(newFieldError(".hostname", errors.New("Required field 'hostname' is not present"))))
+		}
+	})
+
+	bus := NewMemoryBus()
+	replies := []BusReply{}
+	bus.Consume("alexandria.replies", func(msg *BusMessage) {
+		var reply BusReply
+		json.Unmarshal(msg.Body, &reply)
+		replies = append(replies, reply)
+	})
+	bus.Consume("commands", NewCommandConsumer(bus, api, "").Handle)
+
+	bus.Publish(&BusMessage{Subject: "commands", Body: []byte(`{"id":"req-1","action":"create","cmdb":"temp","citype":"server","value":{"hostname":"web01"}}`)})
+	bus.Publish(&BusMessage{Subject: "commands", Body: []byte(`{"id":"req-2","action":"upsert","cmdb":"temp","citype":"server","value":{}}`)})
+	bus.Publish(&BusMessage{Subject: "commands", Id: "req-3", Body: []byte(`not json`)})
+
+	areEqual(t, len(replies), 3)
+	areEqual(t, replies[0].RequestId, "req-1")
+	areEqual(t, replies[0].Status, http.StatusCreated)
+	areEqual(t, replies[0].Result, UpsertCreated)
+	areEqual(t, replies[0].CIId, "0123456789abcdef01234567")
+
+	areEqual(t, replies[1].RequestId, "req-2")
+	areEqual(t, replies[1].Status, http.StatusBadRequest)
+	areEqual(t, replies[1].Error.RequestId, "req-2")
+	areEqual(t, replies[1].Error.Errors[0].Path, "hostname")
+
+	areEqual(t, replies[2].RequestId, "req-3")
+	areEqual(t, replies[2].Error.Code, CodeBadRequest)
+
+	// Replies are correlated by the transport
+	messages := bus.Messages()
+	areEqual(t, messages[len(messages)-1].CorrelationId, "req-3")
+
+	// Commands may only reply below the reply subject
+	bus.Publish(&BusMessage{Subject: "commands", Body: []byte(`{"id":"req-4","action":"create","cmdb":"temp","citype":"server","value":{},"replyTo":"alexandria.replies.client1"}`)})
+	messages = bus.Messages()
+	areEqual(t, messages[len(messages)-1].Subject, "alexandria.replies.client1")
+
+	for _, subject := range []string{"alexandria.acme.temp.ci.server.created", "alexandria.replies.>", "alexandria.replies.a.b", "alexandria.replies."} {
+		bus.Publish(&BusMessage{Subject: "commands", Body: []byte(`{"id":"req-5","action":"create","cmdb":"temp","citype":"server","value":{},"replyTo":"` + subject + `"}`)})
+		messages = bus.Messages()
+		areEqual(t, messages[len(messages)-1].Subject, "alexandria.replies")
+		areEqual(t, replies[len(replies)-1].Status, http.StatusBadRequest)
+	}
+
+	// So may the transport
+	bus.Publish(&BusMessage{Subject: "commands", ReplyTo: "alexandria.acme.temp.ci.server.created", Body: []byte(`{"id":"req-6","action":"create","cmdb":"temp","citype":"server","value":{}}`)})
+	messages = bus.Messages()
+	areEqual(t, messages[len(messages)-1].Subject, "alexandria.replies")
+	areEqual(t, replies[len(replies)-1].RequestId, "req-6")
+	areEqual(t, replies[len(replies)-1].Status, http.StatusBadRequest)
+}
+
+func TestReplySubject(t *testing.T) {
+	tests := []struct {
+		Subject string
+		Memory  bool
+		Nats    bool
+	}{
+		{"alexandria.replies", true, true},
+		{"alexandria.replies.client1", true, true},
+		{"alexandria.replies.a.b", false, false},
+		{"alexandria.commands", false, false},
+		{"_INBOX.abc123", false, true},
+		{"_INBOX.abc123.1", false, true},
+		{"_INBOX.>", false, false},
+		{"_INBOX.", false, false},
+	}
+
+	memory := NewCommandConsumer(NewMemoryBus(), nil, "")
+	nats := NewCommandConsumer(&NatsPublisher{}, nil, "")
+	for _, test := range tests {
+		areEqual(t, memory.isReplySubject(test.Subject), test.Memory)
+		areEqual(t, nats.isReplySubject(test.Subject), test.Nats)
+	}
+}
@@ -0,0 +1,75 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"github.com/nats-io/nats.go"
+)
+
+// NatsPublisher publishes messages to NATS subjects. Publish returns once
+// the server has received the message. Messages are consumed in a queue group
+// named by the subject prefix so that each is handled by only one server of a
+// deployment.
+type NatsPublisher struct {
+	conn  *nats.Conn
+	group string
+}
+
+// NewNatsPublisher connects to a NATS server. The connection is retried in
+// the background if the server is unavailable.
+func NewNatsPublisher(url string, prefix string) (*NatsPublisher, error) {
+	if prefix == "" {
+		prefix = defaultBusPrefix
+	}
+
+	conn, err := nats.Connect(url,
+		nats.Name("Alexandria CMDB"),
+		nats.MaxReconnects(-1),
+		nats.RetryOnFailedConnect(true))
+	if err != nil {
+		return nil, err
+	}
+
+	return &NatsPublisher{conn, prefix}, nil
+}
+
+func (c *NatsPublisher) Publish(msg *BusMessage) error {
+	err := c.conn.Publish(msg.Subject, msg.Body)
+	if err != nil {
+		return err
+	}
+
+	return c.conn.FlushTimeout(busPublishTimeout)
+}
+
+func (c *NatsPublisher) Consume(subject string, handler func(*BusMessage)) error {
+	_, err := c.conn.QueueSubscribe(subject, c.group, func(msg *nats.Msg) {
+		handler(&BusMessage{
+			Subject: msg.Subject,
+			ReplyTo: msg.Reply,
+			Body:    msg.Data,
+		})
+	})
+
+	return err
+}
+
+func (c *NatsPublisher) Close() error {
+	c.conn.Close()
+	return nil
+}
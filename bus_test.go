@@ -0,0 +1,147 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestBusEventSubject(t *testing.T) {
+	event := &BusEvent{Tenant: "acme", Kind: BusKindCI, Action: ChangeCreated, Cmdb: "temp", CIType: "server"}
+	areEqual(t, event.Subject("alexandria"), "alexandria.acme.temp.ci.server.created")
+
+	event = &BusEvent{Tenant: "acme", Kind: BusKindCIType, Action: ChangeDeleted, Cmdb: "temp", CIType: "server"}
+	areEqual(t, event.Subject("cmdb"), "cmdb.acme.temp.citype.deleted")
+}
+
+func TestSubjectMatches(t *testing.T) {
+	tests := []struct {
+		Pattern string
+		Subject string
+		Match   bool
+	}{
+		{"a.b.c", "a.b.c", true},
+		{"a.b.c", "a.b", false},
+		{"a.*.c", "a.b.c", true},
+		{"a.*", "a.b.c", false},
+		{"a.>", "a.b.c", true},
+		{"a.#", "a.b", true},
+		{"a.>", "a", false},
+		{"a.b.>", "a.c.d", false},
+	}
+
+	for _, test := range tests {
+		if subjectMatches(test.Pattern, test.Subject) != test.Match {
+			t.Errorf("Expected match of '%s' against '%s' to be %t", test.Pattern, test.Subject, test.Match)
+		}
+	}
+}
+
+func TestMemoryBus(t *testing.T) {
+	bus := NewMemoryBus()
+	received := []string{}
+	bus.Consume("alexandria.*.temp.>", func(msg *BusMessage) {
+		received = append(received, msg.Subject)
+	})
+
+	bus.Publish(&BusMessage{Subject: "alexandria.acme.temp.ci.server.created", Id: "1"})
+	bus.Publish(&BusMessage{Subject: "alexandria.acme.other.ci.server.created", Id: "2"})
+	areEqual(t, len(bus.Messages()), 2)
+	areEqual(t, len(received), 1)
+
+	// Simulate an unavailable broker
+	bus.Err = errors.New("Connection refused")
+	if err := bus.Publish(&BusMessage{Subject: "alexandria.acme.temp.ci.server.deleted"}); err == nil {
+		t.Errorf("Expected publish to fail")
+	}
+	areEqual(t, len(bus.Messages()), 2)
+
+	// Only the most recent messages are retained
+	bus.Err = nil
+	for i := 0; i < memoryBusMaxMessages; i++ {
+		bus.Publish(&BusMessage{Subject: "alexandria.acme.temp.ci.server.updated", Id: fmt.Sprintf("%d", i+3)})
+	}
+
+	messages := bus.Messages()
+	areEqual(t, len(messages), memoryBusMaxMessages)
+	areEqual(t, messages[0].Id, "3")
+}
+
+func TestNewPublisher(t *testing.T) {
+	publisher, err := NewPublisher(&BusConfig{})
+	if publisher != nil || err != nil {
+		t.Errorf("Expected no publisher if no driver is configured")
+	}
+
+	publisher, err = NewPublisher(&BusConfig{Driver: "memory"})
+	if _, ok := publisher.(*MemoryBus); !ok || err != nil {
+		t.Errorf("Expected memory bus but got %#v: %v", publisher, err)
+	}
+
+	_, err = NewPublisher(&BusConfig{Driver: "carrierpigeon"})
+	if err == nil {
+		t.Errorf("Expected unsupported driver to fail")
+	}
+}
+
+func TestOutboxRelay(t *testing.T) {
+	RootDb().C(outboxCollection).RemoveAll(M{"status": OutboxPending})
+
+	bus := NewMemoryBus()
+	relay := NewOutboxRelay(bus, "test")
+
+	events := []*BusEvent{
+		{Id: "1", Tenant: "acme", Kind: BusKindCmdb, Action: ChangeCreated, Cmdb: "temp"},
+		{Id: "2", Tenant: "acme", Kind: BusKindCmdb, Action: ChangeDeleted, Cmdb: "temp"},
+	}
+	err := relay.Queue(events)
+	if err != nil {
+		t.Fatalf("Error queueing events: %s", err)
+	}
+
+	// Messages are kept while the broker is unavailable
+	bus.Err = errors.New("Connection refused")
+	published, err := relay.publishNext()
+	if published || err == nil {
+		t.Errorf("Expected publish to fail")
+	}
+
+	// and published in order once it recovers
+	bus.Err = nil
+	for i := 0; i < 2; i++ {
+		published, err = relay.publishNext()
+		if !published || err != nil {
+			t.Fatalf("Expected message %d to be published: %v", i, err)
+		}
+	}
+
+	published, _ = relay.publishNext()
+	areEqual(t, published, false)
+
+	messages := bus.Messages()
+	areEqual(t, len(messages), 2)
+	areEqual(t, messages[0].Subject, "test.acme.temp.cmdb.created")
+	areEqual(t, messages[1].Id, "2")
+
+	var event BusEvent
+	json.Unmarshal(messages[1].Body, &event)
+	areEqual(t, event.Action, ChangeDeleted)
+}
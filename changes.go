@@ -0,0 +1,655 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	changeCollection        = "changes"
+	changeCounterCollection = "changecounters"
+
+	// Change events are removed after the retention period
+	changeRetention = 7 * 24 * time.Hour
+
+	// Streams poll for events appended by other servers and keep idle
+	// connections alive at this interval
+	changePollInterval = 5 * time.Second
+
+	changeBatchSize    = 100
+	changeWriteTimeout = 10 * time.Second
+)
+
+// Change event types
+const (
+	ChangeCreated = "created"
+	ChangeUpdated = "updated"
+	ChangeDeleted = "deleted"
+)
+
+// Change diff operations
+const (
+	DiffAdd     = "add"
+	DiffReplace = "replace"
+	DiffRemove  = "remove"
+)
+
+// ChangeDiff is a difference in a single attribute between two revisions of
+// a CI.
+type ChangeDiff struct {
+	Op       string      `json:"op"`
+	Path     string      `json:"path"`
+	Value    interface{} `json:"value,omitempty" bson:",omitempty"`
+	Previous interface{} `json:"previous,omitempty" bson:",omitempty"`
+}
+
+// ChangeEvent is an entry in the change feed of a tenant. Events are
+// identified by their sequence in the feed.
+type ChangeEvent struct {
+	model      `json:"-" bson:",inline"`
+	TenantId   interface{}  `json:"-" xml:"-"`
+	Sequence   int64        `json:"id"`
+	Time       time.Time    `json:"time"`
+	Type       string       `json:"type"`
+	Actor      string       `json:"actor,omitempty" bson:",omitempty"`
+	Cmdb       string       `json:"cmdb"`
+	CIType     string       `json:"citype"`
+	CIId       string       `json:"ci"`
+	CIRevision int          `json:"revision"`
+	Diff       []ChangeDiff `json:"diff,omitempty" bson:",omitempty"`
+
+	// Value of the CI after the change, or before it was deleted
+	value map[string]interface{}
+
+	// Code of the tenant
+	tenant string
+
+	// Backend database of the CMDB
+	backend string
+}
+
+// copyValue returns a deep copy of a CI value.
+func copyValue(v interface{}) interface{} {
+	if m, ok := asMap(v); ok {
+		c := make(map[string]interface{}, len(m))
+		for key, val := range m {
+			c[key] = copyValue(val)
+		}
+		return c
+	}
+
+	if a, ok := v.([]interface{}); ok {
+		c := make([]interface{}, len(a))
+		for i, val := range a {
+			c[i] = copyValue(val)
+		}
+		return c
+	}
+
+	return v
+}
+
+// diffValues returns the differences between two CI values in path order.
+// Groups are compared attribute by attribute and all other values, including
+// arrays, are compared as a whole.
+func diffValues(old map[string]interface{}, new map[string]interface{}, path string) []ChangeDiff {
+	keys := []string{}
+	for key, _ := range old {
+		keys = append(keys, key)
+	}
+
+	for key, _ := range new {
+		if _, ok := old[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	diff := []ChangeDiff{}
+	for _, key := range keys {
+		oldVal, inOld := old[key]
+		newVal, inNew := new[key]
+		switch {
+		case !inOld:
+			diff = append(diff, ChangeDiff{Op: DiffAdd, Path: path + key, Value: newVal})
+
+		case !inNew:
+			diff = append(diff, ChangeDiff{Op: DiffRemove, Path: path + key, Previous: oldVal})
+
+		default:
+			oldMap, oldIsMap := asMap(oldVal)
+			newMap, newIsMap := asMap(newVal)
+			if oldIsMap && newIsMap {
+				diff = append(diff, diffValues(oldMap, newMap, path+key+".")...)
+			} else if !valuesEqual(oldVal, newVal) {
+				diff = append(diff, ChangeDiff{Op: DiffReplace, Path: path + key, Value: newVal, Previous: oldVal})
+			}
+		}
+	}
+
+	return diff
+}
+
+// NewCIChange returns a change event for a CI which was created, updated or
+// deleted by a request. Previous is the value of the CI before an update or
+// deletion. Nil is returned if an update changed nothing.
+func NewCIChange(req *http.Request, changeType string, cmdb string, citype string, ci *CI, previous map[string]interface{}) *ChangeEvent {
+	event := newCIChange(req, changeType, cmdb, citype, ci, previous)
+	if event != nil && changeType == ChangeUpdated && len(event.Diff) == 0 {
+		return nil
+	}
+	return event
+}
+
+// newCIChange returns a change event like NewCIChange, but keeps updates
+// which did not change the value of the CI.
+func newCIChange(req *http.Request, changeType string, cmdb string, citype string, ci *CI, previous map[string]interface{}) *ChangeEvent {
+	auth := GetAuthContext(req)
+	if auth == nil {
+		return nil
+	}
+
+	event := &ChangeEvent{
+		TenantId:   auth.Tenant.Id,
+		Time:       time.Now().UTC().Truncate(time.Millisecond),
+		Type:       changeType,
+		Actor:      auth.User.Email,
+		Cmdb:       strings.ToLower(cmdb),
+		CIType:     citype,
+		CIId:       IdToString(ci.Id),
+		CIRevision: ci.Revision,
+	}
+	event.InitModel()
+
+	event.tenant = auth.Tenant.Code
+	if c, ok := auth.Tenant.Cmdbs[event.Cmdb]; ok {
+		event.backend = c.GetBackendName()
+	}
+
+	event.value = ci.Value
+	switch changeType {
+	case ChangeCreated:
+		event.Diff = diffValues(nil, ci.Value, "")
+
+	case ChangeUpdated:
+		event.Diff = diffValues(previous, ci.Value, "")
+
+	case ChangeDeleted:
+		event.value = previous
+		event.Diff = diffValues(previous, nil, "")
+	}
+
+	return event
+}
+
+var changeMutex sync.Mutex
+
+// changeCounter is the last sequence number allocated in the change feed of a
+// tenant. It is kept apart from the events so that sequence numbers are
+// never reused once the events have expired.
+type changeCounter struct {
+	TenantId interface{} `bson:"_id"`
+	Sequence int64
+}
+
+// allocateChangeSequences reserves n consecutive sequence numbers in the
+// change feed of a tenant and returns the first.
+func allocateChangeSequences(tenantId interface{}, n int) (int64, error) {
+	c := RootDb().C(changeCounterCollection)
+	change := mgo.Change{Update: M{"$inc": M{"sequence": n}}, ReturnNew: true}
+
+	var counter changeCounter
+	_, err := c.FindId(tenantId).Apply(change, &counter)
+	if err == mgo.ErrNotFound {
+		// Feeds which were started before counters were kept continue from
+		// their last event
+		var last ChangeEvent
+		err = RootDb().C(changeCollection).Find(M{"tenantid": tenantId}).Sort("-sequence").One(&last)
+		if err != nil && err != mgo.ErrNotFound {
+			return 0, err
+		}
+
+		err = c.Insert(&changeCounter{TenantId: tenantId, Sequence: last.Sequence})
+		if err != nil && !mgo.IsDup(err) {
+			return 0, err
+		}
+
+		_, err = c.FindId(tenantId).Apply(change, &counter)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return counter.Sequence - int64(n) + 1, nil
+}
+
+// AppendChangeEvents adds events to the end of their tenant's change feed.
+// All events must belong to the same tenant.
+func AppendChangeEvents(events []*ChangeEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	changeMutex.Lock()
+	defer changeMutex.Unlock()
+
+	c := RootDb().C(changeCollection)
+	docs := make([]interface{}, len(events))
+	for i, event := range events {
+		docs[i] = event
+	}
+
+	// Sequence numbers are allocated atomically so they are unique unless a
+	// counter was seeded concurrently, in which case the unique sequence
+	// index rejects the events and they are given new numbers and ids
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		var first int64
+		first, err = allocateChangeSequences(events[0].TenantId, len(events))
+		if err != nil {
+			return err
+		}
+
+		for i, event := range events {
+			event.Id = bson.NewObjectId()
+			event.Sequence = first + int64(i)
+		}
+
+		err = c.Insert(docs...)
+		if !mgo.IsDup(err) {
+			break
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	changeBroker.Notify(events[0].TenantId)
+	return nil
+}
+
+// RecordCIChanges appends change events to the change feed and queues their
+// delivery to webhooks and the message bus. Nil events are ignored and errors are logged but not
+// returned so that a change which has been stored is never reported as
+// failed.
+func RecordCIChanges(events ...*ChangeEvent) {
+	valid := make([]*ChangeEvent, 0, len(events))
+	for _, event := range events {
+		if event != nil {
+			valid = append(valid, event)
+		}
+	}
+
+	err := IndexCIChanges(valid)
+	if err != nil {
+		log.Printf("Error updating the search index: %s", err)
+	}
+
+	// Messages are queued whether or not the events could be appended so
+	// that consumers of the message bus see every change
+	if busRelay != nil {
+		busEvents := make([]*BusEvent, len(valid))
+		for i, event := range valid {
+			busEvents[i] = newCIBusEvent(event)
+		}
+
+		QueueBusEvents(busEvents...)
+	}
+
+	err = AppendChangeEvents(valid)
+	if err != nil {
+		log.Printf("Error writing %d change events to the database: %s", len(valid), err)
+		return
+	}
+
+	// Webhook deliveries refer to events by their sequence in the feed
+	err = QueueWebhookDeliveries(valid)
+	if err != nil {
+		log.Printf("Error queueing webhook deliveries: %s", err)
+	}
+}
+
+// RecordCIChange appends a change event for a CI which was created, updated
+// or deleted by a request to the change feed.
+func RecordCIChange(req *http.Request, changeType string, cmdb string, citype string, ci *CI, previous map[string]interface{}) {
+	RecordCIChanges(NewCIChange(req, changeType, cmdb, citype, ci, previous))
+}
+
+// ChangeBroker wakes the change feed streams of a tenant when events are
+// appended to its feed.
+type ChangeBroker struct {
+	mutex       sync.Mutex
+	subscribers map[chan struct{}]interface{}
+}
+
+var changeBroker = NewChangeBroker()
+
+func NewChangeBroker() *ChangeBroker {
+	return &ChangeBroker{subscribers: map[chan struct{}]interface{}{}}
+}
+
+// Subscribe returns a channel which receives a value when events are appended
+// to the change feed of the given tenant.
+func (c *ChangeBroker) Subscribe(tenantId interface{}) chan struct{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ch := make(chan struct{}, 1)
+	c.subscribers[ch] = tenantId
+	return ch
+}
+
+func (c *ChangeBroker) Unsubscribe(ch chan struct{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.subscribers, ch)
+}
+
+// Notify wakes the subscribers of a tenant without blocking. Subscribers
+// which have not yet handled a previous notification are not notified again.
+func (c *ChangeBroker) Notify(tenantId interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for ch, id := range c.subscribers {
+		if id == tenantId {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// ChangeFeed reads the change events of a tenant which match a filter,
+// starting after the last event read.
+type ChangeFeed struct {
+	filter M
+	last   int64
+}
+
+// parseLastEventId returns the id of the last event received by a client
+// resuming a stream from the Last-Event-ID header or lastEventId query
+// parameter. False is returned if the client is not resuming.
+func parseLastEventId(req *http.Request) (int64, bool, error) {
+	s := req.Header.Get("Last-Event-ID")
+	if s == "" {
+		s = req.URL.Query().Get("lastEventId")
+	}
+
+	if s == "" {
+		return 0, false, nil
+	}
+
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id < 0 {
+		return 0, false, errors.New(fmt.Sprintf("Invalid last event id: %s", s))
+	}
+
+	return id, true, nil
+}
+
+// NewChangeFeed returns the change feed requested by a client. The feed is
+// filtered by the CMDB and CI Type in the request path or the cmdb, citype
+// and type query parameters. Clients which are not resuming a stream only
+// receive new events.
+func NewChangeFeed(req *http.Request) (*ChangeFeed, error) {
+	auth := GetAuthContext(req)
+	query := req.URL.Query()
+	feed := &ChangeFeed{filter: M{"tenantid": auth.Tenant.Id}}
+
+	cmdb := GetPathVar(req, "cmdb")
+	if cmdb == "" {
+		cmdb = query.Get("cmdb")
+	}
+
+	if cmdb != "" {
+		feed.filter["cmdb"] = strings.ToLower(cmdb)
+	}
+
+	citype := GetPathVar(req, "citype")
+	if citype == "" {
+		citype = query.Get("citype")
+	}
+
+	if citype != "" {
+		feed.filter["citype"] = citype
+	}
+
+	if s := query.Get("type"); s != "" {
+		types := strings.Split(s, ",")
+		for _, t := range types {
+			if t != ChangeCreated && t != ChangeUpdated && t != ChangeDeleted {
+				return nil, errors.New(fmt.Sprintf("Invalid change type: %s", t))
+			}
+		}
+
+		feed.filter["type"] = M{"$in": types}
+	}
+
+	last, resume, err := parseLastEventId(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resume {
+		feed.last = last
+	} else {
+		var event ChangeEvent
+		err = RootDb().C(changeCollection).Find(M{"tenantid": auth.Tenant.Id}).Sort("-sequence").One(&event)
+		if err != nil && err != mgo.ErrNotFound {
+			return nil, err
+		}
+
+		feed.last = event.Sequence
+	}
+
+	return feed, nil
+}
+
+// Next returns the next batch of events in the feed.
+func (c *ChangeFeed) Next() ([]ChangeEvent, error) {
+	filter := M{"sequence": M{"$gt": c.last}}
+	for key, val := range c.filter {
+		filter[key] = val
+	}
+
+	events := []ChangeEvent{}
+	err := RootDb().C(changeCollection).Find(filter).Sort("sequence").Limit(changeBatchSize).All(&events)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(events) > 0 {
+		c.last = events[len(events)-1].Sequence
+	}
+
+	return events, nil
+}
+
+// Stream sends each event in the feed until sending fails or done is closed.
+// Keepalive is called when the feed has been idle for the poll interval.
+func (c *ChangeFeed) Stream(send func(*ChangeEvent) error, keepalive func() error, done <-chan struct{}) error {
+	wake := changeBroker.Subscribe(c.filter["tenantid"])
+	defer changeBroker.Unsubscribe(wake)
+
+	ticker := time.NewTicker(changePollInterval)
+	defer ticker.Stop()
+
+	for {
+		events, err := c.Next()
+		if err != nil {
+			return err
+		}
+
+		for i, _ := range events {
+			err = send(&events[i])
+			if err != nil {
+				return err
+			}
+		}
+
+		// Read the remainder of a backlog immediately
+		if len(events) == changeBatchSize {
+			continue
+		}
+
+		select {
+		case <-done:
+			return nil
+
+		case <-wake:
+
+		case <-ticker.C:
+			err = keepalive()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// writeServerSentEvent writes a change event in the Server-Sent Events
+// format.
+func writeServerSentEvent(w io.Writer, event *ChangeEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Sequence, event.Type, data)
+	return err
+}
+
+// getChangeFeed returns the change feed for a request or renders an error.
+func getChangeFeed(res http.ResponseWriter, req *http.Request) *ChangeFeed {
+	if cmdb := GetPathVar(req, "cmdb"); cmdb != "" && GetCmdbBackend(req, cmdb) == nil {
+		ErrNotFound(res, req)
+		return nil
+	}
+
+	feed, err := NewChangeFeed(req)
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return nil
+	}
+
+	return feed
+}
+
+// StreamChanges streams the change feed as Server-Sent Events. Clients
+// resume from the last event they received with the Last-Event-ID header.
+func StreamChanges(res http.ResponseWriter, req *http.Request) {
+	flusher, ok := res.(http.Flusher)
+	if !ok {
+		ErrUnknown(res, req, errors.New("Streaming is not supported by the response writer"))
+		return
+	}
+
+	feed := getChangeFeed(res, req)
+	if feed == nil {
+		return
+	}
+
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	fmt.Fprintf(res, "retry: %d\n\n", changePollInterval/time.Millisecond)
+	flusher.Flush()
+
+	err := feed.Stream(func(event *ChangeEvent) error {
+		err := writeServerSentEvent(res, event)
+		flusher.Flush()
+		return err
+	}, func() error {
+		_, err := io.WriteString(res, ": keepalive\n\n")
+		flusher.Flush()
+		return err
+	}, req.Context().Done())
+
+	if err != nil {
+		log.Printf("Change feed stream closed: %s", err)
+	}
+}
+
+var changeUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// StreamChangesWebSocket streams the change feed as JSON messages over a
+// WebSocket. Clients resume from the last event they received with the
+// lastEventId query parameter.
+func StreamChangesWebSocket(res http.ResponseWriter, req *http.Request) {
+	feed := getChangeFeed(res, req)
+	if feed == nil {
+		return
+	}
+
+	// The upgrader responds to failed handshakes
+	conn, err := changeUpgrader.Upgrade(res, req, nil)
+	if err != nil {
+		log.Printf("Error opening change feed WebSocket: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	// Messages from the client are discarded but must be read to process
+	// control messages and detect when the connection is closed
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	err = feed.Stream(func(event *ChangeEvent) error {
+		conn.SetWriteDeadline(time.Now().Add(changeWriteTimeout))
+		return conn.WriteJSON(event)
+	}, func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(changeWriteTimeout))
+	}, done)
+
+	if err != nil {
+		log.Printf("Change feed WebSocket closed: %s", err)
+		return
+	}
+
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(changeWriteTimeout))
+}
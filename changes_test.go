@@ -0,0 +1,203 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffValues(t *testing.T) {
+	old := map[string]interface{}{
+		"name":    "web01",
+		"cores":   4,
+		"tags":    []interface{}{"a"},
+		"network": bson.M{"address": "10.0.0.1", "gateway": "10.0.0.254"},
+		"retired": false,
+	}
+
+	new := map[string]interface{}{
+		"name":    "web01",
+		"cores":   8,
+		"tags":    []interface{}{"a", "b"},
+		"network": map[string]interface{}{"address": "10.0.0.2", "mask": 24},
+		"owner":   "ops",
+	}
+
+	diff := diffValues(old, new, "")
+	summary := []string{}
+	for _, d := range diff {
+		summary = append(summary, fmt.Sprintf("%s %s", d.Op, d.Path))
+	}
+
+	areEqual(t, strings.Join(summary, ", "), "replace cores, replace network.address, remove network.gateway, add network.mask, add owner, remove retired, replace tags")
+	areEqual(t, diff[0].Previous, 4)
+	areEqual(t, diff[0].Value, 8)
+
+	areEqual(t, len(diffValues(old, old, "")), 0)
+	areEqual(t, len(diffValues(nil, new, "")), 5)
+	areEqual(t, diffValues(old, nil, "")[0].Op, DiffRemove)
+}
+
+func TestCopyValue(t *testing.T) {
+	orig := map[string]interface{}{"group": bson.M{"list": []interface{}{bson.M{"a": 1}}}}
+	c := copyValue(orig).(map[string]interface{})
+	putPath(c, "group.name", "changed")
+	c["group"].(map[string]interface{})["list"].([]interface{})[0].(map[string]interface{})["a"] = 2
+
+	if !valuesEqual(orig, map[string]interface{}{"group": bson.M{"list": []interface{}{bson.M{"a": 1}}}}) {
+		t.Errorf("Expected original value to be unchanged but got %#v", orig)
+	}
+}
+
+func TestChangeBroker(t *testing.T) {
+	broker := NewChangeBroker()
+	a := broker.Subscribe("a")
+	b := broker.Subscribe("b")
+	defer broker.Unsubscribe(b)
+
+	// Notifications do not block or queue
+	broker.Notify("a")
+	broker.Notify("a")
+	areEqual(t, len(a), 1)
+	areEqual(t, len(b), 0)
+	<-a
+
+	broker.Unsubscribe(a)
+	broker.Notify("a")
+	areEqual(t, len(a), 0)
+}
+
+func TestServerSentEvent(t *testing.T) {
+	var buf bytes.Buffer
+	event := &ChangeEvent{Sequence: 42, Type: ChangeUpdated, CIId: "abc"}
+	if err := writeServerSentEvent(&buf, event); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(buf.String(), "\n")
+	areEqual(t, lines[0], "id: 42")
+	areEqual(t, lines[1], "event: updated")
+	areEqual(t, strings.HasPrefix(lines[2], `data: {"id":42,`), true)
+	areEqual(t, strings.HasSuffix(buf.String(), "\n\n"), true)
+}
+
+func TestParseLastEventId(t *testing.T) {
+	req := httptest.NewRequest("GET", "/changes?lastEventId=7", nil)
+	id, resume, err := parseLastEventId(req)
+	areEqual(t, err, nil)
+	areEqual(t, resume, true)
+	areEqual(t, id, int64(7))
+
+	// The header takes precedence
+	req.Header.Set("Last-Event-ID", "9")
+	id, _, _ = parseLastEventId(req)
+	areEqual(t, id, int64(9))
+
+	req = httptest.NewRequest("GET", "/changes", nil)
+	_, resume, _ = parseLastEventId(req)
+	areEqual(t, resume, false)
+
+	req.Header.Set("Last-Event-ID", "-1")
+	_, _, err = parseLastEventId(req)
+	areUnequal(t, err, nil)
+}
+
+func TestCIChangeFeed(t *testing.T) {
+	typUrl := Post(t, V1Uri("/cmdbs/temp/citypes"), LoadTestFixture("citype-test.json"))
+	defer Delete(t, typUrl)
+
+	// Create and delete a CI
+	location := Post(t, V1Uri(fmt.Sprintf("/cmdbs/temp/%s", ciType)), LoadTestFixture("ci-test.json"))
+	Delete(t, location)
+	id := location[strings.LastIndex(location, "/")+1:]
+
+	events := []ChangeEvent{}
+	err := RootDb().C(changeCollection).Find(M{"ciid": id}).Sort("sequence").All(&events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	areEqual(t, len(events), 2)
+	areEqual(t, events[0].Type, ChangeCreated)
+	areEqual(t, events[1].Type, ChangeDeleted)
+	areEqual(t, events[0].Cmdb, "temp")
+	areEqual(t, events[0].CIType, ciType)
+
+	// Resume the stream from before the CI was created
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	req := NewRequest("GET", V1Uri(fmt.Sprintf("/cmdbs/temp/%s/changes", ciType)), nil).WithContext(ctx)
+	req.Header.Set("Last-Event-ID", fmt.Sprintf("%d", events[0].Sequence-1))
+	res := httptest.NewRecorder()
+	GetServer().ServeHTTP(res, req)
+
+	areEqual(t, res.Code, http.StatusOK)
+	areEqual(t, res.Header().Get("Content-Type"), "text/event-stream")
+
+	body := res.Body.String()
+	created := strings.Index(body, fmt.Sprintf("id: %d\nevent: created\n", events[0].Sequence))
+	deleted := strings.Index(body, fmt.Sprintf("id: %d\nevent: deleted\n", events[1].Sequence))
+	if created < 0 || deleted < created {
+		t.Errorf("Expected created and deleted events in change feed:\n%s", body)
+	}
+
+	var event ChangeEvent
+	line := body[created:]
+	line = line[strings.Index(line, "data: ")+6:]
+	line = line[:strings.Index(line, "\n")]
+	json.Unmarshal([]byte(line), &event)
+	areEqual(t, event.CIId, id)
+	areUnequal(t, len(event.Diff), 0)
+}
+
+func TestChangeSequenceAfterExpiry(t *testing.T) {
+	tenantId := bson.NewObjectId()
+	defer RootDb().C(changeCollection).RemoveAll(M{"tenantid": tenantId})
+	defer RootDb().C(changeCounterCollection).RemoveId(tenantId)
+
+	newEvents := func() []*ChangeEvent {
+		return []*ChangeEvent{
+			{TenantId: tenantId, Time: time.Now(), Type: ChangeCreated},
+			{TenantId: tenantId, Time: time.Now(), Type: ChangeDeleted},
+		}
+	}
+
+	events := newEvents()
+	areEqual(t, AppendChangeEvents(events), nil)
+	areEqual(t, events[0].Sequence, int64(1))
+	areEqual(t, events[1].Sequence, int64(2))
+
+	// Sequence numbers are not reused once events have expired
+	_, err := RootDb().C(changeCollection).RemoveAll(M{"tenantid": tenantId})
+	areEqual(t, err, nil)
+
+	events = newEvents()
+	areEqual(t, AppendChangeEvents(events), nil)
+	areEqual(t, events[0].Sequence, int64(3))
+	areEqual(t, events[1].Sequence, int64(4))
+}
@@ -18,16 +18,34 @@
 package main
 
 import (
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"sort"
+	"strings"
 )
 
 type CI struct {
 	model `json:"-" xml:"-" bson:",inline"`
 
 	Value map[string]interface{}
+
+	Sources   []CIAttributeSource `json:"sources,omitempty" xml:"source,omitempty" bson:",omitempty"`
+	Conflicts []CIConflict        `json:"conflicts,omitempty" xml:"conflict,omitempty" bson:",omitempty"`
+}
+
+// MarshalXML encodes the value of the CI, which encoding/xml cannot do for
+// maps.
+func (c CI) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	doc := struct {
+		Value     xmlValue
+		Sources   []CIAttributeSource `xml:"source,omitempty"`
+		Conflicts []CIConflict        `xml:"conflict,omitempty"`
+	}{xmlValue{c.Value}, c.Sources, c.Conflicts}
+
+	return e.EncodeElement(doc, start)
 }
 
 func (c *CI) Validate() error {
@@ -45,7 +63,8 @@ func AddCI(res http.ResponseWriter, req *http.Request) {
 	// Parse request into CIType
 	var ci CI
 	err := Bind(req, &ci.Value)
-	if Handle(res, req, err) {
+	if err != nil {
+		ErrBadRequest(res, req, err)
 		return
 	}
 	ci.InitModel()
@@ -66,15 +85,13 @@ func AddCI(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Validate parser
-	err = ci.Validate()
-	if err != nil {
-		ErrBadRequest(res, req, err)
+	// Validate against schema
+	err = validateCI(&ci, &typ)
+	if IsDryRun(req) {
+		RenderValidationResult(res, req, ci.Value, err)
 		return
 	}
 
-	// Validate against schema
-	err = validateFields(&ci.Value, &typ.Attributes, "")
 	if err != nil {
 		ErrBadRequest(res, req, err)
 		return
@@ -82,15 +99,81 @@ func AddCI(res http.ResponseWriter, req *http.Request) {
 
 	// Insert new CI
 	err = db.C(citype).Insert(&ci)
-	if Handle(res, req, err) {
+	if HandleCIError(res, req, &typ, err) {
 		return
 	}
 
+	RecordCIChange(req, ChangeCreated, cmdb, citype, &ci, nil)
 	RenderCreated(res, req, V1Uri(fmt.Sprintf("/cmdbs/%s/%s/%s", cmdb, citype, IdToString(ci.Id))))
 }
 
+// FieldError is a validation error for a field of a CI, identified by its
+// dotted attribute path.
+type FieldError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (c *FieldError) Error() string {
+	return c.Message
+}
+
+func newFieldError(path string, err error) *FieldError {
+	return &FieldError{
+		Path:    strings.TrimPrefix(path, "."),
+		Message: err.Error(),
+	}
+}
+
+// validateCI validates a CI against the schema of its CI Type, applying
+// default values, evaluating computed attributes and then checking the
+// validation rules of the CI Type. Computed attributes and rules are only
+// evaluated if all fields are valid.
+func validateCI(ci *CI, citype *CIType) error {
+	err := ci.Validate()
+	if err != nil {
+		return err
+	}
+
+	err = validateFields(&ci.Value, &citype.Attributes, "")
+	if err != nil {
+		return err
+	}
+
+	err = computeFields(ci.Value, &citype.Attributes, ci.Value, "")
+	if err != nil {
+		return err
+	}
+
+	return checkRules(ci.Value, citype)
+}
+
+// validateFields validates each field of a CI against the schema, translates
+// values to their stored format, applies default values and ensures all
+// required fields are present. All problems found are returned.
 func validateFields(fields *map[string]interface{}, schema *CITypeAttributeList, path string) error {
-	for key, _ := range *fields {
+	errs := ValidationErrors{}
+	errs = errs.Add(validateFieldTypes(fields, schema, path))
+	errs = errs.Add(applyDefaults(*fields, schema, path))
+	errs = errs.Add(checkRequiredFields(*fields, schema, path))
+
+	return errs.Err()
+}
+
+// validateFieldTypes validates and translates the fields which are present in
+// a CI without applying defaults or checking for required fields, so that
+// partial submissions may be validated before they are merged.
+func validateFieldTypes(fields *map[string]interface{}, schema *CITypeAttributeList, path string) error {
+	errs := ValidationErrors{}
+
+	// Validate in a stable order so errors are reported consistently
+	keys := make([]string, 0, len(*fields))
+	for key := range *fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
 		fullPath := fmt.Sprintf("%s.%s", path, key)
 
 		// Dereference the value so it may be modified by format.Validate()
@@ -99,46 +182,162 @@ func validateFields(fields *map[string]interface{}, schema *CITypeAttributeList,
 		// Does this key exist in the schema?
 		att := schema.Get(key)
 		if att == nil {
-			return errors.New(fmt.Sprintf("No schema definition found for field '%s'", fullPath))
+			errs = errs.Add(newFieldError(fullPath, errors.New(fmt.Sprintf("No schema definition found for field '%s'", fullPath))))
+			continue
 		}
 
-		// Does the format exist?
-		format := GetAttributeFormat(att.Type)
-		if format == nil {
-			return errors.New(fmt.Sprintf("No format parser found for type '%s' in field '%s'", att.Type, fullPath))
+		if att.Computed != "" {
+			errs = errs.Add(newFieldError(fullPath, errors.New(fmt.Sprintf("Field '%s' is computed and may not be set", fullPath))))
+			continue
 		}
 
-		// Is the value valid?
-		// This will also translate the value if required
-		// TODO: Need to dereference val in the range loop so the original object is updated
-		err := format.Validate(att, &val)
+		err := validateField(&val, att, fullPath)
 		if err != nil {
-			return err
+			errs = errs.Add(err)
+			continue
 		}
 
-		// Process children?
-		if len(att.Children) > 0 {
-			childFields, ok := val.(map[string]interface{})
-			if !ok {
-				return errors.New(fmt.Sprintf("Expected '%s' to be a valid JSON object", fullPath))
-			}
+		// Store the translated value
+		(*fields)[key] = val
+	}
+
+	return errs.Err()
+}
 
-			err = validateFields(&childFields, &att.Children, fullPath)
-			if err != nil {
-				return err
+// applyDefaults sets the default value of each absent field in a CI and in
+// each of its group values.
+func applyDefaults(fields map[string]interface{}, schema *CITypeAttributeList, path string) error {
+	errs := ValidationErrors{}
+	for i := range *schema {
+		att := &(*schema)[i]
+		fullPath := fmt.Sprintf("%s.%s", path, att.ShortName)
+		if val, ok := fields[att.ShortName]; ok {
+			if att.Type == "group" {
+				errs = errs.Add(forEachGroup(val, att, fullPath, applyDefaults))
 			}
+			continue
+		}
+
+		if att.Default == nil {
+			continue
+		}
+
+		val := att.Default
+		if vals, ok := val.([]interface{}); ok {
+			val = append([]interface{}{}, vals...)
+		}
+
+		err := validateField(&val, att, fullPath)
+		if err != nil {
+			errs = errs.Add(err)
+			continue
 		}
+
+		fields[att.ShortName] = val
 	}
 
-	// Ensure all required fields were included
-	for _, att := range *schema {
-		if att.Required {
-			if _, ok := (*fields)[att.ShortName]; !ok {
-				return errors.New(fmt.Sprintf("Required field '%s' is not present", att.Name))
+	return errs.Err()
+}
+
+// checkRequiredFields ensures all required fields are present in a CI and in
+// each of its group values.
+func checkRequiredFields(fields map[string]interface{}, schema *CITypeAttributeList, path string) error {
+	errs := ValidationErrors{}
+	for i := range *schema {
+		att := &(*schema)[i]
+		fullPath := fmt.Sprintf("%s.%s", path, att.ShortName)
+		val, ok := fields[att.ShortName]
+		if !ok {
+			if att.Required {
+				errs = errs.Add(newFieldError(fullPath, errors.New(fmt.Sprintf("Required field '%s' is not present", att.Name))))
 			}
+			continue
+		}
+
+		if att.Type == "group" {
+			errs = errs.Add(forEachGroup(val, att, fullPath, checkRequiredFields))
 		}
 	}
 
+	return errs.Err()
+}
+
+// forEachGroup calls fn with the fields of a group value, or of each group in
+// an array of groups. Values which are not groups are ignored.
+func forEachGroup(val interface{}, att *CITypeAttribute, path string, fn func(map[string]interface{}, *CITypeAttributeList, string) error) error {
+	if !att.IsArray {
+		if m, ok := asMap(val); ok {
+			return fn(m, &att.Children, path)
+		}
+
+		return nil
+	}
+
+	errs := ValidationErrors{}
+	vals, _ := val.([]interface{})
+	for i, v := range vals {
+		if m, ok := asMap(v); ok {
+			errs = errs.Add(fn(m, &att.Children, fmt.Sprintf("%s[%d]", path, i)))
+		}
+	}
+
+	return errs.Err()
+}
+
+// validateField validates the value of a field, or each of its values if the
+// attribute is an array.
+func validateField(val *interface{}, att *CITypeAttribute, fullPath string) error {
+	if !att.IsArray {
+		return validateValue(val, att, fullPath)
+	}
+
+	vals, ok := (*val).([]interface{})
+	if !ok {
+		return newFieldError(fullPath, errors.New(fmt.Sprintf("Expected '%s' to be an array", fullPath)))
+	}
+
+	if len(vals) < att.MinCount {
+		return newFieldError(fullPath, errors.New(fmt.Sprintf("Field '%s' does not meet the minimum count of %d values", fullPath, att.MinCount)))
+	}
+
+	if att.MaxCount > 0 && len(vals) > att.MaxCount {
+		return newFieldError(fullPath, errors.New(fmt.Sprintf("Field '%s' exceeds the maximum count of %d values", fullPath, att.MaxCount)))
+	}
+
+	errs := ValidationErrors{}
+	for i := range vals {
+		errs = errs.Add(validateValue(&vals[i], att, fmt.Sprintf("%s[%d]", fullPath, i)))
+	}
+
+	return errs.Err()
+}
+
+// validateValue validates a single value of a field against its schema and
+// translates it to its stored format if required.
+func validateValue(val *interface{}, att *CITypeAttribute, fullPath string) error {
+	// Does the format exist?
+	format := GetAttributeFormat(att.Type)
+	if format == nil {
+		return newFieldError(fullPath, errors.New(fmt.Sprintf("No format parser found for type '%s' in field '%s'", att.Type, fullPath)))
+	}
+
+	// Is the value valid?
+	// This will also translate the value if required
+	err := format.Validate(att, val)
+	if err != nil {
+		return newFieldError(fullPath, err)
+	}
+
+	// Process children?
+	if len(att.Children) > 0 {
+		childFields, ok := (*val).(map[string]interface{})
+		if !ok {
+			return newFieldError(fullPath, errors.New(fmt.Sprintf("Expected '%s' to be a valid JSON object", fullPath)))
+		}
+
+		return validateFieldTypes(&childFields, &att.Children, fullPath)
+	}
+
 	return nil
 }
 
@@ -152,16 +351,56 @@ func GetCIs(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	filter, err := GetRequestFilter(req)
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
 	citype := GetPathVar(req, "citype")
 	var cis []CI
-	err := db.C(citype).Find(nil).All(&cis)
+	err = db.C(citype).Find(nil).All(&cis)
 	if Handle(res, req, err) {
 		return
 	}
 
+	if filter != nil {
+		cis = filterCIs(cis, filter)
+	}
+
+	// CSV columns are derived from the CI Type schema
+	if NegotiateFormat(req, "json", "xml", "yaml", "csv") == "csv" {
+		var typ CIType
+		err = db.C(ciTypeCollection).Find(M{"shortname": citype}).One(&typ)
+		if Handle(res, req, err) {
+			return
+		}
+
+		delimiter := req.URL.Query().Get("delimiter")
+		if delimiter == "" {
+			delimiter = defaultCsvDelimiter
+		}
+
+		Render(res, req, http.StatusOK, &CICsv{&typ.Attributes, cis, delimiter})
+		return
+	}
+
 	Render(res, req, http.StatusOK, cis)
 }
 
+// filterCIs returns the CIs for which the filter expression is true. CIs
+// where the expression cannot be evaluated are excluded.
+func filterCIs(cis []CI, filter *Expression) []CI {
+	result := []CI{}
+	for _, ci := range cis {
+		if ok, err := filter.IsTrue(ci.Value); err == nil && ok {
+			result = append(result, ci)
+		}
+	}
+
+	return result
+}
+
 func GetCIById(res http.ResponseWriter, req *http.Request) {
 	// Get CMDB details
 	cmdb := GetPathVar(req, "cmdb")
@@ -189,6 +428,7 @@ func GetCIById(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	SetETag(res, &ci.model)
 	Render(res, req, http.StatusOK, ci)
 }
 
@@ -212,11 +452,24 @@ func DeleteCIById(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// Fetch the current revision
+	var ci CI
+	err = db.C(citype).FindId(oid).One(&ci)
+	if Handle(res, req, err) {
+		return
+	}
+
+	if CheckIfMatch(res, req, &ci.model) {
+		return
+	}
+
 	// Remove the CI
-	err = db.C(citype).RemoveId(oid)
+	err = RemoveRevision(db.C(citype), oid, ci.Revision)
 	if Handle(res, req, err) {
 		return
 	}
 
+	RecordCIChange(req, ChangeDeleted, cmdb, citype, &ci, ci.Value)
+
 	Render(res, req, http.StatusNoContent, "")
 }
@@ -0,0 +1,323 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+)
+
+const (
+	ciBulkBatchSize = 500
+)
+
+// CIBulkResult is the outcome of importing a single CI in a bulk request.
+type CIBulkResult struct {
+	Index    int    `json:"index" xml:",attr"`
+	Id       string `json:"id,omitempty" xml:",omitempty"`
+	Status   string `json:"status,omitempty" xml:",omitempty"`
+	Location string `json:"location,omitempty" xml:",omitempty"`
+	Error    string `json:"error,omitempty" xml:",omitempty"`
+	Path     string `json:"path,omitempty" xml:",omitempty"`
+
+	Errors []ValidationProblem `json:"errors,omitempty" xml:"error,omitempty"`
+}
+
+// CIBulkReport is the response to a bulk CI import.
+type CIBulkReport struct {
+	Atomic    bool           `json:"atomic"`
+	Created   int            `json:"created"`
+	Updated   int            `json:"updated"`
+	Unchanged int            `json:"unchanged"`
+	Failed    int            `json:"failed"`
+	Results   []CIBulkResult `json:"results" xml:"result"`
+}
+
+type bulkCI struct {
+	ci       CI
+	status   string
+	previous map[string]interface{}
+	err      error
+}
+
+func (c *CIBulkResult) setError(err error) {
+	c.Error = err.Error()
+	c.Errors = GetValidationProblems(err)
+	if len(c.Errors) > 0 {
+		c.Path = c.Errors[0].Path
+	}
+}
+
+// decodeBulkCIs reads CIs from a JSON array, newline delimited JSON or CSV
+// request body. Values which are not JSON objects are returned with an error.
+func decodeBulkCIs(req *http.Request, schema *CITypeAttributeList) ([]*bulkCI, error) {
+	if req.Body == nil {
+		return nil, errors.New("Request body is empty")
+	}
+	defer req.Body.Close()
+
+	ctype, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid content type: %s", req.Header.Get("Content-Type")))
+	}
+
+	dec := json.NewDecoder(req.Body)
+	switch ctype {
+	case "application/json":
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+			return nil, errors.New("Expected a JSON array of CIs")
+		}
+
+	case "application/x-ndjson", "application/ndjson":
+
+	case "text/csv":
+		// Parse column mapping. Should be:
+		// {"Column Header":"group.attribute"}
+		query := req.URL.Query()
+		mapping := map[string]string{}
+		if s := query.Get("mapping"); s != "" {
+			err = json.Unmarshal([]byte(s), &mapping)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid CSV column mapping: %s", err))
+			}
+		}
+
+		delimiter := query.Get("delimiter")
+		if delimiter == "" {
+			delimiter = defaultCsvDelimiter
+		}
+
+		return decodeCsvCIs(req.Body, schema, mapping, delimiter)
+
+	default:
+		return nil, errors.New(fmt.Sprintf("Invalid content type: %s", ctype))
+	}
+
+	items := []*bulkCI{}
+	for dec.More() {
+		item := &bulkCI{}
+		err := dec.Decode(&item.ci.Value)
+		if _, ok := err.(*json.UnmarshalTypeError); ok {
+			item.err = errors.New("Expected CI to be a valid JSON object")
+		} else if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.New(fmt.Sprintf("Error parsing CI %d: %s", len(items), err))
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// insertBulkCIs inserts the valid CIs in batches and records any insertion
+// errors against the failed CIs. The number of CIs inserted is returned.
+func insertBulkCIs(c *mgo.Collection, items []*bulkCI) int {
+	created := 0
+	batch := make([]*bulkCI, 0, ciBulkBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		bulk := c.Bulk()
+		bulk.Unordered()
+		for _, item := range batch {
+			bulk.Insert(&item.ci)
+		}
+
+		_, err := bulk.Run()
+		if berr, ok := err.(*mgo.BulkError); ok {
+			for _, ecase := range berr.Cases() {
+				if ecase.Index < 0 {
+					for _, item := range batch {
+						item.err = ecase.Err
+					}
+				} else {
+					batch[ecase.Index].err = ecase.Err
+				}
+			}
+		} else if err != nil {
+			for _, item := range batch {
+				item.err = err
+			}
+		}
+
+		for _, item := range batch {
+			if item.err == nil {
+				item.status = UpsertCreated
+				created++
+			}
+		}
+
+		batch = batch[:0]
+	}
+
+	for _, item := range items {
+		if item.err != nil {
+			continue
+		}
+
+		batch = append(batch, item)
+		if len(batch) == ciBulkBatchSize {
+			flush()
+		}
+	}
+	flush()
+
+	return created
+}
+
+// AddCIs imports many CIs of the same type from a JSON array, newline
+// delimited JSON or CSV request body and reports the outcome for each CI. If the
+// atomic query parameter is true, no CIs are stored unless all of them are
+// valid and stored successfully. If the upsert query parameter is true, CIs
+// which match an existing CI by the identification rules of the CI Type
+// update it instead.
+func AddCIs(res http.ResponseWriter, req *http.Request) {
+	cmdb := GetPathVar(req, "cmdb")
+	citype := GetPathVar(req, "citype")
+	atomic := req.URL.Query().Get("atomic") == "true"
+	upsert := req.URL.Query().Get("upsert") == "true"
+	if atomic && upsert {
+		ErrBadRequest(res, req, errors.New("Atomic upserts are not supported"))
+		return
+	}
+
+	// Get CMDB details
+	db := GetCmdbBackend(req, cmdb)
+	if db == nil {
+		log.Printf("No such CMDB found: %s", cmdb)
+		ErrNotFound(res, req)
+		return
+	}
+
+	// Get CI Type schema
+	var typ CIType
+	err := db.C("citypes").Find(M{"shortname": citype}).One(&typ)
+	if Handle(res, req, err) {
+		log.Printf("No such CI type found: %s", citype)
+		return
+	}
+
+	// Parse request into CIs
+	items, err := decodeBulkCIs(req, &typ.Attributes)
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
+	// Validate each CI against the schema
+	invalid := 0
+	for _, item := range items {
+		if item.err == nil {
+			item.ci.InitModel()
+			item.err = validateCI(&item.ci, &typ)
+		}
+
+		if item.err != nil {
+			invalid++
+		}
+	}
+
+	report := CIBulkReport{
+		Atomic:  atomic,
+		Results: make([]CIBulkResult, len(items)),
+	}
+
+	status := http.StatusOK
+	if atomic && invalid > 0 {
+		status = http.StatusBadRequest
+		for _, item := range items {
+			if item.err == nil {
+				item.err = errors.New("Not created because other CIs in the request are invalid")
+			}
+		}
+	} else if upsert {
+		for _, item := range items {
+			if item.err == nil {
+				item.status, item.previous, item.err = upsertCI(db.C(citype), &typ, &item.ci)
+			}
+		}
+	} else {
+		created := insertBulkCIs(db.C(citype), items)
+
+		// Roll back partial imports
+		if atomic && created < len(items) {
+			status = http.StatusConflict
+			ids := []interface{}{}
+			for _, item := range items {
+				if item.err == nil {
+					ids = append(ids, item.ci.Id)
+					item.err = errors.New("Not created because other CIs in the request could not be stored")
+				}
+			}
+
+			_, err = db.C(citype).RemoveAll(M{"_id": M{"$in": ids}})
+			if Handle(res, req, err) {
+				return
+			}
+		}
+	}
+
+	changes := []*ChangeEvent{}
+	for i, item := range items {
+		result := &report.Results[i]
+		result.Index = i
+		if item.err != nil {
+			if mgo.IsDup(item.err) {
+				item.err = typ.DuplicateKeyError(item.err)
+			}
+
+			result.setError(item.err)
+			report.Failed++
+		} else {
+			result.Status = item.status
+			switch item.status {
+			case UpsertCreated:
+				report.Created++
+				changes = append(changes, NewCIChange(req, ChangeCreated, cmdb, citype, &item.ci, nil))
+			case UpsertUpdated:
+				report.Updated++
+				changes = append(changes, NewCIChange(req, ChangeUpdated, cmdb, citype, &item.ci, item.previous))
+			case UpsertUnchanged:
+				report.Unchanged++
+			}
+
+			result.Id = IdToString(item.ci.Id)
+			result.Location = V1Uri(fmt.Sprintf("/cmdbs/%s/%s/%s", cmdb, citype, result.Id))
+		}
+	}
+
+	RecordCIChanges(changes...)
+
+	log.Printf("Bulk imported %d of %d CIs into %s/%s", report.Created+report.Updated+report.Unchanged, len(items), cmdb, citype)
+	Render(res, req, status, report)
+}
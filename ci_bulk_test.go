@@ -0,0 +1,86 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func newBulkRequest(ctype string, body string) *http.Request {
+	req, _ := http.NewRequest("POST", V1Uri("/cmdbs/temp/test/bulk"), strings.NewReader(body))
+	req.Header.Set("Content-Type", ctype)
+	return req
+}
+
+func TestDecodeBulkCIs(t *testing.T) {
+	// JSON array
+	items, err := decodeBulkCIs(newBulkRequest("application/json; charset=utf-8", `[{"a":1}, "not an object", {"b":2}]`), &CITypeAttributeList{})
+	if err != nil {
+		t.Fatalf("Expected JSON array to decode but got: %s", err)
+	}
+
+	areEqual(t, len(items), 3)
+	areEqual(t, items[0].ci.Value["a"], float64(1))
+	areUnequal(t, items[1].err, nil)
+	areEqual(t, items[2].ci.Value["b"], float64(2))
+
+	// Newline delimited JSON
+	items, err = decodeBulkCIs(newBulkRequest("application/x-ndjson", "{\"a\":1}\n{\"b\":2}\n\n{\"c\":3}\n"), &CITypeAttributeList{})
+	if err != nil {
+		t.Fatalf("Expected NDJSON to decode but got: %s", err)
+	}
+
+	areEqual(t, len(items), 3)
+	areEqual(t, items[2].ci.Value["c"], float64(3))
+
+	// Bad requests
+	bad := map[string]string{
+		"application/json":     `{"a":1}`,
+		"application/x-ndjson": "{\"a\":1}\n{\"b\":",
+		"text/plain":           `[{"a":1}]`,
+	}
+
+	for ctype, body := range bad {
+		if _, err := decodeBulkCIs(newBulkRequest(ctype, body), &CITypeAttributeList{}); err == nil {
+			t.Errorf("Expected bulk request to fail with %s body: %s", ctype, body)
+		}
+	}
+}
+
+func TestBulkCIs(t *testing.T) {
+	// Create temporary CI Type
+	typUrl := Post(t, V1Uri("/cmdbs/temp/citypes"), LoadTestFixture("citype-test.json"))
+	defer Delete(t, typUrl)
+
+	uri := V1Uri(fmt.Sprintf("/cmdbs/temp/%s/bulk", ciType))
+	good := LoadTestFixture("ci-test.json")
+	bad := `{"badAttribute":"some value", "required":false}`
+
+	// All or nothing
+	post(t, uri+"?atomic=true", fmt.Sprintf("[%s,%s]", good, bad), http.StatusBadRequest)
+	post(t, uri+"?atomic=true", fmt.Sprintf("[%s,%s]", good, good), http.StatusOK)
+
+	// Best effort
+	post(t, uri, fmt.Sprintf("[%s,%s]", good, bad), http.StatusOK)
+
+	// Malformed
+	post(t, uri, good, http.StatusBadRequest)
+}
@@ -0,0 +1,166 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+func (c *CIType) validateDefault(att *CITypeAttribute, path string) error {
+	if att.Default == nil {
+		return nil
+	}
+
+	if att.Type == "group" || att.Computed != "" {
+		return errors.New(fmt.Sprintf("CI Attribute '%s%s' may not have a default value", path, att.ShortName))
+	}
+
+	// Validate a copy so the default is stored as submitted
+	val := att.Default
+	if vals, ok := val.([]interface{}); ok && att.IsArray {
+		for _, v := range vals {
+			if err := GetAttributeFormat(att.Type).Validate(att, &v); err != nil {
+				return errors.New(fmt.Sprintf("Invalid default value for CI Attribute '%s%s': %s", path, att.ShortName, err))
+			}
+		}
+
+		return nil
+	}
+
+	if err := GetAttributeFormat(att.Type).Validate(att, &val); err != nil {
+		return errors.New(fmt.Sprintf("Invalid default value for CI Attribute '%s%s': %s", path, att.ShortName, err))
+	}
+
+	return nil
+}
+
+func (c *CIType) validateComputed(att *CITypeAttribute, path string) error {
+	if att.Computed == "" {
+		return nil
+	}
+
+	if att.Type == "group" || att.Required {
+		return errors.New(fmt.Sprintf("CI Attribute '%s%s' may not be computed", path, att.ShortName))
+	}
+
+	_, err := ParseExpression(att.Computed)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid expression for computed CI Attribute '%s%s': %s", path, att.ShortName, err))
+	}
+
+	return nil
+}
+
+// validateExpressionPaths ensures every attribute referenced by an
+// expression exists in the CI Type.
+func (c *CIType) validateExpressionPaths(expr *Expression, self string) error {
+	for _, path := range expr.Paths() {
+		if path == self {
+			return errors.New(fmt.Sprintf("Expression for '%s' refers to itself", self))
+		}
+
+		if c.Attributes.GetByPath(path) == nil {
+			return errors.New(fmt.Sprintf("Expression '%s' refers to unknown CI Attribute '%s'", expr.Source, path))
+		}
+	}
+
+	return nil
+}
+
+// validateComputedPaths ensures the expressions of all computed attributes
+// refer to attributes which exist. Expressions are evaluated against the whole
+// CI, so attributes in an array of groups, which would all compute the same
+// value, may not be computed.
+func (c *CIType) validateComputedPaths(atts *CITypeAttributeList, path string, inArray bool) error {
+	errs := ValidationErrors{}
+	for _, att := range *atts {
+		if att.Computed != "" && inArray {
+			errs = errs.Add(errors.New(fmt.Sprintf("CI Attribute '%s%s' in an array of groups may not be computed", path, att.ShortName)))
+		} else if att.Computed != "" {
+			expr, err := ParseExpression(att.Computed)
+			if err == nil {
+				err = c.validateExpressionPaths(expr, path+att.ShortName)
+			}
+
+			errs = errs.Add(err)
+		}
+
+		errs = errs.Add(c.validateComputedPaths(&att.Children, path+att.ShortName+".", inArray || att.IsArray))
+	}
+
+	return errs.Err()
+}
+
+// computeFields evaluates the expressions of computed attributes against the
+// whole CI and stores the results. Attributes are computed in the order they
+// are defined, so may refer to computed attributes defined before them. If an
+// expression evaluates to null, the attribute is removed.
+func computeFields(fields map[string]interface{}, schema *CITypeAttributeList, root map[string]interface{}, path string) error {
+	for i := range *schema {
+		att := &(*schema)[i]
+		fullPath := strings.TrimPrefix(fmt.Sprintf("%s.%s", path, att.ShortName), ".")
+
+		if att.Computed != "" {
+			expr, err := ParseExpression(att.Computed)
+			if err != nil {
+				return newFieldError(fullPath, err)
+			}
+
+			val, err := expr.Evaluate(root)
+			if err != nil {
+				return newFieldError(fullPath, errors.New(fmt.Sprintf("Error computing '%s': %s", fullPath, err)))
+			}
+
+			if val == nil {
+				delete(fields, att.ShortName)
+				continue
+			}
+
+			if vals, ok := val.([]interface{}); ok && att.IsArray {
+				for i := range vals {
+					err = validateValue(&vals[i], att, fmt.Sprintf("%s[%d]", fullPath, i))
+					if err != nil {
+						return err
+					}
+				}
+			} else {
+				err = validateValue(&val, att, fullPath)
+				if err != nil {
+					return err
+				}
+			}
+
+			fields[att.ShortName] = val
+			continue
+		}
+
+		// Compute the children of groups
+		if att.Type == "group" && !att.IsArray {
+			if child, ok := asMap(fields[att.ShortName]); ok {
+				err := computeFields(child, &att.Children, root, fullPath)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
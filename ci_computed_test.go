@@ -0,0 +1,105 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"testing"
+)
+
+func testComputedCIType() *CIType {
+	return &CIType{
+		Name: "Server",
+		Attributes: CITypeAttributeList{
+			{Name: "hostname", Type: "string"},
+			{Name: "domain", Type: "string", Default: "example.com"},
+			{Name: "fqdn", Type: "string", Computed: `hostname + "." + domain`},
+			{Name: "enabled", Type: "boolean", Default: "yes"},
+			{Name: "dimms", Type: "group", IsArray: true, Children: CITypeAttributeList{
+				{Name: "size", Type: "number"},
+			}},
+			{Name: "totalRam", Type: "number", Computed: `sum(dimms[].size)`},
+		},
+	}
+}
+
+func TestValidateComputedCIType(t *testing.T) {
+	citype := testComputedCIType()
+	err := citype.Validate()
+	if err != nil {
+		t.Fatalf("Expected CI Type to validate but got: %s", err)
+	}
+
+	bad := []CITypeAttribute{
+		{Name: "bad", Type: "number", Default: "not a number"},
+		{Name: "bad", Type: "string", Computed: `hostname +`},
+		{Name: "bad", Type: "string", Computed: `nosuchattribute`},
+		{Name: "bad", Type: "string", Computed: `bad + "x"`},
+		{Name: "bad", Type: "string", Computed: `hostname`, Required: true},
+		{Name: "bad", Type: "group", IsArray: true, Children: CITypeAttributeList{
+			{Name: "name", Type: "string", Computed: `hostname`},
+		}},
+	}
+
+	for _, att := range bad {
+		citype := testComputedCIType()
+		citype.Attributes = append(citype.Attributes, att)
+		if err := citype.Validate(); err == nil {
+			t.Errorf("Expected attribute to fail validation: %+v", att)
+		}
+	}
+}
+
+func TestValidateComputedCI(t *testing.T) {
+	citype := testComputedCIType()
+	citype.Validate()
+
+	ci := CI{Value: map[string]interface{}{
+		"hostname": "web01",
+		"dimms": []interface{}{
+			map[string]interface{}{"size": "8"},
+			map[string]interface{}{"size": float64(16)},
+		},
+	}}
+
+	err := validateCI(&ci, citype)
+	if err != nil {
+		t.Fatalf("Expected CI to validate but got: %s", err)
+	}
+
+	areEqual(t, ci.Value["domain"], "example.com")
+	areEqual(t, ci.Value["enabled"], true)
+	areEqual(t, ci.Value["fqdn"], "web01.example.com")
+	areEqual(t, ci.Value["totalram"], float64(24))
+
+	// Computed attributes are read-only
+	ci = CI{Value: map[string]interface{}{"fqdn": "web01"}}
+	if err := validateCI(&ci, citype); err == nil {
+		t.Errorf("Expected computed attribute to be read-only")
+	}
+
+	// Computed attributes are omitted if their inputs are missing
+	ci = CI{Value: map[string]interface{}{"domain": "example.org"}}
+	err = validateCI(&ci, citype)
+	if err != nil {
+		t.Fatalf("Expected CI to validate but got: %s", err)
+	}
+
+	if _, ok := ci.Value["fqdn"]; ok {
+		t.Errorf("Expected fqdn to be omitted")
+	}
+}
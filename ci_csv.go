@@ -0,0 +1,282 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultCsvDelimiter = ";"
+)
+
+// csvColumn maps a CSV column to a dotted CI attribute path
+type csvColumn struct {
+	Path      string
+	Attribute *CITypeAttribute
+}
+
+// CICsv renders a list of CIs as CSV with a column for each attribute of
+// their CI Type. Group attributes are flattened into dotted column headers and
+// array values are joined with the delimiter.
+type CICsv struct {
+	Schema    *CITypeAttributeList
+	CIs       []CI
+	Delimiter string
+}
+
+func (c *CICsv) MarshalCSV() ([][]string, error) {
+	columns := csvColumns(c.Schema, "")
+
+	header := make([]string, len(columns)+1)
+	header[0] = "id"
+	for i, col := range columns {
+		header[i+1] = col.Path
+	}
+
+	records := [][]string{header}
+	for _, ci := range c.CIs {
+		record := make([]string, len(columns)+1)
+		if ci.Id != nil {
+			record[0] = IdToString(ci.Id)
+		}
+		for i, col := range columns {
+			val := getPath(ci.Value, col.Path)
+			if col.Attribute.Type == "group" && val != nil {
+				// Arrays of groups are rendered as a JSON array
+				b, err := json.Marshal(val)
+				if err != nil {
+					return nil, err
+				}
+				record[i+1] = string(b)
+			} else {
+				record[i+1] = formatCsvValue(val, c.Delimiter)
+			}
+		}
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// csvColumns returns a column for each attribute in the schema. Groups are
+// flattened unless they are arrays, which are rendered as JSON in a single
+// column.
+func csvColumns(schema *CITypeAttributeList, prefix string) []csvColumn {
+	columns := []csvColumn{}
+	for i := range *schema {
+		att := &(*schema)[i]
+		path := prefix + att.ShortName
+		if att.Type == "group" && !att.IsArray {
+			columns = append(columns, csvColumns(&att.Children, path+".")...)
+		} else {
+			columns = append(columns, csvColumn{path, att})
+		}
+	}
+
+	return columns
+}
+
+// asMap returns a JSON object or BSON document as a map.
+func asMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+
+	case bson.M:
+		return map[string]interface{}(m), true
+	}
+
+	return nil, false
+}
+
+// getPath returns the value at a dotted path in a CI or nil if it does not
+// exist.
+func getPath(fields map[string]interface{}, path string) interface{} {
+	var val interface{} = fields
+	for _, key := range strings.Split(path, ".") {
+		m, ok := asMap(val)
+		if !ok {
+			return nil
+		}
+
+		val = m[key]
+	}
+
+	return val
+}
+
+// setPath sets the value at a dotted path in a CI, creating groups as
+// required.
+func setPath(fields map[string]interface{}, path string, val interface{}) error {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		if _, ok := fields[key]; !ok {
+			fields[key] = map[string]interface{}{}
+		}
+
+		m, ok := asMap(fields[key])
+		if !ok {
+			return newFieldError(path, errors.New(fmt.Sprintf("Field '%s' is not a group", key)))
+		}
+
+		fields = m
+	}
+
+	key := keys[len(keys)-1]
+	if _, ok := fields[key]; ok {
+		return newFieldError(path, errors.New(fmt.Sprintf("Field '%s' is mapped more than once", path)))
+	}
+
+	fields[key] = val
+	return nil
+}
+
+func formatCsvValue(val interface{}, delimiter string) string {
+	switch v := val.(type) {
+	case nil:
+		return ""
+
+	case string:
+		return v
+
+	case bool:
+		return strconv.FormatBool(v)
+
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+
+	case int:
+		return strconv.Itoa(v)
+
+	case int64:
+		return strconv.FormatInt(v, 10)
+
+	case []interface{}:
+		vals := make([]string, len(v))
+		for i, elem := range v {
+			vals[i] = formatCsvValue(elem, delimiter)
+		}
+		return strings.Join(vals, delimiter)
+	}
+
+	b, err := json.Marshal(val)
+	if err != nil {
+		return fmt.Sprintf("%v", val)
+	}
+
+	return string(b)
+}
+
+// normalizePath converts each segment of a dotted attribute path to its short
+// name.
+func normalizePath(path string) string {
+	keys := strings.Split(path, ".")
+	for i, key := range keys {
+		keys[i] = GetShortName(key)
+	}
+
+	return strings.Join(keys, ".")
+}
+
+// decodeCsvCIs reads CIs from CSV with a header row. Columns are mapped to
+// attribute paths by their header unless overridden in the mapping, where an
+// empty path skips the column. The id column written by CICsv is skipped unless
+// it is mapped or the schema has an id attribute. Values for array attributes
+// are split with the delimiter, except arrays of groups which are parsed as a
+// JSON array. Empty cells are ignored.
+func decodeCsvCIs(r io.Reader, schema *CITypeAttributeList, mapping map[string]string, delimiter string) ([]*bulkCI, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("CSV has no header row")
+	} else if err != nil {
+		return nil, err
+	}
+
+	columns := make([]csvColumn, len(header))
+	for i, name := range header {
+		path := strings.TrimSpace(name)
+		if mapped, ok := mapping[path]; ok {
+			path = mapped
+		} else if path == "id" && schema.Get("id") == nil {
+			path = ""
+		}
+
+		if path != "" {
+			path = normalizePath(path)
+			columns[i] = csvColumn{path, schema.GetByPath(path)}
+		}
+	}
+
+	items := []*bulkCI{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		item := &bulkCI{}
+		items = append(items, item)
+		if perr, ok := err.(*csv.ParseError); ok && perr.Err == csv.ErrFieldCount {
+			item.err = errors.New(fmt.Sprintf("Expected %d fields on line %d but found %d", len(header), perr.Line, len(record)))
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		item.ci.Value = map[string]interface{}{}
+		for i, cell := range record {
+			if columns[i].Path == "" || cell == "" {
+				continue
+			}
+
+			var val interface{} = cell
+			if att := columns[i].Attribute; att != nil && att.IsArray && att.Type == "group" {
+				vals := []interface{}{}
+				if err := json.Unmarshal([]byte(cell), &vals); err != nil {
+					item.err = errors.New(fmt.Sprintf("Invalid JSON array for attribute '%s': %s", columns[i].Path, err))
+					break
+				}
+				val = vals
+			} else if att != nil && att.IsArray {
+				vals := []interface{}{}
+				for _, s := range strings.Split(cell, delimiter) {
+					vals = append(vals, strings.TrimSpace(s))
+				}
+				val = vals
+			}
+
+			err = setPath(item.ci.Value, columns[i].Path, val)
+			if err != nil {
+				item.err = err
+				break
+			}
+		}
+	}
+
+	return items, nil
+}
@@ -0,0 +1,152 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"gopkg.in/mgo.v2/bson"
+	"strings"
+	"testing"
+)
+
+func testCsvSchema() *CITypeAttributeList {
+	return &CITypeAttributeList{
+		{Name: "Host Name", ShortName: "host-name", Type: "string"},
+		{Name: "Tags", ShortName: "tags", Type: "string", IsArray: true},
+		{Name: "Cores", ShortName: "cores", Type: "number"},
+		{Name: "Network", ShortName: "network", Type: "group", Children: CITypeAttributeList{
+			{Name: "Address", ShortName: "address", Type: "string"},
+		}},
+	}
+}
+
+func TestDecodeCsvCIs(t *testing.T) {
+	body := "Host Name,Tags,Cores,Network.Address,Notes\n" +
+		"web01,a; b,4,10.0.0.1,skipped\n" +
+		"web02,,,,\n" +
+		"web03,c\n"
+
+	mapping := map[string]string{"Notes": ""}
+	items, err := decodeCsvCIs(strings.NewReader(body), testCsvSchema(), mapping, ";")
+	if err != nil {
+		t.Fatalf("Expected CSV to decode but got: %s", err)
+	}
+
+	areEqual(t, len(items), 3)
+	areEqual(t, items[0].err, nil)
+	areEqual(t, items[0].ci.Value["host-name"], "web01")
+	areEqual(t, items[0].ci.Value["cores"], "4")
+	areEqual(t, getPath(items[0].ci.Value, "network.address"), "10.0.0.1")
+	areEqual(t, len(items[0].ci.Value), 4)
+
+	tags := items[0].ci.Value["tags"].([]interface{})
+	areEqual(t, len(tags), 2)
+	areEqual(t, tags[1], "b")
+
+	// Values are coerced by their attribute format
+	err = validateFields(&items[0].ci.Value, testCsvSchema(), "")
+	if err != nil {
+		t.Fatalf("Expected CSV values to validate but got: %s", err)
+	}
+
+	areEqual(t, items[0].ci.Value["cores"], float64(4))
+
+	// Empty cells are omitted
+	areEqual(t, len(items[1].ci.Value), 1)
+
+	// Short rows are reported per item
+	areUnequal(t, items[2].err, nil)
+
+	// Columns which map to the same attribute
+	items, err = decodeCsvCIs(strings.NewReader("host-name,Host Name\na,b\n"), testCsvSchema(), nil, ";")
+	if err != nil {
+		t.Fatalf("Expected CSV to decode but got: %s", err)
+	}
+
+	areUnequal(t, items[0].err, nil)
+
+	// Missing header
+	if _, err := decodeCsvCIs(strings.NewReader(""), testCsvSchema(), nil, ";"); err == nil {
+		t.Errorf("Expected empty CSV to fail")
+	}
+}
+
+func TestMarshalCiCsv(t *testing.T) {
+	cis := []CI{
+		{Value: map[string]interface{}{
+			"host-name": "web01",
+			"tags":      []interface{}{"a", "b"},
+			"cores":     float64(4),
+			"network":   bson.M{"address": "10.0.0.1"},
+		}},
+		{Value: map[string]interface{}{"host-name": "web02"}},
+	}
+
+	csv := &CICsv{testCsvSchema(), cis, "|"}
+	records, err := csv.MarshalCSV()
+	if err != nil {
+		t.Fatalf("Expected CIs to marshal but got: %s", err)
+	}
+
+	areEqual(t, len(records), 3)
+	areEqual(t, strings.Join(records[0], ","), "id,host-name,tags,cores,network.address")
+	areEqual(t, strings.Join(records[1][1:], ","), "web01,a|b,4,10.0.0.1")
+	areEqual(t, strings.Join(records[2][1:], ","), "web02,,,")
+}
+
+func TestCsvRoundTrip(t *testing.T) {
+	schema := testCsvSchema()
+	*schema = append(*schema, CITypeAttribute{Name: "Disks", ShortName: "disks", Type: "group", IsArray: true, Children: CITypeAttributeList{
+		{Name: "Size", ShortName: "size", Type: "number"},
+	}})
+
+	value := map[string]interface{}{
+		"host-name": "web01",
+		"tags":      []interface{}{"a", "b"},
+		"cores":     float64(4),
+		"network":   map[string]interface{}{"address": "10.0.0.1"},
+		"disks":     []interface{}{bson.M{"size": float64(100)}, bson.M{"size": float64(200)}},
+	}
+
+	records, err := (&CICsv{schema, []CI{{model: model{Id: NewId()}, Value: value}}, ";"}).MarshalCSV()
+	if err != nil {
+		t.Fatalf("Expected CIs to marshal but got: %s", err)
+	}
+
+	var buf bytes.Buffer
+	csv.NewWriter(&buf).WriteAll(records)
+
+	items, err := decodeCsvCIs(&buf, schema, nil, ";")
+	if err != nil {
+		t.Fatalf("Expected exported CSV to decode but got: %s", err)
+	}
+
+	areEqual(t, len(items), 1)
+	areEqual(t, items[0].err, nil)
+
+	err = validateFields(&items[0].ci.Value, schema, "")
+	if err != nil {
+		t.Fatalf("Expected exported CSV to validate but got: %s", err)
+	}
+
+	expected, _ := json.Marshal(value)
+	actual, _ := json.Marshal(items[0].ci.Value)
+	areEqual(t, string(actual), string(expected))
+}
@@ -0,0 +1,278 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Upsert outcomes
+const (
+	UpsertCreated   = "created"
+	UpsertUpdated   = "updated"
+	UpsertUnchanged = "unchanged"
+)
+
+var ErrIdentityConflict = errors.New("CI matches different existing CIs by more than one identification rule")
+
+// CIIdentityRule is a set of attributes which together uniquely identify a CI
+// of a CI Type, such as a serial number or a host name and domain.
+type CIIdentityRule struct {
+	Attributes []string `json:"attributes" xml:"attribute"`
+}
+
+// CIUpsertResult is the response to a CI upsert.
+type CIUpsertResult struct {
+	Id     string `json:"id" xml:",attr"`
+	Status string `json:"status" xml:",attr"`
+}
+
+// IndexName returns the name of the unique index which enforces the rule.
+func (c *CIIdentityRule) IndexName() string {
+	return identityIndexPrefix + strings.Join(c.Attributes, indexPathSeparator)
+}
+
+// Query returns a query for CIs which match the given CI value by this rule
+// or nil if the value does not include every attribute of the rule.
+func (c *CIIdentityRule) Query(value map[string]interface{}) M {
+	query := M{}
+	for _, path := range c.Attributes {
+		val := getPath(value, path)
+		if val == nil {
+			return nil
+		}
+
+		query["value."+path] = val
+	}
+
+	return query
+}
+
+func (c *CIType) validateIdentityRules() error {
+	errs := ValidationErrors{}
+	for i := range c.IdentityRules {
+		rule := &c.IdentityRules[i]
+		if len(rule.Attributes) == 0 {
+			errs = errs.Add(errors.New(fmt.Sprintf("Identification rule %d has no attributes", i)))
+			continue
+		}
+
+		for j, path := range rule.Attributes {
+			path = normalizePath(path)
+			att := c.Attributes.GetByPath(path)
+			if att == nil {
+				errs = errs.Add(errors.New(fmt.Sprintf("Identification rule %d refers to unknown CI Attribute '%s'", i, path)))
+			} else if att.Type == "group" || att.IsArray {
+				errs = errs.Add(errors.New(fmt.Sprintf("CI Attribute '%s' may not be used for identification as it is not a single value", path)))
+			}
+
+			rule.Attributes[j] = path
+		}
+	}
+
+	return errs.Err()
+}
+
+// findIdentifiedCI returns the existing CI identified by any of the
+// identification rules of a CI Type or nil if there is none.
+func findIdentifiedCI(c *mgo.Collection, citype *CIType, value map[string]interface{}) (*CI, error) {
+	var match *CI
+	for _, rule := range citype.IdentityRules {
+		query := rule.Query(value)
+		if query == nil {
+			continue
+		}
+
+		var ci CI
+		err := c.Find(query).One(&ci)
+		if err == mgo.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if match != nil && match.Id != ci.Id {
+			return nil, ErrIdentityConflict
+		}
+
+		match = &ci
+	}
+
+	return match, nil
+}
+
+// upsertCI replaces the existing CI identified by the identification rules of
+// its CI Type or inserts it if there is none. The CI must already be
+// validated. The value of the replaced CI is returned.
+func upsertCI(c *mgo.Collection, citype *CIType, ci *CI) (string, map[string]interface{}, error) {
+	existing, err := findIdentifiedCI(c, citype, ci.Value)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if existing == nil {
+		ci.InitModel()
+		err = c.Insert(ci)
+		if err != nil {
+			return "", nil, err
+		}
+
+		return UpsertCreated, nil, nil
+	}
+
+	return replaceCI(c, existing, ci)
+}
+
+// replaceCI replaces an existing CI with the value of ci, only if the existing
+// CI has not been modified since it was read. Otherwise ErrStaleRevision is
+// returned. The value of the replaced CI is returned.
+func replaceCI(c *mgo.Collection, existing *CI, ci *CI) (string, map[string]interface{}, error) {
+	ci.Id = existing.Id
+	ci.Created = existing.Created
+	ci.Modified = existing.Modified
+	ci.Revision = existing.Revision
+	ci.Sources = existing.Sources
+	ci.Conflicts = existing.Conflicts
+	if valuesEqual(existing.Value, ci.Value) {
+		return UpsertUnchanged, existing.Value, nil
+	}
+
+	ci.SetModified()
+	err := UpdateRevision(c, ci.Id, existing.Revision, ci)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return UpsertUpdated, existing.Value, nil
+}
+
+// UpsertCI updates the existing CI which matches the request body by the
+// identification rules of its CI Type, or creates a new CI if none match.
+func UpsertCI(res http.ResponseWriter, req *http.Request) {
+	cmdb := GetPathVar(req, "cmdb")
+	citype := GetPathVar(req, "citype")
+
+	// Parse request into CI
+	var ci CI
+	err := Bind(req, &ci.Value)
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
+	// Get CMDB details
+	db := GetCmdbBackend(req, cmdb)
+	if db == nil {
+		log.Printf("No such CMDB found: %s", cmdb)
+		ErrNotFound(res, req)
+		return
+	}
+
+	// Get CI Type schema
+	var typ CIType
+	err = db.C(ciTypeCollection).Find(M{"shortname": citype}).One(&typ)
+	if Handle(res, req, err) {
+		log.Printf("No such CI type found: %s", citype)
+		return
+	}
+
+	if len(typ.IdentityRules) == 0 {
+		ErrBadRequest(res, req, errors.New(fmt.Sprintf("CI Type '%s' has no identification rules", citype)))
+		return
+	}
+
+	// Validate against schema
+	err = validateCI(&ci, &typ)
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
+	// Evaluate preconditions against the CI which would be updated. Creating
+	// a CI requires no entity tag but If-Match fails if there is no CI to
+	// match and If-None-Match: * fails if there is.
+	var status string
+	var previous map[string]interface{}
+	if HasPrecondition(req) || req.Header.Get("If-None-Match") != "" {
+		var existing *CI
+		existing, err = findIdentifiedCI(db.C(citype), &typ, ci.Value)
+		if err == ErrIdentityConflict {
+			ErrConflict(res, req)
+			return
+		} else if Handle(res, req, err) {
+			return
+		}
+
+		if existing == nil {
+			if req.Header.Get("If-Match") != "" {
+				ErrPreconditionFailed(res, req)
+				return
+			}
+
+			// Insert rather than upsert so that a CI created by another
+			// request since is not replaced without its precondition
+			ci.InitModel()
+			err = db.C(citype).Insert(&ci)
+			status = UpsertCreated
+		} else {
+			if CheckIfNoneMatch(res, req, &existing.model) || CheckIfMatch(res, req, &existing.model) {
+				return
+			}
+
+			// Replace the revision which satisfied the preconditions, so
+			// that a concurrent write fails the request
+			status, previous, err = replaceCI(db.C(citype), existing, &ci)
+		}
+	} else {
+		status, previous, err = upsertCI(db.C(citype), &typ, &ci)
+	}
+
+	if err == ErrIdentityConflict {
+		log.Printf("Error upserting CI: %s", err)
+		ErrConflict(res, req)
+		return
+	} else if HandleCIError(res, req, &typ, err) {
+		return
+	}
+
+	switch status {
+	case UpsertCreated:
+		RecordCIChange(req, ChangeCreated, cmdb, citype, &ci, nil)
+	case UpsertUpdated:
+		RecordCIChange(req, ChangeUpdated, cmdb, citype, &ci, previous)
+	}
+
+	result := CIUpsertResult{
+		Id:     IdToString(ci.Id),
+		Status: status,
+	}
+
+	if status == UpsertCreated {
+		res.Header().Set("Location", V1Uri(fmt.Sprintf("/cmdbs/%s/%s/%s", cmdb, citype, result.Id)))
+		Render(res, req, http.StatusCreated, result)
+		return
+	}
+
+	SetETag(res, &ci.model)
+	Render(res, req, http.StatusOK, result)
+}
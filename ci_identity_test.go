@@ -0,0 +1,166 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateIdentityRules(t *testing.T) {
+	citype := CIType{
+		Name:       "Server",
+		Attributes: *testCsvSchema(),
+		IdentityRules: []CIIdentityRule{
+			{Attributes: []string{"Host Name"}},
+			{Attributes: []string{"host-name", "Network.Address"}},
+		},
+	}
+
+	err := citype.Validate()
+	if err != nil {
+		t.Fatalf("Expected identification rules to validate but got: %s", err)
+	}
+
+	areEqual(t, citype.IdentityRules[0].Attributes[0], "host-name")
+	areEqual(t, citype.IdentityRules[1].Attributes[1], "network.address")
+	areEqual(t, citype.IdentityRules[1].IndexName(), "identity_host-name,network.address")
+
+	bad := [][]string{
+		{},
+		{"no-such-attribute"},
+		{"network"},
+		{"tags"},
+	}
+
+	for _, attributes := range bad {
+		citype.IdentityRules = []CIIdentityRule{{Attributes: attributes}}
+		if err := citype.Validate(); err == nil {
+			t.Errorf("Expected identification rule to fail: %v", attributes)
+		}
+	}
+}
+
+func TestIdentityRuleQuery(t *testing.T) {
+	rule := CIIdentityRule{Attributes: []string{"host-name", "network.address"}}
+	query := rule.Query(map[string]interface{}{
+		"host-name": "web01",
+		"network":   map[string]interface{}{"address": "10.0.0.1"},
+	})
+
+	areEqual(t, query["value.host-name"], "web01")
+	areEqual(t, query["value.network.address"], "10.0.0.1")
+
+	// Incomplete values are not identified by the rule
+	if rule.Query(map[string]interface{}{"host-name": "web01"}) != nil {
+		t.Errorf("Expected no query for a CI without all identifying attributes")
+	}
+}
+
+func TestValuesEqual(t *testing.T) {
+	a := map[string]interface{}{"a": float64(1), "b": map[string]interface{}{"c": "d"}}
+	b := map[string]interface{}{"b": bson.M{"c": "d"}, "a": float64(1)}
+	areEqual(t, valuesEqual(a, b), true)
+
+	b["a"] = float64(2)
+	areEqual(t, valuesEqual(a, b), false)
+}
+
+func TestUpsertCI(t *testing.T) {
+	typUrl := Post(t, V1Uri("/cmdbs/temp/citypes"), `{
+		"name":"Upsert Test",
+		"attributes":[
+			{ "name":"serial", "type":"string" },
+			{ "name":"description", "type":"string" }
+		],
+		"identityRules":[ { "attributes":["serial"] } ]
+	}`)
+	defer Delete(t, typUrl)
+
+	uri := V1Uri("/cmdbs/temp/upsert-test")
+	put(t, uri, `{"serial":"ABC123","description":"one"}`, http.StatusCreated)
+	put(t, uri, `{"serial":"ABC123","description":"one"}`, http.StatusOK)
+	put(t, uri, `{"serial":"ABC123","description":"two"}`, http.StatusOK)
+
+	// Duplicates are refused by the identification rule index
+	post(t, uri, `{"serial":"ABC123"}`, http.StatusConflict)
+
+	// Bulk upsert
+	post(t, fmt.Sprintf("%s/bulk?upsert=true", uri), `[{"serial":"ABC123"},{"serial":"DEF456"}]`, http.StatusOK)
+}
+
+func TestUpsertCIPreconditions(t *testing.T) {
+	typUrl := Post(t, V1Uri("/cmdbs/temp/citypes"), `{
+		"name":"Upsert Precondition Test",
+		"attributes":[ { "name":"serial", "type":"string" } ],
+		"identityRules":[ { "attributes":["serial"] } ]
+	}`)
+	defer Delete(t, typUrl)
+
+	config, _ := GetConfig()
+	config.Server.RequireIfMatch = true
+	defer func() { config.Server.RequireIfMatch = false }()
+
+	send := func(body string, header string, value string) *httptest.ResponseRecorder {
+		req := NewRequest("PUT", V1Uri("/cmdbs/temp/upsert-precondition-test"), strings.NewReader(body))
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+
+		res := httptest.NewRecorder()
+		GetServer().ServeHTTP(res, req)
+		return res
+	}
+
+	// If-Match cannot match a CI which does not exist
+	areEqual(t, send(`{"serial":"ABC123"}`, "If-Match", "*").Code, http.StatusPreconditionFailed)
+
+	// New CIs require no entity tag
+	areEqual(t, send(`{"serial":"ABC123"}`, "", "").Code, http.StatusCreated)
+	areEqual(t, send(`{"serial":"DEF456"}`, "If-None-Match", "*").Code, http.StatusCreated)
+
+	// Existing CIs do
+	areEqual(t, send(`{"serial":"ABC123"}`, "", "").Code, http.StatusPreconditionRequired)
+	areEqual(t, send(`{"serial":"ABC123"}`, "If-None-Match", "*").Code, http.StatusPreconditionFailed)
+	areEqual(t, send(`{"serial":"ABC123"}`, "If-Match", "*").Code, http.StatusOK)
+}
+
+func TestReplaceStaleCI(t *testing.T) {
+	c := RootDb().C("test.replaceci")
+	defer c.DropCollection()
+
+	existing := CI{Value: map[string]interface{}{"serial": "ABC123", "description": "one"}}
+	existing.Id = bson.NewObjectId()
+	existing.InitModel()
+	if err := c.Insert(&existing); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another request updates the CI after it was read
+	if err := c.UpdateId(existing.Id, M{"$inc": M{"revision": 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	ci := CI{Value: map[string]interface{}{"serial": "ABC123", "description": "two"}}
+	_, _, err := replaceCI(c, &existing, &ci)
+	areEqual(t, err, ErrStaleRevision)
+}
@@ -0,0 +1,233 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Prefixes of the names of CI collection indexes which are managed by their
+// CI Type
+const (
+	identityIndexPrefix = "identity_"
+	uniqueIndexPrefix   = "unique_"
+	indexPrefix         = "index_"
+
+	// Separates the attribute paths in the name of a compound index. Short
+	// names may include underscores but never commas.
+	indexPathSeparator = ","
+)
+
+// MongoDB error codes for an index which exists with different options
+const (
+	indexOptionsConflict  = 85
+	indexKeySpecsConflict = 86
+)
+
+var dupKeyIndexPattern = regexp.MustCompile(`index: (?:\S+\.\$)?(\S+)\s+dup key`)
+
+// CIUniqueKey is a set of attributes whose values must be unique in
+// combination across all CIs of a CI Type.
+type CIUniqueKey struct {
+	Attributes []string `json:"attributes" xml:"attribute"`
+}
+
+// ciIndex is a backend index on the CIs of a CI Type.
+type ciIndex struct {
+	Name   string
+	Paths  []string
+	Unique bool
+}
+
+// spec returns the createIndexes specification of the index. Unique indexes
+// only include CIs which have a value for every indexed attribute, so CIs
+// which are missing any of them never conflict.
+func (c *ciIndex) spec() bson.M {
+	key := bson.D{}
+	filter := bson.M{}
+	for _, path := range c.Paths {
+		key = append(key, bson.DocElem{Name: "value." + path, Value: 1})
+		filter["value."+path] = bson.M{"$exists": true}
+	}
+
+	spec := bson.M{"key": key, "name": c.Name}
+	if c.Unique {
+		spec["unique"] = true
+		spec["partialFilterExpression"] = filter
+	}
+
+	return spec
+}
+
+// create creates the index on a CI collection, replacing any existing index
+// of the same name with different options.
+func (c *ciIndex) create(coll *mgo.Collection) error {
+	cmd := bson.D{
+		{Name: "createIndexes", Value: coll.Name},
+		{Name: "indexes", Value: []bson.M{c.spec()}},
+	}
+
+	err := coll.Database.Run(cmd, nil)
+	if qerr, ok := err.(*mgo.QueryError); ok && (qerr.Code == indexOptionsConflict || qerr.Code == indexKeySpecsConflict) {
+		log.Printf("Replacing index %s on %s", c.Name, coll.Name)
+		err = coll.DropIndexName(c.Name)
+		if err == nil {
+			err = coll.Database.Run(cmd, nil)
+		}
+	}
+
+	return err
+}
+
+func isManagedIndex(name string) bool {
+	return strings.HasPrefix(name, identityIndexPrefix) ||
+		strings.HasPrefix(name, uniqueIndexPrefix) ||
+		strings.HasPrefix(name, indexPrefix)
+}
+
+func (c *CIType) validateUniqueKeys() error {
+	errs := ValidationErrors{}
+	for i := range c.UniqueKeys {
+		key := &c.UniqueKeys[i]
+		if len(key.Attributes) == 0 {
+			errs = errs.Add(errors.New(fmt.Sprintf("Unique key %d has no attributes", i)))
+			continue
+		}
+
+		for j, path := range key.Attributes {
+			path = normalizePath(path)
+			att := c.Attributes.GetByPath(path)
+			if att == nil {
+				errs = errs.Add(errors.New(fmt.Sprintf("Unique key %d refers to unknown CI Attribute '%s'", i, path)))
+			} else if att.Type == "group" {
+				errs = errs.Add(errors.New(fmt.Sprintf("Group CI Attribute '%s' may not be used in a unique key", path)))
+			}
+
+			key.Attributes[j] = path
+		}
+	}
+
+	return errs.Err()
+}
+
+// indexes returns the backend indexes required by the identification rules,
+// unique keys and unique or indexed attributes of a CI Type.
+func (c *CIType) indexes() []ciIndex {
+	indexes := []ciIndex{}
+	for _, rule := range c.IdentityRules {
+		indexes = append(indexes, ciIndex{rule.IndexName(), rule.Attributes, true})
+	}
+
+	for _, key := range c.UniqueKeys {
+		indexes = append(indexes, ciIndex{uniqueIndexPrefix + strings.Join(key.Attributes, indexPathSeparator), key.Attributes, true})
+	}
+
+	var walk func(atts *CITypeAttributeList, prefix string)
+	walk = func(atts *CITypeAttributeList, prefix string) {
+		for _, att := range *atts {
+			path := prefix + att.ShortName
+			if att.Unique {
+				indexes = append(indexes, ciIndex{uniqueIndexPrefix + path, []string{path}, true})
+			} else if att.Indexed {
+				indexes = append(indexes, ciIndex{indexPrefix + path, []string{path}, false})
+			}
+
+			walk(&att.Children, path+".")
+		}
+	}
+	walk(&c.Attributes, "")
+
+	return indexes
+}
+
+// ensureCIIndexes creates the backend indexes required by a CI Type and drops
+// any managed indexes which are no longer required.
+func ensureCIIndexes(db *mgo.Database, citype *CIType) error {
+	c := db.C(citype.ShortName)
+	want := map[string]bool{}
+	for _, index := range citype.indexes() {
+		want[index.Name] = true
+		err := index.create(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	indexes, err := c.Indexes()
+	if err != nil {
+		// Collection does not yet exist
+		if len(want) == 0 {
+			return nil
+		}
+
+		return err
+	}
+
+	for _, index := range indexes {
+		if isManagedIndex(index.Name) && !want[index.Name] {
+			log.Printf("Dropping index %s from %s", index.Name, citype.ShortName)
+			err = c.DropIndexName(index.Name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// DuplicateKeyError returns an error naming the attributes of the CI Type
+// whose unique index was violated by a duplicate key error.
+func (c *CIType) DuplicateKeyError(err error) error {
+	paths := []string{}
+	if match := dupKeyIndexPattern.FindStringSubmatch(err.Error()); match != nil {
+		for _, index := range c.indexes() {
+			if index.Name == match[1] {
+				paths = index.Paths
+				break
+			}
+		}
+	}
+
+	if len(paths) == 0 {
+		return errors.New("A CI with the same unique attribute values already exists")
+	}
+
+	return &FieldError{
+		Path:    paths[0],
+		Message: fmt.Sprintf("A CI with the same value for '%s' already exists", strings.Join(paths, "', '")),
+	}
+}
+
+// HandleCIError writes a conflict response naming the violated attributes if
+// err is a duplicate key error, otherwise it behaves as Handle.
+func HandleCIError(res http.ResponseWriter, req *http.Request, citype *CIType, err error) bool {
+	if err != nil && mgo.IsDup(err) {
+		ErrDuplicate(res, req, citype.DuplicateKeyError(err))
+		return true
+	}
+
+	return Handle(res, req, err)
+}
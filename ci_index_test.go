@@ -0,0 +1,152 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"errors"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func testIndexedCIType() *CIType {
+	citype := &CIType{
+		Name:       "Server",
+		Attributes: *testCsvSchema(),
+		IdentityRules: []CIIdentityRule{
+			{Attributes: []string{"host-name"}},
+		},
+		UniqueKeys: []CIUniqueKey{
+			{Attributes: []string{"host-name", "Network.Address"}},
+		},
+	}
+
+	citype.Attributes[2].Indexed = true
+	citype.Attributes[3].Children[0].Unique = true
+	return citype
+}
+
+func TestCITypeIndexes(t *testing.T) {
+	citype := testIndexedCIType()
+	err := citype.Validate()
+	if err != nil {
+		t.Fatalf("Expected CI Type to validate but got: %s", err)
+	}
+
+	indexes := citype.indexes()
+	areEqual(t, len(indexes), 4)
+	areEqual(t, indexes[0].Name, "identity_host-name")
+	areEqual(t, indexes[1].Name, "unique_host-name,network.address")
+	areEqual(t, indexes[2].Name, "index_cores")
+	areEqual(t, indexes[2].Unique, false)
+	areEqual(t, indexes[3].Name, "unique_network.address")
+
+	spec := indexes[1].spec()
+	areEqual(t, spec["key"].(bson.D)[1].Name, "value.network.address")
+	areEqual(t, spec["unique"], true)
+
+	// Unique indexes only include CIs with a value for every attribute
+	filter := spec["partialFilterExpression"].(bson.M)
+	areEqual(t, len(filter), 2)
+	areEqual(t, filter["value.host-name"].(bson.M)["$exists"], true)
+
+	spec = indexes[2].spec()
+	areEqual(t, spec["unique"], nil)
+	areEqual(t, spec["partialFilterExpression"], nil)
+
+	// Paths which include underscores do not collide
+	a := ciIndex{Name: uniqueIndexPrefix + strings.Join([]string{"a_b", "c"}, indexPathSeparator)}
+	b := ciIndex{Name: uniqueIndexPrefix + strings.Join([]string{"a", "b_c"}, indexPathSeparator)}
+	areUnequal(t, a.Name, b.Name)
+
+	// Groups may not be unique
+	citype.Attributes[3].Unique = true
+	if err := citype.Validate(); err == nil {
+		t.Errorf("Expected unique group attribute to fail validation")
+	}
+}
+
+func TestDuplicateKeyError(t *testing.T) {
+	citype := testIndexedCIType()
+	citype.Validate()
+
+	err := citype.DuplicateKeyError(errors.New(`E11000 duplicate key error collection: temp.server index: unique_network.address dup key: { : "10.0.0.1" }`))
+	fieldErr, ok := err.(*FieldError)
+	if !ok {
+		t.Fatalf("Expected a field error but got: %s", err)
+	}
+	areEqual(t, fieldErr.Path, "network.address")
+
+	// Legacy error format
+	err = citype.DuplicateKeyError(errors.New(`E11000 duplicate key error index: temp.server.$unique_host-name,network.address  dup key: { : "web01" }`))
+	areUnequal(t, err.(*FieldError), nil)
+}
+
+func TestUniqueCIAttributes(t *testing.T) {
+	typUrl := Post(t, V1Uri("/cmdbs/temp/citypes"), `{
+		"name":"Unique Test",
+		"attributes":[
+			{ "name":"serial", "type":"string", "unique":true },
+			{ "name":"description", "type":"string", "indexed":true }
+		]
+	}`)
+	defer Delete(t, typUrl)
+
+	uri := V1Uri("/cmdbs/temp/unique-test")
+	post(t, uri, `{"serial":"ABC123"}`, http.StatusCreated)
+	post(t, uri, `{"serial":"ABC123"}`, http.StatusConflict)
+	post(t, uri, `{"description":"no serial"}`, http.StatusCreated)
+	post(t, uri, `{"description":"no serial"}`, http.StatusCreated)
+}
+
+func TestUniqueCIKeys(t *testing.T) {
+	typUrl := Post(t, V1Uri("/cmdbs/temp/citypes"), `{
+		"name":"Unique Key Test",
+		"attributes":[
+			{ "name":"hostname", "type":"string" },
+			{ "name":"domain", "type":"string" }
+		],
+		"uniqueKeys":[{ "attributes":["hostname", "domain"] }]
+	}`)
+	defer Delete(t, typUrl)
+
+	// CIs without every key attribute never conflict
+	uri := V1Uri("/cmdbs/temp/unique-key-test")
+	post(t, uri, `{"hostname":"web01"}`, http.StatusCreated)
+	post(t, uri, `{"hostname":"web01"}`, http.StatusCreated)
+	post(t, uri, `{"hostname":"web01","domain":"example.com"}`, http.StatusCreated)
+	post(t, uri, `{"hostname":"web01","domain":"example.com"}`, http.StatusConflict)
+}
+
+func TestUniqueCITypeUpdate(t *testing.T) {
+	typUrl := Post(t, V1Uri("/cmdbs/temp/citypes"), `{"name":"Unique Update Test","attributes":[{"name":"serial","type":"string"}]}`)
+	defer Delete(t, typUrl)
+
+	uri := V1Uri("/cmdbs/temp/unique-update-test")
+	Post(t, uri, `{"serial":"ABC123"}`)
+	Post(t, uri, `{"serial":"ABC123"}`)
+
+	// Existing duplicates prevent the update and the original is restored
+	put(t, typUrl, `{"name":"Unique Update Test","attributes":[{"name":"serial","type":"string","unique":true}]}`, http.StatusConflict)
+	citype := Get(t, typUrl)
+	attribute := citype["attributes"].([]interface{})[0].(map[string]interface{})
+	areEqual(t, attribute["unique"], nil)
+
+	post(t, uri, `{"serial":"ABC123"}`, http.StatusCreated)
+}
@@ -0,0 +1,377 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CIAttributeSource records which data source supplied the current value of
+// an attribute of a CI and when.
+type CIAttributeSource struct {
+	Path   string    `json:"path" xml:",attr"`
+	Source string    `json:"source" xml:",attr"`
+	Time   time.Time `json:"time" xml:",attr"`
+}
+
+// CIConflict is a value for an attribute of a CI which was not used because a
+// source with higher precedence supplied a different value.
+type CIConflict struct {
+	Path   string      `json:"path" xml:",attr"`
+	Source string      `json:"source" xml:",attr"`
+	Time   time.Time   `json:"time" xml:",attr"`
+	Value  interface{} `json:"value"`
+}
+
+// MarshalXML encodes the conflicting value, which may be a map.
+func (c CIConflict) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	doc := struct {
+		Path   string    `xml:",attr"`
+		Source string    `xml:",attr"`
+		Time   time.Time `xml:",attr"`
+		Value  xmlValue
+	}{c.Path, c.Source, c.Time, xmlValue{c.Value}}
+
+	return e.EncodeElement(doc, start)
+}
+
+// CIReconcileResult is the response to data submitted by a source.
+type CIReconcileResult struct {
+	Id        string `json:"id" xml:",attr"`
+	Status    string `json:"status" xml:",attr"`
+	Conflicts int    `json:"conflicts" xml:",attr"`
+}
+
+// valuesEqual returns true if two attribute values have the same content,
+// regardless of whether they were decoded from JSON or BSON.
+func valuesEqual(a interface{}, b interface{}) bool {
+	ja, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+
+	jb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+
+	return string(ja) == string(jb)
+}
+
+// putPath sets the value at a dotted path in a CI, creating groups and
+// replacing any existing value as required.
+func putPath(fields map[string]interface{}, path string, val interface{}) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		m, ok := asMap(fields[key])
+		if !ok {
+			m = map[string]interface{}{}
+			fields[key] = m
+		}
+
+		fields = m
+	}
+
+	fields[keys[len(keys)-1]] = val
+}
+
+// ciLeafPaths returns the dotted path of each attribute value in a CI which
+// is not a group. Arrays of groups are treated as a single value.
+func ciLeafPaths(fields map[string]interface{}, schema *CITypeAttributeList, prefix string) []string {
+	paths := []string{}
+	for key, val := range fields {
+		att := schema.Get(key)
+		if att == nil || att.Computed != "" {
+			continue
+		}
+
+		if m, ok := asMap(val); ok && att.Type == "group" && !att.IsArray {
+			paths = append(paths, ciLeafPaths(m, &att.Children, prefix+key+".")...)
+		} else {
+			paths = append(paths, prefix+key)
+		}
+	}
+
+	return paths
+}
+
+// sourceRank returns the precedence of a source for an attribute, where zero
+// is the highest. The attribute's own precedence list is used if defined,
+// otherwise that of the CI Type. Unlisted sources rank below all listed
+// sources.
+func (c *CIType) sourceRank(att *CITypeAttribute, source string) int {
+	sources := c.Sources
+	if att != nil && len(att.Sources) > 0 {
+		sources = att.Sources
+	}
+
+	for i, s := range sources {
+		if s == source {
+			return i
+		}
+	}
+
+	return len(sources)
+}
+
+func (c *CI) getSource(path string) *CIAttributeSource {
+	for i := range c.Sources {
+		if c.Sources[i].Path == path {
+			return &c.Sources[i]
+		}
+	}
+
+	return nil
+}
+
+func (c *CI) setSource(path string, source string, now time.Time) {
+	if s := c.getSource(path); s != nil {
+		s.Source = source
+		s.Time = now
+		return
+	}
+
+	c.Sources = append(c.Sources, CIAttributeSource{path, source, now})
+}
+
+// setConflict records a losing value from a source, replacing any previous
+// value the source supplied for the same attribute.
+func (c *CI) setConflict(conflict CIConflict) {
+	c.removeConflict(conflict.Path, conflict.Source)
+	c.Conflicts = append(c.Conflicts, conflict)
+}
+
+func (c *CI) removeConflict(path string, source string) {
+	conflicts := c.Conflicts[:0]
+	for _, conflict := range c.Conflicts {
+		if conflict.Path != path || conflict.Source != source {
+			conflicts = append(conflicts, conflict)
+		}
+	}
+
+	c.Conflicts = conflicts
+}
+
+// Reconcile merges attribute values submitted by a source into the CI. Each
+// value replaces the current value unless the current value was supplied by a
+// source with higher precedence for the attribute. Sources with the same
+// precedence replace each other's values. Values which are not used are kept
+// as conflicts for review. Returns true if any attribute value changed.
+func (c *CI) Reconcile(citype *CIType, value map[string]interface{}, source string, now time.Time) bool {
+	if c.Value == nil {
+		c.Value = map[string]interface{}{}
+	}
+
+	changed := false
+	for _, path := range ciLeafPaths(value, &citype.Attributes, "") {
+		val := getPath(value, path)
+		current := getPath(c.Value, path)
+		att := citype.Attributes.GetByPath(path)
+
+		prev := c.getSource(path)
+		if prev != nil && prev.Source != source && citype.sourceRank(att, source) > citype.sourceRank(att, prev.Source) {
+			// Keep the current value
+			c.removeConflict(path, source)
+			if !valuesEqual(current, val) {
+				c.setConflict(CIConflict{path, source, now, val})
+			}
+
+			continue
+		}
+
+		// Keep the replaced value from another source for review
+		if prev != nil && prev.Source != source && !valuesEqual(current, val) {
+			c.setConflict(CIConflict{prev.Path, prev.Source, prev.Time, current})
+		}
+
+		c.removeConflict(path, source)
+		c.setSource(path, source, now)
+		if !valuesEqual(current, val) {
+			putPath(c.Value, path, val)
+			changed = true
+		}
+	}
+
+	// Conflicts which agree with the current values are resolved
+	conflicts := c.Conflicts[:0]
+	for _, conflict := range c.Conflicts {
+		if !valuesEqual(getPath(c.Value, conflict.Path), conflict.Value) {
+			conflicts = append(conflicts, conflict)
+		}
+	}
+	c.Conflicts = conflicts
+
+	return changed
+}
+
+// ReconcileCI merges CI data submitted by the source named in the source
+// query parameter into the existing CI identified by the identification rules
+// of its CI Type, or creates a new CI if none match.
+func ReconcileCI(res http.ResponseWriter, req *http.Request) {
+	cmdb := GetPathVar(req, "cmdb")
+	citype := GetPathVar(req, "citype")
+	source := req.URL.Query().Get("source")
+	if source == "" {
+		ErrBadRequest(res, req, errors.New("No data source specified"))
+		return
+	}
+
+	// Parse request into CI value
+	var value map[string]interface{}
+	err := Bind(req, &value)
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
+	// Get CMDB details
+	db := GetCmdbBackend(req, cmdb)
+	if db == nil {
+		log.Printf("No such CMDB found: %s", cmdb)
+		ErrNotFound(res, req)
+		return
+	}
+
+	// Get CI Type schema
+	var typ CIType
+	err = db.C(ciTypeCollection).Find(M{"shortname": citype}).One(&typ)
+	if Handle(res, req, err) {
+		log.Printf("No such CI type found: %s", citype)
+		return
+	}
+
+	if len(typ.IdentityRules) == 0 {
+		ErrBadRequest(res, req, errors.New(fmt.Sprintf("CI Type '%s' has no identification rules", citype)))
+		return
+	}
+
+	// Validate the types of the submitted fields. Defaults, required fields
+	// and validation rules are applied once the submission is merged with
+	// data from other sources so that defaults are never attributed to the
+	// source.
+	submitted := CI{Value: value}
+	err = submitted.Validate()
+	if err == nil {
+		err = validateFieldTypes(&submitted.Value, &typ.Attributes, "")
+	}
+
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
+	// Find the existing CI
+	c := db.C(citype)
+	ci, err := findIdentifiedCI(c, &typ, submitted.Value)
+	if err == ErrIdentityConflict {
+		log.Printf("Error reconciling CI: %s", err)
+		ErrConflict(res, req)
+		return
+	} else if Handle(res, req, err) {
+		return
+	}
+
+	// Merge and recompute
+	status := UpsertCreated
+	revision := 0
+	var previous map[string]interface{}
+	var conflicts []CIConflict
+	var sources []CIAttributeSource
+	if ci == nil {
+		ci = &CI{}
+		ci.InitModel()
+		ci.Reconcile(&typ, submitted.Value, source, ci.Modified)
+	} else {
+		status = UpsertUnchanged
+		revision = ci.Revision
+		previous, _ = copyValue(ci.Value).(map[string]interface{})
+		conflicts = append([]CIConflict{}, ci.Conflicts...)
+		sources = append([]CIAttributeSource{}, ci.Sources...)
+		ci.Reconcile(&typ, submitted.Value, source, time.Now())
+	}
+
+	err = applyDefaults(ci.Value, &typ.Attributes, "")
+	if err == nil {
+		err = checkRequiredFields(ci.Value, &typ.Attributes, "")
+	}
+
+	if err == nil {
+		err = computeFields(ci.Value, &typ.Attributes, ci.Value, "")
+	}
+
+	if err == nil {
+		err = checkRules(ci.Value, &typ)
+	}
+
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
+	// Any difference in the stored document is a new revision, but only
+	// differences in the value or conflicts are reported as changes. A
+	// source which supplied the same data again updates only its sources.
+	if status == UpsertUnchanged {
+		if !valuesEqual(previous, ci.Value) || !valuesEqual(conflicts, ci.Conflicts) {
+			status = UpsertUpdated
+			ci.SetModified()
+		} else if !valuesEqual(sources, ci.Sources) {
+			ci.SetModified()
+		}
+	}
+
+	// Store
+	if status == UpsertCreated {
+		err = c.Insert(ci)
+	} else if ci.Revision != revision {
+		err = UpdateRevision(c, ci.Id, revision, ci)
+	}
+
+	if HandleCIError(res, req, &typ, err) {
+		return
+	}
+
+	switch status {
+	case UpsertCreated:
+		RecordCIChange(req, ChangeCreated, cmdb, citype, ci, nil)
+	case UpsertUpdated:
+		// A new conflict is a change even if the value stayed the same
+		RecordCIChanges(newCIChange(req, ChangeUpdated, cmdb, citype, ci, previous))
+	}
+
+	result := CIReconcileResult{
+		Id:        IdToString(ci.Id),
+		Status:    status,
+		Conflicts: len(ci.Conflicts),
+	}
+
+	if status == UpsertCreated {
+		res.Header().Set("Location", V1Uri(fmt.Sprintf("/cmdbs/%s/%s/%s", cmdb, citype, result.Id)))
+		Render(res, req, http.StatusCreated, result)
+		return
+	}
+
+	Render(res, req, http.StatusOK, result)
+}
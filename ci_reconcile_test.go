@@ -0,0 +1,134 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReconcileCI(t *testing.T) {
+	citype := &CIType{
+		Name:       "Server",
+		Attributes: *testCsvSchema(),
+		Sources:    []string{"cmdb", "scanner"},
+	}
+
+	// Cores are best reported by the scanner
+	citype.Attributes[2].Sources = []string{"scanner", "cmdb"}
+
+	t0 := time.Now()
+	t1 := t0.Add(time.Minute)
+	t2 := t1.Add(time.Minute)
+
+	ci := &CI{}
+	changed := ci.Reconcile(citype, map[string]interface{}{
+		"host-name": "web01",
+		"cores":     float64(2),
+		"network":   map[string]interface{}{"address": "10.0.0.1"},
+	}, "cmdb", t0)
+
+	areEqual(t, changed, true)
+	areEqual(t, len(ci.Sources), 3)
+	areEqual(t, ci.getSource("network.address").Source, "cmdb")
+
+	// The scanner loses on host name but wins on cores
+	changed = ci.Reconcile(citype, map[string]interface{}{
+		"host-name": "WEB01",
+		"cores":     float64(4),
+	}, "scanner", t1)
+
+	areEqual(t, changed, true)
+	areEqual(t, ci.Value["host-name"], "web01")
+	areEqual(t, ci.Value["cores"], float64(4))
+	areEqual(t, ci.getSource("cores").Source, "scanner")
+	areEqual(t, ci.getSource("cores").Time, t1)
+	areEqual(t, len(ci.Conflicts), 2)
+
+	// Resubmitting the same data changes nothing
+	changed = ci.Reconcile(citype, map[string]interface{}{
+		"cores": float64(4),
+	}, "scanner", t2)
+
+	areEqual(t, changed, false)
+	areEqual(t, len(ci.Conflicts), 2)
+
+	// Conflicts are resolved when sources agree
+	ci.Reconcile(citype, map[string]interface{}{
+		"host-name": "web01",
+	}, "scanner", t2)
+
+	ci.Reconcile(citype, map[string]interface{}{
+		"cores": float64(4),
+	}, "cmdb", t2)
+
+	areEqual(t, len(ci.Conflicts), 0)
+
+	// Unlisted sources rank below listed sources
+	ci.Reconcile(citype, map[string]interface{}{
+		"host-name": "other",
+	}, "spreadsheet", t2)
+
+	areEqual(t, ci.Value["host-name"], "web01")
+	areEqual(t, len(ci.Conflicts), 1)
+	areEqual(t, ci.Conflicts[0].Source, "spreadsheet")
+	areEqual(t, ci.Conflicts[0].Value, "other")
+}
+
+func TestReconcileConflictRevision(t *testing.T) {
+	typUrl := Post(t, V1Uri("/cmdbs/temp/citypes"), `{
+		"name":"Reconcile Test",
+		"attributes":[
+			{ "name":"serial", "type":"string" },
+			{ "name":"description", "type":"string" }
+		],
+		"identityRules":[ { "attributes":["serial"] } ],
+		"sources":[ "cmdb" ]
+	}`)
+	defer Delete(t, typUrl)
+
+	reconcile := func(source string, body string) CIReconcileResult {
+		req := NewRequest("POST", V1Uri("/cmdbs/temp/reconcile-test/reconcile?source="+source), strings.NewReader(body))
+		res := httptest.NewRecorder()
+		GetServer().ServeHTTP(res, req)
+		if res.Code != http.StatusOK && res.Code != http.StatusCreated {
+			t.Fatalf("Reconcile failed with %d: %s", res.Code, res.Body.String())
+		}
+
+		var result CIReconcileResult
+		if err := json.Unmarshal(res.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	areEqual(t, reconcile("cmdb", `{"serial":"ABC123","description":"one"}`).Status, UpsertCreated)
+
+	// A losing source changes only the conflicts of the CI
+	result := reconcile("spreadsheet", `{"serial":"ABC123","description":"two"}`)
+	areEqual(t, result.Status, UpsertUpdated)
+	areEqual(t, result.Conflicts, 1)
+
+	result = reconcile("spreadsheet", `{"serial":"ABC123","description":"two"}`)
+	areEqual(t, result.Status, UpsertUnchanged)
+	areEqual(t, result.Conflicts, 1)
+}
@@ -0,0 +1,196 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// CIValidationRule is an expression which must be true for every CI of a CI
+// Type, such as decommissioned > commissioned.
+type CIValidationRule struct {
+	Name    string `json:"name" xml:",attr"`
+	Rule    string `json:"rule"`
+	Message string `json:"message,omitempty" xml:",omitempty" bson:",omitempty"`
+}
+
+// RuleError is the error returned when a CI fails a validation rule.
+type RuleError struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+func (c *RuleError) Error() string {
+	return c.Message
+}
+
+// CIRuleFailure identifies a CI which failed a validation rule.
+type CIRuleFailure struct {
+	Id      string `json:"id" xml:",attr"`
+	Message string `json:"message"`
+}
+
+// CIRuleTestResult is the outcome of testing a validation rule against the
+// existing CIs of a CI Type.
+type CIRuleTestResult struct {
+	Name     string          `json:"name" xml:",attr"`
+	Rule     string          `json:"rule"`
+	Tested   int             `json:"tested"`
+	Failed   int             `json:"failed"`
+	Failures []CIRuleFailure `json:"failures,omitempty" xml:"failure,omitempty"`
+}
+
+func (c *CIType) validateRules() error {
+	errs := ValidationErrors{}
+	for i := range c.ValidationRules {
+		rule := &c.ValidationRules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+
+		expr, err := ParseExpression(rule.Rule)
+		if err == nil {
+			err = c.validateExpressionPaths(expr, "")
+		}
+
+		if err != nil {
+			errs = errs.Add(&RuleError{rule.Name, fmt.Sprintf("Invalid validation rule '%s': %s", rule.Name, err)})
+		}
+	}
+
+	return errs.Err()
+}
+
+// Check evaluates the rule against a CI value and returns a RuleError if it
+// is not true.
+func (c *CIValidationRule) Check(fields map[string]interface{}) error {
+	expr, err := ParseExpression(c.Rule)
+	if err != nil {
+		return &RuleError{c.Name, err.Error()}
+	}
+
+	ok, err := expr.IsTrue(fields)
+	if err != nil {
+		return &RuleError{c.Name, fmt.Sprintf("Error evaluating validation rule '%s': %s", c.Name, err)}
+	}
+
+	if !ok {
+		message := c.Message
+		if message == "" {
+			message = fmt.Sprintf("CI does not satisfy validation rule '%s'", c.Name)
+		}
+
+		return &RuleError{c.Name, message}
+	}
+
+	return nil
+}
+
+// checkRules evaluates each validation rule of a CI Type against a CI value
+// and returns all failures.
+func checkRules(fields map[string]interface{}, citype *CIType) error {
+	errs := ValidationErrors{}
+	for _, rule := range citype.ValidationRules {
+		errs = errs.Add(rule.Check(fields))
+	}
+
+	return errs.Err()
+}
+
+// TestCITypeRules evaluates validation rules against every existing CI of a
+// CI Type without changing anything. Rules are taken from a JSON request body
+// of the form {"rules":[...]}, or from the CI Type if no body is given. The
+// limit query parameter sets the maximum number of failures reported for
+// each rule.
+func TestCITypeRules(res http.ResponseWriter, req *http.Request) {
+	cmdb := GetPathVar(req, "cmdb")
+	name := GetPathVar(req, "name")
+
+	// Get CMDB details
+	db := GetCmdbBackend(req, cmdb)
+	if db == nil {
+		log.Printf("No such CMDB found: %s", cmdb)
+		ErrNotFound(res, req)
+		return
+	}
+
+	// Get CI Type schema
+	var typ CIType
+	err := db.C(ciTypeCollection).Find(M{"shortname": name}).One(&typ)
+	if Handle(res, req, err) {
+		return
+	}
+
+	// Parse the rules to test
+	if req.ContentLength != 0 {
+		var body struct {
+			Rules []CIValidationRule `json:"rules"`
+		}
+
+		err = Bind(req, &body)
+		if err != nil {
+			ErrBadRequest(res, req, err)
+			return
+		}
+
+		typ.ValidationRules = body.Rules
+	}
+
+	err = typ.validateRules()
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
+	limit, err := GetRequestLimit(req, 100)
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
+	results := make([]CIRuleTestResult, len(typ.ValidationRules))
+	for i, rule := range typ.ValidationRules {
+		results[i] = CIRuleTestResult{Name: rule.Name, Rule: rule.Rule, Failures: []CIRuleFailure{}}
+	}
+
+	var ci CI
+	iter := db.C(name).Find(nil).Iter()
+	for iter.Next(&ci) {
+		for i, rule := range typ.ValidationRules {
+			result := &results[i]
+			result.Tested++
+			if err := rule.Check(ci.Value); err != nil {
+				result.Failed++
+				if len(result.Failures) < limit {
+					result.Failures = append(result.Failures, CIRuleFailure{IdToString(ci.Id), err.Error()})
+				}
+			}
+		}
+
+		ci = CI{}
+	}
+
+	err = iter.Close()
+	if Handle(res, req, err) {
+		return
+	}
+
+	Render(res, req, http.StatusOK, results)
+}
@@ -0,0 +1,92 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"testing"
+)
+
+func testRulesCIType() *CIType {
+	return &CIType{
+		Name: "Server",
+		Attributes: CITypeAttributeList{
+			{Name: "environment", Type: "string"},
+			{Name: "owner", Type: "string"},
+			{Name: "commissioned", Type: "timestamp"},
+			{Name: "decommissioned", Type: "timestamp"},
+		},
+		ValidationRules: []CIValidationRule{
+			{
+				Name:    "owner-required",
+				Rule:    `environment != "production" || owner != null`,
+				Message: "Production servers must have an owner",
+			},
+			{
+				Rule: `decommissioned == null || decommissioned > commissioned`,
+			},
+		},
+	}
+}
+
+func TestValidateRulesCIType(t *testing.T) {
+	citype := testRulesCIType()
+	err := citype.Validate()
+	if err != nil {
+		t.Fatalf("Expected CI Type to validate but got: %s", err)
+	}
+
+	areEqual(t, citype.ValidationRules[1].Name, "rule-1")
+
+	for _, rule := range []string{`owner ==`, `nosuchattribute > 1`} {
+		citype := testRulesCIType()
+		citype.ValidationRules = []CIValidationRule{{Rule: rule}}
+		if err := citype.Validate(); err == nil {
+			t.Errorf("Expected rule to fail validation: %s", rule)
+		}
+	}
+}
+
+func TestCheckRules(t *testing.T) {
+	citype := testRulesCIType()
+	citype.Validate()
+
+	ci := CI{Value: map[string]interface{}{
+		"environment":    "production",
+		"owner":          "ops",
+		"commissioned":   "1000",
+		"decommissioned": "2000",
+	}}
+
+	err := validateCI(&ci, citype)
+	if err != nil {
+		t.Fatalf("Expected CI to validate but got: %s", err)
+	}
+
+	// All failed rules are reported with custom or default messages
+	ci = CI{Value: map[string]interface{}{
+		"environment":    "production",
+		"commissioned":   "2000",
+		"decommissioned": "1000",
+	}}
+
+	problems := GetValidationProblems(validateCI(&ci, citype))
+	areEqual(t, len(problems), 2)
+	areEqual(t, problems[0].Rule, "owner-required")
+	areEqual(t, problems[0].Message, "Production servers must have an owner")
+	areEqual(t, problems[1].Rule, "rule-1")
+}
@@ -19,6 +19,7 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"testing"
 )
 
@@ -62,3 +63,20 @@ func TestCI(t *testing.T) {
 	body = `{"alphanumeric":"abc123","number":"123"}`
 	PostInvalid(t, uri, body)
 }
+
+func TestCIDryRun(t *testing.T) {
+	// Create temporary CI Type
+	typUrl := Post(t, V1Uri("/cmdbs/temp/citypes"), LoadTestFixture("citype-test.json"))
+	defer Delete(t, typUrl)
+
+	// Valid CIs are normalised but not stored
+	uri := V1Uri(fmt.Sprintf("/cmdbs/temp/%s?dryRun=true", ciType))
+	post(t, uri, `{"number":"123", "required":"yes"}`, http.StatusOK)
+
+	// All problems are reported
+	post(t, uri, `{"number":1, "timestamp":"The day after tomorrow"}`, http.StatusBadRequest)
+
+	// CI Types
+	post(t, V1Uri("/cmdbs/temp/citypes?dryRun=true"), `{"name":"Dry Run","attributes":[{"name":"a","type":"string"}]}`, http.StatusOK)
+	put(t, typUrl+"?dryRun=true", `{"name":"Test CI Type","attributes":[{"name":"a"}]}`, http.StatusBadRequest)
+}
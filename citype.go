@@ -20,6 +20,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"strings"
 )
@@ -28,6 +29,10 @@ const (
 	ciTypeCollection = "citypes"
 )
 
+// Path segments which follow a CMDB name in the API but are not CI Types. CI
+// Types may not be given these names as their routes would be unreachable.
+var ciTypeReservedNames = []string{"changes", "citypes", "graphql", "search", "webhooks"}
+
 type CIType struct {
 	model `json:"-" bson:",inline"`
 
@@ -35,6 +40,14 @@ type CIType struct {
 	ShortName   string              `json:"shortName,omitempty"`
 	Description string              `json:"description,omitempty" xml:",omitempty" bson:",omitempty"`
 	Attributes  CITypeAttributeList `json:"attributes,omitempty" xml:"attribute"`
+
+	IdentityRules []CIIdentityRule `json:"identityRules,omitempty" xml:"identityRule,omitempty" bson:",omitempty"`
+	UniqueKeys    []CIUniqueKey    `json:"uniqueKeys,omitempty" xml:"uniqueKey,omitempty" bson:",omitempty"`
+
+	ValidationRules []CIValidationRule `json:"validationRules,omitempty" xml:"validationRule,omitempty" bson:",omitempty"`
+
+	// Data sources in order of precedence
+	Sources []string `json:"sources,omitempty" xml:"source,omitempty" bson:",omitempty"`
 }
 
 type CITypeAttribute struct {
@@ -46,11 +59,22 @@ type CITypeAttribute struct {
 
 	// Common Options
 	Required bool `json:"required,omitempty" xml:",omitempty" bson:",omitempty"`
+	Unique   bool `json:"unique,omitempty" xml:",omitempty" bson:",omitempty"`
+	Indexed  bool `json:"indexed,omitempty" xml:",omitempty" bson:",omitempty"`
 
 	IsArray  bool `json:"isArray,omitempty" xml:",omitempty" bson:",omitempty"`
 	MinCount int  `json:"minCount,omitempty" xml:",omitempty" bson:",omitempty"`
 	MaxCount int  `json:"maxCount,omitempty" xml:",omitempty" bson:",omitempty"`
 
+	// Data sources in order of precedence, overriding those of the CI Type
+	Sources []string `json:"sources,omitempty" xml:"source,omitempty" bson:",omitempty"`
+
+	// Value used when the attribute is absent
+	Default interface{} `json:"default,omitempty" xml:",omitempty" bson:",omitempty"`
+
+	// Expression which computes the value of a read-only attribute
+	Computed string `json:"computed,omitempty" xml:",omitempty" bson:",omitempty"`
+
 	// Group options
 	Singular string `json:"singular,omitempty" xml:",omitempty" bson:",omitempty"`
 
@@ -63,6 +87,9 @@ type CITypeAttribute struct {
 	Units    string  `json:"units,omitempty" xml:",omitempty" bson:",omitempty"`
 	MinValue float64 `json:"minValue,omitempty" xml:",omitempty" bson:",omitempty"`
 	MaxValue float64 `json:"maxValue,omitempty" xml:",omitempty" bson:",omitempty"`
+
+	// Reference options
+	Target string `json:"target,omitempty" xml:",omitempty" bson:",omitempty"`
 }
 
 type CITypeAttributeList []CITypeAttribute
@@ -78,6 +105,27 @@ func (c *CITypeAttributeList) Get(name string) *CITypeAttribute {
 	return nil
 }
 
+// GetByPath returns the attribute at the given dotted path of group
+// attributes, or nil if no such attribute exists.
+func (c *CITypeAttributeList) GetByPath(path string) *CITypeAttribute {
+	atts := c
+	var att *CITypeAttribute
+	for _, name := range strings.Split(path, ".") {
+		if atts == nil {
+			return nil
+		}
+
+		att = atts.Get(name)
+		if att == nil {
+			return nil
+		}
+
+		atts = &att.Children
+	}
+
+	return att
+}
+
 func (c *CIType) Validate() error {
 	if c.Name == "" {
 		return errors.New("No CI Type name specified")
@@ -91,50 +139,85 @@ func (c *CIType) Validate() error {
 		return errors.New("Invalid characters in CI Type name")
 	}
 
+	if containsString(ciTypeReservedNames, c.ShortName) {
+		return errors.New(fmt.Sprintf("CI Type name '%s' is reserved", c.ShortName))
+	}
+
 	// Validate each attribute
 	err := c.validateAttributes(&c.Attributes, "")
 	if err != nil {
 		return err
 	}
 
-	return nil
+	// Validate everything which refers to the attributes
+	errs := ValidationErrors{}
+	errs = errs.Add(c.validateComputedPaths(&c.Attributes, "", false))
+	errs = errs.Add(c.validateRules())
+	errs = errs.Add(c.validateIdentityRules())
+	errs = errs.Add(c.validateUniqueKeys())
+
+	return errs.Err()
 }
 
+// validateAttributes validates each attribute and returns all problems
+// found.
 func (c *CIType) validateAttributes(atts *CITypeAttributeList, path string) error {
+	errs := ValidationErrors{}
 	for index, _ := range *atts {
 		// Derefence the attribute so it may be modified
 		att := &(*atts)[index]
+		errs = errs.Add(c.validateAttribute(att, path))
+	}
 
-		if att.Name == "" {
-			return errors.New("No attribute name specified")
-		}
+	return errs.Err()
+}
 
-		att.ShortName = GetShortName(att.Name)
-		if !IsValidShortName(att.ShortName) {
-			return errors.New(fmt.Sprintf("Invalid characters in CI Attribute '%s%s'", path, att.ShortName))
-		}
+func (c *CIType) validateAttribute(att *CITypeAttribute, path string) error {
+	if att.Name == "" {
+		return errors.New("No attribute name specified")
+	}
 
-		// Validate format
-		if att.Type == "" {
-			return errors.New(fmt.Sprintf("No type specified for CI Attribute '%s%s'", path, att.ShortName))
-		}
+	att.ShortName = GetShortName(att.Name)
+	if !IsValidShortName(att.ShortName) {
+		return errors.New(fmt.Sprintf("Invalid characters in CI Attribute '%s%s'", path, att.ShortName))
+	}
 
-		if GetAttributeFormat(att.Type) == nil {
-			return errors.New(fmt.Sprintf("Unsupported attribute format '%s' for CI Attribute '%s%s'", att.Type, path, att.ShortName))
-		}
+	// Validate format
+	if att.Type == "" {
+		return errors.New(fmt.Sprintf("No type specified for CI Attribute '%s%s'", path, att.ShortName))
+	}
 
-		// Validate children
-		if att.Type == "group" {
-			err := c.validateAttributes(&att.Children, fmt.Sprintf("%s.", att.ShortName))
-			if err != nil {
-				return err
-			}
-		} else if len(att.Children) > 0 {
-			return errors.New(fmt.Sprintf("CI Attribute '%s%s' has children but is not a group attribute", path, att.ShortName))
+	if GetAttributeFormat(att.Type) == nil {
+		return errors.New(fmt.Sprintf("Unsupported attribute format '%s' for CI Attribute '%s%s'", att.Type, path, att.ShortName))
+	}
+
+	// Validate constraints
+	if att.Type == "group" && (att.Unique || att.Indexed) {
+		return errors.New(fmt.Sprintf("Group CI Attribute '%s%s' may not be unique or indexed", path, att.ShortName))
+	}
+
+	if att.Type == "reference" {
+		att.Target = GetShortName(att.Target)
+		if att.Target == "" {
+			return errors.New(fmt.Sprintf("No target CI Type specified for reference CI Attribute '%s%s'", path, att.ShortName))
 		}
+	} else if att.Target != "" {
+		return errors.New(fmt.Sprintf("CI Attribute '%s%s' has a target CI Type but is not a reference attribute", path, att.ShortName))
 	}
 
-	return nil
+	// Validate default and computed values
+	errs := ValidationErrors{}
+	errs = errs.Add(c.validateDefault(att, path))
+	errs = errs.Add(c.validateComputed(att, path))
+
+	// Validate children
+	if att.Type == "group" {
+		errs = errs.Add(c.validateAttributes(&att.Children, fmt.Sprintf("%s%s.", path, att.ShortName)))
+	} else if len(att.Children) > 0 {
+		errs = errs.Add(errors.New(fmt.Sprintf("CI Attribute '%s%s' has children but is not a group attribute", path, att.ShortName)))
+	}
+
+	return errs.Err()
 }
 
 func GetCITypes(res http.ResponseWriter, req *http.Request) {
@@ -193,6 +276,11 @@ func GetCITypeByName(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// Partial documents are tagged by their content
+	if sel == nil {
+		SetETag(res, &citype.model)
+	}
+
 	Render(res, req, http.StatusOK, citype)
 }
 
@@ -200,13 +288,19 @@ func AddCIType(res http.ResponseWriter, req *http.Request) {
 	// Parse request into CIType
 	var citype CIType
 	err := Bind(req, &citype)
-	if Handle(res, req, err) {
+	if err != nil {
+		ErrBadRequest(res, req, err)
 		return
 	}
 	citype.InitModel()
 
 	// Validate
 	err = citype.Validate()
+	if IsDryRun(req) {
+		RenderValidationResult(res, req, citype, err)
+		return
+	}
+
 	if err != nil {
 		ErrBadRequest(res, req, err)
 		return
@@ -226,6 +320,17 @@ func AddCIType(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// Create indexes for the new type
+	err = ensureCIIndexes(db, &citype)
+	if err != nil {
+		db.C(ciTypeCollection).RemoveId(citype.Id)
+	}
+
+	if HandleCIError(res, req, &citype, err) {
+		return
+	}
+
+	RecordBusEvent(req, BusKindCIType, ChangeCreated, cmdb, citype.ShortName, citype.Revision, &citype)
 	RenderCreated(res, req, V1Uri(fmt.Sprintf("/cmdbs/%s/citypes/%s", cmdb, citype.ShortName)))
 }
 
@@ -233,12 +338,18 @@ func UpdateCITypeByName(res http.ResponseWriter, req *http.Request) {
 	// Parse request into CIType
 	var citype CIType
 	err := Bind(req, &citype)
-	if Handle(res, req, err) {
+	if err != nil {
+		ErrBadRequest(res, req, err)
 		return
 	}
 
 	// Skip InitModel() but still validate
 	err = citype.Validate()
+	if IsDryRun(req) {
+		RenderValidationResult(res, req, citype, err)
+		return
+	}
+
 	if err != nil {
 		ErrBadRequest(res, req, err)
 		return
@@ -260,24 +371,56 @@ func UpdateCITypeByName(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if CheckIfMatch(res, req, &orig.model) {
+		return
+	}
+
 	// Prepare the new record
 	citype.Id = orig.Id
 	citype.Created = orig.Created
+	citype.Revision = orig.Revision
 	citype.ShortName = GetShortName(citype.Name)
 	citype.InitModel()
 
-	// Update
-	err = db.C(ciTypeCollection).Update(M{"_id": orig.Id}, &citype)
+	// Update unless modified by another request since it was fetched
+	err = UpdateRevision(db.C(ciTypeCollection), orig.Id, orig.Revision, &citype)
 	if Handle(res, req, err) {
 		return
 	}
 
+	// Existing CIs which violate a new unique constraint prevent the update,
+	// so the original CI Type and its indexes are restored
+	err = ensureCIIndexes(db, &citype)
+	if err != nil {
+		if rerr := UpdateRevision(db.C(ciTypeCollection), orig.Id, citype.Revision, &orig); rerr != nil {
+			log.Printf("Error restoring CI Type %s: %s", orig.ShortName, rerr)
+		} else if rerr = ensureCIIndexes(db, &orig); rerr != nil {
+			log.Printf("Error restoring the indexes of CI Type %s: %s", orig.ShortName, rerr)
+		}
+	}
+
+	if HandleCIError(res, req, &citype, err) {
+		return
+	}
+
+	// Index the CIs by the attributes of the new schema
+	if citype.ShortName != orig.ShortName {
+		db.C(searchCollection).RemoveAll(M{"citype": orig.ShortName})
+	}
+
+	_, err = ReindexCIType(db, &citype)
+	if err != nil {
+		log.Printf("Error updating the search index for CI Type %s: %s", citype.ShortName, err)
+	}
+
 	// Compute the new URL
 	location := ""
 	if citype.ShortName != orig.ShortName {
 		location = V1Uri(fmt.Sprintf("/cmdbs/%s/citypes/%s", cmdb, citype.ShortName))
 	}
 
+	RecordBusEvent(req, BusKindCIType, ChangeUpdated, cmdb, citype.ShortName, citype.Revision, &citype)
+	SetETag(res, &citype.model)
 	RenderUpdated(res, req, location)
 }
 
@@ -292,8 +435,19 @@ func DeleteCITypeByName(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// Fetch the current revision
+	var citype CIType
+	err := db.C(ciTypeCollection).Find(M{"shortname": name}).Select(M{"revision": 1}).One(&citype)
+	if Handle(res, req, err) {
+		return
+	}
+
+	if CheckIfMatch(res, req, &citype.model) {
+		return
+	}
+
 	// Remove CI Type entry
-	err := db.C(ciTypeCollection).Remove(M{"shortname": name})
+	err = RemoveRevision(db.C(ciTypeCollection), citype.Id, citype.Revision)
 	if Handle(res, req, err) {
 		return
 	}
@@ -304,5 +458,11 @@ func DeleteCITypeByName(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	_, err = db.C(searchCollection).RemoveAll(M{"citype": name})
+	if err != nil {
+		log.Printf("Error removing CI Type %s from the search index: %s", name, err)
+	}
+
+	RecordBusEvent(req, BusKindCIType, ChangeDeleted, cmdb, name, citype.Revision, nil)
 	Render(res, req, http.StatusNoContent, "")
 }
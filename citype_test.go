@@ -77,3 +77,19 @@ func TestCrudCITypes(t *testing.T) {
 	body := LoadTestFixture("citype.json")
 	Crud(t, uri, body, true)
 }
+
+func TestReservedCITypeNames(t *testing.T) {
+	for _, name := range []string{"Changes", "citypes", "GraphQL", "search", "Webhooks"} {
+		citype := CIType{Name: name}
+		if err := citype.Validate(); err == nil {
+			t.Errorf("Expected CI Type name '%s' to be reserved", name)
+		}
+	}
+
+	citype := CIType{Name: "Search Results"}
+	areEqual(t, citype.Validate(), nil)
+}
+
+func TestMalformedCIType(t *testing.T) {
+	PostInvalid(t, V1Uri("/cmdbs/temp/citypes"), `{"name":`)
+}
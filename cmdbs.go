@@ -20,6 +20,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"gopkg.in/mgo.v2"
 	"log"
 	"net/http"
 )
@@ -77,6 +78,7 @@ func GetCmdbByName(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	SetETag(res, &cmdb.model)
 	Render(res, req, http.StatusOK, cmdb)
 }
 
@@ -86,7 +88,8 @@ func AddCmdb(res http.ResponseWriter, req *http.Request) {
 	// Parse request and bind to Cmdb{}
 	var cmdb Cmdb
 	err := Bind(req, &cmdb)
-	if Handle(res, req, err) {
+	if err != nil {
+		ErrBadRequest(res, req, err)
 		return
 	}
 
@@ -122,6 +125,7 @@ func AddCmdb(res http.ResponseWriter, req *http.Request) {
 	}
 
 	// Tell the world
+	RecordBusEvent(req, BusKindCmdb, ChangeCreated, cmdb.ShortName, cmdb.ShortName, cmdb.Revision, &cmdb)
 	RenderCreated(res, req, V1Uri(fmt.Sprintf("/cmdbs/%s", cmdb.ShortName)))
 }
 
@@ -135,8 +139,17 @@ func DeleteCmdbByName(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if CheckIfMatch(res, req, &cmdb.model) {
+		return
+	}
+
+	// Remove unless replaced by another request
 	field := fmt.Sprintf("cmdbs.%s", cmdb.ShortName)
-	mgoErr := RootDb().C("tenants").Update(M{"_id": auth.User.TenantId}, M{"$unset": M{field: ""}})
+	mgoErr := RootDb().C("tenants").Update(M{"_id": auth.User.TenantId, field + "._id": cmdb.Id}, M{"$unset": M{field: ""}})
+	if mgoErr == mgo.ErrNotFound {
+		mgoErr = ErrStaleRevision
+	}
+
 	if Handle(res, req, mgoErr) {
 		return
 	}
@@ -147,5 +160,6 @@ func DeleteCmdbByName(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	RecordBusEvent(req, BusKindCmdb, ChangeDeleted, cmdb.ShortName, cmdb.ShortName, cmdb.Revision, nil)
 	Render(res, req, http.StatusNoContent, "")
 }
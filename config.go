@@ -27,12 +27,22 @@ import (
 type Config struct {
 	Server   ServerConfig   `json:"server"`
 	Database DatabaseConfig `json:"database"`
+	Auth     AuthConfig     `json:"auth"`
+	Bus      BusConfig      `json:"bus"`
 }
 
 type ServerConfig struct {
-	Production bool   `json:"production"`
-	ListenOn   string `json:"listenOn"`
-	ListenPort int    `json:"listenPort"`
+	Production          bool   `json:"production"`
+	ListenOn            string `json:"listenOn"`
+	ListenPort          int    `json:"listenPort"`
+	TrustProxy          bool   `json:"trustProxy"`
+	SessionTimeout      int    `json:"sessionTimeout"`
+	LoginMaxFailures    int    `json:"loginMaxFailures"`
+	LoginMaxIpFailures  int    `json:"loginMaxIpFailures"`
+	LoginBackoff        int    `json:"loginBackoff"`
+	LoginLockout        int    `json:"loginLockout"`
+	RequireIfMatch      bool   `json:"requireIfMatch"`
+	WebhookAllowPrivate bool   `json:"webhookAllowPrivate"`
 }
 
 type DatabaseConfig struct {
@@ -44,6 +54,49 @@ type DatabaseConfig struct {
 	Password string   `json:"password"`
 }
 
+type AuthConfig struct {
+	Providers []string   `json:"providers"`
+	Ldap      LdapConfig `json:"ldap"`
+	Oidc      OidcConfig `json:"oidc"`
+}
+
+type LdapConfig struct {
+	Url          string            `json:"url"`
+	StartTLS     bool              `json:"startTLS"`
+	BindDN       string            `json:"bindDN"`
+	BindPassword string            `json:"bindPassword"`
+	BaseDN       string            `json:"baseDN"`
+	UserFilter   string            `json:"userFilter"`
+	GroupMap     map[string]string `json:"groupMap"`
+	TenantCode   string            `json:"tenantCode"`
+	Provision    bool              `json:"provision"`
+}
+
+type OidcConfig struct {
+	Issuer       string            `json:"issuer"`
+	ClientId     string            `json:"clientId"`
+	ClientSecret string            `json:"clientSecret"`
+	RedirectUrl  string            `json:"redirectUrl"`
+	Scopes       []string          `json:"scopes"`
+	TenantClaim  string            `json:"tenantClaim"`
+	TenantMap    map[string]string `json:"tenantMap"`
+	TenantCode   string            `json:"tenantCode"`
+	RoleClaim    string            `json:"roleClaim"`
+	RoleMap      map[string]string `json:"roleMap"`
+	Provision    bool              `json:"provision"`
+}
+
+// BusConfig selects the message bus to which changes are published. Driver
+// is one of amqp, nats or memory, or empty to disable publishing. CI commands
+// are consumed from CommandQueue if it is set.
+type BusConfig struct {
+	Driver       string `json:"driver"`
+	Url          string `json:"url"`
+	Exchange     string `json:"exchange"`
+	Prefix       string `json:"prefix"`
+	CommandQueue string `json:"commandQueue"`
+}
+
 // default config file path
 var confFilePath string = ""
 
@@ -83,10 +136,31 @@ func GetConfig() (*Config, error) {
 
 		// Configuration defaults
 		config = &Config{
+			Server: ServerConfig{
+				SessionTimeout:     480,
+				LoginMaxFailures:   5,
+				LoginMaxIpFailures: 50,
+				LoginBackoff:       1,
+				LoginLockout:       900,
+			},
 			Database: DatabaseConfig{
 				Driver:   "mongodb",
 				Database: "alexandria",
 			},
+			Auth: AuthConfig{
+				Providers: []string{"local"},
+				Ldap: LdapConfig{
+					UserFilter: "(&(objectClass=person)(|(mail=%s)(sAMAccountName=%s)))",
+				},
+				Oidc: OidcConfig{
+					Scopes:    []string{"openid", "email", "profile"},
+					RoleClaim: "groups",
+				},
+			},
+			Bus: BusConfig{
+				Exchange: defaultBusPrefix,
+				Prefix:   defaultBusPrefix,
+			},
 		}
 
 		// Apply JSON config file
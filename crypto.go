@@ -48,6 +48,18 @@ func RandomSalt() []byte {
 	return salt
 }
 
+// RandomToken returns a URL safe string encoding the given number of random
+// bytes.
+func RandomToken(size int) string {
+	b := make([]byte, size)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
 func HashPasswordWithSalt(password string, salt []byte) string {
 	// Prepend the salt with the password
 	salted := append(salt, []byte(password)...)
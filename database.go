@@ -124,6 +124,35 @@ func BootStrap(answers *Answers) error {
 	db.C("users").EnsureIndex(mgo.Index{Key: []string{"apikey"}, Unique: true})
 	db.C("users").EnsureIndex(mgo.Index{Key: []string{"tenantid"}, Unique: false})
 
+	db.C("sessions").Create(&mgo.CollectionInfo{})
+	db.C("sessions").EnsureIndex(mgo.Index{Key: []string{"token"}, Unique: true})
+	db.C("sessions").EnsureIndex(mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second})
+
+	db.C("securityevents").Create(&mgo.CollectionInfo{})
+	db.C("securityevents").EnsureIndex(mgo.Index{Key: []string{"tenantid", "-time"}, Unique: false})
+
+	db.C("audit").Create(&mgo.CollectionInfo{})
+	db.C("audit").EnsureIndex(mgo.Index{Key: []string{"tenantid", "sequence"}, Unique: true})
+
+	db.C("changes").Create(&mgo.CollectionInfo{})
+	db.C("changes").EnsureIndex(mgo.Index{Key: []string{"tenantid", "sequence"}, Unique: true})
+	db.C("changes").EnsureIndex(mgo.Index{Key: []string{"time"}, ExpireAfter: changeRetention})
+
+	db.C("webhooks").EnsureIndex(mgo.Index{Key: []string{"tenantid", "cmdb", "shortname"}, Unique: true})
+	db.C("webhookdeliveries").EnsureIndex(mgo.Index{Key: []string{"status", "nextattempt"}, Unique: false})
+	db.C("webhookdeliveries").EnsureIndex(mgo.Index{Key: []string{"webhookid", "-created"}, Unique: false})
+	db.C("webhookdeliveries").EnsureIndex(mgo.Index{Key: []string{"created"}, ExpireAfter: webhookRetention})
+
+	db.C("outbox").EnsureIndex(mgo.Index{Key: []string{"status", "created"}, Unique: false})
+	db.C("outbox").EnsureIndex(mgo.Index{Key: []string{"published"}, ExpireAfter: outboxRetention})
+
+	db.C("loginfailures").Create(&mgo.CollectionInfo{})
+	db.C("loginfailures").EnsureIndex(mgo.Index{Key: []string{"key"}, Unique: true})
+
+	db.C("oidclogins").Create(&mgo.CollectionInfo{})
+	db.C("oidclogins").EnsureIndex(mgo.Index{Key: []string{"state"}, Unique: true})
+	db.C("oidclogins").EnsureIndex(mgo.Index{Key: []string{"created"}, ExpireAfter: oidcLoginTimeout})
+
 	// Create default tenant
 	tenant := Tenant{
 		Name: answers.Tenant.Name,
@@ -141,6 +170,7 @@ func BootStrap(answers *Answers) error {
 		LastName:     answers.User.LastName,
 		Email:        answers.User.Email,
 		PasswordHash: HashPassword(answers.User.Password),
+		Roles:        []string{RoleAdmin},
 	}
 	user.InitModel()
 	user.TenantId = tenant.Id
@@ -199,6 +229,12 @@ func CreateCmdb(name string) error {
 		return err
 	}
 
+	// Create search index
+	err = ensureSearchIndexes(db)
+	if err != nil {
+		return err
+	}
+
 	return err
 }
 
@@ -0,0 +1,205 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"net/http"
+	"strings"
+)
+
+// ErrStaleRevision is returned when a document is modified or removed by
+// another request between being read and written.
+var ErrStaleRevision = errors.New("The resource has been modified by another request")
+
+// ETag returns a strong entity tag which changes with each revision of the
+// model.
+func (c *model) ETag() string {
+	id := ""
+	if c.Id != nil {
+		id = IdToString(c.Id)
+	}
+
+	return fmt.Sprintf("\"%s-%d\"", id, c.Revision)
+}
+
+// SetETag sets the ETag header of a response to the entity tag of the given
+// model.
+func SetETag(res http.ResponseWriter, m *model) {
+	res.Header().Set("ETag", m.ETag())
+}
+
+// contentETag returns a weak entity tag derived from the content of a
+// response.
+func contentETag(data []byte) string {
+	return fmt.Sprintf("W/\"%x\"", sha1.Sum(data))
+}
+
+// parseETags returns the entity tags listed in an If-Match or If-None-Match
+// header. Malformed tags are ignored.
+func parseETags(header string) []string {
+	tags := []string{}
+	for header != "" {
+		header = strings.TrimLeft(header, " \t,")
+		if header == "" {
+			break
+		}
+
+		if header[0] == '*' {
+			tags = append(tags, "*")
+			header = header[1:]
+			continue
+		}
+
+		start := 0
+		if strings.HasPrefix(header, "W/") {
+			start = 2
+		}
+
+		if len(header) <= start || header[start] != '"' {
+			// Skip to the next tag
+			i := strings.Index(header, ",")
+			if i < 0 {
+				break
+			}
+			header = header[i:]
+			continue
+		}
+
+		end := strings.Index(header[start+1:], "\"")
+		if end < 0 {
+			break
+		}
+
+		end += start + 2
+		tags = append(tags, header[:end])
+		header = header[end:]
+	}
+
+	return tags
+}
+
+// etagMatches returns true if the given entity tag matches any of the tags in
+// an If-Match or If-None-Match header. Weak tags never match when using the
+// strong comparison.
+func etagMatches(header string, etag string, weak bool) bool {
+	for _, tag := range parseETags(header) {
+		if tag == "*" {
+			return true
+		}
+
+		if weak {
+			if strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		} else if tag == etag && !strings.HasPrefix(tag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requireIfMatch returns true if the server is configured to require
+// If-Match headers on requests which modify resources.
+func requireIfMatch() bool {
+	config, err := GetConfig()
+	return err == nil && config.Server.RequireIfMatch
+}
+
+// CheckIfMatch evaluates the If-Match precondition of a request to modify
+// the given model, which is nil if the resource does not exist. If the
+// precondition fails, an error is rendered and true is returned.
+func CheckIfMatch(res http.ResponseWriter, req *http.Request, m *model) bool {
+	header := req.Header.Get("If-Match")
+	if header == "" {
+		if requireIfMatch() {
+			ErrPreconditionRequired(res, req)
+			return true
+		}
+
+		return false
+	}
+
+	if m == nil || !etagMatches(header, m.ETag(), false) {
+		ErrPreconditionFailed(res, req)
+		return true
+	}
+
+	return false
+}
+
+// CheckIfNoneMatch evaluates the If-None-Match precondition of a request to
+// create or modify the given model, which is nil if the resource does not
+// exist. If-None-Match: * succeeds only if the resource does not exist. If
+// the precondition fails, an error is rendered and true is returned.
+func CheckIfNoneMatch(res http.ResponseWriter, req *http.Request, m *model) bool {
+	header := req.Header.Get("If-None-Match")
+	if header == "" || m == nil {
+		return false
+	}
+
+	if etagMatches(header, m.ETag(), true) {
+		ErrPreconditionFailed(res, req)
+		return true
+	}
+
+	return false
+}
+
+// HasPrecondition returns true if the If-Match precondition of a request
+// must be evaluated.
+func HasPrecondition(req *http.Request) bool {
+	return req.Header.Get("If-Match") != "" || requireIfMatch()
+}
+
+// revisionQuery selects the document with the given id only if it is at the
+// given revision. Documents created before revisions were introduced have no
+// revision and are at revision zero.
+func revisionQuery(id interface{}, revision int) M {
+	if revision == 0 {
+		return M{"_id": id, "revision": M{"$in": []interface{}{0, nil}}}
+	}
+
+	return M{"_id": id, "revision": revision}
+}
+
+// UpdateRevision applies an update to the document with the given id only if
+// it is still at the given revision.
+func UpdateRevision(c *mgo.Collection, id interface{}, revision int, update interface{}) error {
+	err := c.Update(revisionQuery(id, revision), update)
+	if err == mgo.ErrNotFound {
+		return ErrStaleRevision
+	}
+
+	return err
+}
+
+// RemoveRevision removes the document with the given id only if it is still
+// at the given revision.
+func RemoveRevision(c *mgo.Collection, id interface{}, revision int) error {
+	err := c.Remove(revisionQuery(id, revision))
+	if err == mgo.ErrNotFound {
+		return ErrStaleRevision
+	}
+
+	return err
+}
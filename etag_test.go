@@ -0,0 +1,170 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseETags(t *testing.T) {
+	tags := parseETags(` "a-1", W/"b,2" ,*, bad, "c"`)
+	areEqual(t, strings.Join(tags, "|"), `"a-1"|W/"b,2"|*|"c"`)
+	areEqual(t, len(parseETags("")), 0)
+	areEqual(t, len(parseETags(`"unterminated`)), 0)
+}
+
+func TestETagMatches(t *testing.T) {
+	areEqual(t, etagMatches(`"a", "b"`, `"b"`, false), true)
+	areEqual(t, etagMatches(`"a"`, `"b"`, false), false)
+	areEqual(t, etagMatches(`*`, `"b"`, false), true)
+	areEqual(t, etagMatches(`W/"b"`, `"b"`, false), false)
+	areEqual(t, etagMatches(`W/"b"`, `"b"`, true), true)
+	areEqual(t, etagMatches(`"b"`, `W/"b"`, true), true)
+}
+
+func TestModelRevision(t *testing.T) {
+	var m model
+	m.InitModel()
+	areEqual(t, m.Revision, 1)
+
+	etag := m.ETag()
+	m.SetModified()
+	areEqual(t, m.Revision, 2)
+	areUnequal(t, m.ETag(), etag)
+
+	req := httptest.NewRequest("PUT", "/", nil)
+	res := httptest.NewRecorder()
+	areEqual(t, CheckIfMatch(res, req, &m), false)
+
+	req.Header.Set("If-Match", m.ETag())
+	areEqual(t, CheckIfMatch(res, req, &m), false)
+
+	req.Header.Set("If-Match", etag)
+	areEqual(t, CheckIfMatch(res, req, &m), true)
+	areEqual(t, res.Code, http.StatusPreconditionFailed)
+
+	// Resources which do not exist never match
+	req.Header.Set("If-Match", "*")
+	res = httptest.NewRecorder()
+	areEqual(t, CheckIfMatch(res, req, nil), true)
+	areEqual(t, res.Code, http.StatusPreconditionFailed)
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	// Content derived entity tags
+	req := httptest.NewRequest("GET", "/", nil)
+	res := httptest.NewRecorder()
+	Render(res, req, http.StatusOK, M{"a": 1})
+
+	etag := res.Header().Get("ETag")
+	areEqual(t, strings.HasPrefix(etag, "W/\""), true)
+
+	req.Header.Set("If-None-Match", etag)
+	res = httptest.NewRecorder()
+	Render(res, req, http.StatusOK, M{"a": 1})
+	areEqual(t, res.Code, http.StatusNotModified)
+	areEqual(t, res.Body.Len(), 0)
+
+	res = httptest.NewRecorder()
+	Render(res, req, http.StatusOK, M{"a": 2})
+	areEqual(t, res.Code, http.StatusOK)
+
+	// Revision entity tags
+	var m model
+	m.InitModel()
+	req.Header.Set("If-None-Match", m.ETag())
+	res = httptest.NewRecorder()
+	SetETag(res, &m)
+	Render(res, req, http.StatusOK, M{"a": 2})
+	areEqual(t, res.Code, http.StatusNotModified)
+	areEqual(t, res.Header().Get("ETag"), m.ETag())
+
+	// Only GET responses are tagged
+	req = httptest.NewRequest("POST", "/", nil)
+	res = httptest.NewRecorder()
+	Render(res, req, http.StatusOK, M{"a": 1})
+	areEqual(t, res.Header().Get("ETag"), "")
+}
+
+func TestCITypeConcurrentUpdate(t *testing.T) {
+	location := Post(t, V1Uri("/cmdbs/temp/citypes"), `{"name":"ETag CI Type"}`)
+	defer Delete(t, location)
+
+	send := func(method string, body string, ifMatch string) *httptest.ResponseRecorder {
+		req := NewRequest(method, location, strings.NewReader(body))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+
+		res := httptest.NewRecorder()
+		GetServer().ServeHTTP(res, req)
+		return res
+	}
+
+	// Fetch the current revision
+	res := send("GET", "", "")
+	areEqual(t, res.Code, http.StatusOK)
+	etag := res.Header().Get("ETag")
+	areUnequal(t, etag, "")
+
+	// Update it
+	body := `{"name":"ETag CI Type","description":"Updated"}`
+	res = send("PUT", body, etag)
+	areEqual(t, res.Code, http.StatusNoContent)
+	areUnequal(t, res.Header().Get("ETag"), etag)
+
+	// Updates and deletes of the stale revision fail
+	res = send("PUT", body, etag)
+	areEqual(t, res.Code, http.StatusPreconditionFailed)
+
+	res = send("DELETE", "", etag)
+	areEqual(t, res.Code, http.StatusPreconditionFailed)
+}
+
+func TestCheckIfNoneMatch(t *testing.T) {
+	var m model
+	m.InitModel()
+
+	tests := []struct {
+		Header   string
+		Model    *model
+		Expected bool
+	}{
+		{"", &m, false},
+		{"*", nil, false},
+		{"*", &m, true},
+		{m.ETag(), &m, true},
+		{`"other"`, &m, false},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("PUT", "/", nil)
+		if test.Header != "" {
+			req.Header.Set("If-None-Match", test.Header)
+		}
+
+		res := httptest.NewRecorder()
+		areEqual(t, CheckIfNoneMatch(res, req, test.Model), test.Expected)
+		if test.Expected {
+			areEqual(t, res.Code, http.StatusPreconditionFailed)
+		}
+	}
+}
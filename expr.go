@@ -0,0 +1,1018 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+// A small expression language for computed attributes and validation rules.
+//
+// Expressions may only read the attributes of the CI they are evaluated
+// against and call the built-in functions below. They have no loops,
+// assignments or access to the host, so are safe to accept from users.
+//
+// Attributes are referenced by their dotted short name path, such as
+// network.address. A path segment suffixed with [] projects over an array, so
+// dimms[].size is an array of the size of each dimm. As short names may
+// contain hyphens, subtraction must be surrounded by spaces (a - b).
+//
+// Operators, from lowest to highest precedence:
+//
+//     ||
+//     &&
+//     ==  !=
+//     <  <=  >  >=
+//     +  -
+//     *  /  %
+//     !  - (unary)
+//
+// Arithmetic and comparisons involving null yield null and false
+// respectively, so a computed attribute is omitted if any of its inputs are
+// missing unless coalesce() is used.
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	maxExpressionLength = 4096
+	maxExpressionDepth  = 64
+)
+
+// Expression is a parsed expression.
+type Expression struct {
+	Source string
+	root   exprNode
+	paths  []string
+}
+
+type exprNode interface {
+	eval(env map[string]interface{}) (interface{}, error)
+}
+
+type exprFunc struct {
+	minArgs int
+	maxArgs int // -1 for variadic
+	call    func(env map[string]interface{}, args []exprNode) (interface{}, error)
+}
+
+var exprFuncs map[string]*exprFunc
+
+func init() {
+	exprFuncs = map[string]*exprFunc{
+		"sum":        {1, -1, wrapFunc(exprSum)},
+		"avg":        {1, -1, wrapFunc(exprAvg)},
+		"min":        {1, -1, wrapFunc(exprMin)},
+		"max":        {1, -1, wrapFunc(exprMax)},
+		"count":      {1, -1, wrapFunc(exprCount)},
+		"len":        {1, 1, wrapFunc(exprLen)},
+		"abs":        {1, 1, wrapFunc(exprAbs)},
+		"round":      {1, 2, wrapFunc(exprRound)},
+		"lower":      {1, 1, wrapFunc(exprLower)},
+		"upper":      {1, 1, wrapFunc(exprUpper)},
+		"trim":       {1, 1, wrapFunc(exprTrim)},
+		"concat":     {1, -1, wrapFunc(exprConcat)},
+		"join":       {2, 2, wrapFunc(exprJoin)},
+		"contains":   {2, 2, wrapFunc(exprContains)},
+		"startsWith": {2, 2, wrapFunc(exprStartsWith)},
+		"endsWith":   {2, 2, wrapFunc(exprEndsWith)},
+		"matches":    {2, 2, wrapFunc(exprMatches)},
+		"now":        {0, 0, wrapFunc(exprNow)},
+		"coalesce":   {1, -1, exprCoalesce},
+		"if":         {3, 3, exprIf},
+	}
+}
+
+// ParseExpression parses an expression.
+func ParseExpression(source string) (*Expression, error) {
+	if len(source) > maxExpressionLength {
+		return nil, errors.New(fmt.Sprintf("Expression exceeds the maximum length of %d characters", maxExpressionLength))
+	}
+
+	tokens, err := tokenizeExpression(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, errors.New(fmt.Sprintf("Unexpected '%s' at position %d", tok.text, tok.pos))
+	}
+
+	return &Expression{
+		Source: source,
+		root:   root,
+		paths:  p.paths,
+	}, nil
+}
+
+// Paths returns the dotted path of each attribute referenced by the
+// expression, with array projections removed.
+func (c *Expression) Paths() []string {
+	return c.paths
+}
+
+// Evaluate evaluates the expression against the given CI value.
+func (c *Expression) Evaluate(fields map[string]interface{}) (interface{}, error) {
+	return c.root.eval(fields)
+}
+
+// IsTrue evaluates the expression against the given CI value and returns
+// whether the result is truthy.
+func (c *Expression) IsTrue(fields map[string]interface{}) (bool, error) {
+	val, err := c.Evaluate(fields)
+	if err != nil {
+		return false, err
+	}
+
+	return exprTruthy(val), nil
+}
+
+// Tokenizer
+
+const (
+	tokEOF = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOp
+)
+
+type exprToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+var exprOperators = []string{"||", "&&", "==", "!=", "<=", ">=", "<", ">", "+", "-", "*", "/", "%", "!", "(", ")", ","}
+
+func isIdentStart(r rune) bool {
+	return unicode.IsLetter(r) || r == '_'
+}
+
+func isIdentPart(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-'
+}
+
+func tokenizeExpression(source string) ([]exprToken, error) {
+	tokens := []exprToken{}
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case unicode.IsDigit(r):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, exprToken{tokNumber, string(runes[start:i]), start})
+
+		case r == '"' || r == '\'':
+			start := i
+			quote := r
+			var sb strings.Builder
+			for i++; ; i++ {
+				if i >= len(runes) {
+					return nil, errors.New(fmt.Sprintf("Unterminated string at position %d", start))
+				}
+
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+					sb.WriteRune(runes[i])
+					continue
+				}
+
+				if runes[i] == quote {
+					i++
+					break
+				}
+
+				sb.WriteRune(runes[i])
+			}
+			tokens = append(tokens, exprToken{tokString, sb.String(), start})
+
+		case isIdentStart(r):
+			start := i
+			for i < len(runes) {
+				if isIdentPart(runes[i]) {
+					i++
+				} else if runes[i] == '.' && i+1 < len(runes) && isIdentStart(runes[i+1]) {
+					i++
+				} else if runes[i] == '[' && i+1 < len(runes) && runes[i+1] == ']' {
+					i += 2
+				} else {
+					break
+				}
+			}
+			tokens = append(tokens, exprToken{tokIdent, string(runes[start:i]), start})
+
+		default:
+			matched := false
+			for _, op := range exprOperators {
+				if strings.HasPrefix(string(runes[i:]), op) {
+					tokens = append(tokens, exprToken{tokOp, op, i})
+					i += len([]rune(op))
+					matched = true
+					break
+				}
+			}
+
+			if !matched {
+				return nil, errors.New(fmt.Sprintf("Unexpected character '%c' at position %d", r, i))
+			}
+		}
+	}
+
+	return append(tokens, exprToken{tokEOF, "end of expression", len(runes)}), nil
+}
+
+// Parser
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+	depth  int
+	paths  []string
+}
+
+func (c *exprParser) peek() exprToken {
+	return c.tokens[c.pos]
+}
+
+func (c *exprParser) next() exprToken {
+	tok := c.tokens[c.pos]
+	if tok.kind != tokEOF {
+		c.pos++
+	}
+
+	return tok
+}
+
+func (c *exprParser) accept(ops ...string) (string, bool) {
+	tok := c.peek()
+	if tok.kind != tokOp {
+		return "", false
+	}
+
+	for _, op := range ops {
+		if tok.text == op {
+			c.pos++
+			return op, true
+		}
+	}
+
+	return "", false
+}
+
+func (c *exprParser) expect(op string) error {
+	if _, ok := c.accept(op); !ok {
+		tok := c.peek()
+		return errors.New(fmt.Sprintf("Expected '%s' but found '%s' at position %d", op, tok.text, tok.pos))
+	}
+
+	return nil
+}
+
+func (c *exprParser) parseExpr() (exprNode, error) {
+	c.depth++
+	defer func() { c.depth-- }()
+	if c.depth > maxExpressionDepth {
+		return nil, errors.New("Expression is nested too deeply")
+	}
+
+	return c.parseBinary(0)
+}
+
+var exprPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (c *exprParser) parseBinary(level int) (exprNode, error) {
+	if level == len(exprPrecedence) {
+		return c.parseUnary()
+	}
+
+	left, err := c.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op, ok := c.accept(exprPrecedence[level]...)
+		if !ok {
+			return left, nil
+		}
+
+		right, err := c.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		left = &binaryNode{op, left, right}
+	}
+}
+
+func (c *exprParser) parseUnary() (exprNode, error) {
+	if op, ok := c.accept("!", "-"); ok {
+		c.depth++
+		defer func() { c.depth-- }()
+		if c.depth > maxExpressionDepth {
+			return nil, errors.New("Expression is nested too deeply")
+		}
+
+		operand, err := c.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return &unaryNode{op, operand}, nil
+	}
+
+	return c.parsePrimary()
+}
+
+func (c *exprParser) parsePrimary() (exprNode, error) {
+	tok := c.next()
+	switch tok.kind {
+	case tokNumber:
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid number '%s' at position %d", tok.text, tok.pos))
+		}
+		return &literalNode{f}, nil
+
+	case tokString:
+		return &literalNode{tok.text}, nil
+
+	case tokIdent:
+		switch tok.text {
+		case "true":
+			return &literalNode{true}, nil
+		case "false":
+			return &literalNode{false}, nil
+		case "null":
+			return &literalNode{nil}, nil
+		}
+
+		if _, ok := c.accept("("); ok {
+			return c.parseCall(tok)
+		}
+
+		return c.parsePath(tok), nil
+
+	case tokOp:
+		if tok.text == "(" {
+			node, err := c.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+
+			if err := c.expect(")"); err != nil {
+				return nil, err
+			}
+
+			return node, nil
+		}
+	}
+
+	return nil, errors.New(fmt.Sprintf("Unexpected '%s' at position %d", tok.text, tok.pos))
+}
+
+func (c *exprParser) parseCall(tok exprToken) (exprNode, error) {
+	fn, ok := exprFuncs[tok.text]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Unknown function '%s' at position %d", tok.text, tok.pos))
+	}
+
+	args := []exprNode{}
+	if _, ok := c.accept(")"); !ok {
+		for {
+			arg, err := c.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+
+			if _, ok := c.accept(","); ok {
+				continue
+			}
+
+			if err := c.expect(")"); err != nil {
+				return nil, err
+			}
+
+			break
+		}
+	}
+
+	if len(args) < fn.minArgs || (fn.maxArgs >= 0 && len(args) > fn.maxArgs) {
+		return nil, errors.New(fmt.Sprintf("Wrong number of arguments for function '%s' at position %d", tok.text, tok.pos))
+	}
+
+	return &callNode{tok.text, fn, args}, nil
+}
+
+func (c *exprParser) parsePath(tok exprToken) exprNode {
+	node := &pathNode{}
+	names := []string{}
+	for _, segment := range strings.Split(tok.text, ".") {
+		each := strings.HasSuffix(segment, "[]")
+		name := GetShortName(strings.TrimSuffix(segment, "[]"))
+		node.segments = append(node.segments, pathSegment{name, each})
+		names = append(names, name)
+	}
+
+	c.paths = append(c.paths, strings.Join(names, "."))
+	return node
+}
+
+// Nodes
+
+type literalNode struct {
+	value interface{}
+}
+
+func (c *literalNode) eval(env map[string]interface{}) (interface{}, error) {
+	return c.value, nil
+}
+
+type pathSegment struct {
+	name string
+	each bool
+}
+
+type pathNode struct {
+	segments []pathSegment
+}
+
+func (c *pathNode) eval(env map[string]interface{}) (interface{}, error) {
+	values := []interface{}{env}
+	projected := false
+	for _, segment := range c.segments {
+		next := []interface{}{}
+		for _, v := range values {
+			m, ok := asMap(v)
+			if !ok {
+				continue
+			}
+
+			val := m[segment.name]
+			if segment.each {
+				projected = true
+				if arr, ok := val.([]interface{}); ok {
+					next = append(next, arr...)
+				}
+			} else if val != nil || !projected {
+				next = append(next, val)
+			}
+		}
+
+		values = next
+	}
+
+	if projected {
+		return values, nil
+	}
+
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	return values[0], nil
+}
+
+type unaryNode struct {
+	op      string
+	operand exprNode
+}
+
+func (c *unaryNode) eval(env map[string]interface{}) (interface{}, error) {
+	val, err := c.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.op == "!" {
+		return !exprTruthy(val), nil
+	}
+
+	if val == nil {
+		return nil, nil
+	}
+
+	f, ok := exprNumber(val)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Cannot negate '%v'", val))
+	}
+
+	return -f, nil
+}
+
+type binaryNode struct {
+	op    string
+	left  exprNode
+	right exprNode
+}
+
+func (c *binaryNode) eval(env map[string]interface{}) (interface{}, error) {
+	left, err := c.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	// Short circuit logical operators
+	switch c.op {
+	case "&&":
+		if !exprTruthy(left) {
+			return false, nil
+		}
+
+		right, err := c.right.eval(env)
+		return exprTruthy(right), err
+
+	case "||":
+		if exprTruthy(left) {
+			return true, nil
+		}
+
+		right, err := c.right.eval(env)
+		return exprTruthy(right), err
+	}
+
+	right, err := c.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch c.op {
+	case "==":
+		return exprEqual(left, right), nil
+
+	case "!=":
+		return !exprEqual(left, right), nil
+
+	case "<", "<=", ">", ">=":
+		cmp, ok := exprCompare(left, right)
+		if !ok {
+			return false, nil
+		}
+
+		switch c.op {
+		case "<":
+			return cmp < 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		case ">":
+			return cmp > 0, nil
+		default:
+			return cmp >= 0, nil
+		}
+	}
+
+	// Arithmetic
+	if left == nil || right == nil {
+		return nil, nil
+	}
+
+	if c.op == "+" {
+		_, lstr := left.(string)
+		_, rstr := right.(string)
+		if lstr || rstr {
+			return exprString(left) + exprString(right), nil
+		}
+	}
+
+	l, lok := exprNumber(left)
+	r, rok := exprNumber(right)
+	if !lok || !rok {
+		return nil, errors.New(fmt.Sprintf("Cannot apply '%s' to '%v' and '%v'", c.op, left, right))
+	}
+
+	switch c.op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return nil, errors.New("Division by zero")
+		}
+		return l / r, nil
+	default:
+		if r == 0 {
+			return nil, errors.New("Division by zero")
+		}
+		return math.Mod(l, r), nil
+	}
+}
+
+type callNode struct {
+	name string
+	fn   *exprFunc
+	args []exprNode
+}
+
+func (c *callNode) eval(env map[string]interface{}) (interface{}, error) {
+	val, err := c.fn.call(env, c.args)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s(): %s", c.name, err))
+	}
+
+	return val, nil
+}
+
+// Values
+
+func exprNumber(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+
+	return 0, false
+}
+
+func exprString(val interface{}) string {
+	if val == nil {
+		return ""
+	}
+
+	if f, ok := exprNumber(val); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+
+	return fmt.Sprintf("%v", val)
+}
+
+func exprTruthy(val interface{}) bool {
+	switch v := val.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	}
+
+	if f, ok := exprNumber(val); ok {
+		return f != 0
+	}
+
+	return true
+}
+
+func exprEqual(a interface{}, b interface{}) bool {
+	if fa, ok := exprNumber(a); ok {
+		fb, ok := exprNumber(b)
+		return ok && fa == fb
+	}
+
+	return valuesEqual(a, b)
+}
+
+// exprCompare orders two numbers or two strings.
+func exprCompare(a interface{}, b interface{}) (int, bool) {
+	if fa, ok := exprNumber(a); ok {
+		fb, ok := exprNumber(b)
+		if !ok {
+			return 0, false
+		}
+
+		switch {
+		case fa < fb:
+			return -1, true
+		case fa > fb:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	sa, ok := a.(string)
+	if !ok {
+		return 0, false
+	}
+
+	sb, ok := b.(string)
+	if !ok {
+		return 0, false
+	}
+
+	return strings.Compare(sa, sb), true
+}
+
+// Functions
+
+// wrapFunc evaluates all arguments of a function before calling it.
+func wrapFunc(fn func(args []interface{}) (interface{}, error)) func(map[string]interface{}, []exprNode) (interface{}, error) {
+	return func(env map[string]interface{}, nodes []exprNode) (interface{}, error) {
+		args := make([]interface{}, len(nodes))
+		for i, node := range nodes {
+			val, err := node.eval(env)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = val
+		}
+
+		return fn(args)
+	}
+}
+
+// exprList returns the arguments with array arguments flattened, ignoring
+// nulls.
+func exprList(args []interface{}) []interface{} {
+	list := []interface{}{}
+	for _, arg := range args {
+		if arr, ok := arg.([]interface{}); ok {
+			list = append(list, exprList(arr)...)
+		} else if arg != nil {
+			list = append(list, arg)
+		}
+	}
+
+	return list
+}
+
+func exprNumbers(args []interface{}) ([]float64, error) {
+	list := exprList(args)
+	nums := make([]float64, len(list))
+	for i, v := range list {
+		f, ok := exprNumber(v)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("'%v' is not a number", v))
+		}
+		nums[i] = f
+	}
+
+	return nums, nil
+}
+
+func exprSum(args []interface{}) (interface{}, error) {
+	nums, err := exprNumbers(args)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := float64(0)
+	for _, f := range nums {
+		sum += f
+	}
+
+	return sum, nil
+}
+
+func exprAvg(args []interface{}) (interface{}, error) {
+	nums, err := exprNumbers(args)
+	if err != nil || len(nums) == 0 {
+		return nil, err
+	}
+
+	sum, _ := exprSum(args)
+	return sum.(float64) / float64(len(nums)), nil
+}
+
+func exprMin(args []interface{}) (interface{}, error) {
+	nums, err := exprNumbers(args)
+	if err != nil || len(nums) == 0 {
+		return nil, err
+	}
+
+	min := nums[0]
+	for _, f := range nums[1:] {
+		min = math.Min(min, f)
+	}
+
+	return min, nil
+}
+
+func exprMax(args []interface{}) (interface{}, error) {
+	nums, err := exprNumbers(args)
+	if err != nil || len(nums) == 0 {
+		return nil, err
+	}
+
+	max := nums[0]
+	for _, f := range nums[1:] {
+		max = math.Max(max, f)
+	}
+
+	return max, nil
+}
+
+func exprCount(args []interface{}) (interface{}, error) {
+	return float64(len(exprList(args))), nil
+}
+
+func exprLen(args []interface{}) (interface{}, error) {
+	switch v := args[0].(type) {
+	case nil:
+		return float64(0), nil
+	case string:
+		return float64(len([]rune(v))), nil
+	case []interface{}:
+		return float64(len(v)), nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("'%v' has no length", args[0]))
+}
+
+func exprAbs(args []interface{}) (interface{}, error) {
+	if args[0] == nil {
+		return nil, nil
+	}
+
+	f, ok := exprNumber(args[0])
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("'%v' is not a number", args[0]))
+	}
+
+	return math.Abs(f), nil
+}
+
+func exprRound(args []interface{}) (interface{}, error) {
+	if args[0] == nil {
+		return nil, nil
+	}
+
+	f, ok := exprNumber(args[0])
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("'%v' is not a number", args[0]))
+	}
+
+	digits := float64(0)
+	if len(args) > 1 {
+		digits, ok = exprNumber(args[1])
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("'%v' is not a number", args[1]))
+		}
+	}
+
+	scale := math.Pow(10, digits)
+	return math.Round(f*scale) / scale, nil
+}
+
+func exprStringArg(val interface{}) (string, bool) {
+	s, ok := val.(string)
+	return s, ok
+}
+
+func exprLower(args []interface{}) (interface{}, error) {
+	if s, ok := exprStringArg(args[0]); ok {
+		return strings.ToLower(s), nil
+	}
+
+	return nil, nil
+}
+
+func exprUpper(args []interface{}) (interface{}, error) {
+	if s, ok := exprStringArg(args[0]); ok {
+		return strings.ToUpper(s), nil
+	}
+
+	return nil, nil
+}
+
+func exprTrim(args []interface{}) (interface{}, error) {
+	if s, ok := exprStringArg(args[0]); ok {
+		return strings.TrimSpace(s), nil
+	}
+
+	return nil, nil
+}
+
+func exprConcat(args []interface{}) (interface{}, error) {
+	var sb strings.Builder
+	for _, arg := range args {
+		sb.WriteString(exprString(arg))
+	}
+
+	return sb.String(), nil
+}
+
+func exprJoin(args []interface{}) (interface{}, error) {
+	list := exprList(args[:1])
+	vals := make([]string, len(list))
+	for i, v := range list {
+		vals[i] = exprString(v)
+	}
+
+	return strings.Join(vals, exprString(args[1])), nil
+}
+
+func exprContains(args []interface{}) (interface{}, error) {
+	switch v := args[0].(type) {
+	case string:
+		return strings.Contains(v, exprString(args[1])), nil
+	case []interface{}:
+		for _, elem := range v {
+			if exprEqual(elem, args[1]) {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+func exprStartsWith(args []interface{}) (interface{}, error) {
+	s, ok := exprStringArg(args[0])
+	return ok && strings.HasPrefix(s, exprString(args[1])), nil
+}
+
+func exprEndsWith(args []interface{}) (interface{}, error) {
+	s, ok := exprStringArg(args[0])
+	return ok && strings.HasSuffix(s, exprString(args[1])), nil
+}
+
+func exprMatches(args []interface{}) (interface{}, error) {
+	s, ok := exprStringArg(args[0])
+	if !ok {
+		return false, nil
+	}
+
+	// Go regular expressions run in linear time so are safe to accept
+	r, err := regexp.Compile(exprString(args[1]))
+	if err != nil {
+		return nil, err
+	}
+
+	return r.MatchString(s), nil
+}
+
+// exprNow returns the current time in milliseconds since 1970-01-01, the
+// same as timestamp attributes.
+func exprNow(args []interface{}) (interface{}, error) {
+	return float64(time.Now().UnixNano() / int64(time.Millisecond)), nil
+}
+
+func exprCoalesce(env map[string]interface{}, args []exprNode) (interface{}, error) {
+	for _, arg := range args {
+		val, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+
+		if val != nil {
+			return val, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func exprIf(env map[string]interface{}, args []exprNode) (interface{}, error) {
+	cond, err := args[0].eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	if exprTruthy(cond) {
+		return args[1].eval(env)
+	}
+
+	return args[2].eval(env)
+}
@@ -0,0 +1,139 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+func TestEvaluateExpression(t *testing.T) {
+	fields := map[string]interface{}{
+		"hostname": "web01",
+		"domain":   "example.com",
+		"cores":    float64(4),
+		"started":  int64(1000),
+		"network":  bson.M{"address": "10.0.0.1"},
+		"dimms": []interface{}{
+			map[string]interface{}{"size": float64(8)},
+			map[string]interface{}{"size": float64(16)},
+			map[string]interface{}{},
+		},
+	}
+
+	tests := map[string]interface{}{
+		`hostname + "." + domain`:             "web01.example.com",
+		`sum(dimms[].size)`:                   float64(24),
+		`count(dimms[].size)`:                 float64(2),
+		`max(dimms[].size, 1)`:                float64(16),
+		`cores * 2 + 1`:                       float64(9),
+		`cores - 1`:                           float64(3),
+		`-cores`:                              float64(-4),
+		`(cores + 1) * 2`:                     float64(10),
+		`cores % 3`:                           float64(1),
+		`network.address`:                     "10.0.0.1",
+		`started > 999 && started < 1001`:     true,
+		`cores >= 4 || missing`:               true,
+		`!missing`:                            true,
+		`missing == null`:                     true,
+		`missing + 1`:                         nil,
+		`missing > 1`:                         false,
+		`coalesce(missing, 'none')`:           "none",
+		`if(cores > 2, "big", "small")`:       "big",
+		`upper(hostname)`:                     "WEB01",
+		`len(hostname)`:                       float64(5),
+		`contains(dimms[].size, 8)`:           true,
+		`matches(hostname, "^web[0-9]+$")`:    true,
+		`startsWith(domain, "example")`:       true,
+		`join(dimms[].size, ",")`:             "8,16",
+		`round(10 / 3, 2)`:                    3.33,
+		`concat(hostname, "-", cores)`:        "web01-4",
+		`"a" < "b"`:                           true,
+		`'it\'s'`:                             "it's",
+		`HOSTNAME == "web01"`:                 true,
+		`hostname != "web02" && cores == 4.0`: true,
+	}
+
+	for source, expected := range tests {
+		expr, err := ParseExpression(source)
+		if err != nil {
+			t.Errorf("Expected '%s' to parse but got: %s", source, err)
+			continue
+		}
+
+		val, err := expr.Evaluate(fields)
+		if err != nil {
+			t.Errorf("Expected '%s' to evaluate but got: %s", source, err)
+			continue
+		}
+
+		if !valuesEqual(val, expected) {
+			t.Errorf("Expected '%s' to be %v but got %v", source, expected, val)
+		}
+	}
+
+	// Runtime errors
+	for _, source := range []string{`cores / 0`, `hostname * 2`, `matches(hostname, "(")`} {
+		expr, err := ParseExpression(source)
+		if err != nil {
+			t.Errorf("Expected '%s' to parse but got: %s", source, err)
+			continue
+		}
+
+		if _, err := expr.Evaluate(fields); err == nil {
+			t.Errorf("Expected '%s' to fail", source)
+		}
+	}
+}
+
+func TestParseExpression(t *testing.T) {
+	expr, err := ParseExpression(`sum(dimms[].size) + Network.Address`)
+	if err != nil {
+		t.Fatalf("Expected expression to parse but got: %s", err)
+	}
+
+	areEqual(t, len(expr.Paths()), 2)
+	areEqual(t, expr.Paths()[0], "dimms.size")
+	areEqual(t, expr.Paths()[1], "network.address")
+
+	bad := []string{
+		``,
+		`1 +`,
+		`(1`,
+		`"unterminated`,
+		`unknown(1)`,
+		`len(1, 2)`,
+		`a $ b`,
+		`1 2`,
+	}
+
+	for _, source := range bad {
+		if _, err := ParseExpression(source); err == nil {
+			t.Errorf("Expected '%s' to fail to parse", source)
+		}
+	}
+
+	// Nesting is limited
+	deep := ""
+	for i := 0; i < maxExpressionDepth+1; i++ {
+		deep += "("
+	}
+	if _, err := ParseExpression(deep + "1"); err == nil {
+		t.Errorf("Expected deeply nested expression to fail to parse")
+	}
+}
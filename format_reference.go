@@ -0,0 +1,52 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ReferenceFormat is the id of a CI of the CI Type named by the Target of the
+// attribute.
+type ReferenceFormat struct{}
+
+func (c *ReferenceFormat) GetName() string {
+	return "reference"
+}
+
+func (c *ReferenceFormat) Validate(att *CITypeAttribute, val *interface{}) error {
+	if att.Type != c.GetName() {
+		return errors.New(fmt.Sprintf("Attribute '%s' is not the correct type", att.Name))
+	}
+
+	str, ok := (*val).(string)
+	if !ok {
+		return errors.New(fmt.Sprintf("Value for '%s' is not a string", att.Name))
+	}
+
+	// References are stored as the canonical hex form of the CI id
+	id, err := IdFromString(strings.ToLower(str))
+	if err != nil {
+		return errors.New(fmt.Sprintf("Value '%s' for attribute '%s' is not a valid CI id", str, att.Name))
+	}
+
+	*val = IdToString(id)
+	return nil
+}
@@ -34,6 +34,7 @@ func GetAttributeFormat(name string) AttributeFormat {
 			&NumberFormat{},
 			&BooleanFormat{},
 			&TimeStampFormat{},
+			&ReferenceFormat{},
 		}
 
 		for _, format := range formats {
@@ -0,0 +1,868 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	graphqlDefaultLimit = 100
+	graphqlMaxLimit     = 1000
+
+	// Queries are refused before they are executed if they are nested too
+	// deeply or may resolve too many fields, counting the fields of each
+	// item of a list field once for each CI it may return
+	graphqlMaxDepth      = 10
+	graphqlMaxComplexity = 20000
+
+	graphqlMaxBodySize = 1 << 20
+)
+
+var invalidGraphQLChars = regexp.MustCompile(`[^_0-9A-Za-z]`)
+
+// Fields of every CI which are not attributes
+var graphqlModelFields = []string{"id", "created", "modified", "revision"}
+
+// GraphQLRequest is a GraphQL query submitted to a CMDB.
+type GraphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// graphqlName returns the camel case GraphQL name for a short name, such as
+// ipAddress for ip-address.
+func graphqlName(shortName string) string {
+	parts := strings.FieldsFunc(shortName, func(r rune) bool {
+		return r == '-' || r == '_'
+	})
+
+	for i := 1; i < len(parts); i++ {
+		parts[i] = strings.Title(parts[i])
+	}
+
+	name := invalidGraphQLChars.ReplaceAllString(strings.Join(parts, ""), "")
+	if name == "" || unicode.IsDigit(rune(name[0])) {
+		name = "_" + name
+	}
+
+	return name
+}
+
+// graphqlTypeName returns the GraphQL type name for a short name, such as
+// IpAddress for ip-address.
+func graphqlTypeName(shortName string) string {
+	name := graphqlName(shortName)
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// graphqlValue returns the value of an attribute of a CI or group.
+func graphqlValue(source interface{}, key string) interface{} {
+	if ci, ok := source.(*CI); ok {
+		return ci.Value[key]
+	}
+
+	if m, ok := asMap(source); ok {
+		return m[key]
+	}
+
+	return nil
+}
+
+// graphqlContext is the state of a single GraphQL request.
+type graphqlContext struct {
+	db *mgo.Database
+
+	// Referenced CIs already retrieved by CI Type and id
+	mutex sync.Mutex
+	cache map[string]*CI
+}
+
+type graphqlContextKey struct{}
+
+func getGraphQLContext(ctx context.Context) *graphqlContext {
+	c, _ := ctx.Value(graphqlContextKey{}).(*graphqlContext)
+	return c
+}
+
+// getCI returns the CI of the given CI Type with the given id, or nil if
+// there is none.
+func (c *graphqlContext) getCI(citype string, id string) (*CI, error) {
+	key := citype + "/" + id
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if ci, ok := c.cache[key]; ok {
+		return ci, nil
+	}
+
+	oid, err := IdFromString(id)
+	if err != nil {
+		return nil, err
+	}
+
+	ci := &CI{}
+	err = c.db.C(citype).FindId(oid).One(ci)
+	if err == mgo.ErrNotFound {
+		ci = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	c.cache[key] = ci
+	return ci, nil
+}
+
+// graphqlReference is a reference attribute of a CI Type, which is resolved
+// in reverse on the CI Type it targets.
+type graphqlReference struct {
+	CIType *CIType
+	Path   string
+}
+
+// graphqlSchemaBuilder generates a GraphQL schema from the CI Types of a
+// CMDB. Each CI Type is an object type with a field for each attribute.
+// Groups are nested object types and references resolve to the CI they
+// refer to. Each CI Type has a list field for each reference to it from other
+// CI Types.
+type graphqlSchemaBuilder struct {
+	citypes map[string]*CIType
+	objects map[string]*graphql.Object
+	wheres  map[string]*graphql.InputObject
+	reverse map[string][]graphqlReference
+}
+
+// NewGraphQLSchema generates the GraphQL schema for the given CI Types.
+func NewGraphQLSchema(citypes []CIType) (graphql.Schema, error) {
+	b := &graphqlSchemaBuilder{
+		citypes: map[string]*CIType{},
+		objects: map[string]*graphql.Object{},
+		wheres:  map[string]*graphql.InputObject{},
+		reverse: map[string][]graphqlReference{},
+	}
+
+	for i := range citypes {
+		citype := &citypes[i]
+		b.citypes[citype.ShortName] = citype
+		b.findReferences(citype, &citype.Attributes, "")
+	}
+
+	query := graphql.Fields{}
+	for i := range citypes {
+		citype := &citypes[i]
+		name := graphqlName(citype.ShortName)
+		if query[name] != nil || query[name+"List"] != nil {
+			log.Printf("Skipping CI Type %s in GraphQL schema as its name is already in use", citype.ShortName)
+			continue
+		}
+
+		query[name] = &graphql.Field{
+			Type:        b.object(citype),
+			Description: fmt.Sprintf("%s with the given id", citype.Name),
+			Args: graphql.FieldConfigArgument{
+				"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+			},
+			Resolve: b.resolveCI(citype),
+		}
+
+		query[name+"List"] = b.listField(citype, "", fmt.Sprintf("All %s CIs", citype.Name))
+	}
+
+	// The query type must have at least one field
+	if query["ciTypes"] == nil {
+		query["ciTypes"] = &graphql.Field{
+			Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))),
+			Description: "Short names of the CI Types of the CMDB",
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				names := make([]string, len(citypes))
+				for i, citype := range citypes {
+					names[i] = citype.ShortName
+				}
+
+				return names, nil
+			},
+		}
+	}
+
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{Name: "Query", Fields: query}),
+	})
+}
+
+// findReferences records each reference attribute of a CI Type, excluding
+// those in arrays of groups.
+func (c *graphqlSchemaBuilder) findReferences(citype *CIType, atts *CITypeAttributeList, prefix string) {
+	for _, att := range *atts {
+		switch {
+		case att.Type == "reference":
+			c.reverse[att.Target] = append(c.reverse[att.Target], graphqlReference{citype, prefix + att.ShortName})
+
+		case att.Type == "group" && !att.IsArray:
+			c.findReferences(citype, &att.Children, prefix+att.ShortName+".")
+		}
+	}
+}
+
+// object returns the object type of a CI Type. Fields are created when the
+// schema is built so that CI Types may refer to each other.
+func (c *graphqlSchemaBuilder) object(citype *CIType) *graphql.Object {
+	if obj, ok := c.objects[citype.ShortName]; ok {
+		return obj
+	}
+
+	typeName := graphqlTypeName(citype.ShortName)
+	obj := graphql.NewObject(graphql.ObjectConfig{
+		Name:        typeName,
+		Description: citype.Description,
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			fields := graphql.Fields{
+				"id": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.ID),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return IdToString(p.Source.(*CI).Id), nil
+					},
+				},
+				"created": &graphql.Field{
+					Type: graphql.DateTime,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*CI).Created, nil
+					},
+				},
+				"modified": &graphql.Field{
+					Type: graphql.DateTime,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*CI).Modified, nil
+					},
+				},
+				"revision": &graphql.Field{
+					Type: graphql.Int,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*CI).Revision, nil
+					},
+				},
+			}
+
+			c.addAttributeFields(fields, typeName, &citype.Attributes)
+
+			// CIs of other CI Types which refer to this CI
+			for _, ref := range c.reverse[citype.ShortName] {
+				name := graphqlName(ref.CIType.ShortName) + "ListBy" + graphqlTypeName(strings.Replace(ref.Path, ".", "-", -1))
+				if fields[name] != nil {
+					continue
+				}
+
+				fields[name] = c.listField(ref.CIType, ref.Path, fmt.Sprintf("%s CIs which refer to this CI by '%s'", ref.CIType.Name, ref.Path))
+			}
+
+			return fields
+		}),
+	})
+
+	c.objects[citype.ShortName] = obj
+	return obj
+}
+
+// addAttributeFields adds a field for each attribute to the fields of an
+// object type. Attributes whose names are already in use are skipped.
+func (c *graphqlSchemaBuilder) addAttributeFields(fields graphql.Fields, typeName string, atts *CITypeAttributeList) {
+	for i := range *atts {
+		att := &(*atts)[i]
+		name := graphqlName(att.ShortName)
+		if fields[name] != nil {
+			continue
+		}
+
+		var typ graphql.Output
+		key := att.ShortName
+		resolve := func(p graphql.ResolveParams) (interface{}, error) {
+			return graphqlValue(p.Source, key), nil
+		}
+
+		switch att.Type {
+		case "group":
+			children := graphql.Fields{}
+			c.addAttributeFields(children, typeName+"_"+graphqlTypeName(att.ShortName), &att.Children)
+			if len(children) == 0 {
+				continue
+			}
+
+			typ = graphql.NewObject(graphql.ObjectConfig{
+				Name:        typeName + "_" + graphqlTypeName(att.ShortName),
+				Description: att.Description,
+				Fields:      children,
+			})
+
+		case "string":
+			typ = graphql.String
+
+		case "number", "timestamp":
+			typ = graphql.Float
+
+		case "boolean":
+			typ = graphql.Boolean
+
+		case "reference":
+			target, ok := c.citypes[att.Target]
+			if !ok {
+				typ = graphql.ID
+				break
+			}
+
+			typ = c.object(target)
+			resolve = c.resolveReference(target.ShortName, key, att.IsArray)
+
+		default:
+			continue
+		}
+
+		if att.IsArray {
+			typ = graphql.NewList(typ)
+		}
+
+		fields[name] = &graphql.Field{
+			Type:        typ,
+			Description: att.Description,
+			Resolve:     resolve,
+		}
+	}
+}
+
+// where returns the input object type used to select CIs of a CI Type by
+// attribute values, or nil if it has no attributes which can be compared.
+func (c *graphqlSchemaBuilder) where(citype *CIType) *graphql.InputObject {
+	if where, ok := c.wheres[citype.ShortName]; ok {
+		return where
+	}
+
+	where := c.whereInput(graphqlTypeName(citype.ShortName)+"Where", &citype.Attributes)
+	c.wheres[citype.ShortName] = where
+	return where
+}
+
+func (c *graphqlSchemaBuilder) whereInput(name string, atts *CITypeAttributeList) *graphql.InputObject {
+	fields := graphql.InputObjectConfigFieldMap{}
+	for _, att := range *atts {
+		fieldName := graphqlName(att.ShortName)
+		if fields[fieldName] != nil {
+			continue
+		}
+
+		var typ graphql.Input
+		switch att.Type {
+		case "group":
+			group := c.whereInput(name+"_"+graphqlTypeName(att.ShortName), &att.Children)
+			if group == nil {
+				continue
+			}
+			typ = group
+
+		case "string":
+			typ = graphql.String
+
+		case "number", "timestamp":
+			typ = graphql.Float
+
+		case "boolean":
+			typ = graphql.Boolean
+
+		case "reference":
+			typ = graphql.ID
+
+		default:
+			continue
+		}
+
+		fields[fieldName] = &graphql.InputObjectFieldConfig{Type: typ}
+	}
+
+	if len(fields) == 0 {
+		return nil
+	}
+
+	return graphql.NewInputObject(graphql.InputObjectConfig{Name: name, Fields: fields})
+}
+
+// whereQuery adds the conditions of a where argument to a CI query.
+func whereQuery(query bson.M, where map[string]interface{}, atts *CITypeAttributeList, prefix string) {
+	for _, att := range *atts {
+		val, ok := where[graphqlName(att.ShortName)]
+		if !ok {
+			continue
+		}
+
+		if group, ok := val.(map[string]interface{}); ok && att.Type == "group" {
+			whereQuery(query, group, &att.Children, prefix+att.ShortName+".")
+			continue
+		}
+
+		query[prefix+att.ShortName] = val
+	}
+}
+
+// listField returns a field which lists the CIs of a CI Type, optionally
+// only those which refer to the source CI by the given attribute path.
+func (c *graphqlSchemaBuilder) listField(citype *CIType, refPath string, description string) *graphql.Field {
+	args := graphql.FieldConfigArgument{
+		"filter": &graphql.ArgumentConfig{
+			Type:        graphql.String,
+			Description: "Expression which each CI must satisfy",
+		},
+		"first": &graphql.ArgumentConfig{
+			Type:         graphql.Int,
+			DefaultValue: graphqlDefaultLimit,
+			Description:  fmt.Sprintf("Maximum number of CIs to return, up to %d", graphqlMaxLimit),
+		},
+		"after": &graphql.ArgumentConfig{
+			Type:        graphql.ID,
+			Description: "Id of the last CI of the previous page",
+		},
+	}
+
+	if where := c.where(citype); where != nil {
+		args["where"] = &graphql.ArgumentConfig{
+			Type:        where,
+			Description: "Attribute values which each CI must have",
+		}
+	}
+
+	return &graphql.Field{
+		Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(c.object(citype)))),
+		Description: description,
+		Args:        args,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			query := bson.M{}
+			if where, ok := p.Args["where"].(map[string]interface{}); ok {
+				whereQuery(query, where, &citype.Attributes, "value.")
+			}
+
+			if refPath != "" {
+				query["value."+refPath] = IdToString(p.Source.(*CI).Id)
+			}
+
+			return listCIs(getGraphQLContext(p.Context), citype, query, p.Args)
+		},
+	}
+}
+
+// listCIs returns a page of the CIs of a CI Type which match a query and the
+// filter, first and after arguments of a list field. CIs are ordered by id.
+func listCIs(ctx *graphqlContext, citype *CIType, query bson.M, args map[string]interface{}) ([]*CI, error) {
+	limit, _ := args["first"].(int)
+	if limit < 1 || limit > graphqlMaxLimit {
+		return nil, errors.New(fmt.Sprintf("Argument 'first' must be between 1 and %d", graphqlMaxLimit))
+	}
+
+	if after, ok := args["after"].(string); ok {
+		oid, err := IdFromString(after)
+		if err != nil {
+			return nil, err
+		}
+
+		query["_id"] = bson.M{"$gt": oid}
+	}
+
+	var expr *Expression
+	if filter, ok := args["filter"].(string); ok && filter != "" {
+		var err error
+		expr, err = ParseExpression(filter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cis := []*CI{}
+	iter := ctx.db.C(citype.ShortName).Find(query).Sort("_id").Iter()
+	for len(cis) < limit {
+		ci := &CI{}
+		if !iter.Next(ci) {
+			break
+		}
+
+		if expr != nil {
+			ok, err := expr.IsTrue(ci.Value)
+			if err != nil || !ok {
+				continue
+			}
+		}
+
+		cis = append(cis, ci)
+	}
+
+	return cis, iter.Close()
+}
+
+func (c *graphqlSchemaBuilder) resolveCI(citype *CIType) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		id, _ := p.Args["id"].(string)
+		ci, err := getGraphQLContext(p.Context).getCI(citype.ShortName, id)
+		if ci == nil {
+			return nil, err
+		}
+
+		return ci, err
+	}
+}
+
+// resolveReference returns a resolver for a reference attribute which
+// returns the CI or CIs it refers to. References to missing CIs resolve to
+// null.
+func (c *graphqlSchemaBuilder) resolveReference(target string, key string, isArray bool) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		ctx := getGraphQLContext(p.Context)
+		val := graphqlValue(p.Source, key)
+		if !isArray {
+			id, ok := val.(string)
+			if !ok {
+				return nil, nil
+			}
+
+			ci, err := ctx.getCI(target, id)
+			if ci == nil {
+				return nil, err
+			}
+
+			return ci, err
+		}
+
+		ids, _ := val.([]interface{})
+		cis := make([]interface{}, len(ids))
+		for i, v := range ids {
+			id, _ := v.(string)
+			ci, err := ctx.getCI(target, id)
+			if err != nil {
+				return nil, err
+			}
+
+			if ci != nil {
+				cis[i] = ci
+			}
+		}
+
+		return cis, nil
+	}
+}
+
+type graphqlSchemaEntry struct {
+	fingerprint string
+	schema      graphql.Schema
+}
+
+var graphqlSchemas = map[string]*graphqlSchemaEntry{}
+var graphqlSchemaMutex sync.Mutex
+
+// GetGraphQLSchema returns the GraphQL schema of a CMDB. The schema is
+// generated again whenever a CI Type is added, updated or removed.
+func GetGraphQLSchema(db *mgo.Database) (graphql.Schema, error) {
+	var revisions []CIType
+	err := db.C(ciTypeCollection).Find(nil).Select(M{"_id": 1, "revision": 1}).Sort("_id").All(&revisions)
+	if err != nil {
+		return graphql.Schema{}, err
+	}
+
+	parts := make([]string, len(revisions))
+	for i, citype := range revisions {
+		parts[i] = fmt.Sprintf("%s-%d", IdToString(citype.Id), citype.Revision)
+	}
+	fingerprint := strings.Join(parts, ",")
+
+	graphqlSchemaMutex.Lock()
+	defer graphqlSchemaMutex.Unlock()
+
+	if entry, ok := graphqlSchemas[db.Name]; ok && entry.fingerprint == fingerprint {
+		return entry.schema, nil
+	}
+
+	var citypes []CIType
+	err = db.C(ciTypeCollection).Find(nil).Sort("shortname").All(&citypes)
+	if err != nil {
+		return graphql.Schema{}, err
+	}
+
+	schema, err := NewGraphQLSchema(citypes)
+	if err != nil {
+		return schema, err
+	}
+
+	graphqlSchemas[db.Name] = &graphqlSchemaEntry{fingerprint, schema}
+	return schema, nil
+}
+
+// getGraphQLRequest reads a GraphQL query from the query string of a GET
+// request or from the body of a POST request.
+func getGraphQLRequest(req *http.Request) (*GraphQLRequest, error) {
+	request := &GraphQLRequest{}
+	if req.Method == "GET" {
+		query := req.URL.Query()
+		request.Query = query.Get("query")
+		request.OperationName = query.Get("operationName")
+		if variables := query.Get("variables"); variables != "" {
+			err := json.Unmarshal([]byte(variables), &request.Variables)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid GraphQL variables: %s", err))
+			}
+		}
+	} else if strings.HasPrefix(req.Header.Get("Content-Type"), "application/graphql") {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		request.Query = string(body)
+	} else {
+		err := Bind(req, request)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if request.Query == "" {
+		return nil, errors.New("No GraphQL query specified")
+	}
+
+	return request, nil
+}
+
+// graphqlCost measures the depth and complexity of a GraphQL query.
+type graphqlCost struct {
+	schema    *graphql.Schema
+	variables map[string]interface{}
+	defaults  map[string]ast.Value
+	fragments map[string]*ast.FragmentDefinition
+	depth     int
+	cost      int
+}
+
+// checkGraphQLCost returns an error if a query is nested more deeply or may
+// resolve more fields than allowed. Queries which cannot be parsed are left
+// for graphql.Do to report.
+func checkGraphQLCost(schema *graphql.Schema, request *GraphQLRequest) error {
+	doc, err := parser.Parse(parser.ParseParams{Source: request.Query})
+	if err != nil {
+		return nil
+	}
+
+	c := &graphqlCost{
+		schema:    schema,
+		variables: request.Variables,
+		fragments: map[string]*ast.FragmentDefinition{},
+	}
+
+	for _, def := range doc.Definitions {
+		if fragment, ok := def.(*ast.FragmentDefinition); ok && fragment.Name != nil {
+			c.fragments[fragment.Name.Value] = fragment
+		}
+	}
+
+	for _, def := range doc.Definitions {
+		op, ok := def.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+
+		// Variables which are not given take the operation's defaults
+		c.defaults = map[string]ast.Value{}
+		for _, v := range op.VariableDefinitions {
+			if v.Variable != nil && v.Variable.Name != nil && v.DefaultValue != nil {
+				c.defaults[v.Variable.Name.Value] = v.DefaultValue
+			}
+		}
+
+		var root *graphql.Object
+		if op.Operation == ast.OperationTypeQuery {
+			root = schema.QueryType()
+		}
+
+		c.selections(op.SelectionSet, root, 1, 1, map[string]bool{})
+		if c.depth > graphqlMaxDepth {
+			return errors.New(fmt.Sprintf("GraphQL query is nested more than %d levels deep", graphqlMaxDepth))
+		}
+
+		if c.cost > graphqlMaxComplexity {
+			return errors.New(fmt.Sprintf("GraphQL query may resolve more than %d fields", graphqlMaxComplexity))
+		}
+	}
+
+	return nil
+}
+
+// selections adds the cost of a selection set of the given object type at
+// the given depth, where each field is resolved count times. The walk stops
+// once either limit is exceeded. Fragments which are already being expanded
+// are skipped as graphql.Do refuses cycles.
+func (c *graphqlCost) selections(set *ast.SelectionSet, typ *graphql.Object, depth int, count int, expanding map[string]bool) {
+	if set == nil {
+		return
+	}
+
+	if depth > c.depth {
+		c.depth = depth
+	}
+
+	for _, selection := range set.Selections {
+		if c.depth > graphqlMaxDepth || c.cost > graphqlMaxComplexity {
+			return
+		}
+
+		switch sel := selection.(type) {
+		case *ast.Field:
+			c.cost += count
+
+			var def *graphql.FieldDefinition
+			if typ != nil && sel.Name != nil {
+				def = typ.Fields()[sel.Name.Value]
+			}
+
+			var child *graphql.Object
+			n := count
+			if def != nil {
+				child, _ = graphql.GetNamed(def.Type).(*graphql.Object)
+				n = count * c.listSize(def, sel)
+			}
+
+			c.selections(sel.SelectionSet, child, depth+1, n, expanding)
+
+		case *ast.InlineFragment:
+			c.selections(sel.SelectionSet, c.fragmentType(sel.TypeCondition, typ), depth, count, expanding)
+
+		case *ast.FragmentSpread:
+			if sel.Name == nil || expanding[sel.Name.Value] {
+				continue
+			}
+
+			if fragment, ok := c.fragments[sel.Name.Value]; ok {
+				expanding[sel.Name.Value] = true
+				c.selections(fragment.SelectionSet, c.fragmentType(fragment.TypeCondition, typ), depth, count, expanding)
+				delete(expanding, sel.Name.Value)
+			}
+		}
+	}
+}
+
+// fragmentType returns the object type named by a type condition.
+func (c *graphqlCost) fragmentType(named *ast.Named, typ *graphql.Object) *graphql.Object {
+	if named == nil || named.Name == nil {
+		return typ
+	}
+
+	obj, _ := c.schema.Type(named.Name.Value).(*graphql.Object)
+	return obj
+}
+
+// listSize returns the number of CIs a field may return, which is the value
+// of its first argument for list fields and one for other fields.
+func (c *graphqlCost) listSize(def *graphql.FieldDefinition, field *ast.Field) int {
+	var first *graphql.Argument
+	for _, arg := range def.Args {
+		if arg.PrivateName == "first" {
+			first = arg
+		}
+	}
+
+	if first == nil {
+		return 1
+	}
+
+	size := graphqlDefaultLimit
+	for _, arg := range field.Arguments {
+		if arg.Name == nil || arg.Name.Value != "first" {
+			continue
+		}
+
+		value := arg.Value
+		if v, ok := value.(*ast.Variable); ok && v.Name != nil {
+			if given, ok := c.variables[v.Name.Value]; ok {
+				// Values which are not numbers are costed at the limit
+				size = graphqlMaxLimit
+				if n, ok := given.(float64); ok {
+					size = int(n)
+				}
+			} else if def, ok := c.defaults[v.Name.Value]; ok {
+				value = def
+			}
+		}
+
+		if n, ok := value.(*ast.IntValue); ok {
+			size, _ = strconv.Atoi(n.Value)
+		}
+	}
+
+	// Values out of range are refused when the field is resolved
+	if size < 1 || size > graphqlMaxLimit {
+		return 1
+	}
+
+	return size
+}
+
+// GraphQL executes a GraphQL query against the CIs of a CMDB.
+func GraphQL(res http.ResponseWriter, req *http.Request) {
+	cmdb := GetPathVar(req, "cmdb")
+	db := GetCmdbBackend(req, cmdb)
+	if db == nil {
+		log.Printf("No such CMDB found: %s", cmdb)
+		ErrNotFound(res, req)
+		return
+	}
+
+	req.Body = http.MaxBytesReader(res, req.Body, graphqlMaxBodySize)
+	request, err := getGraphQLRequest(req)
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
+	schema, err := GetGraphQLSchema(db)
+	if Handle(res, req, err) {
+		return
+	}
+
+	err = checkGraphQLCost(&schema, request)
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
+	ctx := &graphqlContext{db: db, cache: map[string]*CI{}}
+	result := graphql.Do(graphql.Params{
+		Schema:         schema,
+		RequestString:  request.Query,
+		VariableValues: request.Variables,
+		OperationName:  request.OperationName,
+		Context:        context.WithValue(req.Context(), graphqlContextKey{}, ctx),
+	})
+
+	RenderJson(res, req, http.StatusOK, result)
+}
@@ -0,0 +1,219 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/graphql-go/graphql"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+)
+
+func testGraphQLTypes() []CIType {
+	return []CIType{
+		{
+			Name:      "Rack",
+			ShortName: "rack",
+			Attributes: CITypeAttributeList{
+				{Name: "Location", ShortName: "location", Type: "string"},
+			},
+		},
+		{
+			Name:      "Server",
+			ShortName: "server",
+			Attributes: CITypeAttributeList{
+				{Name: "Hostname", ShortName: "hostname", Type: "string"},
+				{Name: "CPU Count", ShortName: "cpu-count", Type: "number"},
+				{Name: "Rack", ShortName: "rack", Type: "reference", Target: "rack"},
+				{Name: "OS", ShortName: "os", Type: "group", Children: CITypeAttributeList{
+					{Name: "Name", ShortName: "name", Type: "string"},
+				}},
+			},
+		},
+		{
+			Name:      "Network Interface",
+			ShortName: "network-interface",
+			Attributes: CITypeAttributeList{
+				{Name: "MAC", ShortName: "mac", Type: "string"},
+				{Name: "Server", ShortName: "server", Type: "reference", Target: "server"},
+			},
+		},
+	}
+}
+
+func TestGraphQLName(t *testing.T) {
+	areEqual(t, graphqlName("server"), "server")
+	areEqual(t, graphqlName("ip-address"), "ipAddress")
+	areEqual(t, graphqlName("cpu_count"), "cpuCount")
+	areEqual(t, graphqlName("2nd-nic"), "_2ndNic")
+	areEqual(t, graphqlTypeName("network-interface"), "NetworkInterface")
+}
+
+func TestReferenceFormat(t *testing.T) {
+	att := &CITypeAttribute{Name: "Rack", ShortName: "rack", Type: "reference", Target: "rack"}
+
+	var val interface{} = "0123456789ABCDEF01234567"
+	err := GetAttributeFormat("reference").Validate(att, &val)
+	if err != nil {
+		t.Errorf("Expected valid reference but got: %s", err)
+	}
+	areEqual(t, val, "0123456789abcdef01234567")
+
+	val = "rack-01"
+	if GetAttributeFormat("reference").Validate(att, &val) == nil {
+		t.Errorf("Expected invalid CI id to be rejected")
+	}
+
+	citype := &CIType{Name: "Server", Attributes: CITypeAttributeList{{Name: "Rack", Type: "reference"}}}
+	if citype.Validate() == nil {
+		t.Errorf("Expected reference without a target CI Type to be rejected")
+	}
+}
+
+func TestGraphQLSchema(t *testing.T) {
+	schema, err := NewGraphQLSchema(testGraphQLTypes())
+	if err != nil {
+		t.Fatalf("Error generating GraphQL schema: %s", err)
+	}
+
+	fields := schema.QueryType().Fields()
+	for _, name := range []string{"server", "serverList", "rack", "rackList", "networkInterface", "networkInterfaceList"} {
+		if fields[name] == nil {
+			t.Errorf("Expected query field '%s'", name)
+		}
+	}
+
+	server := schema.Type("Server").(*graphql.Object).Fields()
+	for _, name := range []string{"id", "revision", "hostname", "cpuCount", "rack", "os", "networkInterfaceListByServer"} {
+		if server[name] == nil {
+			t.Errorf("Expected Server field '%s'", name)
+		}
+	}
+
+	areEqual(t, server["rack"].Type.Name(), "Rack")
+	areEqual(t, server["os"].Type.Name(), "Server_Os")
+	if schema.Type("ServerWhere") == nil {
+		t.Errorf("Expected ServerWhere input type")
+	}
+}
+
+func TestGraphQLCost(t *testing.T) {
+	schema, err := NewGraphQLSchema(testGraphQLTypes())
+	if err != nil {
+		t.Fatalf("Error generating GraphQL schema: %s", err)
+	}
+
+	deep := "{ server(id: \"1\") " + strings.Repeat("{ rack ", graphqlMaxDepth) + "{ id }" + strings.Repeat(" }", graphqlMaxDepth) + " }"
+	tests := []struct {
+		Query     string
+		Variables map[string]interface{}
+		Valid     bool
+	}{
+		{`{ serverList { hostname rack { location } } }`, nil, true},
+		{`{ serverList(first: 1000) { hostname cpuCount } }`, nil, true},
+		{`query ($n: Int) { serverList(first: $n) { id networkInterfaceListByServer(first: $n) { mac } } }`, map[string]interface{}{"n": float64(100)}, true},
+		{`query ($n: Int) { serverList(first: $n) { id networkInterfaceListByServer(first: $n) { mac } } }`, map[string]interface{}{"n": float64(1000)}, false},
+		{`query ($n: Int = 1000) { serverList(first: $n) { id networkInterfaceListByServer(first: $n) { mac } } }`, nil, false},
+		{`query ($n: Int = 1000) { serverList(first: $n) { id networkInterfaceListByServer(first: $n) { mac } } }`, map[string]interface{}{"n": float64(10)}, true},
+		{`{ serverList(first: 1000) { ...nics } } fragment nics on Server { networkInterfaceListByServer { mac } }`, nil, false},
+		{`{ serverList(first: 1000) { ... on Server { networkInterfaceListByServer { mac } } } }`, nil, false},
+		{`{ serverList { ...a } } fragment a on Server { ...a }`, nil, true},
+		{deep, nil, false},
+		{`{ not valid`, nil, true},
+	}
+
+	for _, test := range tests {
+		err := checkGraphQLCost(&schema, &GraphQLRequest{Query: test.Query, Variables: test.Variables})
+		if (err == nil) != test.Valid {
+			t.Errorf("Expected valid=%v for query %s but got: %v", test.Valid, test.Query, err)
+		}
+	}
+}
+
+func TestGraphQLWhereQuery(t *testing.T) {
+	citype := testGraphQLTypes()[1]
+	query := bson.M{}
+	whereQuery(query, map[string]interface{}{
+		"hostname": "web01",
+		"cpuCount": 4.0,
+		"os":       map[string]interface{}{"name": "Linux"},
+	}, &citype.Attributes, "value.")
+
+	areEqual(t, query["value.hostname"], "web01")
+	areEqual(t, query["value.cpu-count"], 4.0)
+	areEqual(t, query["value.os.name"], "Linux")
+}
+
+func TestGraphQLResolveCached(t *testing.T) {
+	schema, _ := NewGraphQLSchema(testGraphQLTypes())
+
+	// Referenced CIs are resolved from the request cache without a database
+	rack := &CI{Value: map[string]interface{}{"location": "DC1"}}
+	rack.Id = bson.ObjectIdHex("0123456789abcdef01234567")
+	server := &CI{Value: map[string]interface{}{"hostname": "web01", "rack": IdToString(rack.Id), "os": map[string]interface{}{"name": "Linux"}}}
+	server.Id = bson.ObjectIdHex("0123456789abcdef01234568")
+
+	ctx := &graphqlContext{cache: map[string]*CI{
+		"rack/" + IdToString(rack.Id):     rack,
+		"server/" + IdToString(server.Id): server,
+	}}
+
+	result := graphql.Do(graphql.Params{
+		Schema:        schema,
+		RequestString: fmt.Sprintf(`{ server(id: "%s") { hostname os { name } rack { id location } } }`, IdToString(server.Id)),
+		Context:       context.WithValue(context.Background(), graphqlContextKey{}, ctx),
+	})
+	if len(result.Errors) > 0 {
+		t.Fatalf("GraphQL query failed: %v", result.Errors)
+	}
+
+	b, _ := json.Marshal(result.Data)
+	areEqual(t, string(b), `{"server":{"hostname":"web01","os":{"name":"Linux"},"rack":{"id":"0123456789abcdef01234567","location":"DC1"}}}`)
+}
+
+func TestGraphQL(t *testing.T) {
+	rackType := Post(t, V1Uri("/cmdbs/temp/citypes"), `{"name":"GraphQL Rack","attributes":[{"name":"location","type":"string"}]}`)
+	defer Delete(t, rackType)
+
+	serverType := Post(t, V1Uri("/cmdbs/temp/citypes"), `{
+		"name":"GraphQL Server",
+		"attributes":[
+			{ "name":"hostname", "type":"string" },
+			{ "name":"rack", "type":"reference", "target":"graphql-rack" }
+		]
+	}`)
+	defer Delete(t, serverType)
+
+	rack := path.Base(Post(t, V1Uri("/cmdbs/temp/graphql-rack"), `{"location":"DC1"}`))
+	Post(t, V1Uri("/cmdbs/temp/graphql-server"), fmt.Sprintf(`{"hostname":"web01","rack":"%s"}`, rack))
+	Post(t, V1Uri("/cmdbs/temp/graphql-server"), `{"hostname":"web02"}`)
+
+	query := `{"query":"{ graphqlServerList(where: {hostname: \"web01\"}) { hostname rack { location graphqlServerListByRack { hostname } } } }"}`
+	req := NewRequest("POST", V1Uri("/cmdbs/temp/graphql"), strings.NewReader(query))
+	req.Header.Set("Content-Type", "application/json")
+	res := httptest.NewRecorder()
+	GetServer().ServeHTTP(res, req)
+	areEqual(t, res.Code, http.StatusOK)
+	areEqual(t, res.Body.String(), `{"data":{"graphqlServerList":[{"hostname":"web01","rack":{"graphqlServerListByRack":[{"hostname":"web01"}],"location":"DC1"}}]}}`)
+}
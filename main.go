@@ -23,6 +23,7 @@ import (
 	"github.com/codegangsta/negroni"
 	"github.com/gorilla/mux"
 	"log"
+	"net/http"
 	"os"
 )
 
@@ -104,52 +105,104 @@ func GetServer() *negroni.Negroni {
 	pub := mux.NewRouter().PathPrefix(ApiV1Prefix).Subrouter()
 	pub.HandleFunc("/info", GetApiInfo).Methods("GET")
 	pub.HandleFunc("/apikey", GetApiKey).Methods("POST")
+	pub.HandleFunc("/sessions", CreateSession).Methods("POST")
+	pub.HandleFunc("/auth/oidc/login", OidcLogin).Methods("GET")
+	pub.HandleFunc("/auth/oidc/callback", OidcCallback).Methods("GET")
+	pub.HandleFunc("/auth/oidc/totp", OidcVerifyTotp).Methods("POST")
 
-	// Init private routes
+	// Init private routes. GET routes which address a single resource are
+	// named so that the audit log can hash their state.
 	priv := mux.NewRouter().PathPrefix(ApiV1Prefix).Subrouter()
 
 	// User routes
 	priv.HandleFunc("/users", GetUsers).Methods("GET")
 	priv.HandleFunc("/users", AddUser).Methods("POST")
 	priv.HandleFunc("/users/current", GetCurrentUser).Methods("GET")
-	priv.HandleFunc("/users/{email}", GetUserByEmail).Methods("GET")
+	priv.HandleFunc("/users/current/totp", EnrolTotp).Methods("POST")
+	priv.HandleFunc("/users/current/totp", DisableTotp).Methods("DELETE")
+	priv.HandleFunc("/users/current/totp/verify", VerifyTotp).Methods("POST")
+	priv.HandleFunc("/users/{email}", GetUserByEmail).Methods("GET").Name("user")
 	priv.HandleFunc("/users/{email}", DeleteUserByEmail).Methods("DELETE")
 	priv.HandleFunc("/users/{email}/password", SetUserPassword).Methods("PATCH")
 
+	// Audit routes
+	priv.HandleFunc("/audit", GetAuditRecords).Methods("GET")
+	priv.HandleFunc("/audit/verify", VerifyAuditRecords).Methods("GET")
+
+	// Security routes
+	priv.HandleFunc("/sessions/current", DeleteCurrentSession).Methods("DELETE")
+	priv.HandleFunc("/security/events", GetSecurityEvents).Methods("GET")
+
 	// Tenant routes
 	priv.HandleFunc("/tenants", GetTenants).Methods("GET")
 	priv.HandleFunc("/tenants", AddTenant).Methods("POST")
 	priv.HandleFunc("/tenants/current", GetCurrentTenant).Methods("GET")
-	priv.HandleFunc("/tenants/{code}", GetTenantByCode).Methods("GET")
+	priv.HandleFunc("/tenants/current/policy", SetTenantPolicy).Methods("PATCH")
+	priv.HandleFunc("/tenants/{code}", GetTenantByCode).Methods("GET").Name("tenant")
 	priv.HandleFunc("/tenants/{code}", DeleteTenantByCode).Methods("DELETE")
 
+	// Change feed routes
+	priv.HandleFunc("/changes", StreamChanges).Methods("GET")
+	priv.HandleFunc("/changes/ws", StreamChangesWebSocket).Methods("GET")
+	priv.HandleFunc("/cmdbs/{cmdb}/changes", StreamChanges).Methods("GET")
+	priv.HandleFunc("/cmdbs/{cmdb}/changes/ws", StreamChangesWebSocket).Methods("GET")
+	priv.HandleFunc("/cmdbs/{cmdb}/{citype}/changes", StreamChanges).Methods("GET")
+	priv.HandleFunc("/cmdbs/{cmdb}/{citype}/changes/ws", StreamChangesWebSocket).Methods("GET")
+
 	// CMDB routes
 	priv.HandleFunc("/cmdbs", GetCmdbs).Methods("GET")
 	priv.HandleFunc("/cmdbs", AddCmdb).Methods("POST")
-	priv.HandleFunc("/cmdbs/{name}", GetCmdbByName).Methods("GET")
+	priv.HandleFunc("/cmdbs/{name}", GetCmdbByName).Methods("GET").Name("cmdb")
 	priv.HandleFunc("/cmdbs/{name}", DeleteCmdbByName).Methods("DELETE")
 
+	// Webhook routes
+	priv.HandleFunc("/cmdbs/{cmdb}/webhooks", GetWebhooks).Methods("GET")
+	priv.HandleFunc("/cmdbs/{cmdb}/webhooks", AddWebhook).Methods("POST")
+	priv.HandleFunc("/cmdbs/{cmdb}/webhooks/{name}", GetWebhookByName).Methods("GET").Name("webhook")
+	priv.HandleFunc("/cmdbs/{cmdb}/webhooks/{name}", UpdateWebhookByName).Methods("PUT")
+	priv.HandleFunc("/cmdbs/{cmdb}/webhooks/{name}", DeleteWebhookByName).Methods("DELETE")
+	priv.HandleFunc("/cmdbs/{cmdb}/webhooks/{name}/test", TestWebhook).Methods("POST")
+	priv.HandleFunc("/cmdbs/{cmdb}/webhooks/{name}/deliveries", GetWebhookDeliveries).Methods("GET")
+	priv.HandleFunc("/cmdbs/{cmdb}/webhooks/{name}/deliveries/{id}/retry", RetryWebhookDelivery).Methods("POST")
+
 	// CI Type routes
 	priv.HandleFunc("/cmdbs/{cmdb}/citypes", GetCITypes).Methods("GET")
 	priv.HandleFunc("/cmdbs/{cmdb}/citypes", AddCIType).Methods("POST")
-	priv.HandleFunc("/cmdbs/{cmdb}/citypes/{name}", GetCITypeByName).Methods("GET")
+	priv.HandleFunc("/cmdbs/{cmdb}/citypes/{name}", GetCITypeByName).Methods("GET").Name("citype")
 	priv.HandleFunc("/cmdbs/{cmdb}/citypes/{name}", UpdateCITypeByName).Methods("PUT")
 	priv.HandleFunc("/cmdbs/{cmdb}/citypes/{name}", DeleteCITypeByName).Methods("DELETE")
+	priv.HandleFunc("/cmdbs/{cmdb}/citypes/{name}/rules/test", TestCITypeRules).Methods("POST")
+
+	// GraphQL routes
+	priv.HandleFunc("/cmdbs/{cmdb}/graphql", GraphQL).Methods("GET", "POST")
+
+	// Search routes
+	priv.HandleFunc("/cmdbs/{cmdb}/search", SearchCIs).Methods("GET")
+	priv.HandleFunc("/cmdbs/{cmdb}/search/reindex", ReindexSearch).Methods("POST")
 
 	// CI routes
 	priv.HandleFunc("/cmdbs/{cmdb}/{citype}", GetCIs).Methods("GET")
 	priv.HandleFunc("/cmdbs/{cmdb}/{citype}", AddCI).Methods("POST")
-	priv.HandleFunc("/cmdbs/{cmdb}/{citype}/{id}", GetCIById).Methods("GET")
+	priv.HandleFunc("/cmdbs/{cmdb}/{citype}", UpsertCI).Methods("PUT")
+	priv.HandleFunc("/cmdbs/{cmdb}/{citype}/bulk", AddCIs).Methods("POST")
+	priv.HandleFunc("/cmdbs/{cmdb}/{citype}/reconcile", ReconcileCI).Methods("POST")
+	priv.HandleFunc("/cmdbs/{cmdb}/{citype}/aggregate", AggregateCIs).Methods("GET")
+	priv.HandleFunc("/cmdbs/{cmdb}/{citype}/{id}", GetCIById).Methods("GET").Name("ci")
 	priv.HandleFunc("/cmdbs/{cmdb}/{citype}/{id}", DeleteCIById).Methods("DELETE")
 
 	// Init Negroni with public routes
-	n := negroni.New(negroni.NewRecovery(), NewLogger())
+	n := negroni.New(NewRequestIdHandler(), NewRecovery(), NewLogger())
 	n.UseHandler(pub)
 
 	// If the public router can't find a match, pass the request to the
 	// private Negroni instance
-	npriv := negroni.New(NewAuthHandler())
+	npriv := negroni.New(NewAuthHandler(), NewAuditHandler(priv))
 	npriv.UseHandler(priv)
+
+	// Batched requests are performed by the private Negroni instance
+	priv.Handle("/batch", NewBatchHandler(npriv)).Methods("POST")
+	priv.NotFoundHandler = http.HandlerFunc(ErrNotFound)
+	priv.MethodNotAllowedHandler = http.HandlerFunc(ErrMethodNotAllowed)
 	pub.NotFoundHandler = npriv
 
 	return n
@@ -162,6 +215,33 @@ func Serve() {
 		log.Fatal(err)
 	}
 
+	// The same handler serves HTTP requests and message bus commands
 	n := GetServer()
+
+	// Start background workers
+	webhookDispatcher.AllowPrivate = config.Server.WebhookAllowPrivate
+	webhookDispatcher.Start()
+
+	publisher, err := NewPublisher(&config.Bus)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if publisher != nil {
+		StartBus(publisher, config.Bus.Prefix)
+
+		if config.Bus.CommandQueue != "" {
+			consumer, ok := publisher.(Consumer)
+			if !ok {
+				log.Fatalf("Message bus driver %s does not support consuming commands", config.Bus.Driver)
+			}
+
+			err = StartCommandConsumer(consumer, publisher, n, config.Bus.Prefix, config.Bus.CommandQueue)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
 	n.Run(fmt.Sprintf("%s:%d", config.Server.ListenOn, config.Server.ListenPort))
 }
@@ -31,6 +31,7 @@ type model struct {
 	Id       interface{} `json:"-" xml:"-" bson:"_id,omitempty"`
 	Created  time.Time   `json:"-" xml:"-" bson:"created"`
 	Modified time.Time   `json:"-" xml:"-" bson:"modified"`
+	Revision int         `json:"-" xml:"-" bson:"revision"`
 }
 
 type tenantedModel struct {
@@ -45,6 +46,7 @@ func (c *model) InitModel() {
 	}
 
 	c.Modified = now
+	c.Revision++
 
 	if c.Id == nil {
 		c.Id = NewId()
@@ -53,4 +55,5 @@ func (c *model) InitModel() {
 
 func (c *model) SetModified() {
 	c.Modified = time.Now()
+	c.Revision++
 }
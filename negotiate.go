@@ -0,0 +1,169 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// mediaFormat maps a media type which may be requested in an Accept header
+// to an output format.
+type mediaFormat struct {
+	MediaType string
+	Format    string
+}
+
+// mediaFormats are the media types of resources.
+var mediaFormats = []mediaFormat{
+	{"application/json", "json"},
+	{"application/xml", "xml"},
+	{"text/xml", "xml"},
+	{"application/yaml", "yaml"},
+	{"application/x-yaml", "yaml"},
+	{"text/yaml", "yaml"},
+	{"text/x-yaml", "yaml"},
+	{"text/csv", "csv"},
+}
+
+// problemFormats are the media types of problem documents.
+var problemFormats = []mediaFormat{
+	{"application/problem+json", "json"},
+	{"application/json", "json"},
+	{"application/problem+xml", "xml"},
+	{"application/xml", "xml"},
+	{"text/xml", "xml"},
+}
+
+// mediaRange is a single media range of an Accept header.
+type mediaRange struct {
+	Type    string
+	Subtype string
+	Quality float64
+}
+
+// parseAccept parses the media ranges of an Accept header. Malformed ranges
+// are ignored.
+func parseAccept(header string) []mediaRange {
+	ranges := []mediaRange{}
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		mtype := strings.ToLower(strings.TrimSpace(params[0]))
+		slash := strings.Index(mtype, "/")
+		if slash < 1 || slash == len(mtype)-1 {
+			continue
+		}
+
+		r := mediaRange{
+			Type:    mtype[:slash],
+			Subtype: mtype[slash+1:],
+			Quality: 1,
+		}
+
+		if r.Type == "*" && r.Subtype != "*" {
+			continue
+		}
+
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.ToLower(strings.TrimSpace(kv[0])) == "q" {
+				q, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+				if err != nil || q < 0 || q > 1 {
+					q = 0
+				}
+				r.Quality = q
+			}
+		}
+
+		ranges = append(ranges, r)
+	}
+
+	return ranges
+}
+
+// acceptQuality returns the quality of the given media type according to the
+// most specific matching media range, or zero if none match.
+func acceptQuality(ranges []mediaRange, mediaType string) float64 {
+	slash := strings.Index(mediaType, "/")
+	typ, subtype := mediaType[:slash], mediaType[slash+1:]
+
+	quality := 0.0
+	specificity := -1
+	for _, r := range ranges {
+		s := -1
+		switch {
+		case r.Type == typ && r.Subtype == subtype:
+			s = 2
+		case r.Type == typ && r.Subtype == "*":
+			s = 1
+		case r.Type == "*" && r.Subtype == "*":
+			s = 0
+		}
+
+		if s > specificity {
+			specificity = s
+			quality = r.Quality
+		}
+	}
+
+	return quality
+}
+
+// NegotiateFormat returns which of the given output formats should be used
+// to respond to a request. The format query parameter takes precedence over
+// the Accept header. The first format is used if neither is specified and an
+// empty string is returned if no acceptable format is available.
+func NegotiateFormat(req *http.Request, formats ...string) string {
+	return negotiateFormat(req, mediaFormats, formats)
+}
+
+func negotiateFormat(req *http.Request, types []mediaFormat, formats []string) string {
+	if format := req.URL.Query().Get("format"); format != "" {
+		for _, f := range formats {
+			if f == format {
+				return f
+			}
+		}
+
+		return ""
+	}
+
+	header := req.Header.Get("Accept")
+	if strings.TrimSpace(header) == "" {
+		return formats[0]
+	}
+
+	ranges := parseAccept(header)
+	best := ""
+	bestQuality := 0.0
+	for _, f := range formats {
+		for _, m := range types {
+			if m.Format != f {
+				continue
+			}
+
+			if q := acceptQuality(ranges, m.MediaType); q > bestQuality {
+				best = f
+				bestQuality = q
+			}
+		}
+	}
+
+	return best
+}
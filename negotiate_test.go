@@ -0,0 +1,150 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		Query  string
+		Accept string
+		Format string
+	}{
+		{"", "", "json"},
+		{"", "*/*", "json"},
+		{"", "application/xml", "xml"},
+		{"", "text/xml;q=0.5, application/json;q=0.4", "xml"},
+		{"", "application/json;q=0.1, application/*;q=0.9", "xml"},
+		{"", "application/json;q=0.9, application/*;q=0.1", "json"},
+		{"", "application/json;q=0, application/*", "xml"},
+		{"", "application/*, application/xml;q=0", "json"},
+		{"", "text/csv, */*;q=0.1", "csv"},
+		{"", "text/html", ""},
+		{"", "application/json;q=0", ""},
+		{"?format=xml", "application/json", "xml"},
+		{"?format=yaml", "", ""},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/"+test.Query, nil)
+		if test.Accept != "" {
+			req.Header.Set("Accept", test.Accept)
+		}
+
+		format := NegotiateFormat(req, "json", "xml", "csv")
+		if format != test.Format {
+			t.Errorf("Expected format '%s' for Accept '%s' but got '%s'", test.Format, test.Accept, format)
+		}
+	}
+}
+
+func TestRenderNotAcceptable(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "text/csv")
+	res := httptest.NewRecorder()
+	Render(res, req, http.StatusOK, M{"a": 1})
+
+	areEqual(t, res.Code, http.StatusNotAcceptable)
+	areEqual(t, res.Header().Get("Vary"), "Accept")
+
+	req.Header.Set("Accept", "text/xml, application/json;q=0.5")
+	res = httptest.NewRecorder()
+	Render(res, req, http.StatusOK, []string{"a"})
+
+	areEqual(t, res.Code, http.StatusOK)
+	areEqual(t, res.Header().Get("Content-Type"), "application/xml")
+}
+
+func TestBind(t *testing.T) {
+	type Doc struct {
+		Name  string   `json:"name" xml:"name"`
+		Count int      `json:"count" xml:"count"`
+		Tags  []string `json:"tags" xml:"tag"`
+	}
+
+	tests := []struct {
+		ContentType string
+		Body        string
+	}{
+		{"application/json", `{"name":"test","count":2,"tags":["a","b"]}`},
+		{"application/json; charset=utf-8", `{"name":"test","count":2,"tags":["a","b"]}`},
+		{"application/xml", `<doc><name>test</name><count>2</count><tag>a</tag><tag>b</tag></doc>`},
+		{"text/xml; charset=UTF-8", `<doc><name>test</name><count>2</count><tag>a</tag><tag>b</tag></doc>`},
+		{"application/yaml", "name: test\ncount: 2\ntags:\n  - a\n  - b\n"},
+		{"text/x-yaml", "{name: test, count: 2, tags: [a, b]}"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(test.Body))
+		req.Header.Set("Content-Type", test.ContentType)
+
+		var doc Doc
+		if err := Bind(req, &doc); err != nil {
+			t.Errorf("Failed to bind %s: %s", test.ContentType, err)
+			continue
+		}
+
+		if doc.Name != "test" || doc.Count != 2 || len(doc.Tags) != 2 || doc.Tags[1] != "b" {
+			t.Errorf("Incorrectly bound %s: %#v", test.ContentType, doc)
+		}
+	}
+
+	// YAML maps decode to string keyed maps
+	req := httptest.NewRequest("POST", "/", strings.NewReader("value:\n  1: one\n  nested: {a: b}\n"))
+	req.Header.Set("Content-Type", "application/yaml")
+	var ci CI
+	if err := Bind(req, &ci); err != nil {
+		t.Fatalf("Failed to bind YAML CI: %s", err)
+	}
+
+	areEqual(t, ci.Value["1"], "one")
+	if _, ok := ci.Value["nested"].(map[string]interface{}); !ok {
+		t.Errorf("Expected nested YAML map to have string keys but got %#v", ci.Value["nested"])
+	}
+
+	// XML maps decode to the same values as JSON
+	req = httptest.NewRequest("POST", "/", strings.NewReader(`<CI><name>web01</name><cpus type="number">4</cpus><nics><nic>eth0</nic><nic>eth1</nic></nics><disk><size type="number">20.5</size></disk></CI>`))
+	req.Header.Set("Content-Type", "application/xml")
+	var value map[string]interface{}
+	if err := Bind(req, &value); err != nil {
+		t.Fatalf("Failed to bind XML map: %s", err)
+	}
+
+	areEqual(t, value["name"], "web01")
+	areEqual(t, value["cpus"], float64(4))
+	if nics, ok := value["nics"].(map[string]interface{}); !ok || len(nics["nic"].([]interface{})) != 2 {
+		t.Errorf("Expected repeated XML elements to bind as an array but got %#v", value["nics"])
+	}
+	if disk, ok := value["disk"].(map[string]interface{}); !ok || disk["size"] != 20.5 {
+		t.Errorf("Expected nested XML elements to bind as a map but got %#v", value["disk"])
+	}
+
+	// Unsupported media types and character sets
+	for _, ctype := range []string{"", "text/plain", "application/json; charset=latin1", "application/json; charset"} {
+		req := httptest.NewRequest("POST", "/", strings.NewReader("{}"))
+		req.Header.Set("Content-Type", ctype)
+		if err := Bind(req, &M{}); err == nil {
+			t.Errorf("Expected an error binding content type '%s'", ctype)
+		}
+	}
+}
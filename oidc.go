@@ -0,0 +1,635 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcLoginCollection = "oidclogins"
+	oidcLoginTimeout    = 10 * time.Minute
+	oidcClockSkew       = time.Minute
+)
+
+// oidcDiscovery is the subset of the OpenID Provider metadata document used
+// by the relying party.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+// oidcLogin stores the state of a login between redirecting the browser to the
+// identity provider and receiving the authorization code. Logins by users who
+// have enrolled in two factor authentication are stored again with the user
+// until a code is given.
+type oidcLogin struct {
+	model    `bson:",inline"`
+	State    string
+	Nonce    string
+	Verifier string
+	UserId   interface{} `bson:",omitempty"`
+	Provider string      `bson:",omitempty"`
+}
+
+// OidcTotpChallenge is returned by the OpenID callback instead of a session
+// when the user must also give a two factor authentication code.
+type OidcTotpChallenge struct {
+	Token   string    `json:"totpToken"`
+	Expires time.Time `json:"expires"`
+}
+
+// OidcProvider is an OpenID Connect relying party which uses the authorization
+// code flow with PKCE to authenticate users.
+type OidcProvider struct {
+	Config *OidcConfig
+	Client *http.Client
+
+	mutex     sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+}
+
+var oidcProvider *OidcProvider
+
+// GetOidcProvider returns the singleton OpenID Connect relying party for the
+// global configuration.
+func GetOidcProvider() (*OidcProvider, error) {
+	if oidcProvider == nil {
+		config, err := GetConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		if config.Auth.Oidc.Issuer == "" {
+			return nil, errors.New("OpenID Connect is not configured")
+		}
+
+		oidcProvider = &OidcProvider{Config: &config.Auth.Oidc}
+	}
+
+	return oidcProvider, nil
+}
+
+func (c *OidcProvider) client() *http.Client {
+	if c.Client != nil {
+		return c.Client
+	}
+
+	return http.DefaultClient
+}
+
+func (c *OidcProvider) getJson(uri string, v interface{}) error {
+	res, err := c.client().Get(uri)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("Unexpected response from %s: %s", uri, res.Status))
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// getDiscovery returns the provider metadata from the issuer's discovery
+// document, fetching it on first use.
+func (c *OidcProvider) getDiscovery() (*oidcDiscovery, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.discovery == nil {
+		issuer := strings.TrimSuffix(c.Config.Issuer, "/")
+
+		var discovery oidcDiscovery
+		err := c.getJson(issuer+"/.well-known/openid-configuration", &discovery)
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.TrimSuffix(discovery.Issuer, "/") != issuer {
+			return nil, errors.New(fmt.Sprintf("OpenID discovery document issuer '%s' does not match '%s'", discovery.Issuer, c.Config.Issuer))
+		}
+
+		c.discovery = &discovery
+	}
+
+	return c.discovery, nil
+}
+
+// getKey returns the public key with the given ID from the issuer's JSON Web
+// Key Set. The key set is refreshed if the key is not already known so that
+// keys may be rotated by the issuer.
+func (c *OidcProvider) getKey(kid string) (*rsa.PublicKey, error) {
+	discovery, err := c.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+
+	err = c.getJson(discovery.JwksUri, &jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	c.keys = map[string]*rsa.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid modulus in JSON Web Key '%s'", jwk.Kid))
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid exponent in JSON Web Key '%s'", jwk.Kid))
+		}
+
+		c.keys[jwk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	key, ok := c.keys[kid]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("No JSON Web Key found with ID '%s'", kid))
+	}
+
+	return key, nil
+}
+
+// PkceChallenge returns the S256 code challenge for a PKCE code verifier.
+func PkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeUrl returns the identity provider URL to which the browser should be
+// redirected to begin a login.
+func (c *OidcProvider) AuthCodeUrl(state string, nonce string, verifier string) (string, error) {
+	discovery, err := c.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.Config.ClientId},
+		"redirect_uri":          {c.Config.RedirectUrl},
+		"scope":                 {strings.Join(c.Config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {PkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+
+	return discovery.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+// Exchange redeems an authorization code at the token endpoint and returns the
+// identity asserted by the validated ID token.
+func (c *OidcProvider) Exchange(code string, verifier string, nonce string) (*ExternalIdentity, error) {
+	discovery, err := c.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {c.Config.RedirectUrl},
+		"client_id":     {c.Config.ClientId},
+		"code_verifier": {verifier},
+	}
+
+	req, err := http.NewRequest("POST", discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if c.Config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(c.Config.ClientId), url.QueryEscape(c.Config.ClientSecret))
+	}
+
+	res, err := c.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("OpenID token request failed: %s", res.Status))
+	}
+
+	var token struct {
+		IdToken string `json:"id_token"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&token)
+	if err != nil {
+		return nil, err
+	}
+
+	if token.IdToken == "" {
+		return nil, errors.New("No ID token was returned by the OpenID token endpoint")
+	}
+
+	claims, err := c.VerifyIdToken(token.IdToken, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.MapClaims(claims)
+}
+
+// VerifyIdToken validates the signature, issuer, audience, expiry and nonce of
+// an ID token and returns its claims.
+func (c *OidcProvider) VerifyIdToken(raw string, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Malformed ID token")
+	}
+
+	// Decode the header
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := decodeJwtSegment(parts[0], &header)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Alg != "RS256" {
+		return nil, errors.New(fmt.Sprintf("Unsupported ID token signing algorithm: %s", header.Alg))
+	}
+
+	// Validate the signature
+	key, err := c.getKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("Malformed ID token signature")
+	}
+
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig)
+	if err != nil {
+		return nil, errors.New("Invalid ID token signature")
+	}
+
+	// Validate the claims
+	var claims map[string]interface{}
+	err = decodeJwtSegment(parts[1], &claims)
+	if err != nil {
+		return nil, err
+	}
+
+	discovery, err := c.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	if iss, _ := claims["iss"].(string); iss != discovery.Issuer {
+		return nil, errors.New(fmt.Sprintf("Unexpected ID token issuer: %s", iss))
+	}
+
+	if !containsClaim(claims["aud"], c.Config.ClientId) {
+		return nil, errors.New("ID token was not issued for this client")
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok || time.Unix(int64(exp), 0).Add(oidcClockSkew).Before(time.Now()) {
+		return nil, errors.New("ID token has expired")
+	}
+
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errors.New("ID token nonce does not match")
+	}
+
+	return claims, nil
+}
+
+// MapClaims maps the claims of a validated ID token to an identity, resolving
+// the user's tenant and roles with the configured claim maps.
+func (c *OidcProvider) MapClaims(claims map[string]interface{}) (*ExternalIdentity, error) {
+	identity := &ExternalIdentity{
+		Provider:   "oidc",
+		Roles:      []string{},
+		TenantCode: c.Config.TenantCode,
+		Provision:  c.Config.Provision,
+	}
+
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.FirstName, _ = claims["given_name"].(string)
+	identity.LastName, _ = claims["family_name"].(string)
+
+	if verified, ok := claims["email_verified"].(bool); ok && !verified {
+		return nil, errors.New(fmt.Sprintf("Email address for OpenID subject %s is not verified", identity.Subject))
+	}
+
+	// Map tenant
+	if c.Config.TenantClaim != "" {
+		for _, val := range claimValues(claims[c.Config.TenantClaim]) {
+			if code, ok := c.Config.TenantMap[val]; ok {
+				identity.TenantCode = code
+				break
+			}
+		}
+	}
+
+	// Map roles
+	seen := map[string]bool{}
+	for _, val := range claimValues(claims[c.Config.RoleClaim]) {
+		if role, ok := c.Config.RoleMap[val]; ok && !seen[role] {
+			seen[role] = true
+			identity.Roles = append(identity.Roles, role)
+		}
+	}
+
+	return identity, nil
+}
+
+func decodeJwtSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return errors.New("Malformed ID token")
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// claimValues returns the values of a string or string array claim.
+func claimValues(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+
+	case []interface{}:
+		vals := []string{}
+		for _, i := range v {
+			if s, ok := i.(string); ok {
+				vals = append(vals, s)
+			}
+		}
+		return vals
+	}
+
+	return nil
+}
+
+func containsClaim(claim interface{}, want string) bool {
+	for _, val := range claimValues(claim) {
+		if val == want {
+			return true
+		}
+	}
+
+	return false
+}
+
+// OidcLogin redirects the browser to the OpenID Connect identity provider to
+// begin a login.
+func OidcLogin(res http.ResponseWriter, req *http.Request) {
+	provider, err := GetOidcProvider()
+	if err != nil {
+		log.Print(err)
+		ErrNotFound(res, req)
+		return
+	}
+
+	login := oidcLogin{
+		State:    RandomToken(32),
+		Nonce:    RandomToken(32),
+		Verifier: RandomToken(32),
+	}
+	login.InitModel()
+
+	uri, err := provider.AuthCodeUrl(login.State, login.Nonce, login.Verifier)
+	if Handle(res, req, err) {
+		return
+	}
+
+	err = RootDb().C(oidcLoginCollection).Insert(&login)
+	if Handle(res, req, err) {
+		return
+	}
+
+	http.Redirect(res, req, uri, http.StatusFound)
+}
+
+// OidcCallback receives the authorization code from the identity provider,
+// provisions the user and returns a new Alexandria session token.
+func OidcCallback(res http.ResponseWriter, req *http.Request) {
+	provider, err := GetOidcProvider()
+	if err != nil {
+		log.Print(err)
+		ErrNotFound(res, req)
+		return
+	}
+
+	query := req.URL.Query()
+	if e := query.Get("error"); e != "" {
+		log.Printf("OpenID login failed: %s %s", e, query.Get("error_description"))
+		ErrUnauthorized(res, req)
+		return
+	}
+
+	// Each login state may only be used once
+	var login oidcLogin
+	err = RootDb().C(oidcLoginCollection).Find(M{"state": query.Get("state"), "userid": M{"$exists": false}}).One(&login)
+	if err != nil {
+		log.Printf("OpenID login state not found: %s", query.Get("state"))
+		ErrUnauthorized(res, req)
+		return
+	}
+
+	err = RootDb().C(oidcLoginCollection).RemoveId(login.Id)
+	if Handle(res, req, err) {
+		return
+	}
+
+	if time.Since(login.Created) > oidcLoginTimeout {
+		log.Printf("OpenID login state expired: %s", login.State)
+		ErrUnauthorized(res, req)
+		return
+	}
+
+	identity, err := provider.Exchange(query.Get("code"), login.Verifier, login.Nonce)
+	if err != nil {
+		log.Printf("OpenID login failed: %s", err)
+		ErrUnauthorized(res, req)
+		return
+	}
+
+	user, err := ProvisionUser(identity)
+	if err != nil {
+		log.Printf("OpenID login failed for %s: %s", identity.Subject, err)
+		LogSecurityEvent(req, EventLoginFailure, identity.Email, nil, "oidc")
+		ErrUnauthorized(res, req)
+		return
+	}
+
+	// Enrolled users must give a second factor as for a password login
+	if user.TotpEnabled {
+		pending := oidcLogin{
+			State:    RandomToken(32),
+			UserId:   user.Id,
+			Provider: identity.Provider,
+		}
+		pending.InitModel()
+
+		err = RootDb().C(oidcLoginCollection).Insert(&pending)
+		if Handle(res, req, err) {
+			return
+		}
+
+		challenge := &OidcTotpChallenge{
+			Token:   pending.State,
+			Expires: pending.Created.Add(oidcLoginTimeout),
+		}
+
+		res.Header().Set("X-Auth-Required", "totp")
+		Render(res, req, http.StatusAccepted, challenge)
+		return
+	}
+
+	LogSecurityEvent(req, EventLoginSuccess, user.Email, user, "oidc")
+
+	session, err := NewSession(user, identity.Provider)
+	if Handle(res, req, err) {
+		return
+	}
+
+	Render(res, req, http.StatusOK, session)
+}
+
+// OidcVerifyTotp completes an OpenID login which requires a two factor
+// authentication code and returns a new Alexandria session token.
+func OidcVerifyTotp(res http.ResponseWriter, req *http.Request) {
+	// Parse the request body. Should be:
+	// {"totpToken":"...","code":"123456"}
+	body := make(map[string]string)
+	err := Bind(req, &body)
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
+	var login oidcLogin
+	err = RootDb().C(oidcLoginCollection).Find(M{"state": body["totpToken"], "userid": M{"$exists": true}}).One(&login)
+	if err != nil || time.Since(login.Created) > oidcLoginTimeout {
+		log.Printf("OpenID two factor login not found or expired")
+		ErrUnauthorized(res, req)
+		return
+	}
+
+	var user User
+	err = RootDb().C("users").FindId(login.UserId).One(&user)
+	if err != nil {
+		log.Printf("OpenID two factor login user not found: %v", login.UserId)
+		ErrUnauthorized(res, req)
+		return
+	}
+
+	// Refuse attempts from throttled accounts and addresses
+	address := GetSourceAddress(req)
+	wait, err := CheckLoginThrottle(user.Email, address)
+	if Handle(res, req, err) {
+		return
+	}
+
+	if wait > 0 {
+		LogSecurityEvent(req, EventLoginRefused, user.Email, &user, fmt.Sprintf("retry after %v", wait))
+		ErrTooManyRequests(res, req, wait)
+		return
+	}
+
+	if !checkLoginSecondFactor(res, req, &user, user.Email, address, body["code"]) {
+		return
+	}
+
+	// Each login may only be completed once
+	err = RootDb().C(oidcLoginCollection).RemoveId(login.Id)
+	if err == mgo.ErrNotFound {
+		ErrUnauthorized(res, req)
+		return
+	} else if Handle(res, req, err) {
+		return
+	}
+
+	err = ResetLoginFailures(user.Email)
+	if Handle(res, req, err) {
+		return
+	}
+
+	LogSecurityEvent(req, EventLoginSuccess, user.Email, &user, "oidc")
+
+	session, err := NewSession(&user, login.Provider)
+	if Handle(res, req, err) {
+		return
+	}
+
+	Render(res, req, http.StatusOK, session)
+}
@@ -0,0 +1,284 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockOidcIssuer is a local OpenID Connect identity provider which issues ID
+// tokens for a single authorization code.
+type mockOidcIssuer struct {
+	Server   *httptest.Server
+	Key      *rsa.PrivateKey
+	Code     string
+	Verifier string
+	Claims   map[string]interface{}
+}
+
+func newMockOidcIssuer(t *testing.T) *mockOidcIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &mockOidcIssuer{Key: key, Code: "test-code"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(res http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(res).Encode(map[string]string{
+			"issuer":                 c.Server.URL,
+			"authorization_endpoint": c.Server.URL + "/authorize",
+			"token_endpoint":         c.Server.URL + "/token",
+			"jwks_uri":               c.Server.URL + "/jwks",
+		})
+	})
+
+	mux.HandleFunc("/jwks", func(res http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(res).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test-key",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+
+	mux.HandleFunc("/token", func(res http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		if req.Form.Get("code") != c.Code || PkceChallenge(req.Form.Get("code_verifier")) != PkceChallenge(c.Verifier) {
+			res.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		json.NewEncoder(res).Encode(map[string]string{
+			"token_type": "Bearer",
+			"id_token":   c.Sign("test-key", c.Claims),
+		})
+	})
+
+	c.Server = httptest.NewServer(mux)
+	return c
+}
+
+func (c *mockOidcIssuer) Sign(kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, c.Key, crypto.SHA256, sum[:])
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (c *mockOidcIssuer) Provider() *OidcProvider {
+	return &OidcProvider{
+		Config: &OidcConfig{
+			Issuer:      c.Server.URL,
+			ClientId:    "alexandria",
+			RedirectUrl: "http://localhost:4123/api/v1/auth/oidc/callback",
+			Scopes:      []string{"openid", "email", "profile"},
+			TenantClaim: "org",
+			TenantMap:   map[string]string{"ops": "abcd-123456-123456"},
+			TenantCode:  "ffff-ffffff-ffffff",
+			RoleClaim:   "groups",
+			RoleMap:     map[string]string{"cmdb-admins": RoleAdmin, "staff": RoleUser},
+			Provision:   true,
+		},
+	}
+}
+
+func (c *mockOidcIssuer) DefaultClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":            c.Server.URL,
+		"sub":            "user-1234",
+		"aud":            "alexandria",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          "test-nonce",
+		"email":          "jane.citizen@example.com",
+		"email_verified": true,
+		"given_name":     "Jane",
+		"family_name":    "Citizen",
+		"org":            "ops",
+		"groups":         []string{"staff", "cmdb-admins", "unmapped"},
+	}
+}
+
+func TestPkceChallenge(t *testing.T) {
+	// S256 challenge is the unpadded, URL safe base64 SHA-256 of the verifier
+	areEqual(t, PkceChallenge("test-verifier"), "JBbiqONGWPaAmwXk_8bT6UnlPfrn65D32eZlJS-zGG0")
+}
+
+func TestOidcAuthCodeUrl(t *testing.T) {
+	issuer := newMockOidcIssuer(t)
+	defer issuer.Server.Close()
+
+	uri, err := issuer.Provider().AuthCodeUrl("test-state", "test-nonce", "test-verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(uri, issuer.Server.URL+"/authorize?") {
+		t.Errorf("Expected authorization URL at issuer - Got %s", uri)
+	}
+
+	u, _ := url.Parse(uri)
+	params := u.Query()
+	areEqual(t, params.Get("response_type"), "code")
+	areEqual(t, params.Get("client_id"), "alexandria")
+	areEqual(t, params.Get("scope"), "openid email profile")
+	areEqual(t, params.Get("state"), "test-state")
+	areEqual(t, params.Get("nonce"), "test-nonce")
+	areEqual(t, params.Get("code_challenge"), PkceChallenge("test-verifier"))
+	areEqual(t, params.Get("code_challenge_method"), "S256")
+}
+
+func TestOidcExchange(t *testing.T) {
+	issuer := newMockOidcIssuer(t)
+	defer issuer.Server.Close()
+
+	issuer.Verifier = "test-verifier"
+	issuer.Claims = issuer.DefaultClaims()
+	provider := issuer.Provider()
+
+	identity, err := provider.Exchange(issuer.Code, "test-verifier", "test-nonce")
+	if err != nil {
+		t.Fatalf("Expected OpenID code exchange to succeed but got: %s", err)
+	}
+
+	areEqual(t, identity.Provider, "oidc")
+	areEqual(t, identity.Subject, "user-1234")
+	areEqual(t, identity.Email, "jane.citizen@example.com")
+	areEqual(t, identity.FirstName, "Jane")
+	areEqual(t, identity.LastName, "Citizen")
+	areEqual(t, identity.TenantCode, "abcd-123456-123456")
+	areEqual(t, strings.Join(identity.Roles, ","), "user,admin")
+
+	// Wrong PKCE verifier
+	if _, err := provider.Exchange(issuer.Code, "wrong-verifier", "test-nonce"); err == nil {
+		t.Errorf("Expected OpenID code exchange to fail with the wrong PKCE verifier")
+	}
+
+	// Wrong nonce
+	if _, err := provider.Exchange(issuer.Code, "test-verifier", "wrong-nonce"); err == nil {
+		t.Errorf("Expected OpenID code exchange to fail with the wrong nonce")
+	}
+}
+
+func TestOidcVerifyIdToken(t *testing.T) {
+	issuer := newMockOidcIssuer(t)
+	defer issuer.Server.Close()
+	provider := issuer.Provider()
+
+	// Valid token
+	claims := issuer.DefaultClaims()
+	if _, err := provider.VerifyIdToken(issuer.Sign("test-key", claims), "test-nonce"); err != nil {
+		t.Errorf("Expected valid ID token to verify but got: %s", err)
+	}
+
+	// Unknown key
+	if _, err := provider.VerifyIdToken(issuer.Sign("other-key", claims), "test-nonce"); err == nil {
+		t.Errorf("Expected ID token signed with an unknown key to fail")
+	}
+
+	// Tampered payload
+	token := issuer.Sign("test-key", claims)
+	parts := strings.Split(token, ".")
+	claims["email"] = "mallory@example.com"
+	forged, _ := json.Marshal(claims)
+	parts[1] = base64.RawURLEncoding.EncodeToString(forged)
+	if _, err := provider.VerifyIdToken(strings.Join(parts, "."), "test-nonce"); err == nil {
+		t.Errorf("Expected tampered ID token to fail")
+	}
+
+	// Unsigned
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	if _, err := provider.VerifyIdToken(header+"."+parts[1]+".", "test-nonce"); err == nil {
+		t.Errorf("Expected unsigned ID token to fail")
+	}
+
+	// Wrong audience
+	claims = issuer.DefaultClaims()
+	claims["aud"] = []string{"someone-else"}
+	if _, err := provider.VerifyIdToken(issuer.Sign("test-key", claims), "test-nonce"); err == nil {
+		t.Errorf("Expected ID token for another audience to fail")
+	}
+
+	// Wrong issuer
+	claims = issuer.DefaultClaims()
+	claims["iss"] = "https://evil.example.com"
+	if _, err := provider.VerifyIdToken(issuer.Sign("test-key", claims), "test-nonce"); err == nil {
+		t.Errorf("Expected ID token from another issuer to fail")
+	}
+
+	// Expired
+	claims = issuer.DefaultClaims()
+	claims["exp"] = time.Now().Add(-time.Hour).Unix()
+	if _, err := provider.VerifyIdToken(issuer.Sign("test-key", claims), "test-nonce"); err == nil {
+		t.Errorf("Expected expired ID token to fail")
+	}
+}
+
+func TestOidcMapClaims(t *testing.T) {
+	provider := &OidcProvider{
+		Config: &OidcConfig{
+			TenantClaim: "org",
+			TenantMap:   map[string]string{"ops": "abcd-123456-123456"},
+			TenantCode:  "ffff-ffffff-ffffff",
+			RoleClaim:   "role",
+			RoleMap:     map[string]string{"cmdb-admin": RoleAdmin},
+		},
+	}
+
+	// Unmapped tenant falls back to the default
+	identity, err := provider.MapClaims(map[string]interface{}{
+		"email": "jane.citizen@example.com",
+		"org":   "finance",
+		"role":  "cmdb-admin",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	areEqual(t, identity.TenantCode, "ffff-ffffff-ffffff")
+	areEqual(t, strings.Join(identity.Roles, ","), "admin")
+
+	// Unverified email addresses are refused
+	_, err = provider.MapClaims(map[string]interface{}{
+		"email":          "jane.citizen@example.com",
+		"email_verified": false,
+	})
+	if err == nil {
+		t.Errorf("Expected unverified email address to be refused")
+	}
+}
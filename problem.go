@@ -0,0 +1,166 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+)
+
+// Error codes
+const (
+	CodeBadRequest           = "bad_request"
+	CodeValidationFailed     = "validation_failed"
+	CodeUnauthorized         = "unauthorized"
+	CodeForbidden            = "forbidden"
+	CodeNotFound             = "not_found"
+	CodeMethodNotAllowed     = "method_not_allowed"
+	CodeNotAcceptable        = "not_acceptable"
+	CodeConflict             = "conflict"
+	CodeDuplicate            = "duplicate"
+	CodeTooManyRequests      = "too_many_requests"
+	CodePreconditionFailed   = "precondition_failed"
+	CodePreconditionRequired = "precondition_required"
+	CodeInternalError        = "internal_error"
+)
+
+type requestIdKey struct{}
+
+var validRequestId = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Problem is an error response as described in RFC 7807, extended with an
+// error code, the request id and any field level validation errors.
+type Problem struct {
+	XMLName   xml.Name            `json:"-" xml:"urn:ietf:rfc:7807 problem"`
+	Type      string              `json:"type" xml:"type"`
+	Title     string              `json:"title" xml:"title"`
+	Status    int                 `json:"status" xml:"status"`
+	Detail    string              `json:"detail,omitempty" xml:"detail,omitempty"`
+	Instance  string              `json:"instance,omitempty" xml:"instance,omitempty"`
+	Code      string              `json:"code" xml:"code"`
+	RequestId string              `json:"requestId,omitempty" xml:"requestId,omitempty"`
+	Errors    []ValidationProblem `json:"errors,omitempty" xml:"errors>error,omitempty"`
+}
+
+// NewProblem returns a problem for the given request. If err is a
+// validation error, each of its problems is included.
+func NewProblem(req *http.Request, status int, code string, err error) *Problem {
+	problem := &Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Code:      code,
+		Instance:  req.URL.Path,
+		RequestId: GetRequestId(req),
+	}
+
+	if err != nil {
+		problem.Detail = err.Error()
+		if isValidationError(err) {
+			problem.Errors = GetValidationProblems(err)
+		}
+	}
+
+	return problem
+}
+
+func isValidationError(err error) bool {
+	switch err.(type) {
+	case ValidationErrors, *FieldError, *RuleError:
+		return true
+	}
+
+	return false
+}
+
+// RenderProblem writes a problem as XML if the client prefers XML, otherwise
+// as JSON.
+func RenderProblem(res http.ResponseWriter, req *http.Request, problem *Problem) {
+	var data []byte
+	var err error
+	res.Header().Add("Vary", "Accept")
+	if negotiateFormat(req, problemFormats, []string{"json", "xml"}) == "xml" {
+		res.Header().Set("Content-Type", "application/problem+xml")
+		data, err = xml.Marshal(problem)
+		if err == nil {
+			data = append([]byte(xml.Header), data...)
+		}
+	} else {
+		res.Header().Set("Content-Type", "application/problem+json")
+		data, err = json.Marshal(problem)
+	}
+
+	if err != nil {
+		log.Printf("Error encoding problem response: %s", err)
+	}
+
+	res.Header().Del("Content-Length")
+	res.WriteHeader(problem.Status)
+	res.Write(data)
+}
+
+// RequestIdHandler assigns an id to each request which is returned in the
+// X-Request-Id header and in error responses. A valid id supplied by the
+// client or a proxy is reused.
+type RequestIdHandler struct{}
+
+func NewRequestIdHandler() *RequestIdHandler {
+	return &RequestIdHandler{}
+}
+
+func (c *RequestIdHandler) ServeHTTP(res http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	id := req.Header.Get("X-Request-Id")
+	if !validRequestId.MatchString(id) {
+		id = RandomToken(12)
+	}
+
+	res.Header().Set("X-Request-Id", id)
+	next(res, req.WithContext(context.WithValue(req.Context(), requestIdKey{}, id)))
+}
+
+// GetRequestId returns the id assigned to a request by RequestIdHandler.
+func GetRequestId(req *http.Request) string {
+	id, _ := req.Context().Value(requestIdKey{}).(string)
+	return id
+}
+
+// Recovery is a middleware handler which writes an internal error problem
+// response if a handler panics.
+type Recovery struct{}
+
+func NewRecovery() *Recovery {
+	return &Recovery{}
+}
+
+func (c *Recovery) ServeHTTP(res http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("PANIC: %v\n%s", r, debug.Stack())
+			ErrUnknown(res, req, errors.New(fmt.Sprintf("%v", r)))
+		}
+	}()
+
+	next(res, req)
+}
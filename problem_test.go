@@ -0,0 +1,115 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"github.com/codegangsta/negroni"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestErrBadRequestProblem(t *testing.T) {
+	req := httptest.NewRequest("POST", V1Uri("/cmdbs/temp/test"), nil)
+	res := httptest.NewRecorder()
+
+	err := ValidationErrors{
+		newFieldError(".number", errors.New("Not a number")),
+		&RuleError{"owner-required", "Owner is required"},
+	}
+	ErrBadRequest(res, req, err)
+
+	areEqual(t, res.Code, http.StatusBadRequest)
+	areEqual(t, res.Header().Get("Content-Type"), "application/problem+json")
+
+	var problem Problem
+	if err := json.Unmarshal(res.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("Expected a JSON problem but got: %s", res.Body.String())
+	}
+
+	areEqual(t, problem.Status, http.StatusBadRequest)
+	areEqual(t, problem.Code, CodeValidationFailed)
+	areEqual(t, problem.Instance, V1Uri("/cmdbs/temp/test"))
+	areEqual(t, len(problem.Errors), 2)
+	areEqual(t, problem.Errors[0].Path, "number")
+	areEqual(t, problem.Errors[1].Rule, "owner-required")
+
+	// Plain errors have no field errors
+	res = httptest.NewRecorder()
+	ErrBadRequest(res, req, errors.New("Bad"))
+	json.Unmarshal(res.Body.Bytes(), &problem)
+	areEqual(t, problem.Code, CodeBadRequest)
+	areEqual(t, problem.Detail, "Bad")
+}
+
+func TestXmlProblem(t *testing.T) {
+	req := httptest.NewRequest("GET", V1Uri("/cmdbs/nope?format=xml"), nil)
+	res := httptest.NewRecorder()
+	ErrNotFound(res, req)
+
+	areEqual(t, res.Code, http.StatusNotFound)
+	areEqual(t, res.Header().Get("Content-Type"), "application/problem+xml")
+
+	var problem Problem
+	if err := xml.Unmarshal(res.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("Expected an XML problem but got: %s", res.Body.String())
+	}
+
+	areEqual(t, problem.XMLName.Space, "urn:ietf:rfc:7807")
+	areEqual(t, problem.Code, CodeNotFound)
+}
+
+func TestRecoveryProblem(t *testing.T) {
+	n := negroni.New(NewRequestIdHandler(), NewRecovery())
+	n.UseHandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("format") == "unknown" {
+			Render(res, req, http.StatusOK, "value")
+			return
+		}
+
+		panic("something broke")
+	})
+
+	// Panics are internal errors with the request id
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-Id", "abc-123")
+	res := httptest.NewRecorder()
+	n.ServeHTTP(res, req)
+
+	var problem Problem
+	json.Unmarshal(res.Body.Bytes(), &problem)
+	areEqual(t, res.Code, http.StatusInternalServerError)
+	areEqual(t, res.Header().Get("X-Request-Id"), "abc-123")
+	areEqual(t, problem.RequestId, "abc-123")
+	areEqual(t, problem.Code, CodeInternalError)
+	areEqual(t, problem.Detail, "")
+
+	// Invalid request ids are replaced
+	req = httptest.NewRequest("GET", "/?format=unknown", nil)
+	req.Header.Set("X-Request-Id", "<script>")
+	res = httptest.NewRecorder()
+	n.ServeHTTP(res, req)
+
+	json.Unmarshal(res.Body.Bytes(), &problem)
+	areEqual(t, res.Code, http.StatusNotAcceptable)
+	areUnequal(t, problem.RequestId, "<script>")
+	areEqual(t, problem.RequestId, res.Header().Get("X-Request-Id"))
+}
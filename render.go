@@ -18,6 +18,8 @@
 package main
 
 import (
+	"bytes"
+	"encoding/csv"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
@@ -26,8 +28,12 @@ import (
 	"gopkg.in/mgo.v2"
 	"io"
 	"log"
+	"math"
+	"mime"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -55,6 +61,12 @@ func Handle(res http.ResponseWriter, req *http.Request, err error) bool {
 		}
 	}
 
+	// Modified by another request?
+	if err == ErrStaleRevision {
+		ErrPreconditionFailed(res, req)
+		return true
+	}
+
 	// Mongo 'ns not found' error?
 	// These are expected whe deleting a collection
 	if err != nil && err.Error() == "ns not found" {
@@ -72,40 +84,75 @@ func Handle(res http.ResponseWriter, req *http.Request, err error) bool {
 
 func ErrUnknown(res http.ResponseWriter, req *http.Request, err error) {
 	log.Printf("ERROR: %#v", err)
-	res.WriteHeader(http.StatusInternalServerError)
-	res.Write([]byte("500 Internal server error"))
+
+	// Internal details are not disclosed to the client
+	RenderProblem(res, req, NewProblem(req, http.StatusInternalServerError, CodeInternalError, nil))
 }
 
 func ErrNotFound(res http.ResponseWriter, req *http.Request) {
-	res.WriteHeader(http.StatusNotFound)
-	res.Write([]byte("404 Resource not found"))
+	RenderProblem(res, req, NewProblem(req, http.StatusNotFound, CodeNotFound, errors.New("Resource not found")))
+}
+
+func ErrMethodNotAllowed(res http.ResponseWriter, req *http.Request) {
+	RenderProblem(res, req, NewProblem(req, http.StatusMethodNotAllowed, CodeMethodNotAllowed, nil))
 }
 
 func ErrConflict(res http.ResponseWriter, req *http.Request) {
-	res.WriteHeader(http.StatusConflict)
-	res.Write([]byte("409 Conflict"))
+	RenderProblem(res, req, NewProblem(req, http.StatusConflict, CodeConflict, nil))
+}
+
+func ErrDuplicate(res http.ResponseWriter, req *http.Request, err error) {
+	log.Printf("Conflict: %s", err)
+	RenderProblem(res, req, NewProblem(req, http.StatusConflict, CodeDuplicate, err))
+}
+
+func ErrNotAcceptable(res http.ResponseWriter, req *http.Request) {
+	RenderProblem(res, req, NewProblem(req, http.StatusNotAcceptable, CodeNotAcceptable, nil))
+}
+
+func ErrPreconditionFailed(res http.ResponseWriter, req *http.Request) {
+	RenderProblem(res, req, NewProblem(req, http.StatusPreconditionFailed, CodePreconditionFailed, errors.New("The resource has been modified since it was retrieved")))
+}
+
+func ErrPreconditionRequired(res http.ResponseWriter, req *http.Request) {
+	RenderProblem(res, req, NewProblem(req, http.StatusPreconditionRequired, CodePreconditionRequired, errors.New("An If-Match header is required")))
 }
 
 func ErrBadRequest(res http.ResponseWriter, req *http.Request, err error) {
 	log.Printf("Bad request: %s", err)
-	res.WriteHeader(http.StatusBadRequest)
-	res.Write([]byte(fmt.Sprintf("400 Bad request\n%s", err)))
+	code := CodeBadRequest
+	if isValidationError(err) {
+		code = CodeValidationFailed
+	}
+
+	RenderProblem(res, req, NewProblem(req, http.StatusBadRequest, code, err))
+}
+
+func ErrForbidden(res http.ResponseWriter, req *http.Request, err error) {
+	RenderProblem(res, req, NewProblem(req, http.StatusForbidden, CodeForbidden, err))
 }
 
 func ErrUnauthorized(res http.ResponseWriter, req *http.Request) {
-	res.WriteHeader(http.StatusUnauthorized)
-	res.Write([]byte("401 Unauthorized"))
+	RenderProblem(res, req, NewProblem(req, http.StatusUnauthorized, CodeUnauthorized, nil))
 }
 
-func Render(res http.ResponseWriter, req *http.Request, status int, v interface{}) {
-	format := req.URL.Query().Get("format")
-	if format == "" {
-		format = "json"
-	}
+func ErrTooManyRequests(res http.ResponseWriter, req *http.Request, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	res.Header().Set("Retry-After", fmt.Sprintf("%d", seconds))
+	RenderProblem(res, req, NewProblem(req, http.StatusTooManyRequests, CodeTooManyRequests, errors.New(fmt.Sprintf("Retry after %d seconds", seconds))))
+}
 
+func Render(res http.ResponseWriter, req *http.Request, status int, v interface{}) {
 	if v == nil {
 		res.WriteHeader(status)
 	} else {
+		formats := []string{"json", "xml", "yaml"}
+		if _, ok := v.(CsvMarshaler); ok {
+			formats = append(formats, "csv")
+		}
+
+		res.Header().Add("Vary", "Accept")
+		format := NegotiateFormat(req, formats...)
 		switch format {
 		case "json":
 			RenderJson(res, req, status, v)
@@ -113,8 +160,15 @@ func Render(res http.ResponseWriter, req *http.Request, status int, v interface{
 		case "xml":
 			RenderXml(res, req, status, v)
 
+		case "yaml":
+			RenderYaml(res, req, status, v)
+
+		case "csv":
+			RenderCsv(res, req, status, v)
+
 		default:
-			log.Panic(fmt.Sprintf("Unsupported output format: %s", format))
+			log.Printf("No acceptable output format for: %s", req.Header.Get("Accept"))
+			ErrNotAcceptable(res, req)
 		}
 	}
 }
@@ -136,8 +190,7 @@ func RenderJson(res http.ResponseWriter, req *http.Request, status int, v interf
 	}
 
 	res.Header().Set("Content-Type", "application/json")
-	res.WriteHeader(status)
-	res.Write(data)
+	writeBody(res, req, status, data)
 }
 
 func RenderXml(res http.ResponseWriter, req *http.Request, status int, v interface{}) {
@@ -147,7 +200,10 @@ func RenderXml(res http.ResponseWriter, req *http.Request, status int, v interfa
 
 	var err error
 	var data []byte
-	if req.URL.Query().Get("pretty") == "true" {
+	pretty := req.URL.Query().Get("pretty") == "true"
+	if isXmlMap(v) {
+		data, err = marshalXmlMap(v, pretty)
+	} else if pretty {
 		data, err = xml.MarshalIndent(v, "", "    ")
 	} else {
 		data, err = xml.Marshal(v)
@@ -157,8 +213,53 @@ func RenderXml(res http.ResponseWriter, req *http.Request, status int, v interfa
 	}
 
 	res.Header().Set("Content-Type", "application/xml")
+	writeBody(res, req, status, append([]byte(xml.Header), data...))
+}
+
+// CsvMarshaler is implemented by resources which may be rendered as CSV.
+type CsvMarshaler interface {
+	MarshalCSV() ([][]string, error)
+}
+
+func RenderCsv(res http.ResponseWriter, req *http.Request, status int, v interface{}) {
+	m, ok := v.(CsvMarshaler)
+	if !ok {
+		ErrNotAcceptable(res, req)
+		return
+	}
+
+	records, err := m.MarshalCSV()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.WriteAll(records)
+
+	res.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	writeBody(res, req, status, buf.Bytes())
+}
+
+// writeBody writes a rendered response. Successful GET responses are given
+// an entity tag derived from their content unless the handler set one, and
+// are not sent if the tag matches the If-None-Match header of the request.
+func writeBody(res http.ResponseWriter, req *http.Request, status int, data []byte) {
+	if req.Method == "GET" && status == http.StatusOK {
+		etag := res.Header().Get("ETag")
+		if etag == "" {
+			etag = contentETag(data)
+			res.Header().Set("ETag", etag)
+		}
+
+		if etagMatches(req.Header.Get("If-None-Match"), etag, true) {
+			res.Header().Del("Content-Type")
+			res.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
 	res.WriteHeader(status)
-	res.Write([]byte(xml.Header))
 	res.Write(data)
 }
 
@@ -179,17 +280,39 @@ func RenderUpdated(res http.ResponseWriter, req *http.Request, url string) {
 	}
 }
 
+// Bind decodes a JSON, XML or YAML request body into v.
 func Bind(req *http.Request, v interface{}) error {
 	if req.Body == nil {
 		return errors.New("Request body is empty")
 	}
 	defer req.Body.Close()
 
-	if ctype := req.Header.Get("Content-Type"); ctype != "application/json" {
-		return errors.New(fmt.Sprintf("Invalid content type: %s", ctype))
+	ctype, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid content type: %s", req.Header.Get("Content-Type")))
+	}
+
+	if charset, ok := params["charset"]; ok && !strings.EqualFold(charset, "utf-8") && !strings.EqualFold(charset, "us-ascii") {
+		return errors.New(fmt.Sprintf("Unsupported character set: %s", charset))
 	}
 
-	err := json.NewDecoder(req.Body).Decode(v)
+	switch ctype {
+	case "application/json":
+		err = json.NewDecoder(req.Body).Decode(v)
+
+	case "application/xml", "text/xml":
+		if isXmlMap(v) {
+			err = bindXmlMap(req.Body, v)
+		} else {
+			err = xml.NewDecoder(req.Body).Decode(v)
+		}
+
+	case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+		err = bindYaml(req.Body, v)
+
+	default:
+		return errors.New(fmt.Sprintf("Invalid content type: %s", ctype))
+	}
 
 	if err != nil && err != io.EOF {
 		return err
@@ -224,6 +347,61 @@ func GetRequestSelecter(req *http.Request) (interface{}, error) {
 	return nil, nil
 }
 
+// GetRequestTimeRange returns a query filter for the time range specified by
+// the RFC3339 since and until query parameters, or nil if neither is set.
+func GetRequestTimeRange(req *http.Request) (interface{}, error) {
+	query := req.URL.Query()
+	filter := M{}
+	for param, op := range map[string]string{"since": "$gte", "until": "$lt"} {
+		if s := query.Get(param); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid timestamp for '%s': %s", param, s))
+			}
+
+			filter[op] = t
+		}
+	}
+
+	if len(filter) == 0 {
+		return nil, nil
+	}
+
+	return filter, nil
+}
+
+// GetRequestFilter returns the expression specified by the filter query
+// parameter, or nil if it is not set.
+func GetRequestFilter(req *http.Request) (*Expression, error) {
+	s := req.URL.Query().Get("filter")
+	if s == "" {
+		return nil, nil
+	}
+
+	expr, err := ParseExpression(s)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid filter: %s", err))
+	}
+
+	return expr, nil
+}
+
+// GetRequestLimit returns the result limit specified by the limit query
+// parameter or the given default.
+func GetRequestLimit(req *http.Request, def int) (int, error) {
+	s := req.URL.Query().Get("limit")
+	if s == "" {
+		return def, nil
+	}
+
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit < 1 {
+		return 0, errors.New(fmt.Sprintf("Invalid limit: %s", s))
+	}
+
+	return limit, nil
+}
+
 func GetCmdbBackend(req *http.Request, name string) *mgo.Database {
 	name = strings.ToLower(name)
 
@@ -0,0 +1,620 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"html"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	// Collection of the search index in each CMDB. CI Type names may not
+	// include a period so this never clashes with a CI collection.
+	searchCollection = "search.index"
+
+	// Terms longer than this are not indexed
+	searchMaxTermLength = 64
+
+	// Query terms must match the first characters of a term exactly to be
+	// considered a fuzzy match
+	searchFuzzyPrefix = 2
+
+	searchMaxCandidates = 10000
+	searchDefaultLimit  = 50
+)
+
+// searchDocument is the entry in the search index of a CMDB for a CI. Terms
+// are the lower case words and whole values of the string attributes of the
+// CI, which are kept in Fields to highlight matches.
+type searchDocument struct {
+	Id     interface{} `bson:"_id"`
+	CIType string
+	Terms  []string
+	Fields []searchField
+}
+
+type searchField struct {
+	Path  string
+	Value string
+}
+
+// SearchHighlight is an attribute value of a CI which matched a search, with
+// the matching text in <em> tags. The rest of the value is HTML escaped.
+type SearchHighlight struct {
+	Path  string `json:"path" xml:",attr"`
+	Value string `json:"value" xml:",chardata"`
+}
+
+// SearchHit is a CI which matched a search.
+type SearchHit struct {
+	Id         string            `json:"id" xml:",attr"`
+	Uri        string            `json:"uri" xml:",attr"`
+	Score      float64           `json:"score" xml:",attr"`
+	Highlights []SearchHighlight `json:"highlights" xml:"highlight"`
+}
+
+// SearchGroup is the hits of a search for a single CI Type.
+type SearchGroup struct {
+	CIType string      `json:"citype" xml:",attr"`
+	Count  int         `json:"count" xml:",attr"`
+	Hits   []SearchHit `json:"hits" xml:"hit"`
+}
+
+// SearchResult is the response to a search, with hits grouped by CI Type.
+// Groups are ordered by their most relevant hit. At most searchMaxCandidates
+// CIs are scored. If more could match, Truncated is set, Total is a lower
+// bound and better matches may not be included.
+type SearchResult struct {
+	Query     string        `json:"query" xml:",attr"`
+	Total     int           `json:"total" xml:",attr"`
+	Truncated bool          `json:"truncated" xml:",attr"`
+	Groups    []SearchGroup `json:"groups" xml:"group"`
+}
+
+// searchLower converts a string to lower case one rune at a time so that
+// rune positions are preserved.
+func searchLower(s string) string {
+	return strings.Map(unicode.ToLower, s)
+}
+
+func isSearchSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// searchTerms returns the terms indexed for a value, which are each word of
+// the value and the whole value if it has more than one word.
+func searchTerms(value string) []string {
+	value = strings.TrimSpace(searchLower(value))
+	terms := []string{}
+	for _, word := range strings.FieldsFunc(value, isSearchSeparator) {
+		if len([]rune(word)) <= searchMaxTermLength {
+			terms = append(terms, word)
+		}
+	}
+
+	if len(terms) > 1 && len([]rune(value)) <= searchMaxTermLength {
+		terms = append(terms, value)
+	}
+
+	return terms
+}
+
+// collectSearchFields adds each string attribute value of a CI to fields.
+func collectSearchFields(fields []searchField, value map[string]interface{}, atts *CITypeAttributeList, prefix string) []searchField {
+	for _, att := range *atts {
+		val, ok := value[att.ShortName]
+		if !ok || (att.Type != "string" && att.Type != "group") {
+			continue
+		}
+
+		path := prefix + att.ShortName
+		vals := []interface{}{val}
+		if att.IsArray {
+			vals, _ = val.([]interface{})
+		}
+
+		for i, v := range vals {
+			p := path
+			if att.IsArray {
+				p = fmt.Sprintf("%s[%d]", path, i)
+			}
+
+			if att.Type == "group" {
+				if m, ok := asMap(v); ok {
+					fields = collectSearchFields(fields, m, &att.Children, p+".")
+				}
+			} else if s, ok := v.(string); ok && s != "" {
+				fields = append(fields, searchField{p, s})
+			}
+		}
+	}
+
+	return fields
+}
+
+// newSearchDocument returns the search index entry for a CI.
+func newSearchDocument(citype *CIType, ci *CI) *searchDocument {
+	doc := &searchDocument{
+		Id:     ci.Id,
+		CIType: citype.ShortName,
+		Fields: collectSearchFields([]searchField{}, ci.Value, &citype.Attributes, ""),
+	}
+
+	seen := map[string]bool{}
+	doc.Terms = []string{}
+	for _, field := range doc.Fields {
+		for _, term := range searchTerms(field.Value) {
+			if !seen[term] {
+				seen[term] = true
+				doc.Terms = append(doc.Terms, term)
+			}
+		}
+	}
+
+	return doc
+}
+
+func ensureSearchIndexes(db *mgo.Database) error {
+	c := db.C(searchCollection)
+	err := c.EnsureIndex(mgo.Index{Key: []string{"terms"}})
+	if err == nil {
+		err = c.EnsureIndex(mgo.Index{Key: []string{"citype"}})
+	}
+
+	return err
+}
+
+// IndexCI adds or replaces the search index entry for a CI.
+func IndexCI(db *mgo.Database, citype *CIType, ci *CI) error {
+	doc := newSearchDocument(citype, ci)
+	_, err := db.C(searchCollection).UpsertId(doc.Id, doc)
+	return err
+}
+
+// ReindexCIType replaces the search index entries for all CIs of a CI Type.
+func ReindexCIType(db *mgo.Database, citype *CIType) (int, error) {
+	c := db.C(searchCollection)
+	_, err := c.RemoveAll(M{"citype": citype.ShortName})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	iter := db.C(citype.ShortName).Find(nil).Iter()
+	var ci CI
+	for iter.Next(&ci) {
+		err = IndexCI(db, citype, &ci)
+		if err != nil {
+			iter.Close()
+			return count, err
+		}
+
+		count++
+		ci = CI{}
+	}
+
+	return count, iter.Close()
+}
+
+// IndexCIChanges updates the search index for CIs which were created,
+// updated or deleted.
+func IndexCIChanges(events []*ChangeEvent) error {
+	session := DbConnect()
+	citypes := map[string]*CIType{}
+
+	for _, event := range events {
+		if event.backend == "" {
+			continue
+		}
+
+		db := session.DB(event.backend)
+		oid, err := IdFromString(event.CIId)
+		if err != nil {
+			return err
+		}
+
+		if event.Type == ChangeDeleted {
+			err = db.C(searchCollection).RemoveId(oid)
+			if err != nil && err != mgo.ErrNotFound {
+				return err
+			}
+
+			continue
+		}
+
+		key := event.backend + "/" + event.CIType
+		citype, ok := citypes[key]
+		if !ok {
+			citype = &CIType{}
+			err = db.C(ciTypeCollection).Find(M{"shortname": event.CIType}).One(citype)
+			if err != nil {
+				return err
+			}
+
+			citypes[key] = citype
+		}
+
+		ci := &CI{Value: event.value}
+		ci.Id = oid
+		err = IndexCI(db, citype, ci)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// searchMaxEdits returns the number of edits allowed for a fuzzy match of a
+// query term.
+func searchMaxEdits(term string) int {
+	switch n := len([]rune(term)); {
+	case n < 4:
+		return 0
+	case n < 8:
+		return 1
+	}
+
+	return 2
+}
+
+// editDistance returns the optimal string alignment distance between two
+// strings, in which a transposition counts as a single edit.
+func editDistance(a string, b string) int {
+	s, t := []rune(a), []rune(b)
+	d := make([][]int, len(s)+1)
+	for i := range d {
+		d[i] = make([]int, len(t)+1)
+		d[i][0] = i
+	}
+
+	for j := range d[0] {
+		d[0][j] = j
+	}
+
+	for i := 1; i <= len(s); i++ {
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+
+			d[i][j] = minInt(d[i-1][j]+1, minInt(d[i][j-1]+1, d[i-1][j-1]+cost))
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+				d[i][j] = minInt(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+
+	return d[len(s)][len(t)]
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+// matchTerm scores how well a query term matches an indexed term. Exact
+// matches score 3, prefix matches between 2 and 3 depending on how much of
+// the term matched and fuzzy matches up to 1. Zero is returned if the terms
+// do not match.
+func matchTerm(query string, term string, fuzzy bool) float64 {
+	if term == query {
+		return 3
+	}
+
+	if strings.HasPrefix(term, query) {
+		return 2 + float64(len(query))/float64(len(term))
+	}
+
+	maxEdits := searchMaxEdits(query)
+	if !fuzzy || maxEdits == 0 {
+		return 0
+	}
+
+	// Typos in a prefix of the term are allowed as well as in the term
+	distance := editDistance(query, term)
+	if runes := []rune(term); len(runes) > len([]rune(query)) {
+		distance = minInt(distance, editDistance(query, string(runes[:len([]rune(query))])))
+	}
+
+	if distance > maxEdits {
+		return 0
+	}
+
+	return 1 - float64(distance)/float64(maxEdits+1)
+}
+
+// score returns the relevance of an indexed CI to the query terms, or zero
+// if any query term does not match.
+func (c *searchDocument) score(queries []string, fuzzy bool) float64 {
+	total := 0.0
+	for _, query := range queries {
+		best := 0.0
+		for _, term := range c.Terms {
+			if s := matchTerm(query, term, fuzzy); s > best {
+				best = s
+			}
+		}
+
+		if best == 0 {
+			return 0
+		}
+
+		total += best
+	}
+
+	return total
+}
+
+// highlight returns the value with the text matching any query term wrapped
+// in <em> tags, or false if nothing matched.
+func highlight(value string, queries []string, fuzzy bool) (string, bool) {
+	runes := []rune(value)
+	lower := []rune(searchLower(value))
+	mask := make([]bool, len(runes))
+
+	mark := func(start int, end int) {
+		for i := start; i < end && i < len(mask); i++ {
+			mask[i] = true
+		}
+	}
+
+	// Matches of the whole value
+	whole := strings.TrimLeftFunc(string(lower), unicode.IsSpace)
+	offset := len(lower) - len([]rune(whole))
+	for _, query := range queries {
+		if strings.HasPrefix(whole, query) {
+			mark(offset, offset+len([]rune(query)))
+		}
+	}
+
+	// Matches of each word
+	for start := 0; start < len(lower); {
+		if isSearchSeparator(lower[start]) {
+			start++
+			continue
+		}
+
+		end := start
+		for end < len(lower) && !isSearchSeparator(lower[end]) {
+			end++
+		}
+
+		word := string(lower[start:end])
+		for _, query := range queries {
+			switch {
+			case strings.HasPrefix(word, query):
+				mark(start, start+len([]rune(query)))
+			case matchTerm(query, word, fuzzy) > 0:
+				mark(start, end)
+			}
+		}
+
+		start = end
+	}
+
+	matched := false
+	var b strings.Builder
+	for i := 0; i < len(runes); {
+		j := i
+		for j < len(runes) && mask[j] == mask[i] {
+			j++
+		}
+
+		segment := html.EscapeString(string(runes[i:j]))
+		if mask[i] {
+			matched = true
+			segment = "<em>" + segment + "</em>"
+		}
+
+		b.WriteString(segment)
+		i = j
+	}
+
+	return b.String(), matched
+}
+
+// Search returns the CIs of a CMDB whose string attribute values match every
+// term of the query, grouped by CI Type.
+func Search(db *mgo.Database, cmdb string, query string, citypes []string, fuzzy bool, limit int) (*SearchResult, error) {
+	queries := strings.Fields(searchLower(query))
+	if len(queries) == 0 {
+		return nil, errors.New("No search query specified")
+	}
+
+	// Find candidates by the prefix which every match must share
+	conditions := []interface{}{}
+	for _, q := range queries {
+		prefix := q
+		if runes := []rune(q); fuzzy && searchMaxEdits(q) > 0 && len(runes) > searchFuzzyPrefix {
+			prefix = string(runes[:searchFuzzyPrefix])
+		}
+
+		conditions = append(conditions, M{"terms": M{"$regex": "^" + regexp.QuoteMeta(prefix)}})
+	}
+
+	filter := M{"$and": conditions}
+	if len(citypes) > 0 {
+		filter["citype"] = M{"$in": citypes}
+	}
+
+	type scoredDocument struct {
+		doc   searchDocument
+		score float64
+	}
+
+	// One more candidate than is scored is read to learn if any are left out
+	matches := []scoredDocument{}
+	truncated := false
+	iter := db.C(searchCollection).Find(filter).Limit(searchMaxCandidates + 1).Iter()
+	var doc searchDocument
+	for n := 0; iter.Next(&doc); n++ {
+		if n == searchMaxCandidates {
+			truncated = true
+			break
+		}
+
+		if score := doc.score(queries, fuzzy); score > 0 {
+			matches = append(matches, scoredDocument{doc, score})
+		}
+
+		doc = searchDocument{}
+	}
+
+	err := iter.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+
+		return IdToString(matches[i].doc.Id) < IdToString(matches[j].doc.Id)
+	})
+
+	result := &SearchResult{Query: query, Total: len(matches), Truncated: truncated, Groups: []SearchGroup{}}
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+
+	groups := map[string]int{}
+	for _, match := range matches {
+		id := IdToString(match.doc.Id)
+		hit := SearchHit{
+			Id:         id,
+			Uri:        V1Uri(fmt.Sprintf("/cmdbs/%s/%s/%s", cmdb, match.doc.CIType, id)),
+			Score:      match.score,
+			Highlights: []SearchHighlight{},
+		}
+
+		for _, field := range match.doc.Fields {
+			if value, ok := highlight(field.Value, queries, fuzzy); ok {
+				hit.Highlights = append(hit.Highlights, SearchHighlight{field.Path, value})
+			}
+		}
+
+		i, ok := groups[match.doc.CIType]
+		if !ok {
+			i = len(result.Groups)
+			groups[match.doc.CIType] = i
+			result.Groups = append(result.Groups, SearchGroup{CIType: match.doc.CIType, Hits: []SearchHit{}})
+		}
+
+		result.Groups[i].Hits = append(result.Groups[i].Hits, hit)
+		result.Groups[i].Count++
+	}
+
+	return result, nil
+}
+
+// SearchCIs searches the CIs of a CMDB for the q query parameter. Results
+// may be limited to the CI Types in the comma separated citype parameter and
+// to limit hits. Fuzzy matching is disabled with fuzzy=false.
+func SearchCIs(res http.ResponseWriter, req *http.Request) {
+	cmdb := GetPathVar(req, "cmdb")
+	db := GetCmdbBackend(req, cmdb)
+	if db == nil {
+		log.Printf("No such CMDB found: %s", cmdb)
+		ErrNotFound(res, req)
+		return
+	}
+
+	params := req.URL.Query()
+	limit, err := GetRequestLimit(req, searchDefaultLimit)
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
+	query := params.Get("q")
+	if strings.TrimSpace(query) == "" {
+		ErrBadRequest(res, req, errors.New("No search query specified"))
+		return
+	}
+
+	var citypes []string
+	if s := params.Get("citype"); s != "" {
+		citypes = strings.Split(s, ",")
+	}
+
+	result, err := Search(db, cmdb, query, citypes, params.Get("fuzzy") != "false", limit)
+	if Handle(res, req, err) {
+		return
+	}
+
+	Render(res, req, http.StatusOK, result)
+}
+
+// ReindexSearch rebuilds the search index of a CMDB.
+func ReindexSearch(res http.ResponseWriter, req *http.Request) {
+	cmdb := GetPathVar(req, "cmdb")
+	db := GetCmdbBackend(req, cmdb)
+	if db == nil {
+		log.Printf("No such CMDB found: %s", cmdb)
+		ErrNotFound(res, req)
+		return
+	}
+
+	err := ensureSearchIndexes(db)
+	if Handle(res, req, err) {
+		return
+	}
+
+	var citypes []CIType
+	err = db.C(ciTypeCollection).Find(nil).All(&citypes)
+	if Handle(res, req, err) {
+		return
+	}
+
+	// Remove entries for CI Types which no longer exist
+	names := make([]string, len(citypes))
+	for i, citype := range citypes {
+		names[i] = citype.ShortName
+	}
+
+	_, err = db.C(searchCollection).RemoveAll(M{"citype": M{"$nin": names}})
+	if Handle(res, req, err) {
+		return
+	}
+
+	total := 0
+	for i := range citypes {
+		count, err := ReindexCIType(db, &citypes[i])
+		if Handle(res, req, err) {
+			return
+		}
+
+		total += count
+	}
+
+	Render(res, req, http.StatusOK, map[string]interface{}{"indexed": total})
+}
@@ -0,0 +1,139 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestSearchTerms(t *testing.T) {
+	areEqual(t, reflect.DeepEqual(searchTerms("web01.Example.com"), []string{"web01", "example", "com", "web01.example.com"}), true)
+	areEqual(t, reflect.DeepEqual(searchTerms(" ABC123 "), []string{"abc123"}), true)
+	areEqual(t, len(searchTerms("--")), 0)
+}
+
+func TestEditDistance(t *testing.T) {
+	areEqual(t, editDistance("example", "example"), 0)
+	areEqual(t, editDistance("exmaple", "example"), 1)
+	areEqual(t, editDistance("exampel", "example"), 1)
+	areEqual(t, editDistance("sample", "example"), 2)
+	areEqual(t, editDistance("", "abc"), 3)
+}
+
+func TestMatchTerm(t *testing.T) {
+	areEqual(t, matchTerm("web01", "web01", true), 3.0)
+	if s := matchTerm("web", "web01", false); s <= 2 || s >= 3 {
+		t.Errorf("Expected prefix match to score between 2 and 3 but got %v", s)
+	}
+
+	if s := matchTerm("exmaple", "example", true); s <= 0 || s >= 1 {
+		t.Errorf("Expected fuzzy match to score between 0 and 1 but got %v", s)
+	}
+
+	// Typos in a prefix
+	if matchTerm("exmap", "example", true) == 0 {
+		t.Errorf("Expected fuzzy prefix match")
+	}
+
+	areEqual(t, matchTerm("exmaple", "example", false), 0.0)
+	areEqual(t, matchTerm("wbe", "web", true), 0.0)
+}
+
+func TestHighlight(t *testing.T) {
+	value, ok := highlight("web01.example.com", []string{"web"}, true)
+	areEqual(t, ok, true)
+	areEqual(t, value, "<em>web</em>01.example.com")
+
+	value, _ = highlight("web01.example.com", []string{"web01.ex"}, true)
+	areEqual(t, value, "<em>web01.ex</em>ample.com")
+
+	value, _ = highlight("<Rack> Exmaple", []string{"example"}, true)
+	areEqual(t, value, "&lt;Rack&gt; <em>Exmaple</em>")
+
+	_, ok = highlight("db01", []string{"web"}, true)
+	areEqual(t, ok, false)
+}
+
+func TestSearchDocument(t *testing.T) {
+	citype := &CIType{
+		ShortName: "server",
+		Attributes: CITypeAttributeList{
+			{ShortName: "hostname", Type: "string"},
+			{ShortName: "cpus", Type: "number"},
+			{ShortName: "aliases", Type: "string", IsArray: true},
+			{ShortName: "nics", Type: "group", IsArray: true, Children: CITypeAttributeList{
+				{ShortName: "mac", Type: "string"},
+			}},
+		},
+	}
+
+	ci := &CI{Value: map[string]interface{}{
+		"hostname": "web01",
+		"cpus":     4.0,
+		"aliases":  []interface{}{"www"},
+		"nics":     []interface{}{map[string]interface{}{"mac": "00:1a:2b"}},
+	}}
+	ci.Id = NewId()
+
+	doc := newSearchDocument(citype, ci)
+	areEqual(t, len(doc.Fields), 3)
+	areEqual(t, doc.Fields[1].Path, "aliases[0]")
+	areEqual(t, doc.Fields[2].Path, "nics[0].mac")
+	areEqual(t, reflect.DeepEqual(doc.Terms, []string{"web01", "www", "00", "1a", "2b", "00:1a:2b"}), true)
+
+	if doc.score([]string{"web", "www"}, true) <= doc.score([]string{"web"}, true) {
+		t.Errorf("Expected CIs matching more terms to score higher")
+	}
+	areEqual(t, doc.score([]string{"web", "db"}, true), 0.0)
+}
+
+func TestSearchCIs(t *testing.T) {
+	serverType := Post(t, V1Uri("/cmdbs/temp/citypes"), `{"name":"Search Server","attributes":[{"name":"hostname","type":"string"}]}`)
+	defer Delete(t, serverType)
+
+	switchType := Post(t, V1Uri("/cmdbs/temp/citypes"), `{"name":"Search Switch","attributes":[{"name":"serial","type":"string"}]}`)
+	defer Delete(t, switchType)
+
+	Post(t, V1Uri("/cmdbs/temp/search-server"), `{"hostname":"web01.example.com"}`)
+	Post(t, V1Uri("/cmdbs/temp/search-server"), `{"hostname":"db01.example.com"}`)
+	Post(t, V1Uri("/cmdbs/temp/search-switch"), `{"serial":"WEB-0042"}`)
+
+	req := NewRequest("GET", V1Uri("/cmdbs/temp/search?q=web&format=json"), nil)
+	res := httptest.NewRecorder()
+	GetServer().ServeHTTP(res, req)
+	areEqual(t, res.Code, http.StatusOK)
+
+	var result SearchResult
+	json.Unmarshal(res.Body.Bytes(), &result)
+	areEqual(t, result.Total, 2)
+	areEqual(t, result.Truncated, false)
+	areEqual(t, len(result.Groups), 2)
+
+	// Fuzzy match
+	req = NewRequest("GET", V1Uri("/cmdbs/temp/search?q=exmaple&citype=search-server&format=json"), nil)
+	res = httptest.NewRecorder()
+	GetServer().ServeHTTP(res, req)
+	json.Unmarshal(res.Body.Bytes(), &result)
+	areEqual(t, result.Total, 2)
+	areEqual(t, result.Groups[0].CIType, "search-server")
+	areEqual(t, result.Groups[0].Hits[0].Highlights[0].Path, "hostname")
+}
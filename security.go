@@ -0,0 +1,322 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	securityEventCollection = "securityevents"
+	loginFailureCollection  = "loginfailures"
+)
+
+// Security event types
+const (
+	EventLoginSuccess  = "login_success"
+	EventLoginFailure  = "login_failure"
+	EventLoginRefused  = "login_refused"
+	EventLockout       = "lockout"
+	EventApiKeyCreated = "apikey_created"
+	EventTotpEnabled   = "totp_enabled"
+	EventTotpDisabled  = "totp_disabled"
+)
+
+// SecurityEvent is an entry in the security event log of a tenant.
+type SecurityEvent struct {
+	model         `json:"-" bson:",inline"`
+	TenantId      interface{} `json:"-" xml:"-"`
+	Time          time.Time   `json:"time"`
+	Type          string      `json:"type"`
+	Username      string      `json:"username"`
+	SourceAddress string      `json:"sourceAddress"`
+	UserAgent     string      `json:"userAgent,omitempty" xml:",omitempty" bson:",omitempty"`
+	Message       string      `json:"message,omitempty" xml:",omitempty" bson:",omitempty"`
+}
+
+// LoginFailure counts the failed login attempts for an account or source
+// address.
+type LoginFailure struct {
+	Key         string
+	Count       int
+	Last        time.Time
+	LockedUntil time.Time
+}
+
+// GetSourceAddress returns the IP address of the client which sent the
+// request. X-Forwarded-For is only honoured if the server is configured to
+// trust its reverse proxy.
+func GetSourceAddress(req *http.Request) string {
+	config, err := GetConfig()
+	if err == nil && config.Server.TrustProxy {
+		if fwd := req.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+// LogSecurityEvent adds an event to the security event log. If user is nil,
+// the event is attributed to the tenant of the account with the given
+// username, if any.
+func LogSecurityEvent(req *http.Request, eventType string, username string, user *User, message string) {
+	event := SecurityEvent{
+		Time:          time.Now(),
+		Type:          eventType,
+		Username:      strings.ToLower(username),
+		SourceAddress: GetSourceAddress(req),
+		UserAgent:     req.Header.Get("User-Agent"),
+		Message:       message,
+	}
+	event.InitModel()
+
+	if user == nil {
+		var u User
+		if err := RootDb().C("users").Find(M{"email": username}).One(&u); err == nil {
+			user = &u
+		}
+	}
+
+	if user != nil {
+		event.TenantId = user.TenantId
+		event.Username = user.Email
+	}
+
+	log.Printf("Security event: %s for %s from %s %s", event.Type, event.Username, event.SourceAddress, event.Message)
+
+	err := RootDb().C(securityEventCollection).Insert(&event)
+	if err != nil {
+		log.Printf("Error writing security event to the database: %s", err)
+	}
+}
+
+func secondsToDuration(seconds int) time.Duration {
+	return time.Duration(seconds) * time.Second
+}
+
+// LockedFor returns how long the key remains locked out.
+func (c *LoginFailure) LockedFor(now time.Time) time.Duration {
+	if now.Before(c.LockedUntil) {
+		return c.LockedUntil.Sub(now)
+	}
+
+	return 0
+}
+
+// RetryAfter returns how long a client must wait before it may attempt to
+// login again. The wait doubles with each consecutive failure, up to the
+// lockout duration.
+func (c *LoginFailure) RetryAfter(now time.Time, config *ServerConfig) time.Duration {
+	if d := c.LockedFor(now); d > 0 {
+		return d
+	}
+
+	if c.Count == 0 || config.LoginBackoff <= 0 {
+		return 0
+	}
+
+	lockout := secondsToDuration(config.LoginLockout)
+	backoff := secondsToDuration(config.LoginBackoff)
+	for i := 1; i < c.Count && backoff < lockout; i++ {
+		backoff *= 2
+	}
+
+	if backoff > lockout {
+		backoff = lockout
+	}
+
+	if until := c.Last.Add(backoff); now.Before(until) {
+		return until.Sub(now)
+	}
+
+	return 0
+}
+
+func getLoginFailure(key string) (*LoginFailure, error) {
+	var failure LoginFailure
+	err := RootDb().C(loginFailureCollection).Find(M{"key": key}).One(&failure)
+	if err == mgo.ErrNotFound {
+		return &LoginFailure{Key: key}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &failure, nil
+}
+
+func loginFailureKeys(username string, address string) []string {
+	return []string{
+		fmt.Sprintf("user:%s", strings.ToLower(username)),
+		fmt.Sprintf("ip:%s", address),
+	}
+}
+
+// CheckLoginThrottle returns how long the client must wait before attempting
+// to login to the given account from the given address.
+func CheckLoginThrottle(username string, address string) (time.Duration, error) {
+	config, err := GetConfig()
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	var wait time.Duration
+	for i, key := range loginFailureKeys(username, address) {
+		failure, err := getLoginFailure(key)
+		if err != nil {
+			return 0, err
+		}
+
+		// An address is shared by every account tried from it, so it is
+		// only locked out once it reaches its own limit rather than backed
+		// off after each failure
+		d := failure.LockedFor(now)
+		if i == 0 {
+			d = failure.RetryAfter(now, &config.Server)
+		}
+
+		if d > wait {
+			wait = d
+		}
+	}
+
+	return wait, nil
+}
+
+// RecordLoginFailure counts a failed login attempt against the account and
+// source address and returns true if either is now locked out.
+func RecordLoginFailure(username string, address string) (bool, error) {
+	config, err := GetConfig()
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	lockout := secondsToDuration(config.Server.LoginLockout)
+	locked := false
+	keys := loginFailureKeys(username, address)
+	limits := []int{config.Server.LoginMaxFailures, config.Server.LoginMaxIpFailures}
+	for i, key := range keys {
+		failure, err := incrementLoginFailure(key, now, lockout)
+		if err != nil {
+			return false, err
+		}
+
+		if limits[i] > 0 && failure.Count >= limits[i] {
+			locked = true
+			err = RootDb().C(loginFailureCollection).Update(M{"key": key}, M{"$set": M{"count": 0, "lockeduntil": now.Add(lockout)}})
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	return locked, nil
+}
+
+// incrementLoginFailure atomically counts a failed login attempt for a key
+// so that concurrent attempts may not share a count. Failures are forgotten
+// after a quiet period as long as the lockout duration.
+func incrementLoginFailure(key string, now time.Time, lockout time.Duration) (*LoginFailure, error) {
+	c := RootDb().C(loginFailureCollection)
+	err := c.Update(M{"key": key, "last": M{"$lt": now.Add(-lockout)}}, M{"$set": M{"count": 0}})
+	if err != nil && err != mgo.ErrNotFound {
+		return nil, err
+	}
+
+	change := mgo.Change{
+		Update:    M{"$inc": M{"count": 1}, "$set": M{"last": now}},
+		Upsert:    true,
+		ReturnNew: true,
+	}
+
+	var failure LoginFailure
+	_, err = c.Find(M{"key": key}).Apply(change, &failure)
+	if mgo.IsDup(err) {
+		// A concurrent attempt inserted the key first
+		_, err = c.Find(M{"key": key}).Apply(change, &failure)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &failure, nil
+}
+
+// ResetLoginFailures clears the failed login count for the account of a
+// successful login. The count of the source address is kept, as one valid
+// account would otherwise allow unlimited guesses against others.
+func ResetLoginFailures(username string) error {
+	key := loginFailureKeys(username, "")[0]
+	_, err := RootDb().C(loginFailureCollection).RemoveAll(M{"key": key})
+	return err
+}
+
+// GetSecurityEvents returns the security event log for the current tenant,
+// most recent first. Results may be filtered with the type, username, since
+// and until query parameters and limited with limit.
+func GetSecurityEvents(res http.ResponseWriter, req *http.Request) {
+	auth := GetAuthContext(req)
+	query := req.URL.Query()
+
+	filter := M{"tenantid": auth.Tenant.Id}
+	if t := query.Get("type"); t != "" {
+		filter["type"] = t
+	}
+
+	if u := query.Get("username"); u != "" {
+		filter["username"] = strings.ToLower(u)
+	}
+
+	timeRange, err := GetRequestTimeRange(req)
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
+	if timeRange != nil {
+		filter["time"] = timeRange
+	}
+
+	limit, err := GetRequestLimit(req, 100)
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
+	events := []SecurityEvent{}
+	err = RootDb().C(securityEventCollection).Find(filter).Sort("-time").Limit(limit).All(&events)
+	if Handle(res, req, err) {
+		return
+	}
+
+	Render(res, req, http.StatusOK, events)
+}
@@ -0,0 +1,107 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginBackoff(t *testing.T) {
+	config := &ServerConfig{
+		LoginBackoff: 1,
+		LoginLockout: 60,
+	}
+
+	now := time.Now()
+	failure := &LoginFailure{Key: "user:test@localhost"}
+	areEqual(t, failure.RetryAfter(now, config), time.Duration(0))
+
+	// Each failure doubles the wait
+	expect := []time.Duration{1, 2, 4, 8, 16, 32, 60, 60}
+	for i, seconds := range expect {
+		failure.Count = i + 1
+		failure.Last = now
+		if wait := failure.RetryAfter(now, config); wait != seconds*time.Second {
+			t.Errorf("Expected a wait of %ds after %d failures - Got %v", seconds, i+1, wait)
+		}
+	}
+
+	// Waits elapse
+	areEqual(t, failure.RetryAfter(now.Add(time.Minute), config), time.Duration(0))
+}
+
+func TestLoginLockout(t *testing.T) {
+	config := &ServerConfig{
+		LoginBackoff: 0,
+		LoginLockout: 900,
+	}
+
+	now := time.Now()
+	failure := &LoginFailure{Key: "ip:127.0.0.1", Count: 2, Last: now}
+	areEqual(t, failure.RetryAfter(now, config), time.Duration(0))
+
+	failure.LockedUntil = now.Add(15 * time.Minute)
+	areEqual(t, failure.RetryAfter(now, config), 15*time.Minute)
+	areEqual(t, failure.RetryAfter(now.Add(15*time.Minute), config), time.Duration(0))
+}
+
+func TestRecordLoginFailure(t *testing.T) {
+	username := "lockout@localhost"
+	address := "192.0.2.200"
+	defer RootDb().C(loginFailureCollection).RemoveAll(M{"key": M{"$in": loginFailureKeys(username, address)}})
+
+	config, _ := GetConfig()
+	for i := 1; i < config.Server.LoginMaxFailures; i++ {
+		locked, err := RecordLoginFailure(username, address)
+		areEqual(t, err, nil)
+		areEqual(t, locked, false)
+	}
+
+	locked, _ := RecordLoginFailure(username, address)
+	areEqual(t, locked, true)
+
+	wait, _ := CheckLoginThrottle(strings.ToUpper(username), "192.0.2.201")
+	if wait <= 0 {
+		t.Errorf("Expected account to be locked out")
+	}
+
+	// The address is not backed off until it reaches its own limit
+	wait, _ = CheckLoginThrottle("other@localhost", address)
+	areEqual(t, wait, time.Duration(0))
+
+	// Success clears the account but not the address
+	areEqual(t, ResetLoginFailures(strings.ToUpper(username)), nil)
+	wait, _ = CheckLoginThrottle(username, address)
+	areEqual(t, wait, time.Duration(0))
+
+	failure, _ := getLoginFailure(loginFailureKeys(username, address)[1])
+	areEqual(t, failure.Count, config.Server.LoginMaxFailures)
+}
+
+func TestBadLogin(t *testing.T) {
+	post(t, V1Uri("/apikey"), `{"username":"nobody@localhost","password":"WrongP4ssw0RD!"}`, http.StatusUnauthorized)
+}
+
+func TestGetSecurityEvents(t *testing.T) {
+	Get(t, V1Uri("/security/events"))
+	Get(t, V1Uri("/security/events?type=login_failure&since=2014-01-01T00:00:00Z&limit=10"))
+	get(t, V1Uri("/security/events?since=yesterday"), http.StatusBadRequest)
+}
@@ -0,0 +1,105 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	sessionCollection = "sessions"
+)
+
+// Session is a short lived authentication token issued to a user after an
+// interactive login. It may be used in place of the user's API key in the
+// X-Auth-Token header until it expires.
+type Session struct {
+	model    `json:"-" bson:",inline"`
+	UserId   interface{} `json:"-" xml:"-"`
+	Token    string      `json:"sessionToken"`
+	Provider string      `json:"provider,omitempty" xml:",omitempty"`
+	Expires  time.Time   `json:"expires"`
+}
+
+// NewSession creates and stores a new session for the given user.
+func NewSession(user *User, provider string) (*Session, error) {
+	config, err := GetConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	session := &Session{
+		UserId:   user.Id,
+		Token:    RandomToken(32),
+		Provider: provider,
+		Expires:  time.Now().Add(time.Duration(config.Server.SessionTimeout) * time.Minute),
+	}
+	session.InitModel()
+
+	err = RootDb().C(sessionCollection).Insert(session)
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// GetSessionUser returns the user who owns the given unexpired session token.
+func GetSessionUser(token string) (*User, error) {
+	var session Session
+	err := RootDb().C(sessionCollection).Find(M{"token": token, "expires": M{"$gt": time.Now()}}).One(&session)
+	if err != nil {
+		return nil, err
+	}
+
+	var user User
+	err = RootDb().C("users").FindId(session.UserId).One(&user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// CreateSession accepts the same login request body as GetApiKey and returns a
+// new session token for the user.
+func CreateSession(res http.ResponseWriter, req *http.Request) {
+	user := LoginUser(res, req)
+	if user == nil {
+		return
+	}
+
+	session, err := NewSession(user, "local")
+	if Handle(res, req, err) {
+		return
+	}
+
+	Render(res, req, http.StatusCreated, session)
+}
+
+// DeleteCurrentSession ends the session used to authenticate the request.
+func DeleteCurrentSession(res http.ResponseWriter, req *http.Request) {
+	token := req.Header.Get("X-Auth-Token")
+	err := RootDb().C(sessionCollection).Remove(M{"token": token})
+	if Handle(res, req, err) {
+		return
+	}
+
+	Render(res, req, http.StatusNoContent, "")
+}
@@ -26,10 +26,11 @@ import (
 )
 
 type Tenant struct {
-	model `json:"-" bson:",inline"`
-	Code  string          `json:"code"`
-	Name  string          `json:"name"`
-	Cmdbs map[string]Cmdb `json:"cmdbs,omitempty" xml:"cmdbs,omitempty"`
+	model       `json:"-" bson:",inline"`
+	Code        string          `json:"code"`
+	Name        string          `json:"name"`
+	RequireTotp bool            `json:"requireTotp,omitempty" xml:",omitempty" bson:",omitempty"`
+	Cmdbs       map[string]Cmdb `json:"cmdbs,omitempty" xml:"cmdbs,omitempty"`
 }
 
 func (c *Tenant) InitModel() {
@@ -95,7 +96,8 @@ func GetCurrentTenant(res http.ResponseWriter, req *http.Request) {
 func AddTenant(res http.ResponseWriter, req *http.Request) {
 	var tenant Tenant
 	err := Bind(req, &tenant)
-	if Handle(res, req, err) {
+	if err != nil {
+		ErrBadRequest(res, req, err)
 		return
 	}
 	tenant.InitModel()
@@ -125,3 +127,35 @@ func DeleteTenantByCode(res http.ResponseWriter, req *http.Request) {
 
 	Render(res, req, http.StatusNoContent, "")
 }
+
+// SetTenantPolicy updates the security policy of the current tenant.
+func SetTenantPolicy(res http.ResponseWriter, req *http.Request) {
+	auth := GetAuthContext(req)
+	if !auth.User.IsAdmin() {
+		ErrForbidden(res, req, errors.New("Only tenant administrators may change the tenant policy"))
+		return
+	}
+
+	// Parse the request body. Should be:
+	// {"requireTotp":true}
+	var policy struct {
+		RequireTotp *bool `json:"requireTotp"`
+	}
+	err := Bind(req, &policy)
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
+	if policy.RequireTotp == nil {
+		ErrBadRequest(res, req, errors.New("No policy settings specified"))
+		return
+	}
+
+	err = RootDb().C("tenants").UpdateId(auth.Tenant.Id, M{"$set": M{"requiretotp": *policy.RequireTotp}})
+	if Handle(res, req, err) {
+		return
+	}
+
+	RenderUpdated(res, req, "")
+}
@@ -0,0 +1,325 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpIssuer        = "Alexandria CMDB"
+	totpDigits        = 6
+	totpPeriod        = 30
+	totpSkew          = 1
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTotpSecret returns a new random base32 encoded TOTP secret.
+func GenerateTotpSecret() string {
+	b := make([]byte, 20)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return totpEncoding.EncodeToString(b)
+}
+
+// TotpUri returns the otpauth:// URI used to enrol the given secret in an
+// authenticator app.
+func TotpUri(email string, secret string) string {
+	params := url.Values{
+		"secret":    {secret},
+		"issuer":    {totpIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprintf("%d", totpDigits)},
+		"period":    {fmt.Sprintf("%d", totpPeriod)},
+	}
+
+	label := url.PathEscape(fmt.Sprintf("%s:%s", totpIssuer, email))
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, params.Encode())
+}
+
+// HotpCode computes the RFC 4226 one time password for a secret and counter.
+func HotpCode(key []byte, counter uint64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", digits, code%mod)
+}
+
+// ValidateTotp checks a code against a base32 secret at the given time,
+// allowing for clock skew of one period either side. The matching time step is
+// returned and must be greater than lastCounter so that codes can not be
+// replayed.
+func ValidateTotp(secret string, code string, now time.Time, lastCounter int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	counter := now.Unix() / totpPeriod
+	for i := int64(-totpSkew); i <= totpSkew; i++ {
+		c := counter + i
+		if c <= lastCounter || c < 0 {
+			continue
+		}
+
+		expect := HotpCode(key, uint64(c), totpDigits)
+		if subtle.ConstantTimeCompare([]byte(expect), []byte(code)) == 1 {
+			return c, true
+		}
+	}
+
+	return 0, false
+}
+
+// GenerateRecoveryCodes returns a set of single use recovery codes.
+func GenerateRecoveryCodes() []string {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		_, err := rand.Read(b)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		s := strings.ToLower(totpEncoding.EncodeToString(b))
+		codes[i] = fmt.Sprintf("%s-%s", s[:4], s[4:])
+	}
+
+	return codes
+}
+
+// CheckSecondFactor validates a TOTP or recovery code for a user who has
+// enrolled in two factor authentication and records its use.
+func CheckSecondFactor(user *User, code string) (bool, error) {
+	code = strings.Replace(strings.TrimSpace(code), " ", "", -1)
+	if code == "" {
+		return false, nil
+	}
+
+	// TOTP code. The counter is only advanced if no concurrent request has
+	// already used the same or a later code.
+	if counter, ok := ValidateTotp(user.TotpSecret, code, time.Now(), user.TotpCounter); ok {
+		err := RootDb().C("users").Update(M{
+			"_id": user.Id,
+			"$or": []M{
+				M{"totpcounter": M{"$lt": counter}},
+				M{"totpcounter": M{"$exists": false}},
+			},
+		}, M{"$set": M{"totpcounter": counter}})
+		if err == mgo.ErrNotFound {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		user.TotpCounter = counter
+		return true, nil
+	}
+
+	// Recovery code. Each code is removed only if it has not already been
+	// removed by a concurrent request.
+	for i, hash := range user.RecoveryCodes {
+		if CheckPassword(hash, strings.ToLower(code)) {
+			err := RootDb().C("users").Update(M{
+				"_id":           user.Id,
+				"recoverycodes": hash,
+			}, M{"$pull": M{"recoverycodes": hash}})
+			if err == mgo.ErrNotFound {
+				return false, nil
+			} else if err != nil {
+				return false, err
+			}
+
+			user.RecoveryCodes = append(user.RecoveryCodes[:i], user.RecoveryCodes[i+1:]...)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// EnrolTotp generates a new TOTP secret for the current user. The secret is
+// not required at login until it has been verified with VerifyTotp.
+func EnrolTotp(res http.ResponseWriter, req *http.Request) {
+	auth := GetAuthContext(req)
+	if auth.User.TotpEnabled {
+		ErrConflict(res, req)
+		return
+	}
+
+	secret := GenerateTotpSecret()
+	err := RootDb().C("users").UpdateId(auth.User.Id, M{"$set": M{"totpsecret": secret}})
+	if Handle(res, req, err) {
+		return
+	}
+
+	enrolment := map[string]string{
+		"secret": secret,
+		"uri":    TotpUri(auth.User.Email, secret),
+	}
+
+	Render(res, req, http.StatusOK, enrolment)
+}
+
+// VerifyTotp completes TOTP enrolment for the current user with a code from
+// their authenticator and returns their recovery codes.
+func VerifyTotp(res http.ResponseWriter, req *http.Request) {
+	auth := GetAuthContext(req)
+
+	// Parse the request body. Should be:
+	// {"code":"123456"}
+	body := make(map[string]string)
+	err := Bind(req, &body)
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
+	if auth.User.TotpEnabled {
+		ErrConflict(res, req)
+		return
+	}
+
+	if auth.User.TotpSecret == "" {
+		ErrBadRequest(res, req, errors.New("Two factor authentication enrolment has not been started"))
+		return
+	}
+
+	counter, ok := ValidateTotp(auth.User.TotpSecret, body["code"], time.Now(), 0)
+	if !ok {
+		ErrBadRequest(res, req, errors.New("Invalid two factor authentication code"))
+		return
+	}
+
+	codes := GenerateRecoveryCodes()
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = HashPassword(code)
+	}
+
+	err = RootDb().C("users").UpdateId(auth.User.Id, M{"$set": M{
+		"totpenabled":   true,
+		"totpcounter":   counter,
+		"recoverycodes": hashes,
+	}})
+	if Handle(res, req, err) {
+		return
+	}
+
+	LogSecurityEvent(req, EventTotpEnabled, auth.User.Email, auth.User, "")
+
+	recovery := map[string][]string{
+		"recoveryCodes": codes,
+	}
+
+	Render(res, req, http.StatusOK, recovery)
+}
+
+// DisableTotp removes two factor authentication from the current user. A
+// current TOTP or recovery code is required so that a stolen API key or
+// session may not be used to remove the second factor.
+func DisableTotp(res http.ResponseWriter, req *http.Request) {
+	auth := GetAuthContext(req)
+	if auth.Tenant.RequireTotp {
+		ErrForbidden(res, req, errors.New("Two factor authentication is required by the tenant policy"))
+		return
+	}
+
+	if auth.User.TotpEnabled {
+		// Parse the request body. Should be:
+		// {"code":"123456"}
+		body := make(map[string]string)
+		err := Bind(req, &body)
+		if err != nil {
+			ErrBadRequest(res, req, err)
+			return
+		}
+
+		// Codes are throttled like logins
+		address := GetSourceAddress(req)
+		wait, err := CheckLoginThrottle(auth.User.Email, address)
+		if Handle(res, req, err) {
+			return
+		}
+
+		if wait > 0 {
+			ErrTooManyRequests(res, req, wait)
+			return
+		}
+
+		ok, err := CheckSecondFactor(auth.User, body["code"])
+		if Handle(res, req, err) {
+			return
+		}
+
+		if !ok {
+			_, err = RecordLoginFailure(auth.User.Email, address)
+			if Handle(res, req, err) {
+				return
+			}
+
+			ErrForbidden(res, req, errors.New("Invalid two factor authentication code"))
+			return
+		}
+	}
+
+	err := RootDb().C("users").UpdateId(auth.User.Id, M{"$unset": M{
+		"totpenabled":   "",
+		"totpsecret":    "",
+		"totpcounter":   "",
+		"recoverycodes": "",
+	}})
+	if Handle(res, req, err) {
+		return
+	}
+
+	LogSecurityEvent(req, EventTotpDisabled, auth.User.Email, auth.User, "")
+
+	Render(res, req, http.StatusNoContent, "")
+}
@@ -0,0 +1,230 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/base32"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHotpCode(t *testing.T) {
+	// SHA1 test vectors from RFC 6238 Appendix B
+	key := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	}
+
+	for ts, expect := range vectors {
+		areEqual(t, HotpCode(key, uint64(ts/30), 8), expect)
+	}
+}
+
+func TestValidateTotp(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111109, 0)
+
+	// Current period
+	counter, ok := ValidateTotp(secret, "081804", now, 0)
+	if !ok {
+		t.Errorf("Expected current TOTP code to validate")
+	}
+	areEqual(t, counter, int64(1111111109/30))
+
+	// Clock skew of one period either side
+	if _, ok := ValidateTotp(secret, "081804", now.Add(30*time.Second), 0); !ok {
+		t.Errorf("Expected TOTP code from the previous period to validate")
+	}
+
+	if _, ok := ValidateTotp(secret, "081804", now.Add(-30*time.Second), 0); !ok {
+		t.Errorf("Expected TOTP code from the next period to validate")
+	}
+
+	if _, ok := ValidateTotp(secret, "081804", now.Add(90*time.Second), 0); ok {
+		t.Errorf("Expected stale TOTP code to fail")
+	}
+
+	// Replay
+	if _, ok := ValidateTotp(secret, "081804", now, counter); ok {
+		t.Errorf("Expected replayed TOTP code to fail")
+	}
+
+	// Bad codes
+	for _, code := range []string{"", "000000", "81804", "0818040"} {
+		if _, ok := ValidateTotp(secret, code, now, 0); ok {
+			t.Errorf("Expected invalid TOTP code '%s' to fail", code)
+		}
+	}
+}
+
+func TestTotpEnrolmentUri(t *testing.T) {
+	secret := GenerateTotpSecret()
+	areEqual(t, len(secret), 32)
+
+	uri, err := url.Parse(TotpUri("root@localhost", secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	areEqual(t, uri.Scheme, "otpauth")
+	areEqual(t, uri.Host, "totp")
+	areEqual(t, uri.Path, "/Alexandria CMDB:root@localhost")
+	areEqual(t, uri.Query().Get("secret"), secret)
+	areEqual(t, uri.Query().Get("issuer"), "Alexandria CMDB")
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes := GenerateRecoveryCodes()
+	areEqual(t, len(codes), recoveryCodeCount)
+
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != 9 || strings.Count(code, "-") != 1 {
+			t.Errorf("Unexpected recovery code format: %s", code)
+		}
+
+		if seen[code] {
+			t.Errorf("Duplicate recovery code: %s", code)
+		}
+		seen[code] = true
+	}
+}
+
+func TestTotpEnrolment(t *testing.T) {
+	uri := V1Uri("/users/current/totp")
+	post(t, uri, "", http.StatusOK)
+	post(t, V1Uri("/users/current/totp/verify"), `{"code":"000000"}`, http.StatusBadRequest)
+	Delete(t, uri)
+}
+
+func TestBadTenantPolicy(t *testing.T) {
+	PatchInvalid(t, V1Uri("/tenants/current/policy"), `{}`)
+}
+
+// newTestTotpUser creates a user who has enrolled in two factor
+// authentication and returns them with the URI to delete them.
+func newTestTotpUser(t *testing.T) (*User, string) {
+	body := fmt.Sprintf(`{"email":"%s","firstName":"%s","lastName":"%s","password":"%s"}`, testEmail, testFirstName, testLastName, testPassword)
+	userurl := Post(t, V1Uri("/users"), body)
+
+	secret := GenerateTotpSecret()
+	err := RootDb().C("users").Update(M{"email": testEmail}, M{"$set": M{"totpenabled": true, "totpsecret": secret}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var user User
+	RootDb().C("users").Find(M{"email": testEmail}).One(&user)
+	return &user, userurl
+}
+
+func serveAs(user *User, method string, uri string, body string) *httptest.ResponseRecorder {
+	req := NewRequest(method, uri, strings.NewReader(body))
+	req.Header.Set("X-Auth-Token", user.ApiKey)
+	res := httptest.NewRecorder()
+	GetServer().ServeHTTP(res, req)
+	return res
+}
+
+func TestTenantPolicyRequiresAdmin(t *testing.T) {
+	user, userurl := newTestTotpUser(t)
+	defer Delete(t, userurl)
+
+	res := serveAs(user, "PATCH", V1Uri("/tenants/current/policy"), `{"requireTotp":false}`)
+	areEqual(t, res.Code, http.StatusForbidden)
+}
+
+func TestDisableTotpRequiresCode(t *testing.T) {
+	user, userurl := newTestTotpUser(t)
+	defer Delete(t, userurl)
+
+	res := serveAs(user, "DELETE", V1Uri("/users/current/totp"), `{}`)
+	areEqual(t, res.Code, http.StatusForbidden)
+
+	// The failed attempt is throttled like a login
+	ResetLoginFailures(user.Email)
+
+	code := HotpCode(mustDecodeTotpSecret(t, user.TotpSecret), uint64(time.Now().Unix()/totpPeriod), totpDigits)
+	res = serveAs(user, "DELETE", V1Uri("/users/current/totp"), fmt.Sprintf(`{"code":"%s"}`, code))
+	areEqual(t, res.Code, http.StatusNoContent)
+}
+
+func TestSecondFactorReplay(t *testing.T) {
+	user, userurl := newTestTotpUser(t)
+	defer Delete(t, userurl)
+
+	recovery := HashPassword("abcd-efgh")
+	err := RootDb().C("users").UpdateId(user.Id, M{"$set": M{"recoverycodes": []string{recovery}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each request holds its own copy of the user, as concurrent requests do
+	code := HotpCode(mustDecodeTotpSecret(t, user.TotpSecret), uint64(time.Now().Unix()/totpPeriod), totpDigits)
+	for i, expect := range []bool{true, false} {
+		replay := *user
+		ok, err := CheckSecondFactor(&replay, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ok != expect {
+			t.Errorf("Expected TOTP attempt %d to return %v", i+1, expect)
+		}
+	}
+
+	for i, expect := range []bool{true, false} {
+		replay := *user
+		replay.RecoveryCodes = []string{recovery}
+		ok, err := CheckSecondFactor(&replay, "ABCD-EFGH")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ok != expect {
+			t.Errorf("Expected recovery code attempt %d to return %v", i+1, expect)
+		}
+	}
+}
+
+func mustDecodeTotpSecret(t *testing.T, secret string) []byte {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestOidcVerifyTotp(t *testing.T) {
+	req := NewRequest("POST", V1Uri("/auth/oidc/totp"), strings.NewReader(`{"totpToken":"unknown","code":"123456"}`))
+	req.Header.Del("X-Auth-Token")
+	res := httptest.NewRecorder()
+	GetServer().ServeHTTP(res, req)
+	areEqual(t, res.Code, http.StatusUnauthorized)
+}
@@ -24,6 +24,12 @@ import (
 	"net/http"
 	"regexp"
 	"strings"
+	"sync"
+)
+
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
 )
 
 type User struct {
@@ -36,6 +42,14 @@ type User struct {
 	Email        string      `json:"email"`
 	Password     string      `json:"password,omitempty" xml:",omitempty" bson:"-"`
 	PasswordHash string      `json:"-" xml:"-" bson:"password"`
+	Provider     string      `json:"provider,omitempty" xml:",omitempty" bson:",omitempty"`
+	Roles        []string    `json:"roles,omitempty" xml:"role,omitempty" bson:",omitempty"`
+
+	// Two factor authentication
+	TotpEnabled   bool     `json:"totpEnabled,omitempty" xml:",omitempty" bson:",omitempty"`
+	TotpSecret    string   `json:"-" xml:"-" bson:",omitempty"`
+	TotpCounter   int64    `json:"-" xml:"-" bson:",omitempty"`
+	RecoveryCodes []string `json:"-" xml:"-" bson:",omitempty"`
 }
 
 func (c *User) InitModel() {
@@ -57,13 +71,61 @@ func (c *User) Validate() error {
 		return errors.New("No tenancy code specified")
 	}
 
-	if c.PasswordHash == "" {
+	// Externally authenticated users have no local password
+	if c.PasswordHash == "" && c.IsLocal() {
 		return errors.New("No password specified")
 	}
 
 	return nil
 }
 
+// IsLocal returns true if the user authenticates against the password stored
+// in the users collection rather than an external authentication provider.
+func (c *User) IsLocal() bool {
+	return c.Provider == "" || c.Provider == "local"
+}
+
+// HasRole returns true if the user has been assigned the given role.
+func (c *User) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+var rootUserId interface{}
+var rootUserMutex sync.Mutex
+
+// getRootUserId returns the id of the root user created at installation. It
+// never changes, so it is only read from the database until it is found.
+func getRootUserId() interface{} {
+	rootUserMutex.Lock()
+	defer rootUserMutex.Unlock()
+
+	if rootUserId == nil {
+		var apiInfo ApiInfo
+		if err := RootDb().C("apiInfo").Find(nil).One(&apiInfo); err == nil {
+			rootUserId = apiInfo.RootUserId
+		}
+	}
+
+	return rootUserId
+}
+
+// IsAdmin returns true if the user may administer their tenant. The root user
+// created at installation is always an administrator.
+func (c *User) IsAdmin() bool {
+	if c.HasRole(RoleAdmin) {
+		return true
+	}
+
+	id := getRootUserId()
+	return id != nil && id == c.Id
+}
+
 func GetUsers(res http.ResponseWriter, req *http.Request) {
 	auth := GetAuthContext(req)
 
@@ -86,6 +148,7 @@ func GetUserByEmail(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	SetETag(res, &user.model)
 	Render(res, req, http.StatusOK, user)
 }
 
@@ -100,9 +163,14 @@ func AddUser(res http.ResponseWriter, req *http.Request) {
 	auth := GetAuthContext(req)
 	var user User
 	err := Bind(req, &user)
-	if Handle(res, req, err) {
+	if err != nil {
+		ErrBadRequest(res, req, err)
 		return
 	}
+
+	// Providers are only assigned by authentication providers
+	user.Provider = ""
+
 	user.InitModel()
 	user.PasswordHash = HashPassword(user.Password)
 
@@ -119,6 +187,21 @@ func AddUser(res http.ResponseWriter, req *http.Request) {
 		user.TenantId = tenant.Id
 	}
 
+	// Only administrators may grant roles, and only in their own tenant
+	if len(user.Roles) > 0 {
+		if !auth.User.IsAdmin() || user.TenantId != auth.Tenant.Id {
+			ErrForbidden(res, req, errors.New("Only tenant administrators may assign roles"))
+			return
+		}
+
+		for _, role := range user.Roles {
+			if role != RoleAdmin && role != RoleUser {
+				ErrBadRequest(res, req, errors.New(fmt.Sprintf("Invalid role specified: %s", role)))
+				return
+			}
+		}
+	}
+
 	// Validate
 	err = user.Validate()
 	if err != nil {
@@ -132,6 +215,8 @@ func AddUser(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	LogSecurityEvent(req, EventApiKeyCreated, user.Email, &user, fmt.Sprintf("created by %s", auth.User.Email))
+
 	RenderCreated(res, req, V1Uri(fmt.Sprintf("/users/%s", user.Email)))
 }
 
@@ -139,7 +224,17 @@ func DeleteUserByEmail(res http.ResponseWriter, req *http.Request) {
 	auth := GetAuthContext(req)
 	email := GetPathVar(req, "email")
 
-	err := RootDb().C("users").Remove(M{"tenantid": auth.User.TenantId, "email": email})
+	var user User
+	err := RootDb().C("users").Find(M{"tenantid": auth.User.TenantId, "email": email}).Select(M{"revision": 1}).One(&user)
+	if Handle(res, req, err) {
+		return
+	}
+
+	if CheckIfMatch(res, req, &user.model) {
+		return
+	}
+
+	err = RemoveRevision(RootDb().C("users"), user.Id, user.Revision)
 	if Handle(res, req, err) {
 		return
 	}
@@ -168,9 +263,19 @@ func SetUserPassword(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if CheckIfMatch(res, req, &user.model) {
+		return
+	}
+
 	// Update the password
 	hash := HashPassword(body["password"])
-	err = RootDb().C("users").UpdateId(user.Id, M{"$set": M{"password": hash}})
+	revision := user.Revision
+	user.SetModified()
+	err = UpdateRevision(RootDb().C("users"), user.Id, revision, M{"$set": M{
+		"password": hash,
+		"modified": user.Modified,
+		"revision": user.Revision,
+	}})
 	if Handle(res, req, err) {
 		return
 	}
@@ -47,6 +47,26 @@ func TestAddUser(t *testing.T) {
 	PostInvalid(t, uri, body)
 }
 
+func TestAddUserRoles(t *testing.T) {
+	// Administrators may grant roles but providers are never assigned by
+	// the client
+	body := fmt.Sprintf(`{"email":"%s","firstName":"%s","lastName":"%s","password":"%s","roles":["user"],"provider":"ldap"}`, testEmail, testFirstName, testLastName, testPassword)
+	userurl := Post(t, V1Uri("/users"), body)
+	defer Delete(t, userurl)
+
+	user := Get(t, userurl)
+	areEqual(t, fmt.Sprintf("%v", user["roles"]), "[user]")
+	areEqual(t, user["provider"], nil)
+
+	post(t, V1Uri("/users"), `{"email":"role@localhost.com","password":"Password1","roles":["superuser"]}`, http.StatusBadRequest)
+
+	// Other users may not
+	var u User
+	RootDb().C("users").Find(M{"email": testEmail}).One(&u)
+	res := serveAs(&u, "POST", V1Uri("/users"), `{"email":"role@localhost.com","password":"Password1","roles":["admin"]}`)
+	areEqual(t, res.Code, http.StatusForbidden)
+}
+
 func TestUserPassword(t *testing.T) {
 	// Create a temporary user
 	uri := V1Uri("/users")
@@ -68,6 +88,11 @@ func TestUserPassword(t *testing.T) {
 	testLogin(t, "i_dont_exist", "AnyPassword", http.StatusUnauthorized)
 }
 
+// testLoginCount is used to send each test login from its own address so
+// that the backoff after a failed attempt from an address does not throttle
+// the next attempt.
+var testLoginCount int
+
 func testLogin(t *testing.T, username string, password string, code int) {
 	uri := V1Uri("/apikey")
 	fmt.Printf("[TEST] POST %s (expecting %d)...\n", uri, code)
@@ -76,6 +101,8 @@ func testLogin(t *testing.T, username string, password string, code int) {
 	body := fmt.Sprintf(`{"username":"%s","password":"%s"}`, username, password)
 	req := NewRequest("POST", uri, strings.NewReader(body))
 	req.Header.Del("X-Auth-Token") // Ensure the route works without API key auth
+	testLoginCount++
+	req.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", testLoginCount)
 	res := httptest.NewRecorder()
 
 	// Start web server
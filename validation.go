@@ -0,0 +1,137 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+)
+
+// ValidationErrors is the list of problems found while validating a
+// document.
+type ValidationErrors []error
+
+// ValidationProblem describes a single problem found while validating a
+// document.
+type ValidationProblem struct {
+	Path    string `json:"path,omitempty" xml:",attr,omitempty"`
+	Rule    string `json:"rule,omitempty" xml:",attr,omitempty"`
+	Message string `json:"message"`
+}
+
+// ValidationResult is the response to a dry run of a create or update.
+type ValidationResult struct {
+	Valid    bool                `json:"valid"`
+	Document interface{}         `json:"document"`
+	Errors   []ValidationProblem `json:"errors" xml:"error"`
+}
+
+// MarshalXML encodes the document, which is a map for CIs.
+func (c ValidationResult) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	doc := struct {
+		Valid    bool
+		Document interface{}
+		Errors   []ValidationProblem `xml:"error"`
+	}{c.Valid, c.Document, c.Errors}
+
+	if isXmlMap(c.Document) {
+		doc.Document = xmlValue{c.Document}
+	}
+
+	return e.EncodeElement(doc, start)
+}
+
+func (c ValidationErrors) Error() string {
+	messages := make([]string, len(c))
+	for i, err := range c {
+		messages[i] = err.Error()
+	}
+
+	return strings.Join(messages, "\n")
+}
+
+// Add appends an error to the list, flattening nested lists. Nil errors are
+// ignored.
+func (c ValidationErrors) Add(err error) ValidationErrors {
+	switch e := err.(type) {
+	case nil:
+		return c
+	case ValidationErrors:
+		return append(c, e...)
+	}
+
+	return append(c, err)
+}
+
+// Err returns nil if the list is empty, otherwise the list.
+func (c ValidationErrors) Err() error {
+	if len(c) == 0 {
+		return nil
+	}
+
+	return c
+}
+
+// Problems describes each error in the list.
+func (c ValidationErrors) Problems() []ValidationProblem {
+	problems := make([]ValidationProblem, len(c))
+	for i, err := range c {
+		problems[i] = getValidationProblem(err)
+	}
+
+	return problems
+}
+
+func getValidationProblem(err error) ValidationProblem {
+	switch e := err.(type) {
+	case *FieldError:
+		return ValidationProblem{Path: e.Path, Message: e.Message}
+	case *RuleError:
+		return ValidationProblem{Rule: e.Rule, Message: e.Message}
+	}
+
+	return ValidationProblem{Message: err.Error()}
+}
+
+// GetValidationProblems describes each problem in a validation error.
+func GetValidationProblems(err error) []ValidationProblem {
+	return ValidationErrors{}.Add(err).Problems()
+}
+
+// IsDryRun returns true if the request asks for validation only.
+func IsDryRun(req *http.Request) bool {
+	return req.URL.Query().Get("dryRun") == "true"
+}
+
+// RenderValidationResult renders the outcome of a dry run with the document
+// that would have been stored and all problems found.
+func RenderValidationResult(res http.ResponseWriter, req *http.Request, document interface{}, err error) {
+	result := ValidationResult{
+		Valid:    err == nil,
+		Document: document,
+		Errors:   GetValidationProblems(err),
+	}
+
+	status := http.StatusOK
+	if err != nil {
+		status = http.StatusBadRequest
+	}
+
+	Render(res, req, status, result)
+}
@@ -0,0 +1,108 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidationErrors(t *testing.T) {
+	errs := ValidationErrors{}
+	areEqual(t, errs.Err(), nil)
+
+	errs = errs.Add(nil)
+	errs = errs.Add(newFieldError(".a", errors.New("bad a")))
+	errs = errs.Add(ValidationErrors{&RuleError{"rule", "bad rule"}, errors.New("bad")})
+	areEqual(t, len(errs), 3)
+	areEqual(t, errs.Error(), "bad a\nbad rule\nbad")
+
+	problems := errs.Problems()
+	areEqual(t, problems[0].Path, "a")
+	areEqual(t, problems[1].Rule, "rule")
+	areEqual(t, problems[2].Message, "bad")
+}
+
+func TestValidateAllFields(t *testing.T) {
+	schema := testCsvSchema()
+	(*schema)[0].Required = true
+
+	fields := map[string]interface{}{
+		"cores":   "many",
+		"tags":    "not an array",
+		"unknown": true,
+		"network": map[string]interface{}{"address": float64(1)},
+	}
+
+	problems := GetValidationProblems(validateFields(&fields, schema, ""))
+	areEqual(t, len(problems), 5)
+	areEqual(t, problems[0].Path, "cores")
+	areEqual(t, problems[1].Path, "network.address")
+	areEqual(t, problems[2].Path, "tags")
+	areEqual(t, problems[3].Path, "unknown")
+	areEqual(t, problems[4].Path, "host-name")
+}
+
+func TestValidatePartialFields(t *testing.T) {
+	schema := testCsvSchema()
+	(*schema)[0].Required = true
+	(*schema)[3].Children[0].Required = true
+
+	// Partial submissions are only checked for valid types
+	fields := map[string]interface{}{"cores": "4"}
+	areEqual(t, validateFieldTypes(&fields, schema, ""), nil)
+	areEqual(t, fields["cores"], float64(4))
+
+	// Required fields are checked in the merged CI, including within groups
+	fields["network"] = map[string]interface{}{}
+	problems := GetValidationProblems(checkRequiredFields(fields, schema, ""))
+	areEqual(t, len(problems), 2)
+	areEqual(t, problems[0].Path, "host-name")
+	areEqual(t, problems[1].Path, "network.address")
+}
+
+func TestApplyDefaults(t *testing.T) {
+	schema := testCsvSchema()
+	(*schema)[2].Default = "2"
+	(*schema)[3].Children[0].Default = "127.0.0.1"
+
+	// Defaults are not attributed to partial submissions
+	fields := map[string]interface{}{"host-name": "web01", "network": map[string]interface{}{}}
+	areEqual(t, validateFieldTypes(&fields, schema, ""), nil)
+	areEqual(t, fields["cores"], nil)
+
+	areEqual(t, applyDefaults(fields, schema, ""), nil)
+	areEqual(t, fields["cores"], float64(2))
+	areEqual(t, getPath(fields, "network.address"), "127.0.0.1")
+}
+
+func TestValidateAllCITypeAttributes(t *testing.T) {
+	citype := CIType{
+		Name: "Server",
+		Attributes: CITypeAttributeList{
+			{Name: "a"},
+			{Name: "b", Type: "nosuchtype"},
+			{Name: "c", Type: "group", Children: CITypeAttributeList{
+				{Name: "d", Type: "number", Default: "NaN?"},
+			}},
+		},
+	}
+
+	problems := GetValidationProblems(citype.Validate())
+	areEqual(t, len(problems), 3)
+}
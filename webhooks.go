@@ -0,0 +1,826 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	webhookCollection         = "webhooks"
+	webhookDeliveryCollection = "webhookdeliveries"
+
+	webhookMinSecretLength = 16
+	webhookMaxAttempts     = 8
+	webhookMaxHistory      = 20
+
+	// Failed deliveries are retried after an exponentially increasing delay
+	webhookRetryDelay    = 30 * time.Second
+	webhookMaxRetryDelay = 6 * time.Hour
+
+	// Deliveries are retried if a server claims them and fails to complete
+	// them within the lease
+	webhookLease        = time.Minute
+	webhookTimeout      = 10 * time.Second
+	webhookPollInterval = 5 * time.Second
+	webhookWorkers      = 4
+
+	// Delivery history is removed after the retention period
+	webhookRetention = 30 * 24 * time.Hour
+)
+
+// Webhook delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+// Webhook request headers
+const (
+	WebhookEventHeader     = "X-Alexandria-Event"
+	WebhookDeliveryHeader  = "X-Alexandria-Delivery"
+	WebhookTimestampHeader = "X-Alexandria-Timestamp"
+	WebhookSignatureHeader = "X-Alexandria-Signature"
+)
+
+// WebhookTestEvent is the event type of test deliveries.
+const WebhookTestEvent = "test"
+
+// Webhook is a subscription to the changes of the CIs in a CMDB which are
+// delivered to a URL.
+type Webhook struct {
+	model       `json:"-" bson:",inline"`
+	TenantId    interface{} `json:"-" xml:"-"`
+	Cmdb        string      `json:"-" xml:"-"`
+	Name        string      `json:"name"`
+	ShortName   string      `json:"shortName"`
+	Description string      `json:"description,omitempty" xml:",omitempty" bson:",omitempty"`
+	Url         string      `json:"url"`
+	Disabled    bool        `json:"disabled,omitempty" xml:",omitempty" bson:",omitempty"`
+
+	// Key used to sign payloads. It is never returned to clients.
+	Secret string `json:"secret,omitempty" xml:"-"`
+
+	// Event filters
+	CITypes []string `json:"citypes,omitempty" xml:"citype,omitempty" bson:",omitempty"`
+	Actions []string `json:"actions,omitempty" xml:"action,omitempty" bson:",omitempty"`
+	Filter  string   `json:"filter,omitempty" xml:",omitempty" bson:",omitempty"`
+}
+
+// WebhookAttempt is the outcome of an attempt to deliver a payload.
+type WebhookAttempt struct {
+	Time     time.Time `json:"time"`
+	Duration int64     `json:"duration"`
+	Status   int       `json:"status,omitempty" xml:",omitempty" bson:",omitempty"`
+	Error    string    `json:"error,omitempty" xml:",omitempty" bson:",omitempty"`
+}
+
+// WebhookDelivery is a payload queued for delivery to a webhook and the
+// history of attempts to deliver it.
+type WebhookDelivery struct {
+	model       `json:"-" bson:",inline"`
+	DeliveryId  string           `json:"id" xml:"id,attr" bson:"-"`
+	TenantId    interface{}      `json:"-" xml:"-"`
+	WebhookId   interface{}      `json:"-" xml:"-"`
+	EventId     int64            `json:"eventId,omitempty" xml:",omitempty" bson:",omitempty"`
+	EventType   string           `json:"eventType"`
+	Status      string           `json:"status"`
+	Remaining   int              `json:"remaining"`
+	NextAttempt time.Time        `json:"nextAttempt"`
+	Attempts    []WebhookAttempt `json:"attempts" xml:"attempt"`
+	Payload     string           `json:"-" xml:"-"`
+}
+
+// WebhookPayload is the body of a webhook request.
+type WebhookPayload struct {
+	Delivery string                 `json:"delivery"`
+	Webhook  string                 `json:"webhook"`
+	Cmdb     string                 `json:"cmdb"`
+	Test     bool                   `json:"test,omitempty"`
+	Event    *ChangeEvent           `json:"event,omitempty"`
+	Value    map[string]interface{} `json:"value,omitempty"`
+}
+
+func (c *Webhook) Validate() error {
+	if c.Name == "" {
+		return errors.New("No webhook name specified")
+	}
+
+	c.ShortName = GetShortName(c.Name)
+	if !IsValidShortName(c.ShortName) {
+		return errors.New("Invalid characters in webhook name")
+	}
+
+	errs := ValidationErrors{}
+	u, err := url.Parse(c.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = errs.Add(errors.New(fmt.Sprintf("Invalid webhook URL: '%s'", c.Url)))
+	} else if ip := net.ParseIP(u.Hostname()); ip != nil && !webhookDispatcher.AllowPrivate && !isPublicAddress(ip) {
+		errs = errs.Add(errors.New(fmt.Sprintf("Webhook URL must not be a private address: '%s'", c.Url)))
+	}
+
+	if len(c.Secret) < webhookMinSecretLength {
+		errs = errs.Add(errors.New(fmt.Sprintf("Webhook secret must be at least %d characters", webhookMinSecretLength)))
+	}
+
+	for _, action := range c.Actions {
+		if action != ChangeCreated && action != ChangeUpdated && action != ChangeDeleted {
+			errs = errs.Add(errors.New(fmt.Sprintf("Invalid webhook action: '%s'", action)))
+		}
+	}
+
+	if c.Filter != "" {
+		if _, err := ParseExpression(c.Filter); err != nil {
+			errs = errs.Add(errors.New(fmt.Sprintf("Invalid webhook filter: %s", err)))
+		}
+	}
+
+	return errs.Err()
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Matches returns true if a change event should be delivered to the webhook.
+// Empty filters match all events.
+func (c *Webhook) Matches(event *ChangeEvent) bool {
+	if c.Disabled || event.Cmdb != c.Cmdb {
+		return false
+	}
+
+	if len(c.CITypes) > 0 && !containsString(c.CITypes, event.CIType) {
+		return false
+	}
+
+	if len(c.Actions) > 0 && !containsString(c.Actions, event.Type) {
+		return false
+	}
+
+	if c.Filter != "" {
+		expr, err := ParseExpression(c.Filter)
+		if err != nil {
+			return false
+		}
+
+		ok, err := expr.IsTrue(event.value)
+		if err != nil {
+			log.Printf("Error evaluating filter of webhook %s: %s", c.ShortName, err)
+			return false
+		}
+
+		return ok
+	}
+
+	return true
+}
+
+// NewWebhookDelivery returns a delivery of a change event to a webhook, or a
+// test delivery if the event is nil.
+func NewWebhookDelivery(hook *Webhook, event *ChangeEvent) (*WebhookDelivery, error) {
+	delivery := &WebhookDelivery{
+		TenantId:  hook.TenantId,
+		WebhookId: hook.Id,
+		EventType: WebhookTestEvent,
+		Status:    DeliveryPending,
+		Remaining: webhookMaxAttempts,
+		Attempts:  []WebhookAttempt{},
+	}
+	delivery.InitModel()
+	delivery.NextAttempt = delivery.Created
+
+	payload := WebhookPayload{
+		Delivery: IdToString(delivery.Id),
+		Webhook:  hook.ShortName,
+		Cmdb:     hook.Cmdb,
+		Test:     event == nil,
+	}
+
+	if event != nil {
+		delivery.EventId = event.Sequence
+		delivery.EventType = event.Type
+		payload.Event = event
+		payload.Value = event.value
+	}
+
+	data, err := json.Marshal(&payload)
+	if err != nil {
+		return nil, err
+	}
+
+	delivery.Payload = string(data)
+	return delivery, nil
+}
+
+// SignWebhookPayload returns the signature of a payload sent at the given
+// Unix time. Receivers verify payloads by computing the HMAC-SHA256 of the
+// timestamp, a period and the request body with the webhook secret.
+func SignWebhookPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryDelay returns how long to wait before retrying a delivery which has
+// failed the given number of times.
+func retryDelay(failures int) time.Duration {
+	delay := webhookRetryDelay
+	for i := 1; i < failures && delay < webhookMaxRetryDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > webhookMaxRetryDelay {
+		delay = webhookMaxRetryDelay
+	}
+
+	return delay
+}
+
+// Record adds an attempt to the history of a delivery and schedules a retry
+// if it failed. Deliveries which have no remaining attempts are dead
+// lettered.
+func (c *WebhookDelivery) Record(attempt WebhookAttempt) {
+	c.Attempts = append(c.Attempts, attempt)
+	if len(c.Attempts) > webhookMaxHistory {
+		c.Attempts = c.Attempts[len(c.Attempts)-webhookMaxHistory:]
+	}
+
+	if attempt.Error == "" {
+		c.Status = DeliveryDelivered
+		c.Remaining = 0
+		return
+	}
+
+	c.Remaining--
+	if c.Remaining <= 0 {
+		c.Status = DeliveryDead
+		c.Remaining = 0
+		return
+	}
+
+	c.NextAttempt = attempt.Time.Add(retryDelay(webhookMaxAttempts - c.Remaining))
+}
+
+// Address ranges which are not reachable from the internet. Webhooks may not
+// deliver to them so that they cannot be used to reach internal services.
+var webhookPrivateNetworks = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/3",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		networks[i] = network
+	}
+
+	return networks
+}
+
+// isPublicAddress returns true if an IP address is not in a private,
+// loopback, link-local or otherwise reserved range.
+func isPublicAddress(ip net.IP) bool {
+	for _, network := range webhookPrivateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// WebhookDispatcher delivers queued payloads to webhooks.
+type WebhookDispatcher struct {
+	client *http.Client
+	wake   chan struct{}
+
+	// Deliveries to private addresses are refused unless this is set
+	AllowPrivate bool
+}
+
+var webhookDispatcher = NewWebhookDispatcher()
+
+func NewWebhookDispatcher() *WebhookDispatcher {
+	c := &WebhookDispatcher{wake: make(chan struct{}, 1)}
+
+	// Addresses are checked after they are resolved so that a host name
+	// cannot be made to resolve to a private address after validation.
+	// Connections are made directly as a proxy would resolve the address.
+	dialer := &net.Dialer{
+		Timeout: webhookTimeout,
+		Control: func(network string, address string, conn syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			if ip := net.ParseIP(host); ip == nil || (!c.AllowPrivate && !isPublicAddress(ip)) {
+				return errors.New(fmt.Sprintf("Webhook address %s is not a public address", host))
+			}
+
+			return nil
+		},
+	}
+
+	c.client = &http.Client{
+		Timeout: webhookTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: webhookTimeout,
+		},
+
+		// Redirects are reported as failures rather than followed
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return c
+}
+
+// Send attempts to deliver a payload to a webhook.
+func (c *WebhookDispatcher) Send(hook *Webhook, delivery *WebhookDelivery) WebhookAttempt {
+	attempt := WebhookAttempt{Time: time.Now().UTC().Truncate(time.Millisecond)}
+	body := []byte(delivery.Payload)
+
+	req, err := http.NewRequest("POST", hook.Url, strings.NewReader(delivery.Payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+
+	timestamp := attempt.Time.Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Alexandria CMDB Webhooks")
+	req.Header.Set(WebhookEventHeader, delivery.EventType)
+	req.Header.Set(WebhookDeliveryHeader, IdToString(delivery.Id))
+	req.Header.Set(WebhookTimestampHeader, fmt.Sprintf("%d", timestamp))
+	req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(hook.Secret, timestamp, body))
+
+	start := time.Now()
+	res, err := c.client.Do(req)
+	attempt.Duration = int64(time.Since(start) / time.Millisecond)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024))
+
+	attempt.Status = res.StatusCode
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		attempt.Error = fmt.Sprintf("Unexpected response: %s", res.Status)
+	}
+
+	return attempt
+}
+
+// Start starts the delivery workers.
+func (c *WebhookDispatcher) Start() {
+	for i := 0; i < webhookWorkers; i++ {
+		go c.work()
+	}
+}
+
+// Wake prompts an idle worker to check for queued deliveries.
+func (c *WebhookDispatcher) Wake() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *WebhookDispatcher) work() {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for {
+		for c.deliverNext() {
+		}
+
+		select {
+		case <-c.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverNext claims and attempts the next due delivery. False is returned if
+// no deliveries are due.
+func (c *WebhookDispatcher) deliverNext() bool {
+	now := time.Now()
+	deliveries := RootDb().C(webhookDeliveryCollection)
+
+	// Claim the delivery so no other worker attempts it until the lease
+	// expires
+	var delivery WebhookDelivery
+	_, err := deliveries.Find(M{"status": DeliveryPending, "nextattempt": M{"$lte": now}}).Sort("nextattempt").Apply(mgo.Change{
+		Update:    M{"$set": M{"nextattempt": now.Add(webhookLease)}},
+		ReturnNew: true,
+	}, &delivery)
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			log.Printf("Error claiming webhook delivery: %s", err)
+		}
+
+		return false
+	}
+
+	var hook Webhook
+	err = RootDb().C(webhookCollection).FindId(delivery.WebhookId).One(&hook)
+	switch {
+	case err == mgo.ErrNotFound:
+		delivery.Remaining = 1
+		delivery.Record(WebhookAttempt{Time: now, Error: "Webhook no longer exists"})
+
+	case err != nil:
+		log.Printf("Error retrieving webhook for delivery %s: %s", IdToString(delivery.Id), err)
+		return false
+
+	case hook.Disabled:
+		delivery.Record(WebhookAttempt{Time: now, Error: "Webhook is disabled"})
+
+	default:
+		delivery.Record(c.Send(&hook, &delivery))
+	}
+
+	if delivery.Status == DeliveryDead {
+		log.Printf("Webhook delivery %s is dead lettered: %s", IdToString(delivery.Id), delivery.Attempts[len(delivery.Attempts)-1].Error)
+	}
+
+	err = deliveries.UpdateId(delivery.Id, M{"$set": M{
+		"status":      delivery.Status,
+		"remaining":   delivery.Remaining,
+		"nextattempt": delivery.NextAttempt,
+		"attempts":    delivery.Attempts,
+	}})
+	if err != nil {
+		log.Printf("Error updating webhook delivery %s: %s", IdToString(delivery.Id), err)
+	}
+
+	return true
+}
+
+// QueueWebhookDeliveries queues the delivery of change events to the webhooks
+// which match them.
+func QueueWebhookDeliveries(events []*ChangeEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	hooks := map[string][]Webhook{}
+	docs := []interface{}{}
+	for _, event := range events {
+		cmdbHooks, ok := hooks[event.Cmdb]
+		if !ok {
+			err := RootDb().C(webhookCollection).Find(M{"tenantid": event.TenantId, "cmdb": event.Cmdb}).All(&cmdbHooks)
+			if err != nil {
+				return err
+			}
+
+			hooks[event.Cmdb] = cmdbHooks
+		}
+
+		for i, _ := range cmdbHooks {
+			if !cmdbHooks[i].Matches(event) {
+				continue
+			}
+
+			delivery, err := NewWebhookDelivery(&cmdbHooks[i], event)
+			if err != nil {
+				return err
+			}
+
+			docs = append(docs, delivery)
+		}
+	}
+
+	if len(docs) == 0 {
+		return nil
+	}
+
+	err := RootDb().C(webhookDeliveryCollection).Insert(docs...)
+	if err != nil {
+		return err
+	}
+
+	webhookDispatcher.Wake()
+	return nil
+}
+
+// getWebhookCmdb returns the name of the CMDB in the request path or renders
+// an error if it does not exist.
+func getWebhookCmdb(res http.ResponseWriter, req *http.Request) string {
+	cmdb := strings.ToLower(GetPathVar(req, "cmdb"))
+	if GetCmdbBackend(req, cmdb) == nil {
+		ErrNotFound(res, req)
+		return ""
+	}
+
+	return cmdb
+}
+
+// getWebhook returns the webhook in the request path or renders an error if
+// it does not exist.
+func getWebhook(res http.ResponseWriter, req *http.Request) *Webhook {
+	cmdb := getWebhookCmdb(res, req)
+	if cmdb == "" {
+		return nil
+	}
+
+	auth := GetAuthContext(req)
+	var hook Webhook
+	err := RootDb().C(webhookCollection).Find(M{"tenantid": auth.Tenant.Id, "cmdb": cmdb, "shortname": GetPathVar(req, "name")}).One(&hook)
+	if Handle(res, req, err) {
+		return nil
+	}
+
+	return &hook
+}
+
+func GetWebhooks(res http.ResponseWriter, req *http.Request) {
+	cmdb := getWebhookCmdb(res, req)
+	if cmdb == "" {
+		return
+	}
+
+	auth := GetAuthContext(req)
+	hooks := []Webhook{}
+	err := RootDb().C(webhookCollection).Find(M{"tenantid": auth.Tenant.Id, "cmdb": cmdb}).Sort("shortname").All(&hooks)
+	if Handle(res, req, err) {
+		return
+	}
+
+	for i, _ := range hooks {
+		hooks[i].Secret = ""
+	}
+
+	Render(res, req, http.StatusOK, hooks)
+}
+
+func GetWebhookByName(res http.ResponseWriter, req *http.Request) {
+	hook := getWebhook(res, req)
+	if hook == nil {
+		return
+	}
+
+	hook.Secret = ""
+	SetETag(res, &hook.model)
+	Render(res, req, http.StatusOK, hook)
+}
+
+func AddWebhook(res http.ResponseWriter, req *http.Request) {
+	cmdb := getWebhookCmdb(res, req)
+	if cmdb == "" {
+		return
+	}
+
+	var hook Webhook
+	err := Bind(req, &hook)
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
+	auth := GetAuthContext(req)
+	hook.InitModel()
+	hook.TenantId = auth.Tenant.Id
+	hook.Cmdb = cmdb
+
+	err = hook.Validate()
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
+	err = RootDb().C(webhookCollection).Insert(&hook)
+	if Handle(res, req, err) {
+		return
+	}
+
+	RenderCreated(res, req, V1Uri(fmt.Sprintf("/cmdbs/%s/webhooks/%s", cmdb, hook.ShortName)))
+}
+
+// UpdateWebhookByName replaces a webhook. The existing secret is kept if
+// none is specified.
+func UpdateWebhookByName(res http.ResponseWriter, req *http.Request) {
+	var hook Webhook
+	err := Bind(req, &hook)
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
+	orig := getWebhook(res, req)
+	if orig == nil {
+		return
+	}
+
+	if CheckIfMatch(res, req, &orig.model) {
+		return
+	}
+
+	hook.Id = orig.Id
+	hook.Created = orig.Created
+	hook.Revision = orig.Revision
+	hook.TenantId = orig.TenantId
+	hook.Cmdb = orig.Cmdb
+	if hook.Secret == "" {
+		hook.Secret = orig.Secret
+	}
+	hook.InitModel()
+
+	err = hook.Validate()
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
+	err = UpdateRevision(RootDb().C(webhookCollection), orig.Id, orig.Revision, &hook)
+	if Handle(res, req, err) {
+		return
+	}
+
+	location := ""
+	if hook.ShortName != orig.ShortName {
+		location = V1Uri(fmt.Sprintf("/cmdbs/%s/webhooks/%s", hook.Cmdb, hook.ShortName))
+	}
+
+	SetETag(res, &hook.model)
+	RenderUpdated(res, req, location)
+}
+
+// DeleteWebhookByName removes a webhook and its delivery history.
+func DeleteWebhookByName(res http.ResponseWriter, req *http.Request) {
+	hook := getWebhook(res, req)
+	if hook == nil {
+		return
+	}
+
+	if CheckIfMatch(res, req, &hook.model) {
+		return
+	}
+
+	err := RemoveRevision(RootDb().C(webhookCollection), hook.Id, hook.Revision)
+	if Handle(res, req, err) {
+		return
+	}
+
+	_, err = RootDb().C(webhookDeliveryCollection).RemoveAll(M{"webhookid": hook.Id})
+	if Handle(res, req, err) {
+		return
+	}
+
+	Render(res, req, http.StatusNoContent, "")
+}
+
+// GetWebhookDeliveries returns the delivery history of a webhook, most recent
+// first. Results may be filtered with the status, since and until query
+// parameters and limited with limit.
+func GetWebhookDeliveries(res http.ResponseWriter, req *http.Request) {
+	hook := getWebhook(res, req)
+	if hook == nil {
+		return
+	}
+
+	filter := M{"webhookid": hook.Id}
+	if status := req.URL.Query().Get("status"); status != "" {
+		filter["status"] = status
+	}
+
+	timeRange, err := GetRequestTimeRange(req)
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
+	if timeRange != nil {
+		filter["created"] = timeRange
+	}
+
+	limit, err := GetRequestLimit(req, 100)
+	if err != nil {
+		ErrBadRequest(res, req, err)
+		return
+	}
+
+	deliveries := []WebhookDelivery{}
+	err = RootDb().C(webhookDeliveryCollection).Find(filter).Sort("-created").Limit(limit).All(&deliveries)
+	if Handle(res, req, err) {
+		return
+	}
+
+	for i, _ := range deliveries {
+		deliveries[i].DeliveryId = IdToString(deliveries[i].Id)
+	}
+
+	Render(res, req, http.StatusOK, deliveries)
+}
+
+// RetryWebhookDelivery queues a dead lettered delivery for another round of
+// attempts.
+func RetryWebhookDelivery(res http.ResponseWriter, req *http.Request) {
+	hook := getWebhook(res, req)
+	if hook == nil {
+		return
+	}
+
+	id, err := IdFromString(GetPathVar(req, "id"))
+	if err != nil {
+		ErrNotFound(res, req)
+		return
+	}
+
+	err = RootDb().C(webhookDeliveryCollection).Update(M{"_id": id, "webhookid": hook.Id, "status": DeliveryDead}, M{"$set": M{
+		"status":      DeliveryPending,
+		"remaining":   webhookMaxAttempts,
+		"nextattempt": time.Now(),
+	}})
+	if Handle(res, req, err) {
+		return
+	}
+
+	webhookDispatcher.Wake()
+	Render(res, req, http.StatusAccepted, M{"id": IdToString(id), "status": DeliveryPending})
+}
+
+// TestWebhook sends a test payload to a webhook and returns the outcome.
+// Test deliveries are recorded in the delivery history but are not retried.
+func TestWebhook(res http.ResponseWriter, req *http.Request) {
+	hook := getWebhook(res, req)
+	if hook == nil {
+		return
+	}
+
+	delivery, err := NewWebhookDelivery(hook, nil)
+	if Handle(res, req, err) {
+		return
+	}
+
+	delivery.Remaining = 1
+	delivery.Record(webhookDispatcher.Send(hook, delivery))
+	delivery.DeliveryId = IdToString(delivery.Id)
+
+	err = RootDb().C(webhookDeliveryCollection).Insert(delivery)
+	if Handle(res, req, err) {
+		return
+	}
+
+	Render(res, req, http.StatusOK, delivery)
+}
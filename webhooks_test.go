@@ -0,0 +1,248 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testWebhook(url string) *Webhook {
+	hook := &Webhook{
+		Name:    "Ticketing",
+		Cmdb:    "temp",
+		Url:     url,
+		Secret:  "0123456789abcdef",
+		CITypes: []string{"server"},
+		Actions: []string{ChangeCreated, ChangeUpdated},
+		Filter:  "environment == 'production'",
+	}
+	hook.InitModel()
+
+	return hook
+}
+
+func TestValidateWebhook(t *testing.T) {
+	hook := testWebhook("https://example.com/hook")
+	if err := hook.Validate(); err != nil {
+		t.Fatalf("Expected valid webhook but got: %s", err)
+	}
+	areEqual(t, hook.ShortName, "ticketing")
+
+	hook.Url = "ftp://example.com"
+	hook.Secret = "short"
+	hook.Actions = []string{"renamed"}
+	hook.Filter = "environment =="
+	areEqual(t, len(GetValidationProblems(hook.Validate())), 4)
+
+	// Private addresses are refused
+	hook = testWebhook("http://169.254.169.254/latest/meta-data")
+	if err := hook.Validate(); err == nil {
+		t.Errorf("Expected webhook to a private address to be invalid")
+	}
+}
+
+func TestIsPublicAddress(t *testing.T) {
+	tests := []struct {
+		Address  string
+		Expected bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.31.255.255", false},
+		{"192.168.0.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+	}
+
+	for _, test := range tests {
+		if isPublicAddress(net.ParseIP(test.Address)) != test.Expected {
+			t.Errorf("Expected isPublicAddress(%s) to be %v", test.Address, test.Expected)
+		}
+	}
+}
+
+func TestWebhookMatches(t *testing.T) {
+	hook := testWebhook("https://example.com/hook")
+	event := &ChangeEvent{
+		Cmdb:   "temp",
+		CIType: "server",
+		Type:   ChangeCreated,
+		value:  map[string]interface{}{"environment": "production"},
+	}
+	areEqual(t, hook.Matches(event), true)
+
+	event.value["environment"] = "test"
+	areEqual(t, hook.Matches(event), false)
+	event.value["environment"] = "production"
+
+	event.Type = ChangeDeleted
+	areEqual(t, hook.Matches(event), false)
+	event.Type = ChangeUpdated
+
+	event.CIType = "switch"
+	areEqual(t, hook.Matches(event), false)
+	event.CIType = "server"
+
+	event.Cmdb = "other"
+	areEqual(t, hook.Matches(event), false)
+	event.Cmdb = "temp"
+
+	hook.Disabled = true
+	areEqual(t, hook.Matches(event), false)
+
+	// Empty filters match everything
+	hook = &Webhook{Cmdb: "temp"}
+	areEqual(t, hook.Matches(event), true)
+}
+
+func TestWebhookRetries(t *testing.T) {
+	areEqual(t, retryDelay(1), webhookRetryDelay)
+	areEqual(t, retryDelay(3), 4*webhookRetryDelay)
+	areEqual(t, retryDelay(100), webhookMaxRetryDelay)
+
+	delivery, err := NewWebhookDelivery(testWebhook("https://example.com/hook"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for i := 1; i < webhookMaxAttempts; i++ {
+		delivery.Record(WebhookAttempt{Time: now, Error: "Failed"})
+		areEqual(t, delivery.Status, DeliveryPending)
+		areEqual(t, delivery.NextAttempt, now.Add(retryDelay(i)))
+	}
+
+	delivery.Record(WebhookAttempt{Time: now, Error: "Failed"})
+	areEqual(t, delivery.Status, DeliveryDead)
+	areEqual(t, len(delivery.Attempts), webhookMaxAttempts)
+}
+
+func TestSendWebhook(t *testing.T) {
+	var received *http.Request
+	var body []byte
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		received = req
+		body, _ = ioutil.ReadAll(req.Body)
+		if status == http.StatusFound {
+			http.Redirect(res, req, "/elsewhere", status)
+			return
+		}
+		res.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	hook := testWebhook(server.URL)
+	event := &ChangeEvent{Sequence: 12, Type: ChangeCreated, CIId: "abc", value: map[string]interface{}{"name": "web01"}}
+	delivery, err := NewWebhookDelivery(hook, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The test server listens on a loopback address
+	dispatcher := NewWebhookDispatcher()
+	attempt := dispatcher.Send(hook, delivery)
+	areEqual(t, attempt.Status, 0)
+	areEqual(t, strings.Contains(attempt.Error, "not a public address"), true)
+	areEqual(t, received, (*http.Request)(nil))
+
+	dispatcher.AllowPrivate = true
+	attempt = dispatcher.Send(hook, delivery)
+	areEqual(t, attempt.Error, "")
+	areEqual(t, attempt.Status, http.StatusNoContent)
+
+	// Verify the signature as a receiver would
+	timestamp := received.Header.Get(WebhookTimestampHeader)
+	mac := hmac.New(sha256.New, []byte(hook.Secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	areEqual(t, received.Header.Get(WebhookSignatureHeader), "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	areEqual(t, received.Header.Get(WebhookEventHeader), ChangeCreated)
+	areEqual(t, received.Header.Get(WebhookDeliveryHeader), IdToString(delivery.Id))
+
+	var payload WebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	areEqual(t, payload.Event.Sequence, int64(12))
+	areEqual(t, payload.Value["name"], "web01")
+
+	// Errors and redirects fail
+	for _, status = range []int{http.StatusInternalServerError, http.StatusFound} {
+		attempt = dispatcher.Send(hook, delivery)
+		areEqual(t, attempt.Status, status)
+		areUnequal(t, attempt.Error, "")
+	}
+
+	server.Close()
+	attempt = dispatcher.Send(hook, delivery)
+	areUnequal(t, attempt.Error, "")
+}
+
+func TestWebhookTestFire(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		calls++
+	}))
+	defer server.Close()
+
+	webhookDispatcher.AllowPrivate = true
+	defer func() { webhookDispatcher.AllowPrivate = false }()
+
+	body := fmt.Sprintf(`{"name":"Test Hook","url":"%s","secret":"0123456789abcdef"}`, server.URL)
+	location := Post(t, V1Uri("/cmdbs/temp/webhooks"), body)
+	defer Delete(t, location)
+
+	hook := Get(t, location)
+	areEqual(t, hook["secret"], nil)
+
+	req := NewRequest("POST", location+"/test", nil)
+	res := httptest.NewRecorder()
+	GetServer().ServeHTTP(res, req)
+	areEqual(t, res.Code, http.StatusOK)
+	areEqual(t, calls, 1)
+
+	var delivery WebhookDelivery
+	json.Unmarshal(res.Body.Bytes(), &delivery)
+	areEqual(t, delivery.Status, DeliveryDelivered)
+	areEqual(t, delivery.EventType, WebhookTestEvent)
+
+	// The test is recorded in the history
+	req = NewRequest("GET", location+"/deliveries", nil)
+	res = httptest.NewRecorder()
+	GetServer().ServeHTTP(res, req)
+	areEqual(t, strings.Contains(res.Body.String(), delivery.DeliveryId), true)
+}
@@ -0,0 +1,307 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Values of the type attribute which identify values which are not strings
+const (
+	xmlTypeObject  = "object"
+	xmlTypeArray   = "array"
+	xmlTypeNumber  = "number"
+	xmlTypeBoolean = "boolean"
+	xmlTypeNull    = "null"
+)
+
+// Keys which are not valid XML element names are encoded as a field element
+// with a name attribute.
+var xmlNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// xmlValue encodes a JSON like value as XML, which encoding/xml cannot do for
+// maps. Each key of an object is an element, the items of an array are item
+// elements and values which are not strings are marked with a type attribute
+// so that they may be decoded again.
+type xmlValue struct {
+	Value interface{}
+}
+
+func (c xmlValue) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return encodeXmlValue(e, start, c.Value)
+}
+
+// xmlAny returns v wrapped for encoding as XML, or nil if v is nil so that it
+// may be omitted.
+func xmlAny(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+
+	return xmlValue{v}
+}
+
+func xmlTypeAttr(name string) xml.Attr {
+	return xml.Attr{Name: xml.Name{Local: "type"}, Value: name}
+}
+
+func encodeXmlValue(e *xml.Encoder, start xml.StartElement, val interface{}) error {
+	switch v := val.(type) {
+	case nil:
+		start.Attr = append(start.Attr, xmlTypeAttr(xmlTypeNull))
+		return e.EncodeElement("", start)
+
+	case string:
+		return e.EncodeElement(v, start)
+
+	case bool:
+		start.Attr = append(start.Attr, xmlTypeAttr(xmlTypeBoolean))
+		return e.EncodeElement(strconv.FormatBool(v), start)
+
+	case float64:
+		start.Attr = append(start.Attr, xmlTypeAttr(xmlTypeNumber))
+		return e.EncodeElement(strconv.FormatFloat(v, 'f', -1, 64), start)
+
+	case int, int64:
+		start.Attr = append(start.Attr, xmlTypeAttr(xmlTypeNumber))
+		return e.EncodeElement(fmt.Sprintf("%d", v), start)
+
+	case []interface{}:
+		start.Attr = append(start.Attr, xmlTypeAttr(xmlTypeArray))
+		if err := e.EncodeToken(start); err != nil {
+			return err
+		}
+
+		for _, item := range v {
+			if err := encodeXmlValue(e, xml.StartElement{Name: xml.Name{Local: "item"}}, item); err != nil {
+				return err
+			}
+		}
+
+		return e.EncodeToken(start.End())
+	}
+
+	m, ok := asMap(val)
+	if !ok {
+		// Normalize other types, such as timestamps and typed slices and
+		// maps, to their JSON representation
+		data, err := json.Marshal(val)
+		if err != nil {
+			return err
+		}
+
+		var generic interface{}
+		if err := json.Unmarshal(data, &generic); err != nil {
+			return err
+		}
+
+		return encodeXmlValue(e, start, generic)
+	}
+
+	start.Attr = append(start.Attr, xmlTypeAttr(xmlTypeObject))
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+
+	// Encode keys in a stable order
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		elem := xml.StartElement{Name: xml.Name{Local: key}}
+		if !xmlNamePattern.MatchString(key) || strings.HasPrefix(strings.ToLower(key), "xml") {
+			elem = xml.StartElement{
+				Name: xml.Name{Local: "field"},
+				Attr: []xml.Attr{{Name: xml.Name{Local: "name"}, Value: key}},
+			}
+		}
+
+		if err := encodeXmlValue(e, elem, m[key]); err != nil {
+			return err
+		}
+	}
+
+	return e.EncodeToken(start.End())
+}
+
+// decodeXmlValue decodes the element which begins with start as encoded by
+// encodeXmlValue. Elements without a type attribute are decoded as objects if
+// they have child elements, where repeated elements become arrays, otherwise
+// as strings.
+func decodeXmlValue(d *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	typ := ""
+	for _, attr := range start.Attr {
+		if attr.Name.Local == "type" {
+			typ = attr.Value
+		}
+	}
+
+	var text bytes.Buffer
+	keys := []string{}
+	vals := []interface{}{}
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.CharData:
+			text.Write(t)
+			continue
+
+		case xml.StartElement:
+			key := t.Name.Local
+			for _, attr := range t.Attr {
+				if key == "field" && attr.Name.Local == "name" {
+					key = attr.Value
+				}
+			}
+
+			val, err := decodeXmlValue(d, t)
+			if err != nil {
+				return nil, err
+			}
+
+			keys = append(keys, key)
+			vals = append(vals, val)
+			continue
+
+		case xml.EndElement:
+		default:
+			continue
+		}
+
+		break
+	}
+
+	switch typ {
+	case "":
+		if len(keys) == 0 {
+			return text.String(), nil
+		}
+
+		m := map[string]interface{}{}
+		for i, key := range keys {
+			if prev, ok := m[key]; ok {
+				if a, ok := prev.([]interface{}); ok {
+					m[key] = append(a, vals[i])
+				} else {
+					m[key] = []interface{}{prev, vals[i]}
+				}
+			} else {
+				m[key] = vals[i]
+			}
+		}
+		return m, nil
+
+	case xmlTypeObject:
+		m := make(map[string]interface{}, len(keys))
+		for i, key := range keys {
+			m[key] = vals[i]
+		}
+		return m, nil
+
+	case xmlTypeArray:
+		return vals, nil
+
+	case xmlTypeNumber:
+		return strconv.ParseFloat(strings.TrimSpace(text.String()), 64)
+
+	case xmlTypeBoolean:
+		return strconv.ParseBool(strings.TrimSpace(text.String()))
+
+	case xmlTypeNull:
+		return nil, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("Unknown type '%s' for XML element '%s'", typ, start.Name.Local))
+}
+
+// isXmlMap returns true if v is a map or a pointer to a map, which
+// encoding/xml cannot encode or decode.
+func isXmlMap(v interface{}) bool {
+	t := reflect.TypeOf(v)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	return t != nil && t.Kind() == reflect.Map
+}
+
+// marshalXmlMap encodes a map as the children of a root element.
+func marshalXmlMap(v interface{}, indent bool) ([]byte, error) {
+	var buf bytes.Buffer
+	e := xml.NewEncoder(&buf)
+	if indent {
+		e.Indent("", "    ")
+	}
+
+	err := encodeXmlValue(e, xml.StartElement{Name: xml.Name{Local: "map"}}, v)
+	if err == nil {
+		err = e.Flush()
+	}
+
+	return buf.Bytes(), err
+}
+
+// bindXmlMap decodes an XML document into a map via JSON so that values are
+// decoded as they would be from JSON.
+func bindXmlMap(r io.Reader, v interface{}) error {
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		doc, err := decodeXmlValue(d, start)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := doc.(map[string]interface{}); !ok {
+			return errors.New(fmt.Sprintf("Expected XML element '%s' to have child elements", start.Name.Local))
+		}
+
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+
+		return json.Unmarshal(data, v)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestXmlRoundTrip(t *testing.T) {
+	value := map[string]interface{}{
+		"name":     "web01",
+		"cpus":     float64(4),
+		"virtual":  true,
+		"owner":    nil,
+		"nics":     []interface{}{"eth0", "eth1"},
+		"disks":    []interface{}{map[string]interface{}{"size": 20.5}},
+		"1st rack": "A",
+		"xmlns":    "reserved",
+		"empty":    map[string]interface{}{},
+	}
+
+	ci := CI{
+		Value:     value,
+		Conflicts: []CIConflict{{Path: "cpus", Source: "scanner", Time: time.Now().UTC(), Value: float64(2)}},
+	}
+
+	for _, pretty := range []string{"", "?pretty=true"} {
+		req := httptest.NewRequest("GET", "/"+pretty, nil)
+		req.Header.Set("Accept", "application/xml")
+		res := httptest.NewRecorder()
+		Render(res, req, 200, ci)
+		if res.Code != 200 {
+			t.Fatalf("Expected 200 rendering CI as XML but got %d", res.Code)
+		}
+
+		var doc struct {
+			Value struct {
+				Inner string `xml:",innerxml"`
+			}
+		}
+		if err := bindXmlString(res.Body.String(), &doc); err != nil {
+			t.Fatalf("Failed to parse rendered CI: %s\n%s", err, res.Body.String())
+		}
+
+		var bound map[string]interface{}
+		if err := bindXmlString("<Value>"+doc.Value.Inner+"</Value>", &bound); err != nil {
+			t.Fatalf("Failed to bind rendered CI value: %s", err)
+		}
+
+		if !reflect.DeepEqual(bound, value) {
+			t.Errorf("Expected CI value to round trip through XML\nExpected: %#v\nGot:      %#v", value, bound)
+		}
+
+		if !strings.Contains(res.Body.String(), `<conflict Path="cpus" Source="scanner"`) {
+			t.Errorf("Expected conflict attributes in rendered CI:\n%s", res.Body.String())
+		}
+	}
+
+	// Maps are rendered with a root element
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "application/xml")
+	res := httptest.NewRecorder()
+	Render(res, req, 200, map[string]interface{}{"indexed": 3})
+	if !strings.Contains(res.Body.String(), `<map type="object"><indexed type="number">3</indexed></map>`) {
+		t.Errorf("Unexpected rendering of map as XML:\n%s", res.Body.String())
+	}
+}
+
+func TestXmlBindErrors(t *testing.T) {
+	tests := []string{
+		`<CI><cpus type="number">four</cpus></CI>`,
+		`<CI><cpus type="complex">4</cpus></CI>`,
+		`<CI>web01</CI>`,
+		`<CI><name>web01</name>`,
+	}
+
+	for _, test := range tests {
+		var value map[string]interface{}
+		if err := bindXmlString(test, &value); err == nil {
+			t.Errorf("Expected an error binding %s but got %#v", test, value)
+		}
+	}
+}
+
+func bindXmlString(s string, v interface{}) error {
+	req := httptest.NewRequest("POST", "/", strings.NewReader(s))
+	req.Header.Set("Content-Type", "application/xml")
+	return Bind(req, v)
+}
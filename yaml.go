@@ -0,0 +1,162 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+// RenderYaml writes v as YAML. Values are encoded via JSON so that the JSON
+// field names and ordering of v apply to both formats.
+func RenderYaml(res http.ResponseWriter, req *http.Request, status int, v interface{}) {
+	if v == nil {
+		v = new(struct{})
+	}
+
+	data, err := MarshalYaml(v)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	res.Header().Set("Content-Type", "application/yaml")
+	writeBody(res, req, status, data)
+}
+
+// MarshalYaml encodes v as YAML with the same field names and in the same
+// order as it would be encoded as JSON.
+func MarshalYaml(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	doc, err := decodeOrderedJson(dec)
+	if err != nil {
+		return nil, err
+	}
+
+	return yaml.Marshal(doc)
+}
+
+// decodeOrderedJson decodes the next JSON value from dec, decoding objects as
+// YAML map slices so the order of their keys is preserved.
+func decodeOrderedJson(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch val := tok.(type) {
+	case json.Delim:
+		switch val {
+		case '{':
+			m := yaml.MapSlice{}
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+
+				item, err := decodeOrderedJson(dec)
+				if err != nil {
+					return nil, err
+				}
+
+				m = append(m, yaml.MapItem{Key: key, Value: item})
+			}
+			_, err = dec.Token()
+			return m, err
+
+		case '[':
+			a := []interface{}{}
+			for dec.More() {
+				item, err := decodeOrderedJson(dec)
+				if err != nil {
+					return nil, err
+				}
+
+				a = append(a, item)
+			}
+			_, err = dec.Token()
+			return a, err
+		}
+
+	case json.Number:
+		if i, err := val.Int64(); err == nil {
+			return i, nil
+		}
+		return val.Float64()
+	}
+
+	return tok, nil
+}
+
+// bindYaml decodes a YAML document into v via JSON so that the JSON field
+// names of v apply to both formats.
+func bindYaml(r io.Reader, v interface{}) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	var doc interface{}
+	err = yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return err
+	}
+
+	if doc == nil {
+		return io.EOF
+	}
+
+	data, err = json.Marshal(yamlToJson(doc))
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// yamlToJson converts the maps of a decoded YAML document, which may have keys
+// of any type, to maps with string keys.
+func yamlToJson(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for key, item := range val {
+			m[fmt.Sprintf("%v", key)] = yamlToJson(item)
+		}
+		return m
+
+	case []interface{}:
+		for i, item := range val {
+			val[i] = yamlToJson(item)
+		}
+	}
+
+	return v
+}
@@ -0,0 +1,96 @@
+/*
+ * Alexandria CMDB - Open source configuration management database
+ * Copyright (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func bindFixture(t *testing.T, name string, ctype string) *CIType {
+	req := httptest.NewRequest("POST", "/", strings.NewReader(LoadTestFixture(name)))
+	req.Header.Set("Content-Type", ctype)
+
+	var citype CIType
+	if err := Bind(req, &citype); err != nil {
+		t.Fatalf("Failed to bind %s: %s", name, err)
+	}
+
+	return &citype
+}
+
+func TestYamlCIType(t *testing.T) {
+	// YAML and JSON definitions are equivalent
+	citype := bindFixture(t, "citype.yaml", "application/yaml")
+	if expected := bindFixture(t, "citype.json", "application/json"); !reflect.DeepEqual(citype, expected) {
+		t.Fatalf("Expected YAML CI Type %#v to equal JSON CI Type %#v", citype, expected)
+	}
+
+	// Rendered YAML preserves field and attribute order
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "application/yaml")
+	res := httptest.NewRecorder()
+	Render(res, req, http.StatusOK, citype)
+
+	areEqual(t, res.Code, http.StatusOK)
+	areEqual(t, res.Header().Get("Content-Type"), "application/yaml")
+
+	body := res.Body.String()
+	last := -1
+	for _, s := range []string{"name: Test_CI_Type", "description: A test CI Type", "attributes:", "FirstAttribute", "SecondAttribute", "GrandchildAttribute"} {
+		i := strings.Index(body, s)
+		if i <= last {
+			t.Fatalf("Expected '%s' to follow the preceding fields in:\n%s", s, body)
+		}
+		last = i
+	}
+
+	// Round trip
+	req = httptest.NewRequest("PUT", "/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "text/yaml")
+	var roundTrip CIType
+	if err := Bind(req, &roundTrip); err != nil {
+		t.Fatalf("Failed to bind rendered YAML: %s", err)
+	}
+
+	if !reflect.DeepEqual(&roundTrip, citype) {
+		t.Errorf("Expected round tripped CI Type %#v to equal %#v", roundTrip, citype)
+	}
+}
+
+func TestMarshalYaml(t *testing.T) {
+	data, err := MarshalYaml(M{"b": []interface{}{1, 2.5, "x", nil, true}, "a": M{"z": 1, "y": 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	areEqual(t, string(data), "a:\n  \"y\": 2\n  z: 1\nb:\n- 1\n- 2.5\n- x\n- null\n- true\n")
+
+	// Values survive a round trip through JSON
+	var v interface{}
+	if err := bindYaml(strings.NewReader(string(data)), &v); err != nil {
+		t.Fatal(err)
+	}
+
+	out, _ := json.Marshal(v)
+	areEqual(t, string(out), `{"a":{"y":2,"z":1},"b":[1,2.5,"x",null,true]}`)
+}